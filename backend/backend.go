@@ -4,6 +4,7 @@ import (
 	"fmt"
 
 	"github.com/atlassian/gostatsd/backend/backends/datadog"
+	"github.com/atlassian/gostatsd/backend/backends/forwarder"
 	"github.com/atlassian/gostatsd/backend/backends/graphite"
 	"github.com/atlassian/gostatsd/backend/backends/null"
 	"github.com/atlassian/gostatsd/backend/backends/statsdaemon"
@@ -17,12 +18,20 @@ import (
 // All known backends.
 var backends = map[string]backendTypes.Factory{
 	datadog.BackendName:     datadog.NewClientFromViper,
+	forwarder.BackendName:   forwarder.NewClientFromViper,
 	graphite.BackendName:    graphite.NewClientFromViper,
 	null.BackendName:        null.NewClientFromViper,
 	statsdaemon.BackendName: statsdaemon.NewClientFromViper,
 	stdout.BackendName:      stdout.NewClientFromViper,
 }
 
+// RegisterBackend makes a backend available by the provided name.
+// It is not safe to call concurrently with GetBackend and InitBackend and
+// it is meant to be called during initialisation, e.g. to add custom backends.
+func RegisterBackend(name string, factory backendTypes.Factory) {
+	backends[name] = factory
+}
+
 // GetBackend creates an instance of the named backend, or nil if
 // the name is not known. The error return is only used if the named backend
 // was known but failed to initialize.
@@ -2,11 +2,16 @@ package datadog
 
 import (
 	"bytes"
+	"compress/gzip"
+	"compress/zlib"
 	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
 	"net/url"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
@@ -17,20 +22,32 @@ import (
 	"github.com/cenkalti/backoff"
 	"github.com/spf13/viper"
 	"golang.org/x/net/context"
+	"golang.org/x/net/context/ctxhttp"
 )
 
 const (
-	apiURL = "https://app.datadoghq.com"
 	// BackendName is the name of this backend.
 	BackendName                                = "datadog"
 	dogstatsdVersion                           = "5.6.3"
 	dogstatsdUserAgent                         = "python-requests/2.6.0 CPython/2.7.10"
+	defaultAPIEndpoint                         = "https://app.datadoghq.com"
+	defaultAPIKeyEnv                           = "DD_API_KEY"
 	defaultMaxRequestElapsedTime time.Duration = 10 * time.Second
 	defaultClientTimeout         time.Duration = 5 * time.Second
+	defaultMaxPointsPerRequest                 = 1000
+	defaultCompression                         = compressionNone
+	// compressionNone sends uncompressed requests.
+	compressionNone = "none"
+	// compressionZlib compresses requests with zlib, sent with the deflate content encoding.
+	compressionZlib = "zlib"
+	// compressionGzip compresses requests with gzip.
+	compressionGzip = "gzip"
 	// gauge is datadog gauge type.
 	gauge = "gauge"
 	// rate is datadog rate type.
 	rate = "rate"
+	// distributionType is datadog distribution type.
+	distributionType = "distribution"
 )
 
 // client represents a Datadog client.
@@ -38,24 +55,63 @@ type client struct {
 	apiKey                string
 	apiEndpoint           string
 	hostname              string
+	compression           string
+	maxPointsPerRequest   int
+	timerModes            *TimerModes
 	maxRequestElapsedTime time.Duration
 	client                *http.Client
 }
 
 const sampleConfig = `
 [datadog]
-	## Datadog API key
-	api_key = "my-secret-key" # required.
+	## Datadog API key, sent in the DD-API-KEY header. One of api_key, api_key_file or the
+	## environment variable named by api_key_env is required.
+	api_key = "my-secret-key"
+
+	## File containing the API key, used when api_key is not set.
+	# api_key_file = "/etc/gostatsd/datadog-api-key"
+
+	## Environment variable containing the API key, used when api_key and api_key_file are not set.
+	# api_key_env = "DD_API_KEY"
+
+	## Base URL of the Datadog API, e.g. https://app.datadoghq.eu for the EU site or a proxy.
+	# api_endpoint = "https://app.datadoghq.com"
+
+	## Maximum number of points sent in a single request, larger flushes are split. 0 disables splitting.
+	# max_points_per_request = 1000
+
+	## Compression of requests: none, zlib or gzip.
+	# compression = "none"
+
+	## How timers are sent: gauges (lower, upper, mean, percentiles... computed by gostatsd),
+	## distribution (the values, aggregated globally by Datadog) or sketch (like distribution, with
+	## the values summarised by a sketch, smaller than the values of busy timers).
+	# timers = "gauges"
+
+	## How the timers matching a pattern are sent. When several patterns match a timer, the longest one applies.
+	# [[datadog.timer_overrides]]
+	#	pattern = "api.*.latency"
+	#	timers = "distribution"
 
 	## Connection timeout.
 	# timeout = "5s"
+
+	## Maximum time spent retrying a request.
+	# max_request_elapsed_time = "10s"
 `
 
 // timeSeries represents a time series data structure.
 type timeSeries struct {
-	Series    []metric `json:"series"`
-	Timestamp int64    `json:"-"`
-	Hostname  string   `json:"-"`
+	Series        []metric       `json:"series"`
+	Distributions []distribution `json:"-"` // Posted separately, see distributionSeries
+	Sketches      []sketch       `json:"-"` // Posted separately, see marshalSketches
+	Timestamp     int64          `json:"-"`
+	Hostname      string         `json:"-"`
+}
+
+// distributionSeries is the body of requests to the distribution points API.
+type distributionSeries struct {
+	Series []distribution `json:"series"`
 }
 
 // metric represents a metric data structure for Datadog.
@@ -71,10 +127,22 @@ type metric struct {
 // point is a Datadog data point.
 type point [2]float64
 
+// distribution represents the values of a timer sent as a Datadog distribution.
+type distribution struct {
+	Host   string               `json:"host,omitempty"`
+	Metric string               `json:"metric"`
+	Points [1]distributionPoint `json:"points"`
+	Tags   []string             `json:"tags,omitempty"`
+	Type   string               `json:"type"`
+}
+
+// distributionPoint is a timestamp and the values received at that time, encoded as [timestamp, [values...]].
+type distributionPoint [2]interface{}
+
 // AddMetric adds a metric to the series.
-func (ts *timeSeries) addMetric(name, stags, metricType string, value float64, interval time.Duration) {
-	hostname, tags := types.ExtractSourceFromTags(stags)
-	if hostname == "" {
+func (ts *timeSeries) addMetric(name string, tags *types.TagSet, metricType string, value float64, interval time.Duration) {
+	hostname, ok := tags.Value(types.StatsdSourceID)
+	if !ok || hostname == "" {
 		hostname = ts.Hostname
 	}
 	ts.Series = append(ts.Series, metric{
@@ -82,11 +150,49 @@ func (ts *timeSeries) addMetric(name, stags, metricType string, value float64, i
 		Interval: interval.Seconds(),
 		Metric:   name,
 		Points:   [1]point{{float64(ts.Timestamp), value}},
-		Tags:     tags.Normalise(),
+		Tags:     convertTags(tags.Tags(), true),
 		Type:     metricType,
 	})
 }
 
+// addDistribution adds the values of a timer to the distributions. Timers without values are skipped, and so are
+// idle timers: they hold the values already sent when idle timers are kept, Datadog would count them again.
+func (ts *timeSeries) addDistribution(name string, timer types.Timer) {
+	if len(timer.Values) == 0 || timer.Idle {
+		return
+	}
+	tags := timer.TagSet
+	hostname, ok := tags.Value(types.StatsdSourceID)
+	if !ok || hostname == "" {
+		hostname = ts.Hostname
+	}
+	ts.Distributions = append(ts.Distributions, distribution{
+		Host:   hostname,
+		Metric: name,
+		Points: [1]distributionPoint{{ts.Timestamp, timer.Values}},
+		Tags:   convertTags(tags.Tags(), true),
+		Type:   distributionType,
+	})
+}
+
+// convertTags normalises and sanitizes tags following Datadog's rules. Tags that cannot be
+// sanitized are dropped. The source tag is dropped when dropSource is true as it is sent as the host.
+func convertTags(tags []types.Tag, dropSource bool) []string {
+	result := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		if dropSource && tag.Key == types.StatsdSourceID {
+			continue
+		}
+		s, err := types.SanitizeTag(tag.Normalise().String())
+		if err != nil {
+			log.Debugf("[%s] dropping tag %q: %v", BackendName, tag, err)
+			continue
+		}
+		result = append(result, s)
+	}
+	return result
+}
+
 // event represents an event data structure for Datadog.
 type event struct {
 	Title          string   `json:"title"`
@@ -102,52 +208,109 @@ type event struct {
 
 // SendMetrics sends metrics to Datadog.
 func (d *client) SendMetrics(ctx context.Context, metrics *types.MetricMap) error {
-	if metrics.NumStats == 0 {
+	if metrics.IsEmpty() {
 		return nil
 	}
 	ts := timeSeries{Timestamp: time.Now().Unix(), Hostname: d.hostname}
+	if !metrics.Timestamp.IsZero() {
+		ts.Timestamp = metrics.Timestamp.Unix()
+	}
 
 	metrics.Counters.Each(func(key, tagsKey string, counter types.Counter) {
-		ts.addMetric(key, tagsKey, rate, counter.PerSecond, counter.Flush)
-		ts.addMetric(fmt.Sprintf("%s.count", key), tagsKey, gauge, float64(counter.Value), counter.Flush)
+		ts.addMetric(key, counter.TagSet, rate, counter.PerSecond, counter.Flush)
+		ts.addMetric(fmt.Sprintf("%s.count", key), counter.TagSet, gauge, float64(counter.Value), counter.Flush)
 	})
 
 	metrics.Timers.Each(func(key, tagsKey string, timer types.Timer) {
-		ts.addMetric(fmt.Sprintf("%s.lower", key), tagsKey, gauge, timer.Min, timer.Flush)
-		ts.addMetric(fmt.Sprintf("%s.upper", key), tagsKey, gauge, timer.Max, timer.Flush)
-		ts.addMetric(fmt.Sprintf("%s.count", key), tagsKey, gauge, float64(timer.Count), timer.Flush)
-		ts.addMetric(fmt.Sprintf("%s.count_ps", key), tagsKey, rate, timer.PerSecond, timer.Flush)
-		ts.addMetric(fmt.Sprintf("%s.mean", key), tagsKey, gauge, timer.Mean, timer.Flush)
-		ts.addMetric(fmt.Sprintf("%s.median", key), tagsKey, gauge, timer.Median, timer.Flush)
-		ts.addMetric(fmt.Sprintf("%s.std", key), tagsKey, gauge, timer.StdDev, timer.Flush)
-		ts.addMetric(fmt.Sprintf("%s.sum", key), tagsKey, gauge, timer.Sum, timer.Flush)
-		ts.addMetric(fmt.Sprintf("%s.sum_squares", key), tagsKey, gauge, timer.SumSquares, timer.Flush)
+		switch d.timerModes.mode(key) {
+		case TimersDistribution:
+			ts.addDistribution(key, timer)
+			return
+		case TimersSketch:
+			ts.addSketch(key, timer)
+			return
+		}
+		ts.addMetric(fmt.Sprintf("%s.lower", key), timer.TagSet, gauge, timer.Min, timer.Flush)
+		ts.addMetric(fmt.Sprintf("%s.upper", key), timer.TagSet, gauge, timer.Max, timer.Flush)
+		ts.addMetric(fmt.Sprintf("%s.count", key), timer.TagSet, gauge, float64(timer.Count), timer.Flush)
+		ts.addMetric(fmt.Sprintf("%s.count_ps", key), timer.TagSet, rate, timer.PerSecond, timer.Flush)
+		ts.addMetric(fmt.Sprintf("%s.mean", key), timer.TagSet, gauge, timer.Mean, timer.Flush)
+		ts.addMetric(fmt.Sprintf("%s.median", key), timer.TagSet, gauge, timer.Median, timer.Flush)
+		ts.addMetric(fmt.Sprintf("%s.std", key), timer.TagSet, gauge, timer.StdDev, timer.Flush)
+		ts.addMetric(fmt.Sprintf("%s.sum", key), timer.TagSet, gauge, timer.Sum, timer.Flush)
+		ts.addMetric(fmt.Sprintf("%s.sum_squares", key), timer.TagSet, gauge, timer.SumSquares, timer.Flush)
 		for _, pct := range timer.Percentiles {
-			ts.addMetric(fmt.Sprintf("%s.%s", key, pct.String()), tagsKey, gauge, pct.Float(), timer.Flush)
+			ts.addMetric(fmt.Sprintf("%s.%s", key, pct.String()), timer.TagSet, gauge, pct.Float(), timer.Flush)
 		}
 	})
 
 	metrics.Gauges.Each(func(key, tagsKey string, g types.Gauge) {
-		ts.addMetric(key, tagsKey, gauge, g.Value, g.Flush)
+		ts.addMetric(key, g.TagSet, gauge, g.Value, g.Flush)
 	})
 
 	metrics.Sets.Each(func(key, tagsKey string, set types.Set) {
-		ts.addMetric(key, tagsKey, gauge, float64(len(set.Values)), set.Flush)
+		ts.addMetric(key, set.TagSet, gauge, float64(len(set.Values)), set.Flush)
+	})
+
+	err := d.postBatches(len(ts.Series), func(from, to int) error {
+		return d.post(ctx, "/api/v1/series", "metrics", timeSeries{Series: ts.Series[from:to]})
 	})
+	if len(ts.Distributions) > 0 {
+		distErr := d.postBatches(len(ts.Distributions), func(from, to int) error {
+			return d.post(ctx, "/api/v1/distribution_points", "distributions", distributionSeries{Series: ts.Distributions[from:to]})
+		})
+		if err == nil {
+			err = distErr
+		}
+	}
+	if len(ts.Sketches) > 0 {
+		sketchErr := d.postBatches(len(ts.Sketches), func(from, to int) error {
+			return d.postProto(ctx, "/api/beta/sketches", "sketches", marshalSketches(ts.Sketches[from:to]))
+		})
+		if err == nil {
+			err = sketchErr
+		}
+	}
+	return err
+}
 
-	return d.post("/api/v1/series", "metrics", ts)
+// postBatches posts n series in batches of at most maxPointsPerRequest series, post posts the series
+// from (included) to to (excluded). All the batches are posted even if some of them fail.
+func (d *client) postBatches(n int, post func(from, to int) error) error {
+	batchSize := d.maxPointsPerRequest
+	if batchSize <= 0 {
+		batchSize = n
+	}
+	var firstErr error
+	var failed int
+	for from := 0; from < n; from += batchSize {
+		to := from + batchSize
+		if to > n {
+			to = n
+		}
+		if err := post(from, to); err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			failed++
+		}
+	}
+	if failed > 1 {
+		return fmt.Errorf("%v (and %d more failed requests)", firstErr, failed-1)
+	}
+	return firstErr
 }
 
 // SendEvent sends an event to Datadog.
 func (d *client) SendEvent(ctx context.Context, e *types.Event) error {
-	return d.post("/api/v1/events", "events", event{
+	return d.post(ctx, "/api/v1/events", "events", event{
 		Title:          e.Title,
 		Text:           e.Text,
 		DateHappened:   e.DateHappened,
 		Hostname:       e.Hostname,
 		AggregationKey: e.AggregationKey,
 		SourceTypeName: e.SourceTypeName,
-		Tags:           e.Tags,
+		Tags:           convertTags(types.NewTagSet(e.Tags).Tags(), false),
 		Priority:       e.Priority.StringWithEmptyDefault(),
 		AlertType:      e.AlertType.StringWithEmptyDefault(),
 	})
@@ -163,20 +326,35 @@ func (d *client) BackendName() string {
 	return BackendName
 }
 
-func (d *client) post(path, typeOfPost string, data interface{}) error {
-	tsBytes, err := json.Marshal(data)
+// post posts data encoded as JSON.
+func (d *client) post(ctx context.Context, path, typeOfPost string, data interface{}) error {
+	body, err := d.encode(func(w io.Writer) error {
+		return json.NewEncoder(w).Encode(data)
+	})
 	if err != nil {
-		return fmt.Errorf("[%s] unable to marshal %s: %v", BackendName, typeOfPost, err)
+		return fmt.Errorf("[%s] unable to encode %s: %v", BackendName, typeOfPost, err)
 	}
-	log.Debugf("[%s] %s json: %s", BackendName, typeOfPost, tsBytes)
-	req, err := http.NewRequest("POST", d.authenticatedURL(path), bytes.NewBuffer(tsBytes))
+	return d.postBody(ctx, path, typeOfPost, "application/json", body)
+}
+
+// postProto posts a protocol buffers message.
+func (d *client) postProto(ctx context.Context, path, typeOfPost string, msg []byte) error {
+	body, err := d.encode(func(w io.Writer) error {
+		_, err := w.Write(msg)
+		return err
+	})
 	if err != nil {
-		return fmt.Errorf("[%s] unable to create http.Request: %v", BackendName, err)
+		return fmt.Errorf("[%s] unable to encode %s: %v", BackendName, typeOfPost, err)
 	}
+	return d.postBody(ctx, path, typeOfPost, "application/x-protobuf", body)
+}
+
+func (d *client) postBody(ctx context.Context, path, typeOfPost, contentType string, body []byte) error {
+	log.Debugf("[%s] posting %s: %d bytes", BackendName, typeOfPost, len(body))
 
-	b := backoff.NewExponentialBackOff()
+	b := &retryBackOff{ExponentialBackOff: backoff.NewExponentialBackOff()}
 	b.MaxElapsedTime = d.maxRequestElapsedTime
-	err = backoff.Retry(d.doPost(req), b)
+	err := backoff.Retry(d.doPost(ctx, d.apiEndpoint+path, contentType, body, b), b)
 	if err != nil {
 		return fmt.Errorf("[%s] %v", BackendName, err)
 	}
@@ -184,47 +362,217 @@ func (d *client) post(path, typeOfPost string, data interface{}) error {
 	return nil
 }
 
-func (d *client) doPost(req *http.Request) func() error {
-	req.Header.Add("Content-Type", "application/json")
-	// Mimic dogstatsd code
-	req.Header.Add("DD-Dogstatsd-Version", dogstatsdVersion)
-	req.Header.Add("User-Agent", dogstatsdUserAgent)
+// encode returns what write writes, compressed according to the configuration.
+func (d *client) encode(write func(io.Writer) error) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	var w io.WriteCloser
+	switch d.compression {
+	case compressionZlib:
+		w = zlib.NewWriter(buf)
+	case compressionGzip:
+		w = gzip.NewWriter(buf)
+	default:
+		if err := write(buf); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+	if err := write(w); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// contentEncoding returns the Content-Encoding header of requests, if they are compressed.
+func (d *client) contentEncoding() string {
+	switch d.compression {
+	case compressionZlib:
+		return "deflate"
+	case compressionGzip:
+		return "gzip"
+	}
+	return ""
+}
+
+func (d *client) doPost(ctx context.Context, url, contentType string, body []byte, b *retryBackOff) func() error {
 	return func() error {
-		resp, err := d.client.Do(req)
+		select {
+		case <-ctx.Done():
+			// Do not retry once the server is shutting down
+			b.stop = true
+			return ctx.Err()
+		default:
+		}
+		req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+		if err != nil {
+			b.stop = true
+			return fmt.Errorf("unable to create http.Request: %s", d.redact(err.Error()))
+		}
+		req.Header.Set("Content-Type", contentType)
+		req.Header.Set("DD-API-KEY", d.apiKey)
+		if encoding := d.contentEncoding(); encoding != "" {
+			req.Header.Set("Content-Encoding", encoding)
+		}
+		// Mimic dogstatsd code
+		req.Header.Set("DD-Dogstatsd-Version", dogstatsdVersion)
+		req.Header.Set("User-Agent", dogstatsdUserAgent)
+		resp, err := ctxhttp.Do(ctx, d.client, req)
 		if err != nil {
-			return fmt.Errorf("error POSTing: %s", strings.Replace(err.Error(), d.apiKey, "*****", -1))
+			if ctx.Err() != nil {
+				b.stop = true // Cancelled while in flight
+			}
+			return fmt.Errorf("error POSTing: %s", d.redact(err.Error()))
 		}
 		defer resp.Body.Close()
 
-		if resp.StatusCode < 200 || resp.StatusCode >= 205 {
-			return fmt.Errorf("received bad status code %d", resp.StatusCode)
+		switch {
+		case resp.StatusCode >= 200 && resp.StatusCode < 300:
+			return nil
+		case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable:
+			b.retryAfter = parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
+			return fmt.Errorf("received status code %d with Retry-After %v", resp.StatusCode, b.retryAfter)
+		case resp.StatusCode >= 400 && resp.StatusCode < 500 && resp.StatusCode != http.StatusRequestTimeout:
+			// The request is rejected, sending it again would not help
+			b.stop = true
 		}
-		return nil
+		return fmt.Errorf("received bad status code %d", resp.StatusCode)
 	}
 }
 
-func (d *client) authenticatedURL(path string) string {
-	q := url.Values{
-		"api_key": []string{d.apiKey},
+// redact removes the API key from s, in case a library includes the headers of the request in an error.
+func (d *client) redact(s string) string {
+	return redactAPIKey(s, d.apiKey)
+}
+
+// redactAPIKey replaces apiKey with stars in s.
+func redactAPIKey(s, apiKey string) string {
+	if apiKey == "" {
+		return s
+	}
+	return strings.Replace(s, apiKey, "*****", -1)
+}
+
+// loadAPIKey returns the API key: apiKey if it is set, otherwise the content of apiKeyFile if it is set,
+// otherwise the value of the apiKeyEnv environment variable.
+func loadAPIKey(apiKey, apiKeyFile, apiKeyEnv string) (string, error) {
+	if apiKey != "" {
+		return apiKey, nil
+	}
+	if apiKeyFile != "" {
+		data, err := ioutil.ReadFile(apiKeyFile)
+		if err != nil {
+			return "", fmt.Errorf("[%s] unable to read api_key_file: %v", BackendName, err)
+		}
+		return strings.TrimSpace(string(data)), nil
+	}
+	if apiKeyEnv != "" {
+		return strings.TrimSpace(os.Getenv(apiKeyEnv)), nil
 	}
-	return fmt.Sprintf("%s%s?%s", d.apiEndpoint, path, q.Encode())
+	return "", nil
+}
+
+// retryBackOff is an exponential backoff that waits at least as long as the Datadog API asks
+// with Retry-After and stops retrying requests that are rejected.
+type retryBackOff struct {
+	*backoff.ExponentialBackOff
+	retryAfter time.Duration // Minimum delay before the next attempt
+	stop       bool          // Whether to give up
+}
+
+// NextBackOff returns the delay before the next attempt, or backoff.Stop to give up.
+func (b *retryBackOff) NextBackOff() time.Duration {
+	next := b.ExponentialBackOff.NextBackOff()
+	if b.stop || next == backoff.Stop {
+		return backoff.Stop
+	}
+	if b.retryAfter > next {
+		next = b.retryAfter
+		if b.MaxElapsedTime != 0 && b.GetElapsedTime()+next > b.MaxElapsedTime {
+			return backoff.Stop
+		}
+	}
+	b.retryAfter = 0
+	return next
+}
+
+// parseRetryAfter parses the value of a Retry-After header, either a number of seconds or an HTTP date.
+// It returns 0 when the header is missing or invalid.
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil && t.After(now) {
+		return t.Sub(now)
+	}
+	return 0
 }
 
 // NewClientFromViper returns a new Datadog API client.
 func NewClientFromViper(v *viper.Viper) (backendTypes.Backend, error) {
 	v.SetDefault("datadog.timeout", defaultClientTimeout)
 	v.SetDefault("datadog.max_request_elapsed_time", defaultMaxRequestElapsedTime)
-	return NewClient(
+	v.SetDefault("datadog.api_endpoint", defaultAPIEndpoint)
+	v.SetDefault("datadog.max_points_per_request", defaultMaxPointsPerRequest)
+	v.SetDefault("datadog.compression", defaultCompression)
+	v.SetDefault("datadog.api_key_env", defaultAPIKeyEnv)
+	apiKey, err := loadAPIKey(
 		v.GetString("datadog.api_key"),
+		v.GetString("datadog.api_key_file"),
+		v.GetString("datadog.api_key_env"),
+	)
+	if err != nil {
+		return nil, err
+	}
+	var timerOverrides []TimerOverride
+	if err = v.UnmarshalKey("datadog.timer_overrides", &timerOverrides); err != nil {
+		return nil, fmt.Errorf("[%s] invalid timer_overrides: %v", BackendName, err)
+	}
+	timerModes, err := NewTimerModes(v.GetString("datadog.timers"), timerOverrides)
+	if err != nil {
+		return nil, err
+	}
+	return NewClient(
+		v.GetString("datadog.api_endpoint"),
+		apiKey,
+		v.GetString("datadog.compression"),
+		v.GetInt("datadog.max_points_per_request"),
+		timerModes,
 		v.GetDuration("datadog.timeout"),
 		v.GetDuration("datadog.max_request_elapsed_time"),
 	)
 }
 
 // NewClient returns a new Datadog API client.
-func NewClient(apiKey string, clientTimeout, maxRequestElapsedTime time.Duration) (backendTypes.Backend, error) {
+// A nil timerModes sends all timers as gauges.
+func NewClient(apiEndpoint, apiKey, compression string, maxPointsPerRequest int, timerModes *TimerModes, clientTimeout, maxRequestElapsedTime time.Duration) (backendTypes.Backend, error) {
 	if apiKey == "" {
-		return nil, fmt.Errorf("[%s] api_key is a required field", BackendName)
+		return nil, fmt.Errorf("[%s] api_key is a required field, it can also be read from api_key_file or api_key_env", BackendName)
+	}
+	if apiEndpoint == "" {
+		return nil, fmt.Errorf("[%s] api_endpoint is a required field", BackendName)
+	}
+	if _, err := url.Parse(apiEndpoint); err != nil {
+		return nil, fmt.Errorf("[%s] invalid api_endpoint: %v", BackendName, err)
+	}
+	compression = strings.ToLower(strings.TrimSpace(compression))
+	switch compression {
+	case "":
+		compression = compressionNone
+	case compressionNone, compressionZlib, compressionGzip:
+	default:
+		return nil, fmt.Errorf("[%s] invalid compression %q: must be one of none, zlib or gzip", BackendName, compression)
+	}
+	if maxPointsPerRequest < 0 {
+		return nil, fmt.Errorf("[%s] max_points_per_request must not be negative", BackendName)
 	}
 	hostname, err := os.Hostname()
 	if err != nil {
@@ -232,8 +580,11 @@ func NewClient(apiKey string, clientTimeout, maxRequestElapsedTime time.Duration
 	}
 	return &client{
 		apiKey:                apiKey,
-		apiEndpoint:           apiURL,
+		apiEndpoint:           strings.TrimRight(apiEndpoint, "/"),
 		hostname:              hostname,
+		compression:           compression,
+		maxPointsPerRequest:   maxPointsPerRequest,
+		timerModes:            timerModes,
 		maxRequestElapsedTime: maxRequestElapsedTime,
 		client: &http.Client{
 			Timeout: clientTimeout,
@@ -0,0 +1,347 @@
+package datadog
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/atlassian/gostatsd/types"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+// seriesServer records the number of points of the series it receives.
+type seriesServer struct {
+	mu        sync.Mutex
+	encodings []string
+	points    []int
+}
+
+func (s *seriesServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	var body io.Reader = req.Body
+	var err error
+	switch req.Header.Get("Content-Encoding") {
+	case "deflate":
+		body, err = zlib.NewReader(req.Body)
+	case "gzip":
+		body, err = gzip.NewReader(req.Body)
+	}
+	var ts timeSeries
+	if err == nil {
+		err = json.NewDecoder(body).Decode(&ts)
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.encodings = append(s.encodings, req.Header.Get("Content-Encoding"))
+	s.points = append(s.points, len(ts.Series))
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func TestSendMetricsBatchesAndCompresses(t *testing.T) {
+	now := time.Now()
+	m := &types.MetricMap{Gauges: types.Gauges{}}
+	for _, name := range []string{"a", "b", "c", "d", "e"} {
+		m.Gauges[name] = map[string]types.Gauge{"": types.NewGauge(now, time.Second, 1)}
+	}
+	for _, compression := range []string{compressionNone, compressionZlib, compressionGzip} {
+		s := &seriesServer{}
+		server := httptest.NewServer(s)
+		c, err := NewClient(server.URL+"/", "key", compression, 2, nil, time.Second, time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.NoError(t, c.SendMetrics(context.Background(), m), compression)
+		server.Close()
+
+		assert.Equal(t, []int{2, 2, 1}, s.points, compression)
+		expected := map[string]string{compressionNone: "", compressionZlib: "deflate", compressionGzip: "gzip"}[compression]
+		for _, encoding := range s.encodings {
+			assert.Equal(t, expected, encoding, compression)
+		}
+	}
+}
+
+func TestSendMetricsRetryAfter(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, status := range []int{http.StatusTooManyRequests, http.StatusServiceUnavailable} {
+		var requests int32
+		var retried time.Time
+		first := time.Now()
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if atomic.AddInt32(&requests, 1) == 1 {
+				w.Header().Set("Retry-After", "1")
+				w.WriteHeader(status)
+				return
+			}
+			retried = time.Now()
+			w.WriteHeader(http.StatusAccepted)
+		}))
+
+		c, err := NewClient(server.URL, "key", compressionNone, 0, nil, time.Second, 5*time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := &types.MetricMap{Gauges: types.Gauges{"g": {"": types.NewGauge(time.Now(), time.Second, 1)}}}
+		assert.NoError(c.SendMetrics(context.Background(), m), "status %d", status)
+		server.Close()
+		assert.EqualValues(2, atomic.LoadInt32(&requests), "status %d", status)
+		assert.True(retried.Sub(first) >= time.Second, "status %d retried after %v", status, retried.Sub(first))
+	}
+}
+
+func TestSendMetricsCancelled(t *testing.T) {
+	assert := assert.New(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	unblock := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		cancel() // While the request is in flight
+		<-unblock
+	}))
+	defer server.Close()
+	defer close(unblock)
+
+	c, err := NewClient(server.URL, "key", compressionNone, 0, nil, 10*time.Second, 10*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &types.MetricMap{Gauges: types.Gauges{"g": {"": types.NewGauge(time.Now(), time.Second, 1)}}}
+	start := time.Now()
+	assert.Error(c.SendMetrics(ctx, m))
+	assert.True(time.Since(start) < 5*time.Second)
+
+	// Nothing is sent once the context is done
+	b := &retryBackOff{}
+	assert.Equal(context.Canceled, c.(*client).doPost(ctx, server.URL, "application/json", nil, b)())
+	assert.True(b.stop)
+}
+
+func TestSendMetricsRejected(t *testing.T) {
+	assert := assert.New(t)
+
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	c, err := NewClient(server.URL, "key", compressionNone, 0, nil, time.Second, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &types.MetricMap{Gauges: types.Gauges{"g": {"": types.NewGauge(time.Now(), time.Second, 1)}}}
+	assert.Error(c.SendMetrics(context.Background(), m))
+	assert.EqualValues(1, atomic.LoadInt32(&requests))
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	assert := assert.New(t)
+	now := time.Date(2017, 7, 14, 2, 40, 0, 0, time.UTC)
+
+	assert.Equal(30*time.Second, parseRetryAfter("30", now))
+	assert.Equal(time.Minute, parseRetryAfter(now.Add(time.Minute).Format(http.TimeFormat), now))
+	assert.Zero(parseRetryAfter(now.Add(-time.Minute).Format(http.TimeFormat), now))
+	assert.Zero(parseRetryAfter("", now))
+	assert.Zero(parseRetryAfter("soon", now))
+	assert.Zero(parseRetryAfter("-1", now))
+}
+
+func TestNewClientValidation(t *testing.T) {
+	assert := assert.New(t)
+
+	_, err := NewClient(defaultAPIEndpoint, "", compressionNone, 0, nil, time.Second, time.Second)
+	assert.Error(err)
+	_, err = NewClient(defaultAPIEndpoint, "key", "lz4", 0, nil, time.Second, time.Second)
+	assert.Error(err)
+	_, err = NewClient(defaultAPIEndpoint, "key", "GZIP", -1, nil, time.Second, time.Second)
+	assert.Error(err)
+	_, err = NewClient(defaultAPIEndpoint, "key", "GZIP", 10, nil, time.Second, time.Second)
+	assert.NoError(err)
+}
+
+func TestAPIKeyIsNotLeaked(t *testing.T) {
+	assert := assert.New(t)
+	const apiKey = "0123456789abcdef"
+
+	var mu sync.Mutex
+	var urls, keys []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		urls = append(urls, req.URL.String())
+		keys = append(keys, req.Header.Get("DD-API-KEY"))
+		mu.Unlock()
+		w.WriteHeader(http.StatusForbidden)
+	}))
+
+	c, err := NewClient(server.URL, apiKey, compressionNone, 0, nil, time.Second, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &types.MetricMap{Gauges: types.Gauges{"g": {"": types.NewGauge(time.Now(), time.Second, 1)}}}
+	err = c.SendMetrics(context.Background(), m)
+	if assert.Error(err) {
+		assert.NotContains(err.Error(), apiKey)
+	}
+	err = c.SendEvent(context.Background(), &types.Event{Title: "title", Text: "text"})
+	if assert.Error(err) {
+		assert.NotContains(err.Error(), apiKey)
+	}
+
+	mu.Lock()
+	assert.Len(urls, 2)
+	for _, u := range urls {
+		assert.NotContains(u, apiKey)
+	}
+	assert.Equal([]string{apiKey, apiKey}, keys)
+	mu.Unlock()
+
+	// Connection errors
+	server.Close()
+	err = c.SendMetrics(context.Background(), m)
+	if assert.Error(err) {
+		assert.NotContains(err.Error(), apiKey)
+	}
+}
+
+func TestLoadAPIKey(t *testing.T) {
+	assert := assert.New(t)
+
+	f, err := ioutil.TempFile("", "apikey")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	if _, err = f.WriteString("fromfile\n"); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	os.Setenv("GOSTATSD_TEST_DD_API_KEY", "fromenv")
+	defer os.Unsetenv("GOSTATSD_TEST_DD_API_KEY")
+
+	key, err := loadAPIKey("fromconfig", f.Name(), "GOSTATSD_TEST_DD_API_KEY")
+	assert.NoError(err)
+	assert.Equal("fromconfig", key)
+
+	key, err = loadAPIKey("", f.Name(), "GOSTATSD_TEST_DD_API_KEY")
+	assert.NoError(err)
+	assert.Equal("fromfile", key)
+
+	key, err = loadAPIKey("", "", "GOSTATSD_TEST_DD_API_KEY")
+	assert.NoError(err)
+	assert.Equal("fromenv", key)
+
+	_, err = loadAPIKey("", "/nonexistent/apikey", "")
+	assert.Error(err)
+}
+
+func TestRedactAPIKey(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal("Post https://host/?k=*****: EOF", redactAPIKey("Post https://host/?k=secret: EOF", "secret"))
+	assert.Equal("unchanged", redactAPIKey("unchanged", ""))
+}
+
+func TestTimerModes(t *testing.T) {
+	assert := assert.New(t)
+
+	tm, err := NewTimerModes("", []TimerOverride{
+		{Pattern: "api.*", Timers: "distribution"},
+		{Pattern: "api.*.internal", Timers: "Gauges"},
+	})
+	assert.NoError(err)
+	assert.Equal(TimersGauges, tm.mode("db.latency"))
+	assert.Equal(TimersDistribution, tm.mode("api.login"))
+	assert.Equal(TimersGauges, tm.mode("api.login.internal"))
+
+	tm, err = NewTimerModes("distribution", []TimerOverride{{Pattern: "api.*", Timers: "Sketch"}})
+	assert.NoError(err)
+	assert.Equal(TimersDistribution, tm.mode("db.latency"))
+	assert.Equal(TimersSketch, tm.mode("api.login"))
+
+	var nilModes *TimerModes
+	assert.Equal(TimersGauges, nilModes.mode("db.latency"))
+
+	_, err = NewTimerModes("histogram", nil)
+	assert.Error(err)
+	_, err = NewTimerModes("", []TimerOverride{{Pattern: "[", Timers: "distribution"}})
+	assert.Error(err)
+}
+
+func TestSendTimersAsDistributions(t *testing.T) {
+	assert := assert.New(t)
+
+	var mu sync.Mutex
+	bodies := make(map[string][]map[string]interface{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var body struct {
+			Series []map[string]interface{} `json:"series"`
+		}
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		bodies[req.URL.Path] = append(bodies[req.URL.Path], body.Series...)
+		mu.Unlock()
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+
+	tm, err := NewTimerModes(TimersGauges, []TimerOverride{{Pattern: "api.*", Timers: TimersDistribution}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := NewClient(server.URL, "key", compressionNone, 0, tm, time.Second, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1500000000, 0)
+	tags := types.NewTagSet(types.Tags{"env:prod", "statsd_source_id:10.0.0.1"})
+	dist := types.NewTimer(now, time.Second, []float64{1, 2, 3})
+	dist.TagSet = tags
+	idle := types.NewTimer(now, time.Second, []float64{5}) // Kept from a previous flush
+	idle.TagSet = tags
+	idle.Idle = true
+	fanOut := types.NewTimer(now, time.Second, []float64{4})
+	fanOut.TagSet = tags
+	assert.NoError(c.SendMetrics(context.Background(), &types.MetricMap{
+		Timestamp: now,
+		Timers: types.Timers{
+			"api.login":  {tags.Key(): dist},
+			"api.logout": {tags.Key(): idle},
+			"db.latency": {tags.Key(): fanOut},
+		},
+	}))
+
+	mu.Lock()
+	defer mu.Unlock()
+	if assert.Len(bodies["/api/v1/distribution_points"], 1) {
+		d := bodies["/api/v1/distribution_points"][0]
+		assert.Equal("api.login", d["metric"])
+		assert.Equal("distribution", d["type"])
+		assert.Equal("10.0.0.1", d["host"])
+		assert.Equal([]interface{}{"env:prod"}, d["tags"])
+		assert.Equal([]interface{}{[]interface{}{float64(1500000000), []interface{}{float64(1), float64(2), float64(3)}}}, d["points"])
+	}
+	for _, m := range bodies["/api/v1/series"] {
+		assert.Contains(m["metric"], "db.latency.")
+	}
+	assert.NotEmpty(bodies["/api/v1/series"])
+}
@@ -0,0 +1,194 @@
+package datadog
+
+import (
+	"math"
+	"sort"
+
+	"github.com/atlassian/gostatsd/types"
+)
+
+// Parameters of the sketches, the same as the ones of the Datadog agent so that Datadog merges them with
+// the sketches of agents. A value v is counted in the bin with key round(log(v)/log(gamma)) + sketchBias,
+// whose value is accurate to sketchRelativeAccuracy.
+const (
+	sketchRelativeAccuracy = 1.0 / 128
+	sketchMinValue         = 1e-9 // Smaller values are counted in the bin of 0
+	sketchMaxKey           = math.MaxInt16
+)
+
+var (
+	sketchGammaLn = math.Log1p(2 * sketchRelativeAccuracy)
+	sketchBias    = 1 - int(math.Floor(math.Log(sketchMinValue)/sketchGammaLn))
+)
+
+// sketch represents the values of a timer sent as a Datadog sketch: a count of the values by bin,
+// with the exact count, minimum, maximum, sum and average.
+type sketch struct {
+	Host   string
+	Metric string
+	Tags   []string
+	Ts     int64
+	Cnt    int64
+	Min    float64
+	Max    float64
+	Sum    float64
+	Avg    float64
+	Keys   []int32  // Keys of the bins, in increasing order
+	Counts []uint32 // Number of values in the bin of the key with the same index
+}
+
+// sketchKey returns the key of the bin of v.
+func sketchKey(v float64) int32 {
+	if v < 0 {
+		return -sketchKey(-v)
+	}
+	if v < sketchMinValue {
+		return 0
+	}
+	k := int(math.Floor(math.Log(v)/sketchGammaLn+0.5)) + sketchBias
+	switch {
+	case k > sketchMaxKey:
+		return sketchMaxKey
+	case k < 1:
+		return 1
+	}
+	return int32(k)
+}
+
+// sketchValue returns the value of the bin with the given key, the inverse of sketchKey.
+func sketchValue(k int32) float64 {
+	switch {
+	case k < 0:
+		return -sketchValue(-k)
+	case k == 0:
+		return 0
+	}
+	return math.Exp(float64(int(k)-sketchBias) * sketchGammaLn)
+}
+
+// newSketch returns the sketch of the values.
+func newSketch(values []float64) sketch {
+	s := sketch{Cnt: int64(len(values)), Min: math.Inf(1), Max: math.Inf(-1)}
+	counts := make(map[int32]uint64)
+	for _, v := range values {
+		s.Sum += v
+		s.Min = math.Min(s.Min, v)
+		s.Max = math.Max(s.Max, v)
+		counts[sketchKey(v)]++
+	}
+	if len(values) > 0 {
+		s.Avg = s.Sum / float64(len(values))
+	}
+	keys := make([]int, 0, len(counts))
+	for k := range counts {
+		keys = append(keys, int(k))
+	}
+	sort.Ints(keys)
+	for _, k := range keys {
+		// A key is repeated for the counts that do not fit in a bin
+		for n := counts[int32(k)]; n > 0; {
+			c := n
+			if c > math.MaxUint32 {
+				c = math.MaxUint32
+			}
+			s.Keys = append(s.Keys, int32(k))
+			s.Counts = append(s.Counts, uint32(c))
+			n -= c
+		}
+	}
+	return s
+}
+
+// addSketch adds the sketch of the values of a timer to the sketches, like addDistribution.
+func (ts *timeSeries) addSketch(name string, timer types.Timer) {
+	if len(timer.Values) == 0 || timer.Idle {
+		return
+	}
+	hostname, ok := timer.TagSet.Value(types.StatsdSourceID)
+	if !ok || hostname == "" {
+		hostname = ts.Hostname
+	}
+	s := newSketch(timer.Values)
+	s.Host = hostname
+	s.Metric = name
+	s.Tags = convertTags(timer.TagSet.Tags(), true)
+	s.Ts = ts.Timestamp
+	ts.Sketches = append(ts.Sketches, s)
+}
+
+// marshalSketches encodes the sketches as the protocol buffers message of the Datadog sketches API:
+//
+//	message SketchPayload {
+//	  message Sketch {
+//	    message Dogsketch {
+//	      int64 ts = 1; int64 cnt = 2; double min = 3; double max = 4; double avg = 5; double sum = 6;
+//	      repeated sint32 k = 7; repeated uint32 n = 8;
+//	    }
+//	    string metric = 1; string host = 2; repeated string tags = 4; repeated Dogsketch dogsketches = 7;
+//	  }
+//	  repeated Sketch sketches = 1;
+//	}
+func marshalSketches(sketches []sketch) []byte {
+	var payload []byte
+	for _, s := range sketches {
+		var dog []byte
+		dog = appendVarintField(dog, 1, uint64(s.Ts))
+		dog = appendVarintField(dog, 2, uint64(s.Cnt))
+		dog = appendDoubleField(dog, 3, s.Min)
+		dog = appendDoubleField(dog, 4, s.Max)
+		dog = appendDoubleField(dog, 5, s.Avg)
+		dog = appendDoubleField(dog, 6, s.Sum)
+		var keys, counts []byte
+		for i, k := range s.Keys {
+			keys = appendVarint(keys, uint64(uint32((k<<1)^(k>>31)))) // zigzag encoding of sint32
+			counts = appendVarint(counts, uint64(s.Counts[i]))
+		}
+		dog = appendBytesField(dog, 7, keys)
+		dog = appendBytesField(dog, 8, counts)
+
+		var msg []byte
+		msg = appendBytesField(msg, 1, []byte(s.Metric))
+		msg = appendBytesField(msg, 2, []byte(s.Host))
+		for _, tag := range s.Tags {
+			msg = appendBytesField(msg, 4, []byte(tag))
+		}
+		msg = appendBytesField(msg, 7, dog)
+		payload = appendBytesField(payload, 1, msg)
+	}
+	return payload
+}
+
+// Protocol buffers wire types.
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+)
+
+func appendVarint(b []byte, v uint64) []byte {
+	for v >= 0x80 {
+		b = append(b, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(b, byte(v))
+}
+
+func appendVarintField(b []byte, field int, v uint64) []byte {
+	b = appendVarint(b, uint64(field<<3|wireVarint))
+	return appendVarint(b, v)
+}
+
+func appendDoubleField(b []byte, field int, v float64) []byte {
+	b = appendVarint(b, uint64(field<<3|wireFixed64))
+	bits := math.Float64bits(v)
+	for i := uint(0); i < 64; i += 8 {
+		b = append(b, byte(bits>>i))
+	}
+	return b
+}
+
+func appendBytesField(b []byte, field int, v []byte) []byte {
+	b = appendVarint(b, uint64(field<<3|wireBytes))
+	b = appendVarint(b, uint64(len(v)))
+	return append(b, v...)
+}
@@ -0,0 +1,168 @@
+package datadog
+
+import (
+	"compress/zlib"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/atlassian/gostatsd/types"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+func TestSketchKeys(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.EqualValues(0, sketchKey(0))
+	assert.EqualValues(0, sketchKey(1e-10))
+	assert.EqualValues(sketchMaxKey, sketchKey(math.MaxFloat64))
+	for _, v := range []float64{1e-9, 0.001, 0.5, 1, 2, 3.7, 100, 12345.678, 1e9} {
+		for _, value := range []float64{v, -v} {
+			k := sketchKey(value)
+			assert.Equal(-k, sketchKey(-value), "%v", value)
+			assert.InEpsilon(value, sketchValue(k), sketchRelativeAccuracy, "%v", value)
+		}
+	}
+	assert.True(sketchKey(1.5) < sketchKey(1.6))
+}
+
+func TestNewSketch(t *testing.T) {
+	assert := assert.New(t)
+
+	s := newSketch([]float64{-1, 0, 1, 1, 1.001, 10})
+	assert.EqualValues(6, s.Cnt)
+	assert.Equal(float64(-1), s.Min)
+	assert.Equal(float64(10), s.Max)
+	assert.InDelta(12.001, s.Sum, 1e-9)
+	assert.InDelta(12.001/6, s.Avg, 1e-9)
+	assert.Equal([]int32{-sketchKey(1), 0, sketchKey(1), sketchKey(10)}, s.Keys)
+	assert.Equal([]uint32{1, 1, 3, 1}, s.Counts) // 1.001 is in the bin of 1
+}
+
+// protoFields decodes a protocol buffers message into the values of its fields: uint64 for varint and
+// fixed64 fields, []byte for length-delimited fields.
+func protoFields(t *testing.T, b []byte) map[int][]interface{} {
+	fields := make(map[int][]interface{})
+	varint := func() uint64 {
+		var v uint64
+		for shift := uint(0); ; shift += 7 {
+			if len(b) == 0 {
+				t.Fatal("truncated varint")
+			}
+			c := b[0]
+			b = b[1:]
+			v |= uint64(c&0x7f) << shift
+			if c < 0x80 {
+				return v
+			}
+		}
+	}
+	for len(b) > 0 {
+		key := varint()
+		field := int(key >> 3)
+		switch key & 7 {
+		case wireVarint:
+			fields[field] = append(fields[field], varint())
+		case wireFixed64:
+			var v uint64
+			for i := uint(0); i < 8; i++ {
+				v |= uint64(b[i]) << (8 * i)
+			}
+			b = b[8:]
+			fields[field] = append(fields[field], v)
+		case wireBytes:
+			n := int(varint())
+			fields[field] = append(fields[field], b[:n])
+			b = b[n:]
+		default:
+			t.Fatalf("unexpected wire type %d", key&7)
+		}
+	}
+	return fields
+}
+
+func TestSendTimersAsSketches(t *testing.T) {
+	assert := assert.New(t)
+
+	var mu sync.Mutex
+	var contentType string
+	var payloads [][]byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/api/beta/sketches" {
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+		r, err := zlib.NewReader(req.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		body, err := ioutil.ReadAll(r)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		contentType = req.Header.Get("Content-Type")
+		payloads = append(payloads, body)
+		mu.Unlock()
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+
+	tm, err := NewTimerModes(TimersSketch, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := NewClient(server.URL, "key", compressionZlib, 0, tm, time.Second, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1500000000, 0)
+	tags := types.NewTagSet(types.Tags{"env:prod", "statsd_source_id:10.0.0.1"})
+	timer := types.NewTimer(now, time.Second, []float64{1, 1, 2})
+	timer.TagSet = tags
+	idle := types.NewTimer(now, time.Second, []float64{5})
+	idle.TagSet = tags
+	idle.Idle = true
+	assert.NoError(c.SendMetrics(context.Background(), &types.MetricMap{
+		Timestamp: now,
+		Timers: types.Timers{
+			"api.login":  {tags.Key(): timer},
+			"api.logout": {tags.Key(): idle},
+		},
+	}))
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal("application/x-protobuf", contentType)
+	if !assert.Len(payloads, 1) {
+		return
+	}
+	sketches := protoFields(t, payloads[0])[1]
+	if !assert.Len(sketches, 1) {
+		return
+	}
+	s := protoFields(t, sketches[0].([]byte))
+	assert.Equal([]interface{}{[]byte("api.login")}, s[1])
+	assert.Equal([]interface{}{[]byte("10.0.0.1")}, s[2])
+	assert.Equal([]interface{}{[]byte("env:prod")}, s[4])
+	if !assert.Len(s[7], 1) {
+		return
+	}
+	dog := protoFields(t, s[7][0].([]byte))
+	assert.Equal([]interface{}{uint64(1500000000)}, dog[1])
+	assert.Equal([]interface{}{uint64(3)}, dog[2])
+	assert.Equal([]interface{}{math.Float64bits(1)}, dog[3])
+	assert.Equal([]interface{}{math.Float64bits(2)}, dog[4])
+	assert.Equal([]interface{}{math.Float64bits(4)}, dog[6])
+	k1, k2 := sketchKey(1), sketchKey(2)
+	assert.Equal([]interface{}{appendVarint(appendVarint(nil, uint64(2*k1)), uint64(2*k2))}, dog[7]) // zigzag
+	assert.Equal([]interface{}{[]byte{2, 1}}, dog[8])
+}
@@ -0,0 +1,77 @@
+package datadog
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/atlassian/gostatsd/types"
+)
+
+const (
+	// TimersGauges sends the aggregations of timers (lower, upper, mean, percentiles...) as gauges.
+	TimersGauges = "gauges"
+	// TimersDistribution sends the values of timers as a Datadog distribution, aggregated by Datadog.
+	TimersDistribution = "distribution"
+	// TimersSketch sends the values of timers as a Datadog distribution summarised by a sketch, smaller than
+	// the values of busy timers. The percentiles computed by Datadog are accurate to 1%.
+	TimersSketch = "sketch"
+)
+
+// TimerOverride sets how the timers whose name matches Pattern are sent.
+// Pattern uses the syntax of types.NamePatterns, e.g. "api.*.latency".
+type TimerOverride struct {
+	Pattern string `mapstructure:"pattern"`
+	Timers  string `mapstructure:"timers"`
+}
+
+// TimerModes holds how timers are sent to Datadog, by name pattern.
+// A nil *TimerModes sends all timers as gauges.
+type TimerModes struct {
+	defaultMode string
+	patterns    types.NamePatterns
+	overrides   map[string]string // Modes by pattern
+}
+
+// NewTimerModes validates the default mode and the overrides.
+// When several patterns match a timer, the longest one applies.
+func NewTimerModes(defaultMode string, overrides []TimerOverride) (*TimerModes, error) {
+	tm := &TimerModes{overrides: make(map[string]string, len(overrides))}
+	var err error
+	if tm.defaultMode, err = parseTimerMode(defaultMode); err != nil {
+		return nil, err
+	}
+	patterns := make([]string, 0, len(overrides))
+	for _, o := range overrides {
+		mode, err := parseTimerMode(o.Timers)
+		if err != nil {
+			return nil, fmt.Errorf("[%s] pattern %q: %v", BackendName, o.Pattern, err)
+		}
+		patterns = append(patterns, o.Pattern)
+		tm.overrides[o.Pattern] = mode
+	}
+	if tm.patterns, err = types.NewNamePatterns(patterns...); err != nil {
+		return nil, fmt.Errorf("[%s] timer_overrides: %v", BackendName, err)
+	}
+	return tm, nil
+}
+
+// mode returns how the timer with the given name is sent.
+func (tm *TimerModes) mode(name string) string {
+	if tm == nil {
+		return TimersGauges
+	}
+	if pattern, ok := tm.patterns.Match(name); ok {
+		return tm.overrides[pattern]
+	}
+	return tm.defaultMode
+}
+
+func parseTimerMode(s string) (string, error) {
+	switch mode := strings.ToLower(strings.TrimSpace(s)); mode {
+	case "":
+		return TimersGauges, nil
+	case TimersGauges, TimersDistribution, TimersSketch:
+		return mode, nil
+	}
+	return "", fmt.Errorf("[%s] invalid timers %q: must be one of gauges, distribution or sketch", BackendName, s)
+}
@@ -0,0 +1,197 @@
+package forwarder
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	backendTypes "github.com/atlassian/gostatsd/backend/types"
+	"github.com/atlassian/gostatsd/types"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/cenkalti/backoff"
+	"github.com/spf13/viper"
+	"golang.org/x/net/context"
+	"golang.org/x/net/context/ctxhttp"
+)
+
+const (
+	// BackendName is the name of this backend.
+	BackendName                                = "forwarder"
+	defaultMaxRequestElapsedTime time.Duration = 15 * time.Second
+	defaultClientTimeout         time.Duration = 5 * time.Second
+	defaultCompress                            = true
+)
+
+const sampleConfig = `
+[forwarder]
+	## Base URL of the ingest endpoint of the receiving gostatsd server
+	address = "http://aggregator.local:8127" # required.
+
+	## Shared secret required by the ingest endpoint, if it is set with --ingest-secret.
+	# secret = ""
+
+	## Compress requests with gzip.
+	# compress = true
+
+	## Connection timeout.
+	# timeout = "5s"
+
+	## Maximum time spent retrying a request.
+	# max_request_elapsed_time = "15s"
+`
+
+// client sends pre-aggregated metrics to another gostatsd server.
+type client struct {
+	address               string
+	secret                string
+	compress              bool
+	maxRequestElapsedTime time.Duration
+	client                *http.Client
+}
+
+// SendMetrics forwards the metrics to the receiving server.
+func (c *client) SendMetrics(ctx context.Context, metrics *types.MetricMap) error {
+	payload := NewPayload(metrics)
+	if payload.Len() == 0 {
+		return nil
+	}
+	return c.post(ctx, MetricsPath, "metrics", payload)
+}
+
+// SendEvent forwards the event to the receiving server.
+func (c *client) SendEvent(ctx context.Context, e *types.Event) error {
+	return c.post(ctx, EventsPath, "events", NewEvent(e))
+}
+
+// SampleConfig returns the sample config for the forwarder backend.
+func (c *client) SampleConfig() string {
+	return sampleConfig
+}
+
+// BackendName returns the name of the backend.
+func (c *client) BackendName() string {
+	return BackendName
+}
+
+func (c *client) post(ctx context.Context, path, typeOfPost string, data interface{}) error {
+	body, err := c.encode(data)
+	if err != nil {
+		return fmt.Errorf("[%s] unable to encode %s: %v", BackendName, typeOfPost, err)
+	}
+
+	b := &stopBackOff{ExponentialBackOff: backoff.NewExponentialBackOff()}
+	b.MaxElapsedTime = c.maxRequestElapsedTime
+	err = backoff.Retry(c.doPost(ctx, b, c.address+path, body), b)
+	if err != nil {
+		return fmt.Errorf("[%s] %v", BackendName, err)
+	}
+	return nil
+}
+
+func (c *client) encode(data interface{}) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	if !c.compress {
+		if err := json.NewEncoder(buf).Encode(data); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+	gz := gzip.NewWriter(buf)
+	if err := json.NewEncoder(gz).Encode(data); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (c *client) doPost(ctx context.Context, b *stopBackOff, url string, body []byte) func() error {
+	return func() error {
+		select {
+		case <-ctx.Done():
+			// Do not retry once the server is shutting down
+			b.stop = true
+			return ctx.Err()
+		default:
+		}
+		req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+		if err != nil {
+			return fmt.Errorf("unable to create http.Request: %v", err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		if c.secret != "" {
+			req.Header.Set(SecretHeader, c.secret)
+		}
+		if c.compress {
+			req.Header.Set("Content-Encoding", "gzip")
+		}
+		resp, err := ctxhttp.Do(ctx, c.client, req)
+		if err != nil {
+			if ctx.Err() != nil {
+				b.stop = true // Cancelled while in flight
+			}
+			return fmt.Errorf("error POSTing: %v", err)
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+			log.Debugf("[%s] received status code %d from %s", BackendName, resp.StatusCode, url)
+			if resp.StatusCode >= 400 && resp.StatusCode < 500 &&
+				resp.StatusCode != http.StatusRequestTimeout && resp.StatusCode != http.StatusTooManyRequests {
+				b.stop = true // The request is rejected, sending it again will not help
+			}
+			return fmt.Errorf("received bad status code %d", resp.StatusCode)
+		}
+		return nil
+	}
+}
+
+// stopBackOff is an exponential backoff that gives up early on requests that cannot succeed.
+type stopBackOff struct {
+	*backoff.ExponentialBackOff
+	stop bool // Whether to give up
+}
+
+// NextBackOff returns the delay before the next attempt, or backoff.Stop to give up.
+func (b *stopBackOff) NextBackOff() time.Duration {
+	if b.stop {
+		return backoff.Stop
+	}
+	return b.ExponentialBackOff.NextBackOff()
+}
+
+// NewClientFromViper returns a new forwarder client.
+func NewClientFromViper(v *viper.Viper) (backendTypes.Backend, error) {
+	v.SetDefault("forwarder.compress", defaultCompress)
+	v.SetDefault("forwarder.timeout", defaultClientTimeout)
+	v.SetDefault("forwarder.max_request_elapsed_time", defaultMaxRequestElapsedTime)
+	return NewClient(
+		v.GetString("forwarder.address"),
+		v.GetString("forwarder.secret"),
+		v.GetBool("forwarder.compress"),
+		v.GetDuration("forwarder.timeout"),
+		v.GetDuration("forwarder.max_request_elapsed_time"),
+	)
+}
+
+// NewClient returns a new forwarder client.
+func NewClient(address, secret string, compress bool, clientTimeout, maxRequestElapsedTime time.Duration) (backendTypes.Backend, error) {
+	if address == "" {
+		return nil, fmt.Errorf("[%s] address is a required field", BackendName)
+	}
+	return &client{
+		address:               strings.TrimRight(address, "/"),
+		secret:                secret,
+		compress:              compress,
+		maxRequestElapsedTime: maxRequestElapsedTime,
+		client: &http.Client{
+			Timeout: clientTimeout,
+		},
+	}, nil
+}
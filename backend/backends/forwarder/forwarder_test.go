@@ -0,0 +1,216 @@
+package forwarder
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/atlassian/gostatsd/types"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+func TestPayloadRoundTrip(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Now()
+	tags := types.NewTagSet(types.Tags{"env:prod", "statsd_source_id:10.0.0.1"})
+	counter := types.NewCounter(now, time.Second, 5)
+	counter.TagSet = tags
+	timer := types.NewTimer(now, time.Second, []float64{1, 2, 3})
+	timer.TagSet = tags
+	gauge := types.NewGauge(now, time.Second, 42)
+	gauge.TagSet = tags
+	set := types.NewSet(now, time.Second, map[string]int64{"joe": 2, "bob": 1})
+	set.TagSet = tags
+	p := NewPayload(&types.MetricMap{
+		NumStats: 8,
+		Counters: types.Counters{
+			"c":               {tags.Key(): counter},
+			"statsd.numStats": {"": types.NewCounter(now, time.Second, 100)},
+		},
+		Timers: types.Timers{"t": {tags.Key(): timer}},
+		Gauges: types.Gauges{"g": {tags.Key(): gauge}},
+		Sets:   types.Sets{"s": {tags.Key(): set}},
+	})
+	assert.Equal(4, p.Len()) // Internal stats are not forwarded
+
+	m := p.MetricMap(nil, now, time.Second)
+	key := "env:prod,statsd_source_id:10.0.0.1"
+
+	assert.Equal(int64(5), m.Counters["c"][key].Value)
+	assert.Equal([]float64{1, 2, 3}, m.Timers["t"][key].Values)
+	assert.Equal(float64(42), m.Gauges["g"][key].Value)
+	assert.Equal(map[string]int64{"joe": 1, "bob": 1}, m.Sets["s"][key].Values)
+	assert.Equal(key, m.Timers["t"][key].TagSet.Key())
+	assert.Equal(uint32(1+3+1+2), m.NumStats)
+}
+
+func TestPayloadForwardsClientStatsdMetrics(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Now()
+	m := &types.MetricMap{
+		Counters: types.Counters{
+			"statsd.numStats":       {"": types.NewCounter(now, time.Second, 100)},
+			"statsd.client.retries": {"": types.NewCounter(now, time.Second, 3)},
+		},
+		Gauges: types.Gauges{
+			"statsd.processing_time": {"": types.NewGauge(now, time.Second, 1)},
+			"statsd.queue_size":      {"": types.NewGauge(now, time.Second, 7)},
+		},
+	}
+	p := NewPayload(m)
+	assert.Equal([]Counter{{Name: "statsd.client.retries", Value: 3}}, p.Counters)
+	assert.Equal([]Gauge{{Name: "statsd.queue_size", Value: 7}}, p.Gauges)
+}
+
+func TestPayloadMergesDuplicateSeries(t *testing.T) {
+	assert := assert.New(t)
+
+	p := &Payload{
+		Counters: []Counter{{Name: "c", Tags: types.Tags{"a", "b"}, Value: 1}, {Name: "c", Tags: types.Tags{"b", "a"}, Value: 2}},
+		Timers:   []Timer{{Name: "t", Values: []float64{1}}, {Name: "t", Values: []float64{2}}},
+	}
+	m := p.MetricMap(types.NewTagInterner(0), time.Now(), time.Second)
+
+	assert.Equal(int64(3), m.Counters["c"]["a,b"].Value)
+	assert.Equal([]float64{1, 2}, m.Timers["t"][""].Values)
+}
+
+func TestSendMetrics(t *testing.T) {
+	now := time.Now()
+	m := &types.MetricMap{
+		Counters: types.Counters{"c": {"": types.NewCounter(now, time.Second, 5)}},
+		Sets:     types.Sets{"s": {"": types.NewSet(now, time.Second, map[string]int64{"joe": 2, "bob": 1})}},
+	}
+	for _, compress := range []bool{true, false} {
+		assert := assert.New(t)
+
+		var received Payload
+		var attempts uint32
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// Fail the first attempt to exercise retries
+			if atomic.AddUint32(&attempts, 1) == 1 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			assert.Equal(MetricsPath, r.URL.Path)
+			if compress {
+				assert.Equal("gzip", r.Header.Get("Content-Encoding"))
+			}
+			if err := Decode(r.Body, r.Header.Get("Content-Encoding"), &received); err != nil {
+				t.Error(err)
+			}
+			w.WriteHeader(http.StatusAccepted)
+		}))
+
+		c, err := NewClient(ts.URL+"/", "", compress, time.Second, 5*time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = c.SendMetrics(context.Background(), m)
+		ts.Close()
+
+		assert.NoError(err)
+		assert.Equal(uint32(2), atomic.LoadUint32(&attempts))
+		sort.Strings(received.Sets[0].Values)
+		assert.Equal([]Counter{{Name: "c", Value: 5}}, received.Counters)
+		assert.Equal([]string{"bob", "joe"}, received.Sets[0].Values)
+	}
+}
+
+func TestSendMetricsGivesUp(t *testing.T) {
+	for _, tc := range []struct {
+		status  int
+		retried bool
+	}{
+		{http.StatusInternalServerError, true},
+		{http.StatusTooManyRequests, true},
+		{http.StatusRequestTimeout, true},
+		{http.StatusBadRequest, false},
+		{http.StatusUnauthorized, false},
+		{http.StatusForbidden, false},
+	} {
+		var attempts uint32
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddUint32(&attempts, 1)
+			w.WriteHeader(tc.status)
+		}))
+
+		c, err := NewClient(ts.URL, "", true, time.Second, time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := &types.MetricMap{Counters: types.Counters{"c": {"": types.NewCounter(time.Now(), time.Second, 5)}}}
+		err = c.SendMetrics(context.Background(), m)
+		ts.Close()
+
+		assert.Error(t, err, "status %d", tc.status)
+		assert.Equal(t, tc.retried, atomic.LoadUint32(&attempts) > 1, "status %d", tc.status)
+	}
+}
+
+func TestSendMetricsCancelled(t *testing.T) {
+	assert := assert.New(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	unblock := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cancel() // While the request is in flight
+		<-unblock
+	}))
+	defer ts.Close()
+	defer close(unblock)
+
+	c, err := NewClient(ts.URL, "", true, 10*time.Second, 10*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &types.MetricMap{Counters: types.Counters{"c": {"": types.NewCounter(time.Now(), time.Second, 5)}}}
+	start := time.Now()
+	assert.Error(c.SendMetrics(ctx, m))
+	assert.True(time.Since(start) < 5*time.Second)
+
+	// Nothing is sent once the context is done
+	assert.Equal(context.Canceled, c.(*client).doPost(ctx, &stopBackOff{}, ts.URL, nil)())
+}
+
+func TestSendEvent(t *testing.T) {
+	assert := assert.New(t)
+
+	var received Event
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(EventsPath, r.URL.Path)
+		assert.Equal("s3cret", r.Header.Get(SecretHeader))
+		if err := Decode(r.Body, r.Header.Get("Content-Encoding"), &received); err != nil {
+			t.Error(err)
+		}
+	}))
+	defer ts.Close()
+
+	c, err := NewClient(ts.URL, "s3cret", true, time.Second, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := &types.Event{Title: "deploy", Text: "done", Tags: types.Tags{"env:prod"}, AlertType: types.AlertSuccess}
+	assert.NoError(c.SendEvent(context.Background(), e))
+	assert.Equal(e, received.Event())
+}
+
+func TestPayloadTimestamp(t *testing.T) {
+	assert := assert.New(t)
+
+	m := &types.MetricMap{Counters: types.Counters{"c": {"": types.NewCounter(time.Now(), time.Second, 5)}}}
+	assert.Zero(NewPayload(m).MetricMap(nil, time.Now(), time.Second).Timestamp)
+
+	m.Timestamp = time.Unix(1500000000, 0)
+	p := NewPayload(m)
+	assert.Equal(int64(1500000000), p.Timestamp)
+	assert.Equal(m.Timestamp, p.MetricMap(nil, time.Now(), time.Second).Timestamp)
+}
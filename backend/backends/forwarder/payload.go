@@ -0,0 +1,222 @@
+package forwarder
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/atlassian/gostatsd/types"
+)
+
+const (
+	// MetricsPath is the path of the ingest endpoint for metrics.
+	MetricsPath = "/v1/metrics"
+	// EventsPath is the path of the ingest endpoint for events.
+	EventsPath = "/v1/events"
+	// SecretHeader is the header carrying the shared secret of the ingest endpoint, if it requires one.
+	SecretHeader = "X-Gostatsd-Secret"
+)
+
+// Payload is the wire representation of a MetricMap sent between gostatsd servers.
+// It carries the pre-aggregated data needed to merge the metrics on the receiving side:
+// counter values, raw timer values, the last value of gauges and set members.
+type Payload struct {
+	Timestamp int64     `json:"timestamp,omitempty"` // Unix time of the metrics, if they are not current
+	Counters  []Counter `json:"counters,omitempty"`
+	Timers    []Timer   `json:"timers,omitempty"`
+	Gauges    []Gauge   `json:"gauges,omitempty"`
+	Sets      []Set     `json:"sets,omitempty"`
+}
+
+// Counter is the wire representation of a counter.
+type Counter struct {
+	Name  string     `json:"name"`
+	Tags  types.Tags `json:"tags,omitempty"`
+	Value int64      `json:"value"`
+}
+
+// Timer is the wire representation of a timer.
+type Timer struct {
+	Name   string     `json:"name"`
+	Tags   types.Tags `json:"tags,omitempty"`
+	Values []float64  `json:"values"`
+}
+
+// Gauge is the wire representation of a gauge.
+type Gauge struct {
+	Name  string     `json:"name"`
+	Tags  types.Tags `json:"tags,omitempty"`
+	Value float64    `json:"value"`
+}
+
+// Set is the wire representation of a set.
+type Set struct {
+	Name   string     `json:"name"`
+	Tags   types.Tags `json:"tags,omitempty"`
+	Values []string   `json:"values"`
+}
+
+// Event is the wire representation of an event.
+type Event struct {
+	Title          string          `json:"title"`
+	Text           string          `json:"text"`
+	DateHappened   int64           `json:"date_happened,omitempty"`
+	Hostname       string          `json:"hostname,omitempty"`
+	AggregationKey string          `json:"aggregation_key,omitempty"`
+	SourceTypeName string          `json:"source_type_name,omitempty"`
+	Tags           types.Tags      `json:"tags,omitempty"`
+	Priority       types.Priority  `json:"priority,omitempty"`
+	AlertType      types.AlertType `json:"alert_type,omitempty"`
+}
+
+// NewPayload creates a Payload from a MetricMap. Internal statistics and idle series are skipped,
+// the receiving server calculates its own statistics and applies its own idle policies.
+func NewPayload(metrics *types.MetricMap) *Payload {
+	p := &Payload{}
+	if !metrics.Timestamp.IsZero() {
+		p.Timestamp = metrics.Timestamp.Unix()
+	}
+	metrics.Counters.Each(func(key, tagsKey string, counter types.Counter) {
+		if !types.IsInternalStat(key) && !counter.Idle {
+			p.Counters = append(p.Counters, Counter{Name: key, Tags: counter.TagSet.Strings(), Value: counter.Value})
+		}
+	})
+	metrics.Timers.Each(func(key, tagsKey string, timer types.Timer) {
+		if !types.IsInternalStat(key) && !timer.Idle && len(timer.Values) > 0 {
+			p.Timers = append(p.Timers, Timer{Name: key, Tags: timer.TagSet.Strings(), Values: timer.Values})
+		}
+	})
+	metrics.Gauges.Each(func(key, tagsKey string, gauge types.Gauge) {
+		if !types.IsInternalStat(key) && !gauge.Idle {
+			p.Gauges = append(p.Gauges, Gauge{Name: key, Tags: gauge.TagSet.Strings(), Value: gauge.Value})
+		}
+	})
+	metrics.Sets.Each(func(key, tagsKey string, set types.Set) {
+		if !types.IsInternalStat(key) && !set.Idle && len(set.Values) > 0 {
+			values := make([]string, 0, len(set.Values))
+			for value := range set.Values {
+				values = append(values, value)
+			}
+			p.Sets = append(p.Sets, Set{Name: key, Tags: set.TagSet.Strings(), Values: values})
+		}
+	})
+	return p
+}
+
+// Len returns the number of series in the payload.
+func (p *Payload) Len() int {
+	return len(p.Counters) + len(p.Timers) + len(p.Gauges) + len(p.Sets)
+}
+
+// MetricMap converts the payload into a MetricMap. Tags are canonicalised with the interner, which may be nil.
+// NumStats is set to the number of values in the payload.
+func (p *Payload) MetricMap(interner *types.TagInterner, now time.Time, flushInterval time.Duration) *types.MetricMap {
+	m := &types.MetricMap{
+		FlushInterval: flushInterval,
+		Counters:      types.Counters{},
+		Timers:        types.Timers{},
+		Gauges:        types.Gauges{},
+		Sets:          types.Sets{},
+	}
+	if p.Timestamp != 0 {
+		m.Timestamp = time.Unix(p.Timestamp, 0)
+	}
+	for _, c := range p.Counters {
+		counter := types.NewCounter(now, flushInterval, c.Value)
+		counter.TagSet = interner.Intern(c.Tags)
+		if existing, ok := m.Counters[c.Name][counter.TagSet.Key()]; ok {
+			counter.Value += existing.Value
+		} else if m.Counters[c.Name] == nil {
+			m.Counters[c.Name] = make(map[string]types.Counter)
+		}
+		m.Counters[c.Name][counter.TagSet.Key()] = counter
+		m.NumStats++
+	}
+	for _, t := range p.Timers {
+		timer := types.NewTimer(now, flushInterval, nil)
+		timer.TagSet = interner.Intern(t.Tags)
+		if existing, ok := m.Timers[t.Name][timer.TagSet.Key()]; ok {
+			timer.Values = existing.Values
+		} else if m.Timers[t.Name] == nil {
+			m.Timers[t.Name] = make(map[string]types.Timer)
+		}
+		timer.Values = append(timer.Values, t.Values...)
+		m.Timers[t.Name][timer.TagSet.Key()] = timer
+		m.NumStats += uint32(len(t.Values))
+	}
+	for _, g := range p.Gauges {
+		gauge := types.NewGauge(now, flushInterval, g.Value)
+		gauge.TagSet = interner.Intern(g.Tags)
+		if m.Gauges[g.Name] == nil {
+			m.Gauges[g.Name] = make(map[string]types.Gauge)
+		}
+		m.Gauges[g.Name][gauge.TagSet.Key()] = gauge
+		m.NumStats++
+	}
+	for _, s := range p.Sets {
+		tags := interner.Intern(s.Tags)
+		set, ok := m.Sets[s.Name][tags.Key()]
+		if !ok {
+			set = types.NewSet(now, flushInterval, make(map[string]int64, len(s.Values)))
+			set.TagSet = tags
+			if m.Sets[s.Name] == nil {
+				m.Sets[s.Name] = make(map[string]types.Set)
+			}
+		}
+		for _, value := range s.Values {
+			set.Values[value]++
+		}
+		m.Sets[s.Name][tags.Key()] = set
+		m.NumStats += uint32(len(s.Values))
+	}
+	return m
+}
+
+// NewEvent creates the wire representation of an event.
+func NewEvent(e *types.Event) *Event {
+	return &Event{
+		Title:          e.Title,
+		Text:           e.Text,
+		DateHappened:   e.DateHappened,
+		Hostname:       e.Hostname,
+		AggregationKey: e.AggregationKey,
+		SourceTypeName: e.SourceTypeName,
+		Tags:           e.Tags,
+		Priority:       e.Priority,
+		AlertType:      e.AlertType,
+	}
+}
+
+// Event converts the wire representation back into an event.
+func (e *Event) Event() *types.Event {
+	return &types.Event{
+		Title:          e.Title,
+		Text:           e.Text,
+		DateHappened:   e.DateHappened,
+		Hostname:       e.Hostname,
+		AggregationKey: e.AggregationKey,
+		SourceTypeName: e.SourceTypeName,
+		Tags:           e.Tags,
+		Priority:       e.Priority,
+		AlertType:      e.AlertType,
+	}
+}
+
+// Decode reads a JSON document into v, decompressing it first if contentEncoding is "gzip".
+func Decode(r io.Reader, contentEncoding string, v interface{}) error {
+	switch contentEncoding {
+	case "":
+	case "gzip":
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		r = gz
+	default:
+		return fmt.Errorf("unsupported content encoding %q", contentEncoding)
+	}
+	return json.NewDecoder(r).Decode(v)
+}
@@ -4,12 +4,12 @@ import (
 	"bytes"
 	"fmt"
 	"net"
-	"strings"
 	"time"
 
 	backendTypes "github.com/atlassian/gostatsd/backend/types"
 	"github.com/atlassian/gostatsd/types"
 
+	log "github.com/Sirupsen/logrus"
 	"github.com/spf13/viper"
 	"golang.org/x/net/context"
 )
@@ -23,58 +23,70 @@ const sampleConfig = `
 	address = "ip:2003"
 `
 
-// normalizeBucketName cleans up a bucket name by replacing or translating invalid characters.
-func normalizeBucketName(bucket string, tagsKey string) string {
-	tags := strings.Split(tagsKey, ",")
-	for _, tag := range tags {
-		if tag != "" {
-			bucket += "." + types.TagToMetricName(tag)
+// normalizeBucketName adds the tags to a bucket name, sanitized by types.Tag.MetricName.
+// Tags that cannot be sanitized are dropped.
+func normalizeBucketName(bucket string, tags *types.TagSet) string {
+	for _, tag := range tags.Tags() {
+		name, err := tag.MetricName()
+		if err != nil {
+			log.Debugf("[%s] dropping tag %q: %v", BackendName, tag, err)
+			continue
 		}
+		bucket += "." + name
 	}
 	return bucket
 }
 
-// client is an object that is used to send messages to a Graphite server's TCP interface.
-type client struct {
-	address string
-}
-
-// SendMetrics sends the metrics in a MetricsMap to the Graphite server.
-func (client *client) SendMetrics(ctx context.Context, metrics *types.MetricMap) error {
-	if metrics.NumStats == 0 {
-		return nil
+// EncodeMetrics writes the metrics to buf in the Graphite plaintext protocol. Metrics without a timestamp
+// are written with now.
+func EncodeMetrics(buf *bytes.Buffer, metrics *types.MetricMap, now time.Time) {
+	ts := now.Unix()
+	if !metrics.Timestamp.IsZero() {
+		ts = metrics.Timestamp.Unix()
 	}
-	buf := new(bytes.Buffer)
-	now := time.Now().Unix()
 	metrics.Counters.Each(func(key, tagsKey string, counter types.Counter) {
-		nk := normalizeBucketName(key, tagsKey)
-		fmt.Fprintf(buf, "stats_count.%s %f %d\n", nk, float64(counter.Value), now)
-		fmt.Fprintf(buf, "stats.%s %f %d\n", nk, counter.PerSecond, now)
+		nk := normalizeBucketName(key, counter.TagSet)
+		fmt.Fprintf(buf, "stats_count.%s %f %d\n", nk, float64(counter.Value), ts)
+		fmt.Fprintf(buf, "stats.%s %f %d\n", nk, counter.PerSecond, ts)
 	})
 	metrics.Timers.Each(func(key, tagsKey string, timer types.Timer) {
-		nk := normalizeBucketName(key, tagsKey)
-		fmt.Fprintf(buf, "stats.timers.%s.lower %f %d\n", nk, timer.Min, now)
-		fmt.Fprintf(buf, "stats.timers.%s.upper %f %d\n", nk, timer.Max, now)
-		fmt.Fprintf(buf, "stats.timers.%s.count %f %d\n", nk, timer.Count, now)
-		fmt.Fprintf(buf, "stats.timers.%s.count_ps %f %d\n", nk, timer.PerSecond, now)
-		fmt.Fprintf(buf, "stats.timers.%s.mean %f %d\n", nk, timer.Mean, now)
-		fmt.Fprintf(buf, "stats.timers.%s.median %f %d\n", nk, timer.Median, now)
-		fmt.Fprintf(buf, "stats.timers.%s.sum %f %d\n", nk, timer.Sum, now)
-		fmt.Fprintf(buf, "stats.timers.%s.sum %f %d\n", nk, timer.SumSquares, now)
-		fmt.Fprintf(buf, "stats.timers.%s.sum_squares %f %d\n", nk, timer.StdDev, now)
+		nk := normalizeBucketName(key, timer.TagSet)
+		fmt.Fprintf(buf, "stats.timers.%s.lower %f %d\n", nk, timer.Min, ts)
+		fmt.Fprintf(buf, "stats.timers.%s.upper %f %d\n", nk, timer.Max, ts)
+		fmt.Fprintf(buf, "stats.timers.%s.count %d %d\n", nk, timer.Count, ts)
+		fmt.Fprintf(buf, "stats.timers.%s.count_ps %f %d\n", nk, timer.PerSecond, ts)
+		fmt.Fprintf(buf, "stats.timers.%s.mean %f %d\n", nk, timer.Mean, ts)
+		fmt.Fprintf(buf, "stats.timers.%s.median %f %d\n", nk, timer.Median, ts)
+		fmt.Fprintf(buf, "stats.timers.%s.sum %f %d\n", nk, timer.Sum, ts)
+		fmt.Fprintf(buf, "stats.timers.%s.sum %f %d\n", nk, timer.SumSquares, ts)
+		fmt.Fprintf(buf, "stats.timers.%s.sum_squares %f %d\n", nk, timer.StdDev, ts)
 		for _, pct := range timer.Percentiles {
-			fmt.Fprintf(buf, "stats.timers.%s.%s %f %d\n", nk, pct.String(), pct.Float(), now)
+			fmt.Fprintf(buf, "stats.timers.%s.%s %f %d\n", nk, pct.String(), pct.Float(), ts)
 		}
 	})
 	metrics.Gauges.Each(func(key, tagsKey string, gauge types.Gauge) {
-		nk := normalizeBucketName(key, tagsKey)
-		fmt.Fprintf(buf, "stats.gauge.%s %f %d\n", nk, gauge.Value, now)
+		nk := normalizeBucketName(key, gauge.TagSet)
+		fmt.Fprintf(buf, "stats.gauge.%s %f %d\n", nk, gauge.Value, ts)
 	})
 
 	metrics.Sets.Each(func(key, tagsKey string, set types.Set) {
-		nk := normalizeBucketName(key, tagsKey)
-		fmt.Fprintf(buf, "stats.sets.%s %d %d\n", nk, len(set.Values), now)
+		nk := normalizeBucketName(key, set.TagSet)
+		fmt.Fprintf(buf, "stats.sets.%s %d %d\n", nk, len(set.Values), ts)
 	})
+}
+
+// client is an object that is used to send messages to a Graphite server's TCP interface.
+type client struct {
+	address string
+}
+
+// SendMetrics sends the metrics in a MetricsMap to the Graphite server.
+func (client *client) SendMetrics(ctx context.Context, metrics *types.MetricMap) error {
+	if metrics.IsEmpty() {
+		return nil
+	}
+	buf := new(bytes.Buffer)
+	EncodeMetrics(buf, metrics, time.Now())
 
 	conn, err := net.Dial("tcp", client.address)
 	if err != nil {
@@ -3,9 +3,13 @@ package statsdaemon
 import (
 	"bytes"
 	"fmt"
+	"math"
 	"net"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	backendTypes "github.com/atlassian/gostatsd/backend/types"
 	"github.com/atlassian/gostatsd/types"
@@ -17,121 +21,259 @@ import (
 
 const (
 	// BackendName is the name of this backend.
-	BackendName      = "statsdaemon"
-	maxUDPPacketSize = 1472
+	BackendName = "statsdaemon"
+	// defaultPacketSize is the maximum size of UDP datagrams that are not fragmented on Ethernet.
+	defaultPacketSize    = 1472
+	defaultNetwork       = "udp"
+	defaultClientTimeout = 5 * time.Second
 )
 
 const sampleConfig = `
 [statsdaemon]
 	# statsdaemon host or ip address
 	address = "statsdaemon-master:6126"
+
+	# Network used to send metrics: udp or tcp.
+	# network = "udp"
+
+	# Maximum size of packets. Over UDP, lines larger than this are dropped.
+	# packet_size = 1472
+
+	# Pack the values of a timer in as few lines as possible, e.g. "name:1:2:3|ms".
+	# The master must support multi-value lines, gostatsd does.
+	# packed_lines = false
+
+	# Pack the members of a set in as few lines as possible, e.g. "name:a:b|s". Members containing a colon
+	# are sent on their own line. The master must split the values of set lines on colons, gostatsd does not.
+	# packed_sets = false
+
+	# Timeout of connections and writes.
+	# timeout = "5s"
 `
 
-// client is an object that is used to send messages to a statsd server's UDP interface.
+// client is an object that is used to send messages to a statsd server's UDP or TCP interface.
+// The connection is kept open between flushes and reopened after errors.
 type client struct {
-	addr string
+	network     string
+	addr        string
+	packetSize  int
+	packedLines bool
+	packedSets  bool
+	timeout     time.Duration
+
+	mu   sync.Mutex // Protects conn and serialises writes
+	conn net.Conn
+}
+
+// packer groups lines into packets of at most size bytes.
+type packer struct {
+	size          int
+	allowOversize bool // Whether lines larger than size are sent in their own packet or dropped
+	packets       [][]byte
+	buf           bytes.Buffer
+	dropped       int
 }
 
-func (client *client) write(conn *net.Conn, buf *bytes.Buffer) error {
-	_, err := buf.WriteTo(*conn)
-	if err != nil {
-		return fmt.Errorf("error sending to statsd backend: %s", err)
+func (p *packer) addLine(line []byte) {
+	if len(line) > p.size {
+		if !p.allowOversize {
+			p.dropped++
+			return
+		}
+		p.flush()
+		p.packets = append(p.packets, append([]byte(nil), line...))
+		return
 	}
-	return nil
+	if p.buf.Len()+len(line) > p.size {
+		p.flush()
+	}
+	p.buf.Write(line)
 }
 
-func (client *client) writeLine(conn *net.Conn, buf *bytes.Buffer, format, name, tags string, value interface{}) error {
-	line := new(bytes.Buffer)
-	if tags != "" {
-		format += "|#%s"
+func (p *packer) flush() {
+	if p.buf.Len() > 0 {
+		p.packets = append(p.packets, append([]byte(nil), p.buf.Bytes()...))
+		p.buf.Reset()
 	}
-	format += "\n"
-	if tags == "" {
-		fmt.Fprintf(line, format, name, value)
-	} else {
-		fmt.Fprintf(line, format, name, value, tags)
+}
+
+// formatLine formats a line with the given values.
+func formatLine(name, tags, metricType string, values ...string) []byte {
+	line := make([]byte, 0, len(name)+len(tags)+16)
+	line = append(line, name...)
+	for _, value := range values {
+		line = append(line, ':')
+		line = append(line, value...)
 	}
-	// Make sure we don't go over max udp datagram size
-	if buf.Len()+line.Len() > maxUDPPacketSize {
-		if err := client.write(conn, buf); err != nil {
-			return err
-		}
-		buf.Reset()
+	line = append(line, '|')
+	line = append(line, metricType...)
+	if tags != "" {
+		line = append(line, "|#"...)
+		line = append(line, tags...)
 	}
-	fmt.Fprint(buf, line)
-	line.Reset()
-	return nil
+	return append(line, '\n')
 }
 
-func logError(err error) error {
-	log.Errorf("Error sending to statsd backend: %s", err)
-	return err
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
 }
 
-// SendMetrics sends the metrics in a MetricsMap to the statsd master server.
-func (client *client) SendMetrics(ctx context.Context, metrics *types.MetricMap) error {
-	if metrics.NumStats == 0 {
-		return nil
+// addPackedLines adds the values in lines of at most the packet size, with as many values per line as possible.
+func (p *packer) addPackedLines(name, tags, metricType string, values []string) {
+	overhead := len(formatLine(name, tags, metricType))
+	var batch []string
+	size := overhead
+	for _, value := range values {
+		if len(batch) > 0 && size+1+len(value) > p.size {
+			p.addLine(formatLine(name, tags, metricType, batch...))
+			batch = batch[:0]
+			size = overhead
+		}
+		batch = append(batch, value)
+		size += 1 + len(value)
 	}
-
-	conn, err := net.Dial("udp", client.addr)
-	if err != nil {
-		return fmt.Errorf("error connecting to statsd backend: %s", err)
+	if len(batch) > 0 {
+		p.addLine(formatLine(name, tags, metricType, batch...))
 	}
-	defer conn.Close()
+}
 
-	var lastError error
-	buf := new(bytes.Buffer)
+// EncodeMetrics writes the metrics to buf as statsd lines, one value per line.
+// Idle series and the internal statsd counters are skipped.
+func EncodeMetrics(buf *bytes.Buffer, metrics *types.MetricMap) {
+	p := &packer{size: math.MaxInt32}
+	encodeMetrics(p, metrics, false, false)
+	p.buf.WriteTo(buf)
+}
+
+// EncodeEvent returns the event in the statsd event format, without a trailing newline.
+func EncodeEvent(e *types.Event) []byte {
+	return constructEventMessage(e).Bytes()
+}
+
+// encodeMetrics adds the lines of the metrics to the packer.
+func encodeMetrics(p *packer, metrics *types.MetricMap, packedLines, packedSets bool) {
+	// Idle series are not sent, the master applies its own idle policies
 	metrics.Counters.Each(func(key, tagsKey string, counter types.Counter) {
 		// do not send statsd stats as they will be recalculated on the master instead
-		if !strings.HasPrefix(key, "statsd.") {
-			if err = client.writeLine(&conn, buf, "%s:%d|c", key, tagsKey, counter.Value); err != nil {
-				lastError = logError(err)
-			}
+		if !strings.HasPrefix(key, "statsd.") && !counter.Idle {
+			p.addLine(formatLine(key, tagsKey, "c", strconv.FormatInt(counter.Value, 10)))
 		}
 	})
 	metrics.Timers.Each(func(key, tagsKey string, timer types.Timer) {
+		if timer.Idle {
+			return
+		}
+		values := make([]string, 0, len(timer.Values))
 		for _, tr := range timer.Values {
-			if err = client.writeLine(&conn, buf, "%s:%f|ms", key, tagsKey, tr); err != nil {
-				lastError = logError(err)
-			}
+			values = append(values, formatFloat(tr))
+		}
+		if packedLines {
+			p.addPackedLines(key, tagsKey, "ms", values)
+			return
+		}
+		for _, value := range values {
+			p.addLine(formatLine(key, tagsKey, "ms", value))
 		}
 	})
 	metrics.Gauges.Each(func(key, tagsKey string, gauge types.Gauge) {
-		if err = client.writeLine(&conn, buf, "%s:%f|g", key, tagsKey, gauge.Value); err != nil {
-			lastError = logError(err)
+		if gauge.Idle {
+			return
 		}
+		p.addLine(formatLine(key, tagsKey, "g", formatFloat(gauge.Value)))
 	})
-
 	metrics.Sets.Each(func(key, tagsKey string, set types.Set) {
-		for k := range set.Values {
-			if err = client.writeLine(&conn, buf, "%s:%s|s", key, tagsKey, k); err != nil {
-				lastError = logError(err)
+		if set.Idle {
+			return
+		}
+		var packed []string
+		for member := range set.Values {
+			// Members with colons cannot be told apart from several members in a packed line
+			if packedSets && !strings.Contains(member, ":") {
+				packed = append(packed, member)
+			} else {
+				p.addLine(formatLine(key, tagsKey, "s", member))
 			}
 		}
+		if len(packed) > 0 {
+			sort.Strings(packed)
+			p.addPackedLines(key, tagsKey, "s", packed)
+		}
 	})
+}
 
-	if err = client.write(&conn, buf); err != nil {
-		return err
+// SendMetrics sends the metrics in a MetricsMap to the statsd master server.
+func (client *client) SendMetrics(ctx context.Context, metrics *types.MetricMap) error {
+	if metrics.IsEmpty() {
+		return nil
 	}
 
-	if lastError != nil {
-		return lastError
+	p := &packer{size: client.packetSize, allowOversize: client.network != "udp"}
+	encodeMetrics(p, metrics, client.packedLines, client.packedSets)
+	p.flush()
+
+	err := client.write(p.packets...)
+	if p.dropped > 0 {
+		dropErr := fmt.Errorf("[%s] dropped %d lines larger than the packet size of %d bytes", BackendName, p.dropped, client.packetSize)
+		log.Warn(dropErr)
+		if err == nil {
+			err = dropErr
+		}
 	}
-	return nil
+	return err
 }
 
 // SendEvent sends events to the statsd master server.
 func (client *client) SendEvent(ctx context.Context, e *types.Event) error {
-	conn, err := net.Dial("udp", client.addr)
-	if err != nil {
-		return fmt.Errorf("error connecting to statsd backend: %s", err)
+	buf := constructEventMessage(e)
+	if client.network != "udp" {
+		buf.WriteByte('\n') // Delimits the event in the stream
+	}
+	return client.write(buf.Bytes())
+}
+
+// write writes the packets to the connection, opening it if needed. The connection is closed on errors
+// and opened again by the next write. Over TCP, packets that could not be written are retried once on a new connection.
+func (client *client) write(packets ...[]byte) error {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	for _, packet := range packets {
+		err := client.writePacket(packet)
+		if err != nil && client.network != "udp" {
+			err = client.writePacket(packet)
+		}
+		if err != nil {
+			return fmt.Errorf("[%s] error sending to statsd backend: %v", BackendName, err)
+		}
 	}
-	defer conn.Close()
+	return nil
+}
 
-	_, err = conn.Write(constructEventMessage(e).Bytes())
+func (client *client) writePacket(packet []byte) error {
+	if client.conn == nil {
+		conn, err := net.DialTimeout(client.network, client.addr, client.timeout)
+		if err != nil {
+			return err
+		}
+		client.conn = conn
+	}
+	if client.timeout > 0 {
+		if err := client.conn.SetWriteDeadline(time.Now().Add(client.timeout)); err != nil {
+			client.closeConn()
+			return err
+		}
+	}
+	if _, err := client.conn.Write(packet); err != nil {
+		client.closeConn()
+		return err
+	}
+	return nil
+}
 
-	return err
+func (client *client) closeConn() {
+	if err := client.conn.Close(); err != nil {
+		log.Debugf("[%s] error closing connection: %v", BackendName, err)
+	}
+	client.conn = nil
 }
 
 func constructEventMessage(e *types.Event) *bytes.Buffer {
@@ -187,15 +329,46 @@ func (client *client) SampleConfig() string {
 	return sampleConfig
 }
 
-// NewClient constructs a GraphiteClient object by connecting to an address.
-func NewClient(address string) (backendTypes.Backend, error) {
-	log.Infof("Backend statsdaemon address: %s", address)
-	return &client{address}, nil
+// NewClient constructs a statsd client sending metrics to address over network, udp or tcp.
+func NewClient(network, address string, packetSize int, packedLines, packedSets bool, timeout time.Duration) (backendTypes.Backend, error) {
+	if address == "" {
+		return nil, fmt.Errorf("[%s] address is a required field", BackendName)
+	}
+	network = strings.ToLower(strings.TrimSpace(network))
+	switch network {
+	case "":
+		network = defaultNetwork
+	case "udp", "tcp":
+	default:
+		return nil, fmt.Errorf("[%s] invalid network %q: must be one of udp or tcp", BackendName, network)
+	}
+	if packetSize <= 0 {
+		return nil, fmt.Errorf("[%s] packet_size must be positive", BackendName)
+	}
+	log.Infof("Backend statsdaemon address: %s/%s", network, address)
+	return &client{
+		network:     network,
+		addr:        address,
+		packetSize:  packetSize,
+		packedLines: packedLines,
+		packedSets:  packedSets,
+		timeout:     timeout,
+	}, nil
 }
 
 // NewClientFromViper constructs a statsd client by connecting to an address.
 func NewClientFromViper(v *viper.Viper) (backendTypes.Backend, error) {
-	return NewClient(v.GetString("statsdaemon.address"))
+	v.SetDefault("statsdaemon.network", defaultNetwork)
+	v.SetDefault("statsdaemon.packet_size", defaultPacketSize)
+	v.SetDefault("statsdaemon.timeout", defaultClientTimeout)
+	return NewClient(
+		v.GetString("statsdaemon.network"),
+		v.GetString("statsdaemon.address"),
+		v.GetInt("statsdaemon.packet_size"),
+		v.GetBool("statsdaemon.packed_lines"),
+		v.GetBool("statsdaemon.packed_sets"),
+		v.GetDuration("statsdaemon.timeout"),
+	)
 }
 
 // BackendName returns the name of the backend.
@@ -0,0 +1,173 @@
+package statsdaemon
+
+import (
+	"bufio"
+	"net"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/atlassian/gostatsd/types"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+func newTimerMap(name string, values ...float64) *types.MetricMap {
+	return &types.MetricMap{
+		Timers: types.Timers{name: {"": types.NewTimer(time.Now(), time.Second, values)}},
+	}
+}
+
+func TestPackerSplitsPackets(t *testing.T) {
+	assert := assert.New(t)
+
+	p := &packer{size: 10}
+	p.addLine([]byte("a:1|c\n"))
+	p.addLine([]byte("b:2|c\n"))
+	p.addLine([]byte("too.long:1|c\n"))
+	p.flush()
+	assert.Equal([][]byte{[]byte("a:1|c\n"), []byte("b:2|c\n")}, p.packets)
+	assert.Equal(1, p.dropped)
+
+	p = &packer{size: 10, allowOversize: true}
+	p.addLine([]byte("a:1|c\n"))
+	p.addLine([]byte("too.long:1|c\n"))
+	p.flush()
+	assert.Equal([][]byte{[]byte("a:1|c\n"), []byte("too.long:1|c\n")}, p.packets)
+	assert.Zero(p.dropped)
+}
+
+func TestPackedLines(t *testing.T) {
+	assert := assert.New(t)
+
+	p := &packer{size: 16}
+	p.addPackedLines("t", "", "ms", []string{"1", "2", "3", "4", "5", "6", "7"})
+	p.flush()
+	// "t:1:2:3:4:5|ms\n" is 15 bytes
+	assert.Equal([][]byte{[]byte("t:1:2:3:4:5|ms\n"), []byte("t:6:7|ms\n")}, p.packets)
+
+	assert.Equal("t:1.5:2|ms|#a:b,c\n", string(formatLine("t", "a:b,c", "ms", "1.5", "2")))
+}
+
+func TestPackedSetMembers(t *testing.T) {
+	assert := assert.New(t)
+
+	m := &types.MetricMap{
+		Sets: types.Sets{"s": {"": types.Set{Values: map[string]int64{"b": 1, "fe80::1": 1, `c\d`: 1}}}},
+	}
+	for _, tc := range []struct {
+		packed   bool
+		expected []string
+	}{
+		{true, []string{`s:b:c\d|s` + "\n", "s:fe80::1|s\n"}}, // Members with colons are not packed
+		{false, []string{"s:b|s\n", `s:c\d|s` + "\n", "s:fe80::1|s\n"}},
+	} {
+		p := &packer{size: 1000}
+		encodeMetrics(p, m, true, tc.packed)
+		p.flush()
+		if assert.Len(p.packets, 1, "packed: %v", tc.packed) {
+			lines := strings.SplitAfter(string(p.packets[0]), "\n")
+			sort.Strings(lines)
+			assert.Equal(tc.expected, lines[1:], "packed: %v", tc.packed) // The first line is empty
+		}
+	}
+}
+
+func TestSendMetricsUDP(t *testing.T) {
+	assert := assert.New(t)
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	c, err := NewClient("udp", conn.LocalAddr().String(), defaultPacketSize, true, false, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(c.SendMetrics(context.Background(), newTimerMap("t", 1, 2.5, 3)))
+
+	buf := make([]byte, 2*defaultPacketSize)
+	if err = conn.SetReadDeadline(time.Now().Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	n, _, err := conn.ReadFrom(buf)
+	assert.NoError(err)
+	assert.Equal("t:1:2.5:3|ms\n", string(buf[:n]))
+
+	m := &types.MetricMap{
+		Gauges: types.Gauges{
+			"g":                       {"": types.NewGauge(time.Now(), time.Second, 1)},
+			strings.Repeat("x", 2000): {"": types.NewGauge(time.Now(), time.Second, 1)},
+		},
+	}
+	assert.Error(c.SendMetrics(context.Background(), m))
+	n, _, err = conn.ReadFrom(buf)
+	assert.NoError(err)
+	assert.Equal("g:1|g\n", string(buf[:n]))
+}
+
+func TestSendMetricsTCPReusesConnection(t *testing.T) {
+	assert := assert.New(t)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	lines := make(chan string, 100)
+	accepted := make(chan struct{}, 10)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- struct{}{}
+			go func() {
+				defer conn.Close()
+				s := bufio.NewScanner(conn)
+				for s.Scan() {
+					lines <- s.Text()
+				}
+			}()
+		}
+	}()
+
+	c, err := NewClient("tcp", l.Addr().String(), 16, false, false, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(c.SendMetrics(context.Background(), newTimerMap("t", 1, 2)))
+	assert.NoError(c.SendMetrics(context.Background(), newTimerMap(strings.Repeat("x", 20), 3)))
+	assert.NoError(c.SendEvent(context.Background(), &types.Event{Title: "a", Text: "b"}))
+
+	var received []string
+	for i := 0; i < 4; i++ {
+		select {
+		case line := <-lines:
+			received = append(received, line)
+		case <-time.After(time.Second):
+			t.Fatalf("received %v", received)
+		}
+	}
+	sort.Strings(received)
+	assert.Equal([]string{"_e{1,1}:a|b", "t:1|ms", "t:2|ms", strings.Repeat("x", 20) + ":3|ms"}, received)
+	assert.Len(accepted, 1)
+}
+
+func TestNewClientValidation(t *testing.T) {
+	assert := assert.New(t)
+
+	_, err := NewClient("udp", "", defaultPacketSize, false, false, time.Second)
+	assert.Error(err)
+	_, err = NewClient("unix", "localhost:8125", defaultPacketSize, false, false, time.Second)
+	assert.Error(err)
+	_, err = NewClient("udp", "localhost:8125", 0, false, false, time.Second)
+	assert.Error(err)
+	_, err = NewClient("TCP", "localhost:8125", defaultPacketSize, false, false, time.Second)
+	assert.NoError(err)
+}
@@ -0,0 +1,110 @@
+package stdout
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/atlassian/gostatsd/types"
+)
+
+var (
+	// influxKeyEscaper escapes measurement names, tag keys and tag values.
+	influxKeyEscaper = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+	// influxStringEscaper escapes string field values.
+	influxStringEscaper = strings.NewReplacer(`"`, `\"`, `\`, `\\`)
+)
+
+// encodeInfluxMetrics writes the metrics to buf in the InfluxDB line protocol, one line per series with
+// the aggregations as fields. Metrics without a timestamp are written with now.
+func encodeInfluxMetrics(buf *bytes.Buffer, metrics *types.MetricMap, now time.Time) {
+	ts := now
+	if !metrics.Timestamp.IsZero() {
+		ts = metrics.Timestamp
+	}
+	metrics.Counters.Each(func(key, tagsKey string, counter types.Counter) {
+		writeInfluxLine(buf, key, counter.TagSet, ts,
+			"count", strconv.FormatInt(counter.Value, 10)+"i",
+			"per_second", influxFloat(counter.PerSecond))
+	})
+	metrics.Timers.Each(func(key, tagsKey string, timer types.Timer) {
+		fields := []string{
+			"lower", influxFloat(timer.Min),
+			"upper", influxFloat(timer.Max),
+			"count", strconv.Itoa(timer.Count) + "i",
+			"count_ps", influxFloat(timer.PerSecond),
+			"mean", influxFloat(timer.Mean),
+			"median", influxFloat(timer.Median),
+			"std", influxFloat(timer.StdDev),
+			"sum", influxFloat(timer.Sum),
+			"sum_squares", influxFloat(timer.SumSquares),
+		}
+		for _, pct := range timer.Percentiles {
+			fields = append(fields, pct.String(), influxFloat(pct.Float()))
+		}
+		writeInfluxLine(buf, key, timer.TagSet, ts, fields...)
+	})
+	metrics.Gauges.Each(func(key, tagsKey string, gauge types.Gauge) {
+		writeInfluxLine(buf, key, gauge.TagSet, ts, "value", influxFloat(gauge.Value))
+	})
+	metrics.Sets.Each(func(key, tagsKey string, set types.Set) {
+		writeInfluxLine(buf, key, set.TagSet, ts, "count", strconv.Itoa(len(set.Values))+"i")
+	})
+}
+
+// encodeInfluxEvent writes the event to buf in the InfluxDB line protocol, in the "events" measurement.
+func encodeInfluxEvent(buf *bytes.Buffer, e *types.Event, now time.Time) {
+	ts := now
+	if e.DateHappened != 0 {
+		ts = time.Unix(e.DateHappened, 0)
+	}
+	writeInfluxLine(buf, "events", types.NewTagSet(e.Tags), ts,
+		"title", influxString(e.Title),
+		"text", influxString(e.Text),
+		"priority", influxString(e.Priority.String()),
+		"alert_type", influxString(e.AlertType.String()))
+}
+
+// writeInfluxLine writes a line with the given field names and encoded values.
+// Bare tags get the value "true" and the values of repeated tag keys are joined with commas.
+func writeInfluxLine(buf *bytes.Buffer, measurement string, tags *types.TagSet, ts time.Time, fields ...string) {
+	buf.WriteString(influxKeyEscaper.Replace(measurement))
+	var lastKey string
+	for i, tag := range tags.Tags() {
+		value := tag.Value
+		if tag.IsBare() {
+			value = "true"
+		}
+		if i > 0 && tag.Key == lastKey {
+			buf.WriteString(`\,`)
+		} else {
+			buf.WriteByte(',')
+			buf.WriteString(influxKeyEscaper.Replace(tag.Key))
+			buf.WriteByte('=')
+		}
+		buf.WriteString(influxKeyEscaper.Replace(value))
+		lastKey = tag.Key
+	}
+	for i := 0; i+1 < len(fields); i += 2 {
+		if i == 0 {
+			buf.WriteByte(' ')
+		} else {
+			buf.WriteByte(',')
+		}
+		buf.WriteString(influxKeyEscaper.Replace(fields[i]))
+		buf.WriteByte('=')
+		buf.WriteString(fields[i+1])
+	}
+	buf.WriteByte(' ')
+	buf.WriteString(strconv.FormatInt(ts.UnixNano(), 10))
+	buf.WriteByte('\n')
+}
+
+func influxFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+func influxString(s string) string {
+	return `"` + influxStringEscaper.Replace(s) + `"`
+}
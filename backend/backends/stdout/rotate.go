@@ -0,0 +1,122 @@
+package stdout
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// rotatingFile is a file that is renamed with a timestamp suffix and replaced by a new file when it grows
+// beyond maxSize bytes. Only the maxBackups most recent rotated files are kept, all of them when maxBackups is 0.
+// It is not safe for concurrent use.
+type rotatingFile struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+	now        func() time.Time
+
+	file *os.File
+	size int64
+}
+
+func newRotatingFile(path string, maxSize int64, maxBackups int) (*rotatingFile, error) {
+	r := &rotatingFile{
+		path:       path,
+		maxSize:    maxSize,
+		maxBackups: maxBackups,
+		now:        time.Now,
+	}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.file = f
+	r.size = info.Size()
+	return nil
+}
+
+// Write writes p to the file, rotating it first if p would make it larger than maxSize.
+// A single write is never split across files.
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	if r.maxSize > 0 && r.size > 0 && r.size+int64(len(p)) > r.maxSize {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.file.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+// rotate renames the file and opens a new one. If it fails, the file is opened again so that the next writes
+// do not fail, they are appended to the file that was not rotated.
+func (r *rotatingFile) rotate() error {
+	if err := r.file.Close(); err != nil {
+		return r.reopen(err)
+	}
+	backup := fmt.Sprintf("%s.%s", r.path, r.now().UTC().Format("20060102T150405.000000000"))
+	if err := os.Rename(r.path, backup); err != nil {
+		return r.reopen(err)
+	}
+	if err := r.open(); err != nil {
+		if e := os.Rename(backup, r.path); e != nil {
+			return err
+		}
+		return r.reopen(err)
+	}
+	return r.removeOldBackups()
+}
+
+// reopen opens the file again after a failed rotation and returns err, the error of the rotation.
+func (r *rotatingFile) reopen(err error) error {
+	if e := r.open(); e != nil {
+		return fmt.Errorf("%v (and reopening %s failed: %v)", err, r.path, e)
+	}
+	return err
+}
+
+// removeOldBackups removes the rotated files beyond the maxBackups most recent ones.
+func (r *rotatingFile) removeOldBackups() error {
+	if r.maxBackups <= 0 {
+		return nil
+	}
+	backups, err := filepath.Glob(r.path + ".*")
+	if err != nil {
+		return err
+	}
+	var rotated []string
+	for _, b := range backups {
+		// Timestamps only contain digits, a T and a dot
+		if strings.Trim(b[len(r.path)+1:], "0123456789T.") == "" {
+			rotated = append(rotated, b)
+		}
+	}
+	sort.Strings(rotated) // Oldest first
+	for len(rotated) > r.maxBackups {
+		if err := os.Remove(rotated[0]); err != nil {
+			return err
+		}
+		rotated = rotated[1:]
+	}
+	return nil
+}
+
+// Close closes the file.
+func (r *rotatingFile) Close() error {
+	return r.file.Close()
+}
@@ -2,10 +2,17 @@ package stdout
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
+	"io"
+	"os"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/atlassian/gostatsd/backend/backends/forwarder"
+	"github.com/atlassian/gostatsd/backend/backends/graphite"
+	"github.com/atlassian/gostatsd/backend/backends/statsdaemon"
 	backendTypes "github.com/atlassian/gostatsd/backend/types"
 	"github.com/atlassian/gostatsd/types"
 
@@ -17,92 +24,186 @@ import (
 // BackendName is the name of this backend.
 const BackendName = "stdout"
 
-// client is an object that is used to send messages to stdout.
-type client struct{}
+const (
+	// FormatDefault prints the metrics as "stats.<type>.<name>.<aggregation> <value> <timestamp>" lines.
+	FormatDefault = "default"
+	// FormatStatsd prints the metrics as statsd lines, like the statsdaemon backend sends them.
+	FormatStatsd = "statsd"
+	// FormatGraphite prints the metrics in the Graphite plaintext protocol, like the graphite backend sends them.
+	FormatGraphite = "graphite"
+	// FormatJSON prints a JSON document per flush, in the format the forwarder backend sends.
+	FormatJSON = "json"
+	// FormatInflux prints the metrics in the InfluxDB line protocol.
+	FormatInflux = "influx"
+)
+
+const sampleConfig = `
+[stdout]
+	## Output format: default, statsd, graphite, json or influx. json prints the values of each flush as
+	## the forwarder backend sends them, one document per line.
+	# format = "default"
+
+	## File the metrics are appended to instead of the standard output.
+	# path = "/var/log/gostatsd/metrics.log"
+
+	## Size in bytes beyond which the file is rotated, 0 disables rotation.
+	# max_size = 104857600
+
+	## Number of rotated files kept, 0 keeps all of them.
+	# max_backups = 5
+`
+
+// client is an object that is used to print metrics to stdout or to a file.
+type client struct {
+	format string
+
+	mu  sync.Mutex // Serialises writes so that flushes are not interleaved
+	out io.Writer
+}
 
 // NewClientFromViper constructs a stdout backend.
 func NewClientFromViper(v *viper.Viper) (backendTypes.Backend, error) {
-	return NewClient()
+	v.SetDefault("stdout.format", FormatDefault)
+	format := v.GetString("stdout.format")
+	path := v.GetString("stdout.path")
+	if path == "" {
+		return NewClient(format, os.Stdout)
+	}
+	f, err := newRotatingFile(path, v.GetInt64("stdout.max_size"), v.GetInt("stdout.max_backups"))
+	if err != nil {
+		return nil, fmt.Errorf("[%s] unable to open %s: %v", BackendName, path, err)
+	}
+	return NewClient(format, f)
 }
 
-// NewClient constructs a stdout backend.
-func NewClient() (backendTypes.Backend, error) {
-	return &client{}, nil
+// NewClient constructs a stdout backend printing in format to out.
+func NewClient(format string, out io.Writer) (backendTypes.Backend, error) {
+	format = strings.ToLower(strings.TrimSpace(format))
+	switch format {
+	case "":
+		format = FormatDefault
+	case FormatDefault, FormatStatsd, FormatGraphite, FormatJSON, FormatInflux:
+	default:
+		return nil, fmt.Errorf("[%s] invalid format %q: must be one of default, statsd, graphite, json or influx", BackendName, format)
+	}
+	return &client{format: format, out: out}, nil
 }
 
-// composeMetricName adds the key and the tags to compose the metric name.
-func composeMetricName(key string, tagsKey string) string {
-	tags := strings.Split(tagsKey, ",")
-	for _, tag := range tags {
-		if tag != "" {
-			key += "." + types.TagToMetricName(tag)
+// composeMetricName adds the key and the tags to compose the metric name, like the graphite backend.
+func composeMetricName(key string, tags *types.TagSet) string {
+	for _, tag := range tags.Tags() {
+		name, err := tag.MetricName()
+		if err != nil {
+			log.Debugf("[%s] dropping tag %q: %v", BackendName, tag, err)
+			continue
 		}
+		key += "." + name
 	}
 	return key
 }
 
 // SampleConfig returns the sample config for the stdout backend.
-func (client client) SampleConfig() string {
-	return ""
+func (client *client) SampleConfig() string {
+	return sampleConfig
 }
 
-// SendMetrics prints the metrics in a MetricsMap to the stdout.
-func (client client) SendMetrics(ctx context.Context, metrics *types.MetricMap) (retErr error) {
+// SendMetrics prints the metrics in a MetricsMap in the configured format.
+func (client *client) SendMetrics(ctx context.Context, metrics *types.MetricMap) error {
 	buf := new(bytes.Buffer)
-	now := time.Now().Unix()
+	now := time.Now()
+	switch client.format {
+	case FormatStatsd:
+		statsdaemon.EncodeMetrics(buf, metrics)
+	case FormatGraphite:
+		graphite.EncodeMetrics(buf, metrics, now)
+	case FormatJSON:
+		payload := forwarder.NewPayload(metrics)
+		if payload.Len() == 0 {
+			return nil
+		}
+		if payload.Timestamp == 0 {
+			payload.Timestamp = now.Unix()
+		}
+		if err := json.NewEncoder(buf).Encode(payload); err != nil {
+			return fmt.Errorf("[%s] unable to encode metrics: %v", BackendName, err)
+		}
+	case FormatInflux:
+		encodeInfluxMetrics(buf, metrics, now)
+	default:
+		encodeMetrics(buf, metrics, now)
+	}
+	return client.write(buf)
+}
+
+// encodeMetrics writes the metrics to buf in the default format.
+func encodeMetrics(buf *bytes.Buffer, metrics *types.MetricMap, now time.Time) {
+	ts := now.Unix()
+	if !metrics.Timestamp.IsZero() {
+		ts = metrics.Timestamp.Unix()
+	}
 	metrics.Counters.Each(func(key, tagsKey string, counter types.Counter) {
-		nk := composeMetricName(key, tagsKey)
-		fmt.Fprintf(buf, "stats.counter.%s.count %d %d\n", nk, counter.Value, now)
-		fmt.Fprintf(buf, "stats.counter.%s.per_second %f %d\n", nk, counter.PerSecond, now)
+		nk := composeMetricName(key, counter.TagSet)
+		fmt.Fprintf(buf, "stats.counter.%s.count %d %d\n", nk, counter.Value, ts)
+		fmt.Fprintf(buf, "stats.counter.%s.per_second %f %d\n", nk, counter.PerSecond, ts)
 	})
 	metrics.Timers.Each(func(key, tagsKey string, timer types.Timer) {
-		nk := composeMetricName(key, tagsKey)
-		fmt.Fprintf(buf, "stats.timers.%s.lower %f %d\n", nk, timer.Min, now)
-		fmt.Fprintf(buf, "stats.timers.%s.upper %f %d\n", nk, timer.Max, now)
-		fmt.Fprintf(buf, "stats.timers.%s.count %d %d\n", nk, timer.Count, now)
-		fmt.Fprintf(buf, "stats.timers.%s.count_ps %f %d\n", nk, timer.PerSecond, now)
-		fmt.Fprintf(buf, "stats.timers.%s.mean %f %d\n", nk, timer.Mean, now)
-		fmt.Fprintf(buf, "stats.timers.%s.median %f %d\n", nk, timer.Median, now)
-		fmt.Fprintf(buf, "stats.timers.%s.sum %f %d\n", nk, timer.Sum, now)
-		fmt.Fprintf(buf, "stats.timers.%s.sum %f %d\n", nk, timer.SumSquares, now)
-		fmt.Fprintf(buf, "stats.timers.%s.sum_squares %f %d\n", nk, timer.StdDev, now)
+		nk := composeMetricName(key, timer.TagSet)
+		fmt.Fprintf(buf, "stats.timers.%s.lower %f %d\n", nk, timer.Min, ts)
+		fmt.Fprintf(buf, "stats.timers.%s.upper %f %d\n", nk, timer.Max, ts)
+		fmt.Fprintf(buf, "stats.timers.%s.count %d %d\n", nk, timer.Count, ts)
+		fmt.Fprintf(buf, "stats.timers.%s.count_ps %f %d\n", nk, timer.PerSecond, ts)
+		fmt.Fprintf(buf, "stats.timers.%s.mean %f %d\n", nk, timer.Mean, ts)
+		fmt.Fprintf(buf, "stats.timers.%s.median %f %d\n", nk, timer.Median, ts)
+		fmt.Fprintf(buf, "stats.timers.%s.sum %f %d\n", nk, timer.Sum, ts)
+		fmt.Fprintf(buf, "stats.timers.%s.sum %f %d\n", nk, timer.SumSquares, ts)
+		fmt.Fprintf(buf, "stats.timers.%s.sum_squares %f %d\n", nk, timer.StdDev, ts)
 		for _, pct := range timer.Percentiles {
-			fmt.Fprintf(buf, "stats.timers.%s.%s %f %d\n", nk, pct.String(), pct.Float(), now)
+			fmt.Fprintf(buf, "stats.timers.%s.%s %f %d\n", nk, pct.String(), pct.Float(), ts)
 		}
 	})
 	metrics.Gauges.Each(func(key, tagsKey string, gauge types.Gauge) {
-		nk := composeMetricName(key, tagsKey)
-		fmt.Fprintf(buf, "stats.gauge.%s %f %d\n", nk, gauge.Value, now)
+		nk := composeMetricName(key, gauge.TagSet)
+		fmt.Fprintf(buf, "stats.gauge.%s %f %d\n", nk, gauge.Value, ts)
 	})
 
 	metrics.Sets.Each(func(key, tagsKey string, set types.Set) {
-		nk := composeMetricName(key, tagsKey)
-		fmt.Fprintf(buf, "stats.set.%s %d %d\n", nk, len(set.Values), now)
+		nk := composeMetricName(key, set.TagSet)
+		fmt.Fprintf(buf, "stats.set.%s %d %d\n", nk, len(set.Values), ts)
 	})
+}
 
-	writer := log.StandardLogger().Writer()
-	defer func() {
-		if err := writer.Close(); err != nil && retErr == nil {
-			retErr = err
+// SendEvent prints events in the configured format. Graphite has no events, they are printed in the default format.
+func (client *client) SendEvent(ctx context.Context, e *types.Event) error {
+	buf := new(bytes.Buffer)
+	switch client.format {
+	case FormatStatsd:
+		buf.Write(statsdaemon.EncodeEvent(e))
+		buf.WriteByte('\n')
+	case FormatJSON:
+		if err := json.NewEncoder(buf).Encode(forwarder.NewEvent(e)); err != nil {
+			return fmt.Errorf("[%s] unable to encode event: %v", BackendName, err)
 		}
-	}()
-	_, err := buf.WriteTo(writer)
-	return err
+	case FormatInflux:
+		encodeInfluxEvent(buf, e, time.Now())
+	default:
+		fmt.Fprintf(buf, "event: %+v\n", e)
+	}
+	return client.write(buf)
 }
 
-// SendEvent prints events to the stdout.
-func (client client) SendEvent(ctx context.Context, e *types.Event) (retErr error) {
-	writer := log.StandardLogger().Writer()
-	defer func() {
-		if err := writer.Close(); err != nil && retErr == nil {
-			retErr = err
-		}
-	}()
-	_, err := fmt.Fprintf(writer, "event: %+v\n", e)
-	return err
+func (client *client) write(buf *bytes.Buffer) error {
+	if buf.Len() == 0 {
+		return nil
+	}
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	if _, err := buf.WriteTo(client.out); err != nil {
+		return fmt.Errorf("[%s] error writing metrics: %v", BackendName, err)
+	}
+	return nil
 }
 
 // BackendName returns the name of the backend.
-func (client client) BackendName() string {
+func (client *client) BackendName() string {
 	return BackendName
 }
@@ -0,0 +1,166 @@
+package stdout
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/atlassian/gostatsd/backend/backends/forwarder"
+	"github.com/atlassian/gostatsd/backend/backends/graphite"
+	"github.com/atlassian/gostatsd/types"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+func sendMetrics(t *testing.T, format string, m *types.MetricMap) string {
+	buf := new(bytes.Buffer)
+	c, err := NewClient(format, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = c.SendMetrics(context.Background(), m); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+func TestFormats(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Unix(1500000000, 0)
+	tags := types.NewTagSet(types.Tags{"env:prod", "canary"})
+	counter := types.NewCounter(now, time.Second, 5)
+	counter.TagSet = tags
+	counter.PerSecond = 5
+	gauge := types.NewGauge(now, time.Second, 1.5)
+	gauge.TagSet = tags
+	m := &types.MetricMap{
+		Timestamp: now,
+		Counters:  types.Counters{"c": {tags.Key(): counter}},
+		Gauges:    types.Gauges{"g": {tags.Key(): gauge}},
+	}
+
+	out := sendMetrics(t, FormatDefault, m)
+	assert.Contains(out, "stats.counter.c.canary.env.prod.count 5 1500000000\n")
+	assert.Contains(out, "stats.gauge.g.canary.env.prod 1.500000 1500000000\n")
+
+	out = sendMetrics(t, FormatStatsd, m)
+	assert.Contains(out, "c:5|c|#canary,env:prod\n")
+	assert.Contains(out, "g:1.5|g|#canary,env:prod\n")
+
+	out = sendMetrics(t, FormatGraphite, m)
+	assert.Contains(out, "stats_count.c.canary.env.prod 5.000000 1500000000\n")
+
+	out = sendMetrics(t, FormatInflux, m)
+	assert.Contains(out, "c,canary=true,env=prod count=5i,per_second=5 1500000000000000000\n")
+	assert.Contains(out, "g,canary=true,env=prod value=1.5 1500000000000000000\n")
+
+	out = sendMetrics(t, "JSON", m)
+	assert.Equal(1, strings.Count(out, "\n"))
+	var p forwarder.Payload
+	if assert.NoError(json.Unmarshal([]byte(out), &p)) {
+		assert.Equal(int64(1500000000), p.Timestamp)
+		assert.Equal(2, p.Len())
+	}
+
+	_, err := NewClient("xml", new(bytes.Buffer))
+	assert.Error(err)
+}
+
+func TestMetricNameTags(t *testing.T) {
+	assert := assert.New(t)
+
+	tags := types.NewTagSet(types.Tags{"team:Site Reliability", "1bad", "env:"})
+	assert.Equal("g.env.team.site_reliability", composeMetricName("g", tags)) // Tags that cannot be sanitized are dropped
+
+	gauge := types.NewGauge(time.Unix(1500000000, 0), time.Second, 1)
+	gauge.TagSet = tags
+	buf := new(bytes.Buffer)
+	graphite.EncodeMetrics(buf, &types.MetricMap{Gauges: types.Gauges{"g": {tags.Key(): gauge}}}, time.Unix(1500000000, 0))
+	assert.Equal("stats.gauge.g.env.team.site_reliability 1.000000 1500000000\n", buf.String())
+}
+
+func TestEventFormats(t *testing.T) {
+	assert := assert.New(t)
+
+	e := &types.Event{Title: "deploy", Text: "v1", DateHappened: 1500000000, Tags: types.Tags{"env:prod"}}
+	expected := map[string]string{
+		FormatStatsd: "_e{6,2}:deploy|v1|d:1500000000|#env:prod\n",
+		FormatInflux: `events,env=prod title="deploy",text="v1",priority="normal",alert_type="info" 1500000000000000000` + "\n",
+	}
+	for format, line := range expected {
+		buf := new(bytes.Buffer)
+		c, err := NewClient(format, buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.NoError(c.SendEvent(context.Background(), e))
+		assert.Equal(line, buf.String(), format)
+	}
+}
+
+func TestInfluxEscaping(t *testing.T) {
+	assert := assert.New(t)
+
+	buf := new(bytes.Buffer)
+	writeInfluxLine(buf, "a b,c", types.NewTagSet(types.Tags{"k=1:v 1", "role:a", "role:b"}), time.Unix(1, 0), "f", influxString(`say "hi"`))
+	assert.Equal(`a\ b\,c,k\=1=v\ 1,role=a\,b f="say \"hi\"" 1000000000`+"\n", buf.String())
+}
+
+func TestRotatingFile(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "stdout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "metrics.log")
+
+	r, err := newRotatingFile(path, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	now := time.Unix(1500000000, 0)
+	r.now = func() time.Time {
+		now = now.Add(time.Second)
+		return now
+	}
+	for _, line := range []string{"aaaaaa\n", "bbbbbb\n", "cccccc\n", "dddddd\n", "eeeeeeeeeeee\n"} {
+		_, err = r.Write([]byte(line))
+		assert.NoError(err)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	assert.NoError(err)
+	assert.Equal("eeeeeeeeeeee\n", string(data))
+	backups, err := filepath.Glob(path + ".*")
+	assert.NoError(err)
+	if assert.Len(backups, 2) {
+		data, err = ioutil.ReadFile(backups[1])
+		assert.NoError(err)
+		assert.Equal("dddddd\n", string(data))
+	}
+
+	// A failed rotation keeps the file open
+	next := now.Add(time.Second)
+	blocker := fmt.Sprintf("%s.%s", path, next.UTC().Format("20060102T150405.000000000"))
+	if err = os.MkdirAll(filepath.Join(blocker, "dir"), 0755); err != nil { // Cannot be replaced by a file
+		t.Fatal(err)
+	}
+	_, err = r.Write([]byte("ffffff\n"))
+	assert.Error(err)
+	_, err = r.Write([]byte("gggggg\n")) // Rotated with the next timestamp
+	assert.NoError(err)
+	data, err = ioutil.ReadFile(path)
+	assert.NoError(err)
+	assert.Equal("gggggg\n", string(data))
+}
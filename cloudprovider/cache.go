@@ -0,0 +1,151 @@
+package cloudprovider
+
+import (
+	"container/list"
+	"fmt"
+	"sync"
+	"time"
+
+	cloudTypes "github.com/atlassian/gostatsd/cloudprovider/types"
+)
+
+// CacheOptions configures a Cache.
+type CacheOptions struct {
+	TTL          time.Duration // How long the details of an instance are cached
+	NegativeTTL  time.Duration // How long a failed lookup is cached before the IP address is looked up again
+	RefreshAhead time.Duration // How long before they expire the instances in use are looked up again, 0 to disable
+	MaxEntries   int           // Maximum number of cached IP addresses, the least recently used are evicted, 0 for no limit
+}
+
+// DefaultCacheOptions are the default cache options: instances are cached for 15 minutes and refreshed
+// after 10 minutes if they are still in use, failed lookups are cached for a minute.
+var DefaultCacheOptions = CacheOptions{
+	TTL:          15 * time.Minute,
+	NegativeTTL:  1 * time.Minute,
+	RefreshAhead: 5 * time.Minute,
+	MaxEntries:   100000,
+}
+
+// Validate checks that the options are consistent.
+func (o CacheOptions) Validate() error {
+	if o.TTL <= 0 {
+		return fmt.Errorf("invalid cache TTL %v: must be positive", o.TTL)
+	}
+	if o.NegativeTTL < 0 {
+		return fmt.Errorf("invalid cache negative TTL %v: must not be negative", o.NegativeTTL)
+	}
+	if o.RefreshAhead < 0 || o.RefreshAhead >= o.TTL {
+		return fmt.Errorf("invalid cache refresh ahead %v: must be between 0 and the TTL %v", o.RefreshAhead, o.TTL)
+	}
+	if o.MaxEntries < 0 {
+		return fmt.Errorf("invalid cache max entries %d: must not be negative", o.MaxEntries)
+	}
+	return nil
+}
+
+// Cache holds the results of the lookups of a cloud provider by IP address.
+// It is safe for concurrent use.
+type Cache struct {
+	options CacheOptions
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List // Of *cacheEntry, most recently used first
+}
+
+type cacheEntry struct {
+	ip         string
+	instance   *cloudTypes.Instance // nil if the lookup failed
+	expires    time.Time
+	refreshAt  time.Time // When the instance is looked up again if it is used, zero for failed lookups
+	refreshing bool      // Whether the instance is being looked up again
+}
+
+// NewCache creates an empty Cache with the given options.
+func NewCache(options CacheOptions) (*Cache, error) {
+	if err := options.Validate(); err != nil {
+		return nil, err
+	}
+	return &Cache{
+		options: options,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+	}, nil
+}
+
+// Get returns the cached instance of ip, nil if its lookup failed, and whether ip is in the cache.
+// refresh is true when the instance should be looked up again in the background, in which case the caller
+// must pass the result to Update. It is only true once per refresh.
+func (c *Cache) Get(ip string, now time.Time) (instance *cloudTypes.Instance, found, refresh bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[ip]
+	if !ok {
+		return nil, false, false
+	}
+	entry := elem.Value.(*cacheEntry)
+	if !now.Before(entry.expires) {
+		c.remove(elem)
+		return nil, false, false
+	}
+	c.lru.MoveToFront(elem)
+	if entry.instance != nil && !entry.refreshing && !entry.refreshAt.IsZero() && !now.Before(entry.refreshAt) {
+		entry.refreshing = true
+		refresh = true
+	}
+	return entry.instance, true, refresh
+}
+
+// Update caches the result of a lookup of ip: its instance, nil if ip is not an instance, or the error.
+// A failed lookup does not replace a cached instance, it is looked up again after the negative TTL.
+// An IP address without an instance replaces the cached one, so that the tags of instances that were
+// terminated do not apply to new instances with the same IP address.
+func (c *Cache) Update(ip string, instance *cloudTypes.Instance, err error, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[ip]; ok {
+		entry := elem.Value.(*cacheEntry)
+		if err != nil && entry.instance != nil && now.Before(entry.expires) {
+			entry.refreshing = false
+			entry.refreshAt = now.Add(c.options.NegativeTTL)
+			return
+		}
+		c.remove(elem)
+	}
+	entry := &cacheEntry{ip: ip, expires: now.Add(c.options.NegativeTTL)}
+	if err == nil && instance != nil {
+		entry.instance = instance
+		entry.expires = now.Add(c.options.TTL)
+		if c.options.RefreshAhead > 0 {
+			entry.refreshAt = entry.expires.Add(-c.options.RefreshAhead)
+		}
+	}
+	c.entries[ip] = c.lru.PushFront(entry)
+	for c.options.MaxEntries > 0 && c.lru.Len() > c.options.MaxEntries {
+		c.remove(c.lru.Back())
+	}
+}
+
+// Expire removes the expired entries.
+func (c *Cache) Expire(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, elem := range c.entries {
+		if !now.Before(elem.Value.(*cacheEntry).expires) {
+			c.remove(elem)
+		}
+	}
+}
+
+// Len returns the number of cached IP addresses, including the expired ones not removed yet.
+func (c *Cache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
+
+// remove must be called with the mutex held.
+func (c *Cache) remove(elem *list.Element) {
+	delete(c.entries, elem.Value.(*cacheEntry).ip)
+	c.lru.Remove(elem)
+}
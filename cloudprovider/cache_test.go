@@ -0,0 +1,118 @@
+package cloudprovider
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	cloudTypes "github.com/atlassian/gostatsd/cloudprovider/types"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCacheTTLs(t *testing.T) {
+	assert := assert.New(t)
+
+	c, err := NewCache(CacheOptions{TTL: time.Hour, NegativeTTL: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1500000000, 0)
+	instance := &cloudTypes.Instance{ID: "i-1"}
+	c.Update("10.0.0.1", instance, nil, now)
+	c.Update("10.0.0.2", nil, errors.New("failed"), now)
+	c.Update("10.0.0.3", nil, nil, now) // Not an instance
+
+	i, found, refresh := c.Get("10.0.0.1", now.Add(59*time.Minute))
+	assert.Equal(instance, i)
+	assert.True(found)
+	assert.False(refresh)
+	_, found, _ = c.Get("10.0.0.2", now.Add(59*time.Second))
+	assert.True(found)
+	_, found, _ = c.Get("10.0.0.3", now.Add(time.Minute))
+	assert.False(found)
+
+	c.Expire(now.Add(time.Minute))
+	assert.Equal(1, c.Len())
+	_, found, _ = c.Get("10.0.0.1", now.Add(time.Hour))
+	assert.False(found)
+	assert.Equal(0, c.Len())
+}
+
+func TestCacheRefreshAhead(t *testing.T) {
+	assert := assert.New(t)
+
+	c, err := NewCache(CacheOptions{TTL: 10 * time.Minute, NegativeTTL: time.Minute, RefreshAhead: 2 * time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1500000000, 0)
+	old := &cloudTypes.Instance{ID: "i-1", Tags: []string{"v:1"}}
+	c.Update("10.0.0.1", old, nil, now)
+
+	_, _, refresh := c.Get("10.0.0.1", now.Add(7*time.Minute))
+	assert.False(refresh)
+	_, _, refresh = c.Get("10.0.0.1", now.Add(8*time.Minute))
+	assert.True(refresh)
+	_, _, refresh = c.Get("10.0.0.1", now.Add(8*time.Minute))
+	assert.False(refresh, "already refreshing")
+
+	// A failed refresh keeps the instance and tries again after the negative TTL
+	c.Update("10.0.0.1", nil, errors.New("throttled"), now.Add(8*time.Minute))
+	i, _, refresh := c.Get("10.0.0.1", now.Add(8*time.Minute+30*time.Second))
+	assert.Equal(old, i)
+	assert.False(refresh)
+	_, _, refresh = c.Get("10.0.0.1", now.Add(9*time.Minute))
+	assert.True(refresh)
+
+	updated := &cloudTypes.Instance{ID: "i-1", Tags: []string{"v:2"}}
+	c.Update("10.0.0.1", updated, nil, now.Add(9*time.Minute))
+	i, found, _ := c.Get("10.0.0.1", now.Add(18*time.Minute))
+	assert.True(found)
+	assert.Equal(updated, i)
+}
+
+func TestCacheEvictsTerminatedInstances(t *testing.T) {
+	assert := assert.New(t)
+
+	c, err := NewCache(DefaultCacheOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1500000000, 0)
+	c.Update("10.0.0.1", &cloudTypes.Instance{ID: "i-1"}, nil, now)
+	c.Update("10.0.0.1", nil, nil, now) // The instance is gone
+	i, found, _ := c.Get("10.0.0.1", now)
+	assert.True(found)
+	assert.Nil(i)
+}
+
+func TestCacheMaxEntries(t *testing.T) {
+	assert := assert.New(t)
+
+	c, err := NewCache(CacheOptions{TTL: time.Hour, MaxEntries: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1500000000, 0)
+	c.Update("10.0.0.1", &cloudTypes.Instance{ID: "i-1"}, nil, now)
+	c.Update("10.0.0.2", &cloudTypes.Instance{ID: "i-2"}, nil, now)
+	c.Get("10.0.0.1", now) // 10.0.0.2 is now the least recently used
+	c.Update("10.0.0.3", &cloudTypes.Instance{ID: "i-3"}, nil, now)
+
+	assert.Equal(2, c.Len())
+	_, found, _ := c.Get("10.0.0.2", now)
+	assert.False(found)
+	_, found, _ = c.Get("10.0.0.1", now)
+	assert.True(found)
+}
+
+func TestCacheOptionsValidate(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.NoError(DefaultCacheOptions.Validate())
+	assert.Error(CacheOptions{}.Validate())
+	assert.Error(CacheOptions{TTL: time.Minute, RefreshAhead: time.Minute}.Validate())
+	assert.Error(CacheOptions{TTL: time.Minute, NegativeTTL: -1}.Validate())
+	assert.Error(CacheOptions{TTL: time.Minute, MaxEntries: -1}.Validate())
+}
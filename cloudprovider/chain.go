@@ -0,0 +1,251 @@
+package cloudprovider
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	cloudTypes "github.com/atlassian/gostatsd/cloudprovider/types"
+	"github.com/atlassian/gostatsd/types"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// ChainPolicy is how a Chain combines the instances of its providers.
+type ChainPolicy byte
+
+const (
+	// ChainFirst looks up the providers in order, a source is resolved by the first provider that knows it.
+	ChainFirst ChainPolicy = iota
+	// ChainMerge looks up all the providers concurrently and merges the instances of a source. The ID of the
+	// instance comes from the first provider that knows the source and, for tags with the same key, the tags of
+	// the provider listed first are kept.
+	ChainMerge
+)
+
+func (p ChainPolicy) String() string {
+	switch p {
+	case ChainMerge:
+		return "merge"
+	default:
+		return "first"
+	}
+}
+
+// ParseChainPolicy parses the name of a ChainPolicy: first or merge.
+func ParseChainPolicy(s string) (ChainPolicy, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "first":
+		return ChainFirst, nil
+	case "merge":
+		return ChainMerge, nil
+	}
+	return ChainFirst, fmt.Errorf("invalid chain policy %q: must be one of first or merge", s)
+}
+
+// Chain is a cloud provider that looks up sources with several providers, in order of precedence.
+// The results of each provider are cached separately, so that a source unknown to a provider is not looked up
+// with it again until its negative TTL expires. The instances returned by a Chain record the providers that
+// resolved them in their Provider field.
+type Chain struct {
+	policy    ChainPolicy
+	providers []cloudTypes.Interface
+	caches    []*Cache
+	now       func() time.Time
+}
+
+// NewChain creates a Chain of the providers, listed in order of precedence, caching the results of each one
+// with the cache options.
+func NewChain(policy ChainPolicy, options CacheOptions, providers ...cloudTypes.Interface) (*Chain, error) {
+	if len(providers) == 0 {
+		return nil, errors.New("no cloud provider to chain")
+	}
+	c := &Chain{policy: policy, providers: providers, now: time.Now}
+	for i, p := range providers {
+		if p == nil {
+			return nil, fmt.Errorf("cloud provider %d of the chain is nil", i)
+		}
+		cache, err := NewCache(options)
+		if err != nil {
+			return nil, err
+		}
+		c.caches = append(c.caches, cache)
+	}
+	return c, nil
+}
+
+// ProviderName returns the names of the providers, joined with +.
+func (c *Chain) ProviderName() string {
+	names := make([]string, 0, len(c.providers))
+	for _, p := range c.providers {
+		names = append(names, p.ProviderName())
+	}
+	return strings.Join(names, "+")
+}
+
+// SampleConfig returns the sample configs of the providers.
+func (c *Chain) SampleConfig() string {
+	var config string
+	for _, p := range c.providers {
+		config += p.SampleConfig()
+	}
+	return config
+}
+
+// MaxInstancesBatch returns the largest batch of the providers, the sources are split into smaller
+// batches for the other providers.
+func (c *Chain) MaxInstancesBatch() int {
+	max := 1
+	for _, p := range c.providers {
+		if n := p.MaxInstancesBatch(); n > max {
+			max = n
+		}
+	}
+	return max
+}
+
+// Instances returns the instances of the sources according to the policy of the chain.
+// A provider that fails is skipped, an error is only returned if all the providers looked up failed.
+func (c *Chain) Instances(IPs ...string) (map[string]*cloudTypes.Instance, error) {
+	found := make([]map[string]*cloudTypes.Instance, len(c.providers))
+	errs := make([]error, len(c.providers))
+	switch c.policy {
+	case ChainMerge:
+		var wg sync.WaitGroup
+		wg.Add(len(c.providers))
+		for i := range c.providers {
+			go func(i int) {
+				defer wg.Done()
+				found[i], errs[i] = c.lookup(i, IPs)
+			}(i)
+		}
+		wg.Wait()
+	default:
+		remaining := IPs
+		for i := range c.providers {
+			if len(remaining) == 0 {
+				break
+			}
+			found[i], errs[i] = c.lookup(i, remaining)
+			unresolved := make([]string, 0, len(remaining))
+			for _, ip := range remaining {
+				if found[i][ip] == nil {
+					unresolved = append(unresolved, ip)
+				}
+			}
+			remaining = unresolved
+		}
+	}
+
+	var err error
+	failed, queried := 0, 0
+	for i, e := range errs {
+		if found[i] == nil && e == nil {
+			continue // Not queried, all the sources were resolved
+		}
+		queried++
+		if e != nil {
+			failed++
+			err = e
+			log.Debugf("Error retrieving instance details from cloud provider %s: %v", c.providers[i].ProviderName(), e)
+		}
+	}
+	if failed > 0 && failed == queried {
+		return nil, err
+	}
+
+	result := make(map[string]*cloudTypes.Instance, len(IPs))
+	for _, ip := range IPs {
+		if instance := c.merge(ip, found); instance != nil {
+			result[ip] = instance
+		}
+	}
+	return result, nil
+}
+
+// lookup returns the instances of the sources known to the provider at index i, from its cache or
+// looked up with the provider. The instances cached before a failed lookup are still returned with the error.
+func (c *Chain) lookup(i int, IPs []string) (map[string]*cloudTypes.Instance, error) {
+	provider, cache := c.providers[i], c.caches[i]
+	now := c.now()
+	found := make(map[string]*cloudTypes.Instance, len(IPs))
+	var missing []string
+	for _, ip := range IPs {
+		instance, ok, refresh := cache.Get(ip, now)
+		if !ok || refresh {
+			missing = append(missing, ip)
+		} else if instance != nil {
+			found[ip] = instance
+		}
+	}
+	var err error
+	for batch := provider.MaxInstancesBatch(); len(missing) > 0; missing = missing[min(batch, len(missing)):] {
+		ips := missing[:min(batch, len(missing))]
+		instances, e := provider.Instances(ips...)
+		if e != nil {
+			err = e
+		}
+		now = c.now()
+		for _, ip := range ips {
+			if instance := instances[ip]; instance != nil {
+				cache.Update(ip, instance, nil, now) // Found even if the lookup of other IP addresses failed
+			} else {
+				cache.Update(ip, nil, e, now)
+			}
+			if instance, _, _ := cache.Get(ip, now); instance != nil {
+				found[ip] = instance
+			}
+		}
+	}
+	return found, err
+}
+
+// merge returns the instance of ip from the instances found by each provider, nil if none knows it.
+func (c *Chain) merge(ip string, found []map[string]*cloudTypes.Instance) *cloudTypes.Instance {
+	var merged *cloudTypes.Instance
+	var names []string
+	keys := make(map[string]bool) // Keys of the tags of the previous providers
+	for i, instances := range found {
+		instance := instances[ip]
+		if instance == nil {
+			continue
+		}
+		names = append(names, c.providers[i].ProviderName())
+		if merged == nil {
+			merged = &cloudTypes.Instance{ID: instance.ID, Region: instance.Region}
+		} else if merged.Region == "" {
+			merged.Region = instance.Region
+		}
+		var added []string
+		for _, tag := range instance.Tags {
+			key := types.ParseTag(tag).Key
+			if !keys[key] {
+				added = append(added, key) // A provider may repeat a key, e.g. for several security groups
+				merged.Tags = append(merged.Tags, tag)
+			}
+		}
+		for _, key := range added {
+			keys[key] = true
+		}
+	}
+	if merged != nil {
+		merged.Provider = strings.Join(names, "+")
+	}
+	return merged
+}
+
+// Expire removes the expired entries of the caches of the providers.
+func (c *Chain) Expire(now time.Time) {
+	for _, cache := range c.caches {
+		cache.Expire(now)
+	}
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
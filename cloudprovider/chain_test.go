@@ -0,0 +1,224 @@
+package cloudprovider
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	cloudTypes "github.com/atlassian/gostatsd/cloudprovider/types"
+	"github.com/atlassian/gostatsd/types"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeProvider looks up instances from a map, returned with err if it is not nil. It records the IP addresses of each lookup.
+type fakeProvider struct {
+	name      string
+	batch     int
+	instances map[string]*cloudTypes.Instance
+	err       error
+
+	mu      sync.Mutex
+	lookups [][]string
+}
+
+func (fp *fakeProvider) ProviderName() string {
+	return fp.name
+}
+
+func (fp *fakeProvider) SampleConfig() string {
+	return "[" + fp.name + "]\n"
+}
+
+func (fp *fakeProvider) MaxInstancesBatch() int {
+	if fp.batch == 0 {
+		return 10
+	}
+	return fp.batch
+}
+
+func (fp *fakeProvider) Instances(IPs ...string) (map[string]*cloudTypes.Instance, error) {
+	fp.mu.Lock()
+	fp.lookups = append(fp.lookups, IPs)
+	fp.mu.Unlock()
+	instances := make(map[string]*cloudTypes.Instance)
+	for _, ip := range IPs {
+		if instance, ok := fp.instances[ip]; ok {
+			instances[ip] = instance
+		}
+	}
+	return instances, fp.err
+}
+
+func TestChainFirst(t *testing.T) {
+	assert := assert.New(t)
+
+	kube := &fakeProvider{name: "kubernetes", instances: map[string]*cloudTypes.Instance{
+		"10.0.0.1": {ID: "web-1", Tags: types.Tags{"namespace:web"}},
+	}}
+	ec2 := &fakeProvider{name: "aws", instances: map[string]*cloudTypes.Instance{
+		"10.0.0.1": {ID: "i-1", Region: "us-east-1"},
+		"10.0.0.2": {ID: "i-2", Region: "us-east-1", Tags: types.Tags{"role:db"}},
+	}}
+	c, err := NewChain(ChainFirst, CacheOptions{TTL: time.Hour, NegativeTTL: time.Minute}, kube, ec2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal("kubernetes+aws", c.ProviderName())
+	assert.Equal("[kubernetes]\n[aws]\n", c.SampleConfig())
+
+	expected := map[string]*cloudTypes.Instance{
+		"10.0.0.1": {ID: "web-1", Tags: types.Tags{"namespace:web"}, Provider: "kubernetes"},
+		"10.0.0.2": {ID: "i-2", Region: "us-east-1", Tags: types.Tags{"role:db"}, Provider: "aws"},
+	}
+	for i := 0; i < 2; i++ { // The second time from the caches
+		instances, err := c.Instances("10.0.0.1", "10.0.0.2", "10.0.0.3")
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(expected, instances)
+	}
+	assert.Equal([][]string{{"10.0.0.1", "10.0.0.2", "10.0.0.3"}}, kube.lookups)
+	assert.Equal([][]string{{"10.0.0.2", "10.0.0.3"}}, ec2.lookups) // 10.0.0.1 is resolved by kubernetes
+}
+
+func TestChainMerge(t *testing.T) {
+	assert := assert.New(t)
+
+	kube := &fakeProvider{name: "kubernetes", instances: map[string]*cloudTypes.Instance{
+		"10.0.0.1": {ID: "web-1", Tags: types.Tags{"namespace:web", "role:frontend"}},
+	}}
+	ec2 := &fakeProvider{name: "aws", instances: map[string]*cloudTypes.Instance{
+		"10.0.0.1": {ID: "i-1", Region: "us-east-1", Tags: types.Tags{"role:web", "az:us-east-1a", "sg:web", "sg:ssh"}},
+		"10.0.0.2": {ID: "i-2", Region: "us-east-1"},
+	}}
+	c, err := NewChain(ChainMerge, CacheOptions{TTL: time.Hour, NegativeTTL: time.Minute}, kube, ec2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	instances, err := c.Instances("10.0.0.1", "10.0.0.2", "10.0.0.3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(map[string]*cloudTypes.Instance{
+		"10.0.0.1": {ID: "web-1", Region: "us-east-1", Tags: types.Tags{"namespace:web", "role:frontend", "az:us-east-1a", "sg:web", "sg:ssh"}, Provider: "kubernetes+aws"},
+		"10.0.0.2": {ID: "i-2", Region: "us-east-1", Provider: "aws"},
+	}, instances)
+	assert.Equal([][]string{{"10.0.0.1", "10.0.0.2", "10.0.0.3"}}, kube.lookups)
+	assert.Equal([][]string{{"10.0.0.1", "10.0.0.2", "10.0.0.3"}}, ec2.lookups)
+}
+
+func TestChainErrors(t *testing.T) {
+	assert := assert.New(t)
+
+	failing := &fakeProvider{name: "failing", err: errors.New("lookup failed")}
+	ec2 := &fakeProvider{name: "aws", instances: map[string]*cloudTypes.Instance{"10.0.0.1": {ID: "i-1"}}}
+	other := &fakeProvider{name: "other", err: errors.New("other failed")}
+	for _, policy := range []ChainPolicy{ChainFirst, ChainMerge} {
+		c, err := NewChain(policy, CacheOptions{TTL: time.Hour, NegativeTTL: time.Minute}, failing, ec2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		instances, err := c.Instances("10.0.0.1")
+		if assert.NoError(err, policy.String()) {
+			assert.Equal(map[string]*cloudTypes.Instance{"10.0.0.1": {ID: "i-1", Provider: "aws"}}, instances, policy.String())
+		}
+
+		c, err = NewChain(policy, CacheOptions{TTL: time.Hour, NegativeTTL: time.Minute}, failing, other)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = c.Instances("10.0.0.1")
+		assert.Error(err, policy.String())
+	}
+
+	// The instances found by a provider are kept even if the lookup of other sources failed
+	partial := &fakeProvider{name: "partial", err: errors.New("throttled"), instances: map[string]*cloudTypes.Instance{"10.0.0.2": {ID: "p-2"}}}
+	ec2.instances["10.0.0.2"] = &cloudTypes.Instance{ID: "i-2"}
+	c, err := NewChain(ChainFirst, CacheOptions{TTL: time.Hour, NegativeTTL: time.Minute}, partial, ec2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ { // The second time from the caches
+		instances, err := c.Instances("10.0.0.1", "10.0.0.2")
+		if assert.NoError(err) {
+			assert.Equal(map[string]*cloudTypes.Instance{
+				"10.0.0.1": {ID: "i-1", Provider: "aws"},
+				"10.0.0.2": {ID: "p-2", Provider: "partial"},
+			}, instances)
+		}
+	}
+	assert.Len(partial.lookups, 1)
+}
+
+func TestChainBatchesAndExpires(t *testing.T) {
+	assert := assert.New(t)
+
+	rdns := &fakeProvider{name: "dns", batch: 1}
+	ec2 := &fakeProvider{name: "aws", batch: 2}
+	c, err := NewChain(ChainFirst, CacheOptions{TTL: time.Hour, NegativeTTL: time.Minute}, rdns, ec2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(2, c.MaxInstancesBatch())
+
+	now := time.Unix(1500000000, 0)
+	c.now = func() time.Time { return now }
+	_, err = c.Instances("10.0.0.1", "10.0.0.2", "10.0.0.3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal([][]string{{"10.0.0.1"}, {"10.0.0.2"}, {"10.0.0.3"}}, rdns.lookups)
+	assert.Equal([][]string{{"10.0.0.1", "10.0.0.2"}, {"10.0.0.3"}}, ec2.lookups)
+
+	now = now.Add(time.Minute) // After the negative TTL
+	c.Expire(now)
+	for _, cache := range c.caches {
+		assert.Equal(0, cache.Len())
+	}
+	_, err = c.Instances("10.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(rdns.lookups, 4)
+	assert.Len(ec2.lookups, 3)
+}
+
+func TestParseChainPolicy(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, policy := range []ChainPolicy{ChainFirst, ChainMerge} {
+		parsed, err := ParseChainPolicy(policy.String())
+		assert.NoError(err)
+		assert.Equal(policy, parsed)
+	}
+	_, err := ParseChainPolicy("last")
+	assert.Error(err)
+	_, err = NewChain(ChainFirst, DefaultCacheOptions)
+	assert.Error(err)
+	_, err = NewChain(ChainFirst, DefaultCacheOptions, &fakeProvider{name: "aws"}, nil)
+	assert.Error(err)
+}
+
+func TestInitCloudProvidersIgnoresBlankNames(t *testing.T) {
+	assert := assert.New(t)
+
+	v := viper.New()
+	for _, names := range [][]string{nil, {""}, {" ", ""}} {
+		provider, err := InitCloudProviders(names, ChainFirst, DefaultCacheOptions, v)
+		assert.NoError(err, "%q", names)
+		assert.Nil(provider, "%q", names)
+	}
+
+	provider, err := InitCloudProviders([]string{"dns", ""}, ChainFirst, DefaultCacheOptions, v)
+	if assert.NoError(err) {
+		assert.Equal("dns", provider.ProviderName()) // Not chained
+	}
+	provider, err = InitCloudProviders([]string{"dns", " ", "dns"}, ChainMerge, DefaultCacheOptions, v)
+	if assert.NoError(err) {
+		assert.Equal("dns+dns", provider.ProviderName())
+	}
+}
@@ -2,20 +2,26 @@ package cloudprovider
 
 import (
 	"fmt"
-	"sync"
-	"time"
+	"strings"
 
 	"github.com/atlassian/gostatsd/cloudprovider/providers/aws"
+	"github.com/atlassian/gostatsd/cloudprovider/providers/dns"
+	"github.com/atlassian/gostatsd/cloudprovider/providers/docker"
+	"github.com/atlassian/gostatsd/cloudprovider/providers/k8s"
+	"github.com/atlassian/gostatsd/cloudprovider/providers/static"
 	cloudTypes "github.com/atlassian/gostatsd/cloudprovider/types"
 
 	log "github.com/Sirupsen/logrus"
-	"github.com/koding/cache"
 	"github.com/spf13/viper"
 )
 
 // All registered cloud providers.
 var providers = map[string]cloudTypes.Factory{
-	aws.ProviderName: aws.NewProviderFromViper,
+	aws.ProviderName:    aws.NewProviderFromViper,
+	dns.ProviderName:    dns.NewProviderFromViper,
+	docker.ProviderName: docker.NewProviderFromViper,
+	k8s.ProviderName:    k8s.NewProviderFromViper,
+	static.ProviderName: static.NewProviderFromViper,
 }
 
 // GetCloudProvider creates an instance of the named provider, or nil if
@@ -48,64 +54,34 @@ func InitCloudProvider(name string, v *viper.Viper) (cloudTypes.Interface, error
 	return provider, nil
 }
 
-// TODO: review mutex e.g. RWMutex
-var runningMutex sync.Mutex
-var running = make(map[string]time.Time)
-var instances = cache.NewMemoryWithTTL(1 * time.Hour)
-var failed = cache.NewMemoryWithTTL(1 * time.Minute)
-
-// GetInstance returns an instance from the cache or from the cloud provider.
-func GetInstance(cloud cloudTypes.Interface, IP string) (instance *cloudTypes.Instance, err error) {
-	iface, err := instances.Get(IP)
-	if err == nil {
-		instance = iface.(*cloudTypes.Instance)
-		return instance, nil
-	}
-
-	if err != cache.ErrNotFound {
-		// Better returning an error than hitting the cloud provider thousands of times per second
-		return nil, err
+// InitCloudProviders creates an instance of the named cloud providers. Several providers are combined in a
+// Chain with the policy, looked up in the order of the names and each cached with the cache options.
+// Blank names are ignored.
+func InitCloudProviders(names []string, policy ChainPolicy, options CacheOptions, v *viper.Viper) (cloudTypes.Interface, error) {
+	trimmed := make([]string, 0, len(names))
+	for _, name := range names {
+		if name = strings.TrimSpace(name); name != "" {
+			trimmed = append(trimmed, name)
+		}
 	}
-
-	cachedErr, err := failed.Get(IP)
-	if err == nil {
-		// We have a cached failure
-		return nil, cachedErr.(error)
+	switch len(trimmed) {
+	case 0:
+		return InitCloudProvider("", v)
+	case 1:
+		return InitCloudProvider(trimmed[0], v)
 	}
-
-	if err != cache.ErrNotFound {
-		// Some error getting it from cache?
-		return nil, err
-	}
-
-	runningMutex.Lock()
-	last, ok := running[IP]
-	runningMutex.Unlock()
-	if ok {
-		if last.Add(60 * time.Second).After(time.Now()) {
-			time.Sleep(100 * time.Microsecond)
-			return GetInstance(cloud, IP)
+	providers := make([]cloudTypes.Interface, 0, len(trimmed))
+	for _, name := range trimmed {
+		provider, err := InitCloudProvider(name, v)
+		if err != nil {
+			return nil, err
 		}
+		providers = append(providers, provider)
 	}
-	runningMutex.Lock()
-	running[IP] = time.Now()
-	runningMutex.Unlock()
-	defer func() {
-		runningMutex.Lock()
-		defer runningMutex.Unlock()
-		delete(running, IP)
-	}()
-
-	if instance, err = cloud.Instance(IP); err != nil {
-		failed.Set(IP, fmt.Errorf("Cached failure: %v for %s", err, IP))
+	chain, err := NewChain(policy, options, providers...)
+	if err != nil {
 		return nil, err
 	}
-	instances.Set(IP, instance)
-
-	return instance, nil
-}
-
-func init() {
-	instances.StartGC(1 * time.Minute)
-	failed.StartGC(1 * time.Minute)
+	log.Infof("Chained cloud providers %q with policy %s", chain.ProviderName(), policy)
+	return chain, nil
 }
@@ -2,9 +2,9 @@ package aws
 
 import (
 	"fmt"
+	"net"
 
 	cloudTypes "github.com/atlassian/gostatsd/cloudprovider/types"
-	"github.com/atlassian/gostatsd/types"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/aws/aws-sdk-go/aws"
@@ -19,6 +19,8 @@ import (
 const (
 	// ProviderName is the name of AWS cloud provider.
 	ProviderName = "aws"
+	// MaxFilterValues is the maximum number of values of the filters of a DescribeInstances request.
+	MaxFilterValues = 200
 )
 
 const sampleConfig = `
@@ -28,6 +30,18 @@ const sampleConfig = `
 
 	# availability zone in which the server is located
 	availability_zone = "us-west-2" # optional, will be retrieved from ec2 metadata if empty
+
+	# patterns of the EC2 tags added to the metrics of an instance, matched case-insensitively
+	include_tags = ["*"] # optional, default to all tags
+	exclude_tags = ["aws:cloudformation:*"] # optional
+
+	# attributes of the instance added as tags: az, instance_type, vpc, ami and asg
+	attributes = ["az", "instance_type", "asg"] # optional
+
+	# keys of EC2 tags and attributes to rename
+	[[aws.rename_tags]]
+	from = "Name"
+	to = "host_name"
 `
 
 // provider represents an aws provider.
@@ -36,6 +50,7 @@ type provider struct {
 	ec2              EC2
 	metadata         EC2Metadata
 	region           string
+	tags             *tagMapper
 }
 
 // Services is an abstraction over AWS, to allow mocking/other implementations.
@@ -102,42 +117,82 @@ func (s *awsSdkEC2) DescribeInstances(request *ec2.DescribeInstancesInput) ([]*e
 	return results, nil
 }
 
-func newEc2Filter(name string, value string) *ec2.Filter {
+func newEc2Filter(name string, values ...string) *ec2.Filter {
 	filter := &ec2.Filter{
-		Name: aws.String(name),
-		Values: []*string{
-			aws.String(value),
-		},
+		Name:   aws.String(name),
+		Values: aws.StringSlice(values),
 	}
 	return filter
 }
 
-// Instance returns the instance details from aws.
-func (p *provider) Instance(IP string) (*cloudTypes.Instance, error) {
-	filters := []*ec2.Filter{newEc2Filter("private-ip-address", IP)}
-	request := &ec2.DescribeInstancesInput{
-		Filters: filters,
+// MaxInstancesBatch returns the maximum number of IP addresses looked up by a single DescribeInstances request.
+func (p *provider) MaxInstancesBatch() int {
+	return MaxFilterValues
+}
+
+// Instances returns the details of the instances with the given private IP addresses from aws.
+// Terminated instances are ignored.
+// The IP addresses are looked up with one DescribeInstances request per MaxFilterValues addresses.
+// If a request fails, the instances found by the previous requests are returned with the error.
+func (p *provider) Instances(IPs ...string) (map[string]*cloudTypes.Instance, error) {
+	result := make(map[string]*cloudTypes.Instance, len(IPs))
+	IPs = validIPs(IPs)
+	for len(IPs) > 0 {
+		n := len(IPs)
+		if n > MaxFilterValues {
+			n = MaxFilterValues
+		}
+		request := &ec2.DescribeInstancesInput{
+			Filters: []*ec2.Filter{newEc2Filter("private-ip-address", IPs[:n]...)},
+		}
+		instances, err := p.ec2.DescribeInstances(request)
+		if err != nil {
+			return result, err // With the instances of the previous batches
+		}
+		for _, i := range instances {
+			ip := aws.StringValue(i.PrivateIpAddress)
+			if ip == "" || isTerminated(i) {
+				continue
+			}
+			result[ip] = p.newInstance(i)
+		}
+		IPs = IPs[n:]
 	}
+	return result, nil
+}
 
-	instances, err := p.ec2.DescribeInstances(request)
-	if err != nil {
-		return nil, err
+// validIPs returns the IP addresses, leaving out the sources that are not one, e.g. processes on a unix socket.
+func validIPs(IPs []string) []string {
+	valid := make([]string, 0, len(IPs))
+	for _, ip := range IPs {
+		if net.ParseIP(ip) != nil {
+			valid = append(valid, ip)
+		}
 	}
-	if len(instances) == 0 {
-		return nil, fmt.Errorf("no instances returned")
+	return valid
+}
+
+// isTerminated returns whether the instance is terminated or being terminated, its IP address may belong
+// to another instance.
+func isTerminated(i *ec2.Instance) bool {
+	if i.State == nil {
+		return false
 	}
+	state := aws.StringValue(i.State.Name)
+	return state == ec2.InstanceStateNameTerminated || state == ec2.InstanceStateNameShuttingDown
+}
 
-	i := instances[0]
-	region, err := azToRegion(aws.StringValue(i.Placement.AvailabilityZone))
+// newInstance returns the details of an EC2 instance.
+func (p *provider) newInstance(i *ec2.Instance) *cloudTypes.Instance {
+	var az string
+	if i.Placement != nil {
+		az = aws.StringValue(i.Placement.AvailabilityZone)
+	}
+	region, err := azToRegion(az)
 	if err != nil {
 		log.Errorf("Error getting instance region: %v", err)
 	}
-	instance := &cloudTypes.Instance{ID: aws.StringValue(i.InstanceId), Region: region}
-	for _, tag := range i.Tags {
-		instance.Tags = append(instance.Tags, fmt.Sprintf("%s:%s",
-			types.NormalizeTagElement(aws.StringValue(tag.Key)), types.NormalizeTagElement(aws.StringValue(tag.Value))))
-	}
-	return instance, nil
+	return &cloudTypes.Instance{ID: aws.StringValue(i.InstanceId), Region: region, Tags: p.tags.tags(i)}
 }
 
 // ProviderName returns the name of the provider.
@@ -175,7 +230,11 @@ func azToRegion(az string) (string, error) {
 }
 
 // NewProvider returns a new aws provider.
-func NewProvider(awsServices Services, az string) (cloudTypes.Interface, error) {
+func NewProvider(awsServices Services, az string, tagOptions TagOptions) (cloudTypes.Interface, error) {
+	tags, err := newTagMapper(tagOptions)
+	if err != nil {
+		return nil, err
+	}
 	metadata, err := awsServices.Metadata()
 	if err != nil {
 		return nil, fmt.Errorf("error creating AWS metadata client: %v", err)
@@ -196,7 +255,7 @@ func NewProvider(awsServices Services, az string) (cloudTypes.Interface, error)
 		return nil, fmt.Errorf("error creating AWS EC2 client: %v", err)
 	}
 
-	return &provider{availabilityZone: az, region: region, ec2: ec2, metadata: metadata}, nil
+	return &provider{availabilityZone: az, region: region, ec2: ec2, metadata: metadata, tags: tags}, nil
 }
 
 func newAWSSDKProvider(creds *credentials.Credentials, maxRetries int) *awsSDKProvider {
@@ -214,6 +273,14 @@ func NewProviderFromViper(v *viper.Viper) (cloudTypes.Interface, error) {
 			},
 			&credentials.SharedCredentialsProvider{},
 		})
+	tagOptions := TagOptions{
+		Include:    v.GetStringSlice("aws.include_tags"),
+		Exclude:    v.GetStringSlice("aws.exclude_tags"),
+		Attributes: v.GetStringSlice("aws.attributes"),
+	}
+	if err := v.UnmarshalKey("aws.rename_tags", &tagOptions.Rename); err != nil {
+		return nil, fmt.Errorf("invalid rename_tags: %v", err)
+	}
 	aws := newAWSSDKProvider(creds, v.GetInt("aws.max_retries"))
-	return NewProvider(aws, v.GetString("aws.availability_zone"))
+	return NewProvider(aws, v.GetString("aws.availability_zone"), tagOptions)
 }
@@ -0,0 +1,152 @@
+package aws
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/atlassian/gostatsd/types"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeEC2 returns an instance for each private IP address in the filter of the requests, and records them.
+// The requests after the first failAfter ones fail, if it is set.
+type fakeEC2 struct {
+	failAfter int
+	requests  []*ec2.DescribeInstancesInput
+}
+
+func (f *fakeEC2) DescribeInstances(request *ec2.DescribeInstancesInput) ([]*ec2.Instance, error) {
+	f.requests = append(f.requests, request)
+	if f.failAfter > 0 && len(f.requests) > f.failAfter {
+		return nil, errors.New("request limit exceeded")
+	}
+	var instances []*ec2.Instance
+	for _, filter := range request.Filters {
+		if aws.StringValue(filter.Name) != "private-ip-address" {
+			continue
+		}
+		for _, ip := range filter.Values {
+			if aws.StringValue(ip) == "10.0.0.99" {
+				continue // Not an instance
+			}
+			state := ec2.InstanceStateNameRunning
+			if aws.StringValue(ip) == "10.0.0.98" {
+				state = ec2.InstanceStateNameTerminated
+			}
+			instances = append(instances, &ec2.Instance{
+				InstanceId:       aws.String("i-" + aws.StringValue(ip)),
+				PrivateIpAddress: ip,
+				Placement:        &ec2.Placement{AvailabilityZone: aws.String("us-west-2a")},
+				State:            &ec2.InstanceState{Name: aws.String(state)},
+				Tags:             []*ec2.Tag{{Key: aws.String("Name"), Value: aws.String("web")}},
+			})
+		}
+	}
+	return instances, nil
+}
+
+func TestInstancesCoalescesRequests(t *testing.T) {
+	assert := assert.New(t)
+
+	f := &fakeEC2{}
+	p := &provider{ec2: f, tags: &tagMapper{}}
+	ips := make([]string, 0, 450)
+	for i := 0; i < 450; i++ {
+		ips = append(ips, fmt.Sprintf("10.0.%d.%d", i/100, i%100))
+	}
+	ips = append(ips, "pid:42") // A process on a unix socket is not looked up
+	instances, err := p.Instances(ips...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(instances, 448) // 10.0.0.98 is terminated and 10.0.0.99 is not an instance
+	assert.NotContains(instances, "10.0.0.98")
+
+	if assert.Len(f.requests, 3) {
+		for i, n := range []int{MaxFilterValues, MaxFilterValues, 50} {
+			if assert.Len(f.requests[i].Filters, 1) {
+				assert.Len(f.requests[i].Filters[0].Values, n)
+			}
+		}
+	}
+
+	instance := instances["10.0.1.5"]
+	if assert.NotNil(instance) {
+		assert.Equal("i-10.0.1.5", instance.ID)
+		assert.Equal("us-west-2", instance.Region)
+		assert.Equal(types.Tags{"name:web"}, instance.Tags)
+	}
+}
+
+func TestInstancesReturnsPartialResults(t *testing.T) {
+	assert := assert.New(t)
+
+	f := &fakeEC2{failAfter: 1}
+	p := &provider{ec2: f, tags: &tagMapper{}}
+	ips := make([]string, 0, 300)
+	for i := 0; i < 300; i++ {
+		ips = append(ips, fmt.Sprintf("10.1.%d.%d", i/100, i%100))
+	}
+	instances, err := p.Instances(ips...)
+	assert.Error(err)
+	assert.Len(instances, MaxFilterValues) // The instances of the first batch
+	assert.Contains(instances, "10.1.0.0")
+	assert.NotContains(instances, ips[len(ips)-1])
+	assert.Len(f.requests, 2) // No more requests after the failed one
+}
+
+func TestInstanceTags(t *testing.T) {
+	assert := assert.New(t)
+
+	i := &ec2.Instance{
+		InstanceId:   aws.String("i-1"),
+		InstanceType: aws.String("m4.large"),
+		ImageId:      aws.String("ami-1"),
+		VpcId:        aws.String("vpc-1"),
+		Placement:    &ec2.Placement{AvailabilityZone: aws.String("us-west-2a")},
+		Tags: []*ec2.Tag{
+			{Key: aws.String("Name"), Value: aws.String("web-1")},
+			{Key: aws.String("team"), Value: aws.String("core")},
+			{Key: aws.String("aws:cloudformation:stack-id"), Value: aws.String("arn")},
+			{Key: aws.String("aws:autoscaling:groupName"), Value: aws.String("web")},
+		},
+	}
+
+	tm, err := newTagMapper(TagOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(types.Tags{"name:web-1", "team:core", "aws_cloudformation_stack-id:arn", "aws_autoscaling_groupname:web"}, tm.tags(i))
+
+	tm, err = newTagMapper(TagOptions{
+		Exclude:    []string{"AWS:*"},
+		Attributes: []string{"az", "instance_type", "vpc", "ami", "asg"},
+		Rename:     []TagRename{{From: "name", To: "host"}, {From: "az", To: "zone"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(types.Tags{"zone:us-west-2a", "instance_type:m4_large", "vpc:vpc-1", "ami:ami-1", "asg:web", "host:web-1", "team:core"}, tm.tags(i))
+
+	tm, err = newTagMapper(TagOptions{Include: []string{"team", "name"}, Exclude: []string{"name"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(types.Tags{"team:core"}, tm.tags(i))
+
+	i.Tags = append(i.Tags, &ec2.Tag{Key: aws.String("kubernetes.io/cluster/prod"), Value: aws.String("owned")})
+	tm, err = newTagMapper(TagOptions{Include: []string{"kubernetes.io*", "team"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(types.Tags{"team:core", "kubernetes_io/cluster/prod:owned"}, tm.tags(i)) // * matches /
+
+	_, err = newTagMapper(TagOptions{Attributes: []string{"subnet"}})
+	assert.Error(err)
+	_, err = newTagMapper(TagOptions{Include: []string{"["}})
+	assert.Error(err)
+}
@@ -0,0 +1,155 @@
+package aws
+
+import (
+	"fmt"
+	"strings"
+
+	cloudTypes "github.com/atlassian/gostatsd/cloudprovider/types"
+	"github.com/atlassian/gostatsd/types"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// Instance attributes that can be added as tags.
+const (
+	// AttributeAZ is the availability zone of the instance.
+	AttributeAZ = "az"
+	// AttributeInstanceType is the type of the instance, e.g. m4.large.
+	AttributeInstanceType = "instance_type"
+	// AttributeVPC is the ID of the VPC of the instance.
+	AttributeVPC = "vpc"
+	// AttributeAMI is the ID of the AMI the instance was launched from.
+	AttributeAMI = "ami"
+	// AttributeASG is the name of the autoscaling group of the instance, from its aws:autoscaling:groupName tag.
+	AttributeASG = "asg"
+)
+
+// asgTagKey is the EC2 tag set by autoscaling groups on their instances.
+const asgTagKey = "aws:autoscaling:groupName"
+
+// TagRename renames the tag or attribute whose key is From to To.
+type TagRename struct {
+	From string `mapstructure:"from"`
+	To   string `mapstructure:"to"`
+}
+
+// TagOptions sets which EC2 tags and instance attributes are added as tags to the metrics of an instance.
+// Patterns use the syntax of cloudTypes.MatchPattern and, like the keys to rename, are matched case-insensitively
+// against the keys of EC2 tags, e.g. "aws:cloudformation:*".
+type TagOptions struct {
+	Include    []string    // Patterns of the EC2 tags to add, all of them if empty
+	Exclude    []string    // Patterns of the EC2 tags not to add, applied after Include
+	Attributes []string    // Instance attributes to add
+	Rename     []TagRename // Keys of the EC2 tags and attributes to rename
+}
+
+// tagMapper turns the EC2 tags and attributes of an instance into tags.
+type tagMapper struct {
+	include    []string
+	exclude    []string
+	attributes []string
+	rename     map[string]string // Lowercase key to new key
+}
+
+func newTagMapper(options TagOptions) (*tagMapper, error) {
+	tm := &tagMapper{rename: make(map[string]string, len(options.Rename))}
+	var err error
+	if tm.include, err = lowerPatterns(options.Include); err != nil {
+		return nil, err
+	}
+	if tm.exclude, err = lowerPatterns(options.Exclude); err != nil {
+		return nil, err
+	}
+	for _, attribute := range options.Attributes {
+		switch attribute = strings.ToLower(strings.TrimSpace(attribute)); attribute {
+		case AttributeAZ, AttributeInstanceType, AttributeVPC, AttributeAMI, AttributeASG:
+			tm.attributes = append(tm.attributes, attribute)
+		default:
+			return nil, fmt.Errorf("invalid attribute %q: must be one of %s, %s, %s, %s or %s",
+				attribute, AttributeAZ, AttributeInstanceType, AttributeVPC, AttributeAMI, AttributeASG)
+		}
+	}
+	for _, r := range options.Rename {
+		if r.From == "" || r.To == "" {
+			return nil, fmt.Errorf("invalid tag rename from %q to %q: both keys are required", r.From, r.To)
+		}
+		tm.rename[strings.ToLower(r.From)] = r.To
+	}
+	return tm, nil
+}
+
+func lowerPatterns(patterns []string) ([]string, error) {
+	lower := make([]string, 0, len(patterns))
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(pattern)
+		if _, err := cloudTypes.MatchPattern(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid tag pattern %q: %v", pattern, err)
+		}
+		lower = append(lower, pattern)
+	}
+	return lower, nil
+}
+
+// tags returns the attributes and the EC2 tags of the instance selected by the options, as tags.
+func (tm *tagMapper) tags(i *ec2.Instance) types.Tags {
+	var tags types.Tags
+	for _, attribute := range tm.attributes {
+		if value := attributeValue(i, attribute); value != "" {
+			tags = append(tags, tm.tag(attribute, value))
+		}
+	}
+	for _, tag := range i.Tags {
+		key := aws.StringValue(tag.Key)
+		if tm.selected(strings.ToLower(key)) {
+			tags = append(tags, tm.tag(key, aws.StringValue(tag.Value)))
+		}
+	}
+	return tags
+}
+
+// selected returns whether the EC2 tag with the given lowercase key is added.
+func (tm *tagMapper) selected(key string) bool {
+	if len(tm.include) > 0 && !matchAny(tm.include, key) {
+		return false
+	}
+	return !matchAny(tm.exclude, key)
+}
+
+func (tm *tagMapper) tag(key, value string) string {
+	if renamed, ok := tm.rename[strings.ToLower(key)]; ok {
+		key = renamed
+	}
+	return fmt.Sprintf("%s:%s", types.NormalizeTagElement(key), types.NormalizeTagElement(value))
+}
+
+func matchAny(patterns []string, key string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := cloudTypes.MatchPattern(pattern, key); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func attributeValue(i *ec2.Instance, attribute string) string {
+	switch attribute {
+	case AttributeAZ:
+		if i.Placement != nil {
+			return aws.StringValue(i.Placement.AvailabilityZone)
+		}
+	case AttributeInstanceType:
+		return aws.StringValue(i.InstanceType)
+	case AttributeVPC:
+		return aws.StringValue(i.VpcId)
+	case AttributeAMI:
+		return aws.StringValue(i.ImageId)
+	case AttributeASG:
+		for _, tag := range i.Tags {
+			if aws.StringValue(tag.Key) == asgTagKey {
+				return aws.StringValue(tag.Value)
+			}
+		}
+	}
+	return ""
+}
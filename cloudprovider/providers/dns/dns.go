@@ -0,0 +1,170 @@
+package dns
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+	"time"
+
+	cloudTypes "github.com/atlassian/gostatsd/cloudprovider/types"
+	"github.com/atlassian/gostatsd/types"
+
+	"github.com/spf13/viper"
+)
+
+const (
+	// ProviderName is the name of the reverse DNS cloud provider.
+	ProviderName = "dns"
+	// DefaultTimeout is the default timeout of a reverse DNS lookup.
+	DefaultTimeout = 2 * time.Second
+)
+
+const sampleConfig = `
+[dns]
+	# regular expression matched against the hostnames, its named groups are added as tags
+	hostname_regex = '^(?P<role>[a-z]+)-\d+\.(?P<dc>[a-z]+)\.' # optional
+
+	# timeout of a reverse DNS lookup
+	timeout = "2s" # optional, default to 2s
+`
+
+// Resolver looks up the names of IP addresses, to allow mocking/other implementations.
+type Resolver interface {
+	// LookupAddr performs a reverse lookup of the address, like net.LookupAddr.
+	LookupAddr(addr string) ([]string, error)
+}
+
+// netResolver is an implementation of Resolver backed by the resolver of the net package.
+type netResolver struct{}
+
+func (netResolver) LookupAddr(addr string) ([]string, error) {
+	return net.LookupAddr(addr)
+}
+
+// Options configures the reverse DNS provider.
+type Options struct {
+	HostnameRegex string        // Regular expression whose named groups are added as tags, optional
+	Timeout       time.Duration // Timeout of a lookup
+}
+
+// provider resolves IP addresses to hostnames with PTR lookups.
+type provider struct {
+	resolver Resolver
+	regex    *regexp.Regexp
+	timeout  time.Duration
+}
+
+// ProviderName returns the name of the provider.
+func (p *provider) ProviderName() string {
+	return ProviderName
+}
+
+// SampleConfig returns the sample config for the reverse DNS provider.
+func (p *provider) SampleConfig() string {
+	return sampleConfig
+}
+
+// MaxInstancesBatch returns 1 as PTR records are looked up one by one, lookups run concurrently in the
+// lookup workers.
+func (p *provider) MaxInstancesBatch() int {
+	return 1
+}
+
+// Instances returns the hostnames of the given IP addresses as the ID of their instance, with the tags
+// extracted by the hostname regex. IP addresses without a PTR record are not in the result.
+func (p *provider) Instances(IPs ...string) (map[string]*cloudTypes.Instance, error) {
+	result := make(map[string]*cloudTypes.Instance, len(IPs))
+	for _, ip := range IPs {
+		hostname, err := p.lookup(ip)
+		if err != nil {
+			return nil, err
+		}
+		if hostname != "" {
+			result[ip] = &cloudTypes.Instance{ID: hostname, Tags: p.tags(hostname)}
+		}
+	}
+	return result, nil
+}
+
+type lookupResult struct {
+	names []string
+	err   error
+}
+
+// lookup returns the first hostname of the IP address, or an empty string if it has none.
+func (p *provider) lookup(ip string) (string, error) {
+	done := make(chan lookupResult, 1)
+	go func() {
+		names, err := p.resolver.LookupAddr(ip)
+		done <- lookupResult{names, err}
+	}()
+	var r lookupResult
+	select {
+	case r = <-done:
+	case <-time.After(p.timeout):
+		return "", fmt.Errorf("reverse lookup of %s timed out after %v", ip, p.timeout)
+	}
+	if r.err != nil {
+		if dnsErr, ok := r.err.(*net.DNSError); ok && !dnsErr.Timeout() && !dnsErr.Temporary() {
+			return "", nil // No PTR record
+		}
+		return "", fmt.Errorf("error looking up %s: %v", ip, r.err)
+	}
+	for _, name := range r.names {
+		if name = strings.ToLower(strings.TrimSuffix(name, ".")); name != "" {
+			return name, nil
+		}
+	}
+	return "", nil
+}
+
+// tags returns the named groups of the hostname regex matched by the hostname as tags.
+func (p *provider) tags(hostname string) types.Tags {
+	if p.regex == nil {
+		return nil
+	}
+	match := p.regex.FindStringSubmatch(hostname)
+	if match == nil {
+		return nil
+	}
+	var tags types.Tags
+	for i, name := range p.regex.SubexpNames() {
+		if name != "" && match[i] != "" {
+			tags = append(tags, fmt.Sprintf("%s:%s", types.NormalizeTagElement(name), types.NormalizeTagElement(match[i])))
+		}
+	}
+	return tags
+}
+
+// NewProvider returns a new reverse DNS provider looking up hostnames with the resolver.
+func NewProvider(resolver Resolver, options Options) (cloudTypes.Interface, error) {
+	p := &provider{resolver: resolver, timeout: options.Timeout}
+	if p.timeout <= 0 {
+		p.timeout = DefaultTimeout
+	}
+	if options.HostnameRegex != "" {
+		regex, err := regexp.Compile(options.HostnameRegex)
+		if err != nil {
+			return nil, fmt.Errorf("invalid hostname regex: %v", err)
+		}
+		named := false
+		for _, name := range regex.SubexpNames() {
+			named = named || name != ""
+		}
+		if !named {
+			return nil, fmt.Errorf("invalid hostname regex %q: no named group to add as a tag", options.HostnameRegex)
+		}
+		p.regex = regex
+	}
+	return p, nil
+}
+
+// NewProviderFromViper returns a new reverse DNS provider using the system resolver.
+func NewProviderFromViper(v *viper.Viper) (cloudTypes.Interface, error) {
+	v.SetDefault("dns.timeout", DefaultTimeout)
+	return NewProvider(netResolver{}, Options{
+		HostnameRegex: v.GetString("dns.hostname_regex"),
+		Timeout:       v.GetDuration("dns.timeout"),
+	})
+}
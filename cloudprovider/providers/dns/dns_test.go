@@ -0,0 +1,81 @@
+package dns
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	cloudTypes "github.com/atlassian/gostatsd/cloudprovider/types"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// stubResolver resolves addresses from a map, addresses not in the map have no PTR record.
+type stubResolver struct {
+	names map[string][]string
+	err   error
+	delay time.Duration
+}
+
+func (r *stubResolver) LookupAddr(addr string) ([]string, error) {
+	time.Sleep(r.delay)
+	if r.err != nil {
+		return nil, r.err
+	}
+	names, ok := r.names[addr]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: addr}
+	}
+	return names, nil
+}
+
+func TestInstances(t *testing.T) {
+	assert := assert.New(t)
+
+	resolver := &stubResolver{names: map[string][]string{
+		"10.0.0.1": {"Web-03.syd.example.com."},
+		"10.0.0.2": {"db.example.com."},
+	}}
+	p, err := NewProvider(resolver, Options{HostnameRegex: `^(?P<role>[a-z]+)-\d+\.(?P<dc>[a-z]+)\.`})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	instances, err := p.Instances("10.0.0.1", "10.0.0.2", "10.0.0.3")
+	assert.NoError(err)
+	assert.Equal(map[string]*cloudTypes.Instance{
+		"10.0.0.1": {ID: "web-03.syd.example.com", Tags: []string{"role:web", "dc:syd"}},
+		"10.0.0.2": {ID: "db.example.com"},
+	}, instances)
+}
+
+func TestInstancesErrors(t *testing.T) {
+	assert := assert.New(t)
+
+	tests := []struct {
+		resolver *stubResolver
+		options  Options
+	}{
+		{&stubResolver{err: &net.DNSError{Err: "i/o timeout", IsTimeout: true}}, Options{}},
+		{&stubResolver{err: errors.New("failed")}, Options{}},
+		{&stubResolver{delay: time.Second}, Options{Timeout: 10 * time.Millisecond}},
+	}
+	for i, test := range tests {
+		p, err := NewProvider(test.resolver, test.options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = p.Instances("10.0.0.1")
+		assert.Error(err, "test %d", i)
+	}
+}
+
+func TestInvalidHostnameRegex(t *testing.T) {
+	assert := assert.New(t)
+
+	_, err := NewProvider(&stubResolver{}, Options{HostnameRegex: `(?P<role>[a-z]+`})
+	assert.Error(err)
+	_, err = NewProvider(&stubResolver{}, Options{HostnameRegex: `^([a-z]+)-`})
+	assert.Error(err)
+}
@@ -0,0 +1,302 @@
+package docker
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	cloudTypes "github.com/atlassian/gostatsd/cloudprovider/types"
+	"github.com/atlassian/gostatsd/types"
+
+	"github.com/spf13/viper"
+)
+
+const (
+	// ProviderName is the name of the Docker cloud provider.
+	ProviderName = "docker"
+	// MaxInstancesBatch is the maximum number of senders looked up in a single call to Instances.
+	// The containers are listed once per call to look up IP addresses.
+	MaxInstancesBatch = 100
+	// DefaultHost is the default address of the Docker API.
+	DefaultHost = "unix:///var/run/docker.sock"
+	// DefaultProcRoot is the default mount point of the proc file system.
+	DefaultProcRoot = "/proc"
+	// DefaultTimeout is the default timeout of the requests to the Docker API.
+	DefaultTimeout = 5 * time.Second
+)
+
+const sampleConfig = `
+[docker]
+	# address of the Docker API, a unix socket or http://host:port
+	host = "unix:///var/run/docker.sock" # optional, default to unix:///var/run/docker.sock
+
+	# mount point of the proc file system of the host, to find the containers of senders on a unix socket
+	proc_root = "/proc" # optional, default to /proc
+
+	# patterns of the labels of the containers added as tags
+	labels = ["com.example.*"] # optional, default to none
+
+	# timeout of the requests to the Docker API
+	timeout = "5s" # optional, default to 5s
+`
+
+// containerIDRegexp matches the ID of a container in the path of a cgroup, e.g. /docker/<id> or
+// /system.slice/docker-<id>.scope.
+var containerIDRegexp = regexp.MustCompile(`[0-9a-f]{64}`)
+
+// errNotFound is returned by the client when the Docker API responds with 404.
+var errNotFound = errors.New("not found")
+
+// Options configures the Docker provider.
+type Options struct {
+	Host     string        // Address of the Docker API, unix:///path or http://host:port
+	ProcRoot string        // Mount point of the proc file system
+	Labels   []string      // Patterns of the labels of containers added as tags, with the syntax of cloudTypes.MatchPattern
+	Timeout  time.Duration // Timeout of the requests to the Docker API
+}
+
+// container holds the fields of a container from the Docker API, as listed or inspected.
+type container struct {
+	ID     string            `json:"Id"`
+	Names  []string          `json:"Names"`  // Listed containers only
+	Name   string            `json:"Name"`   // Inspected containers only
+	Image  string            `json:"Image"`  // Listed containers only
+	Labels map[string]string `json:"Labels"` // Listed containers only
+	// Inspected containers only
+	Config struct {
+		Image  string            `json:"Image"`
+		Labels map[string]string `json:"Labels"`
+	} `json:"Config"`
+	NetworkSettings struct {
+		Networks map[string]struct {
+			IPAddress         string `json:"IPAddress"`
+			GlobalIPv6Address string `json:"GlobalIPv6Address"`
+		} `json:"Networks"`
+	} `json:"NetworkSettings"`
+}
+
+// provider maps the IP addresses and processes of senders to their containers.
+type provider struct {
+	baseURL  string
+	http     *http.Client
+	procRoot string
+	labels   []string
+}
+
+// ProviderName returns the name of the provider.
+func (p *provider) ProviderName() string {
+	return ProviderName
+}
+
+// SampleConfig returns the sample config for the Docker provider.
+func (p *provider) SampleConfig() string {
+	return sampleConfig
+}
+
+// MaxInstancesBatch returns the maximum number of senders looked up in a single call to Instances.
+func (p *provider) MaxInstancesBatch() int {
+	return MaxInstancesBatch
+}
+
+// Instances returns the containers of the senders, identified by the IP address of the container on one of
+// its networks, or by pid:<pid> for the processes of senders on a unix socket.
+// Senders that are not in a container are not in the result.
+func (p *provider) Instances(IPs ...string) (map[string]*cloudTypes.Instance, error) {
+	result := make(map[string]*cloudTypes.Instance, len(IPs))
+	var addresses []string
+	for _, source := range IPs {
+		if pid := strings.TrimPrefix(source, "pid:"); pid != source {
+			instance, err := p.processContainer(pid)
+			if err != nil {
+				return nil, err
+			}
+			if instance != nil {
+				result[source] = instance
+			}
+		} else if net.ParseIP(source) != nil {
+			addresses = append(addresses, source)
+		}
+	}
+	if len(addresses) == 0 {
+		return result, nil
+	}
+	var containers []container
+	if err := p.get("/containers/json", &containers); err != nil {
+		return nil, err
+	}
+	byIP := make(map[string]*container)
+	for i := range containers {
+		for _, network := range containers[i].NetworkSettings.Networks {
+			for _, ip := range []string{network.IPAddress, network.GlobalIPv6Address} {
+				if ip != "" {
+					byIP[ip] = &containers[i]
+				}
+			}
+		}
+	}
+	for _, ip := range addresses {
+		if c, ok := byIP[ip]; ok {
+			var name string
+			if len(c.Names) > 0 {
+				name = c.Names[0]
+			}
+			result[ip] = p.newInstance(c.ID, name, c.Image, c.Labels)
+		}
+	}
+	return result, nil
+}
+
+// processContainer returns the container of the process, nil if the process is gone or not in a container.
+func (p *provider) processContainer(pid string) (*cloudTypes.Instance, error) {
+	if _, err := strconv.Atoi(pid); err != nil {
+		return nil, nil
+	}
+	id, err := p.containerID(pid)
+	if err != nil || id == "" {
+		return nil, err
+	}
+	var c container
+	if err := p.get("/containers/"+id+"/json", &c); err != nil {
+		if err == errNotFound {
+			return nil, nil // Not a Docker container
+		}
+		return nil, err
+	}
+	return p.newInstance(c.ID, c.Name, c.Config.Image, c.Config.Labels), nil
+}
+
+// containerID returns the ID of the container of the process from its cgroups, or an empty string if the
+// process is gone or not in a container.
+func (p *provider) containerID(pid string) (string, error) {
+	data, err := ioutil.ReadFile(filepath.Join(p.procRoot, pid, "cgroup"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", err
+	}
+	var id string
+	for _, line := range strings.Split(string(data), "\n") {
+		if match := containerIDRegexp.FindAllString(line, -1); len(match) > 0 {
+			id = match[len(match)-1]
+		}
+	}
+	return id, nil
+}
+
+// newInstance returns the details of a container: its short ID, name, image and the selected labels.
+func (p *provider) newInstance(id, name, image string, labels map[string]string) *cloudTypes.Instance {
+	if len(id) > 12 {
+		id = id[:12]
+	}
+	var tags types.Tags
+	if name = strings.TrimPrefix(name, "/"); name != "" {
+		tags = append(tags, "container_name:"+types.NormalizeTagElement(name))
+	}
+	if image != "" {
+		tags = append(tags, "image:"+types.NormalizeTagElement(image))
+	}
+	if len(p.labels) > 0 {
+		keys := make([]string, 0, len(labels))
+		for key := range labels {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys) // Same tags in the same order for the same container
+		for _, key := range keys {
+			for _, pattern := range p.labels {
+				if ok, _ := cloudTypes.MatchPattern(pattern, key); ok {
+					tags = append(tags, fmt.Sprintf("%s:%s", types.NormalizeTagElement(key), types.NormalizeTagElement(labels[key])))
+					break
+				}
+			}
+		}
+	}
+	return &cloudTypes.Instance{ID: id, Tags: tags}
+}
+
+// get decodes the response of the Docker API to a GET request into v.
+func (p *provider) get(path string, v interface{}) error {
+	req, err := http.NewRequest("GET", p.baseURL+path, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := p.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("error calling the Docker API: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return errNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("GET %s: %s: %s", path, resp.Status, body)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("error decoding the response of GET %s: %v", path, err)
+	}
+	return nil
+}
+
+// NewProvider returns a new Docker provider.
+func NewProvider(options Options) (cloudTypes.Interface, error) {
+	for _, pattern := range options.Labels {
+		if _, err := cloudTypes.MatchPattern(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid label pattern %q: %v", pattern, err)
+		}
+	}
+	if options.Host == "" {
+		options.Host = DefaultHost
+	}
+	if options.ProcRoot == "" {
+		options.ProcRoot = DefaultProcRoot
+	}
+	if options.Timeout <= 0 {
+		options.Timeout = DefaultTimeout
+	}
+	u, err := url.Parse(options.Host)
+	if err != nil {
+		return nil, fmt.Errorf("invalid Docker host %q: %v", options.Host, err)
+	}
+	p := &provider{procRoot: options.ProcRoot, labels: options.Labels}
+	transport := &http.Transport{}
+	switch u.Scheme {
+	case "unix":
+		socket := u.Path
+		transport.Dial = func(network, addr string) (net.Conn, error) {
+			return net.DialTimeout("unix", socket, options.Timeout)
+		}
+		p.baseURL = "http://docker" // The host is ignored
+	case "http", "tcp":
+		p.baseURL = "http://" + u.Host
+	default:
+		return nil, fmt.Errorf("invalid Docker host %q: the scheme must be unix, http or tcp", options.Host)
+	}
+	p.http = &http.Client{Transport: transport, Timeout: options.Timeout}
+	return p, nil
+}
+
+// NewProviderFromViper returns a new Docker provider.
+func NewProviderFromViper(v *viper.Viper) (cloudTypes.Interface, error) {
+	v.SetDefault("docker.host", DefaultHost)
+	v.SetDefault("docker.proc_root", DefaultProcRoot)
+	v.SetDefault("docker.timeout", DefaultTimeout)
+	return NewProvider(Options{
+		Host:     v.GetString("docker.host"),
+		ProcRoot: v.GetString("docker.proc_root"),
+		Labels:   v.GetStringSlice("docker.labels"),
+		Timeout:  v.GetDuration("docker.timeout"),
+	})
+}
@@ -0,0 +1,145 @@
+package docker
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	cloudTypes "github.com/atlassian/gostatsd/cloudprovider/types"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	webID = "4a5f2cf5a8b3c1f0e9d8c7b6a5f4e3d2c1b0a9f8e7d6c5b4a3f2e1d0c9b8a7f6"
+	dbID  = "9f8e7d6c5b4a3f2e1d0c9b8a7f6e5d4c3b2a1f0e9d8c7b6a5f4e3d2c1b0a9f8e"
+)
+
+// fakeDockerAPI serves the containers of the Docker API and records the paths of the requests.
+type fakeDockerAPI struct {
+	mu    sync.Mutex
+	paths []string
+}
+
+func (f *fakeDockerAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	f.paths = append(f.paths, r.URL.Path)
+	f.mu.Unlock()
+	switch r.URL.Path {
+	case "/containers/json":
+		fmt.Fprintf(w, `[
+			{"Id": %q, "Names": ["/web"], "Image": "nginx:1.13", "Labels": {"com.example.team": "Infra", "other": "x"},
+			 "NetworkSettings": {"Networks": {"bridge": {"IPAddress": "172.17.0.2"}}}},
+			{"Id": %q, "Names": ["/db"], "Image": "postgres", "Labels": {},
+			 "NetworkSettings": {"Networks": {"backend": {"IPAddress": "172.18.0.2"}, "host": {"IPAddress": ""}}}}
+		]`, webID, dbID)
+	case "/containers/" + webID + "/json":
+		fmt.Fprintf(w, `{"Id": %q, "Name": "/web", "Config": {"Image": "nginx:1.13", "Labels": {"com.example.team": "Infra"}}}`, webID)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func writeCgroup(t *testing.T, procRoot string, pid int, content string) {
+	dir := filepath.Join(procRoot, fmt.Sprintf("%d", pid))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "cgroup"), []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestInstances(t *testing.T) {
+	assert := assert.New(t)
+
+	api := &fakeDockerAPI{}
+	s := httptest.NewServer(api)
+	defer s.Close()
+	procRoot, err := ioutil.TempDir("", "proc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(procRoot)
+	writeCgroup(t, procRoot, 100, "12:pids:/docker/"+webID+"\n1:name=systemd:/docker/"+webID+"\n")
+	writeCgroup(t, procRoot, 101, "0::/system.slice/docker-"+dbID+".scope\n") // Not known by the API
+	writeCgroup(t, procRoot, 102, "0::/user.slice/user-1000.slice/session-2.scope\n")
+
+	p, err := NewProvider(Options{Host: s.URL, ProcRoot: procRoot, Labels: []string{"com.example.*"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	instances, err := p.Instances("172.17.0.2", "172.18.0.2", "172.17.0.9", "pid:100", "pid:101", "pid:102", "pid:103")
+	if err != nil {
+		t.Fatal(err)
+	}
+	web := &cloudTypes.Instance{ID: webID[:12], Tags: []string{"container_name:web", "image:nginx_1_13", "com_example_team:infra"}}
+	assert.Equal(map[string]*cloudTypes.Instance{
+		"172.17.0.2": web,
+		"172.18.0.2": {ID: dbID[:12], Tags: []string{"container_name:db", "image:postgres"}},
+		"pid:100":    web,
+	}, instances)
+	assert.Equal([]string{"/containers/" + webID + "/json", "/containers/" + dbID + "/json", "/containers/json"}, api.paths)
+}
+
+func TestInstancesOverUnixSocket(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "docker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "docker.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &httptest.Server{Listener: l, Config: &http.Server{Handler: &fakeDockerAPI{}}}
+	s.Start()
+	defer s.Close()
+
+	p, err := NewProvider(Options{Host: "unix://" + socket, ProcRoot: dir, Labels: []string{"com.example.*"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	instances, err := p.Instances("172.17.0.2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if assert.Contains(instances, "172.17.0.2") {
+		assert.Equal(webID[:12], instances["172.17.0.2"].ID)
+	}
+}
+
+func TestInstancesAPIError(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "daemon is restarting", http.StatusInternalServerError)
+	}))
+	defer s.Close()
+
+	p, err := NewProvider(Options{Host: s.URL, ProcRoot: DefaultProcRoot, Labels: []string{"com.example.*"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = p.Instances("172.17.0.2")
+	if assert.Error(t, err) {
+		assert.True(t, strings.Contains(err.Error(), "daemon is restarting"))
+	}
+}
+
+func TestInvalidOptions(t *testing.T) {
+	assert := assert.New(t)
+
+	_, err := NewProvider(Options{Host: "ftp://docker"})
+	assert.Error(err)
+	_, err = NewProvider(Options{Labels: []string{"["}})
+	assert.Error(err)
+}
@@ -0,0 +1,362 @@
+package k8s
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	inClusterTokenFile = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+	inClusterCAFile    = "/var/run/secrets/kubernetes.io/serviceaccount/ca.crt"
+
+	// responseHeaderTimeout is how long to wait for the API server to respond. Watches stream their
+	// body for longer.
+	responseHeaderTimeout = 30 * time.Second
+	// watchTimeout is how long a watch request lasts before the API server closes it.
+	watchTimeout = 5 * time.Minute
+)
+
+// errGone is returned by a watch when the resource version is too old, the pods must be listed again.
+var errGone = errors.New("resource version too old")
+
+// restConfig holds how to connect to the API server.
+type restConfig struct {
+	host      string // e.g. https://10.0.0.1:443
+	token     string
+	tokenFile string // Read on every request if set, as service account tokens are rotated
+	tls       *tls.Config
+}
+
+// inClusterConfig returns the configuration of a pod to connect to the API server of its cluster.
+func inClusterConfig() (*restConfig, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, errors.New("not running in a cluster: KUBERNETES_SERVICE_HOST and KUBERNETES_SERVICE_PORT must be set")
+	}
+	ca, err := ioutil.ReadFile(inClusterCAFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("no certificate in %s", inClusterCAFile)
+	}
+	return &restConfig{
+		host:      "https://" + net.JoinHostPort(host, port),
+		tokenFile: inClusterTokenFile,
+		tls:       &tls.Config{RootCAs: pool},
+	}, nil
+}
+
+// kubeconfig is the subset of a kubeconfig file used to connect to the API server.
+type kubeconfig struct {
+	CurrentContext string `yaml:"current-context"`
+	Clusters       []struct {
+		Name    string `yaml:"name"`
+		Cluster struct {
+			Server                   string `yaml:"server"`
+			CertificateAuthority     string `yaml:"certificate-authority"`
+			CertificateAuthorityData string `yaml:"certificate-authority-data"`
+			InsecureSkipTLSVerify    bool   `yaml:"insecure-skip-tls-verify"`
+		} `yaml:"cluster"`
+	} `yaml:"clusters"`
+	Users []struct {
+		Name string `yaml:"name"`
+		User struct {
+			Token                 string `yaml:"token"`
+			TokenFile             string `yaml:"tokenFile"`
+			ClientCertificate     string `yaml:"client-certificate"`
+			ClientCertificateData string `yaml:"client-certificate-data"`
+			ClientKey             string `yaml:"client-key"`
+			ClientKeyData         string `yaml:"client-key-data"`
+		} `yaml:"user"`
+	} `yaml:"users"`
+	Contexts []struct {
+		Name    string `yaml:"name"`
+		Context struct {
+			Cluster string `yaml:"cluster"`
+			User    string `yaml:"user"`
+		} `yaml:"context"`
+	} `yaml:"contexts"`
+}
+
+// kubeconfigConfig returns the configuration of the given context of a kubeconfig file,
+// or of its current context if contextName is empty.
+func kubeconfigConfig(path, contextName string) (*restConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var kc kubeconfig
+	if err = yaml.Unmarshal(data, &kc); err != nil {
+		return nil, fmt.Errorf("invalid kubeconfig %s: %v", path, err)
+	}
+	if contextName == "" {
+		contextName = kc.CurrentContext
+	}
+	var clusterName, userName string
+	found := false
+	for _, c := range kc.Contexts {
+		if c.Name == contextName {
+			clusterName, userName, found = c.Context.Cluster, c.Context.User, true
+			break
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("context %q not found in kubeconfig %s", contextName, path)
+	}
+
+	dir := filepath.Dir(path)
+	cfg := &restConfig{tls: &tls.Config{}}
+	found = false
+	for _, c := range kc.Clusters {
+		if c.Name != clusterName {
+			continue
+		}
+		found = true
+		cfg.host = strings.TrimSuffix(c.Cluster.Server, "/")
+		cfg.tls.InsecureSkipVerify = c.Cluster.InsecureSkipTLSVerify
+		ca, err := readData(dir, c.Cluster.CertificateAuthorityData, c.Cluster.CertificateAuthority)
+		if err != nil {
+			return nil, err
+		}
+		if ca != nil {
+			cfg.tls.RootCAs = x509.NewCertPool()
+			if !cfg.tls.RootCAs.AppendCertsFromPEM(ca) {
+				return nil, fmt.Errorf("no certificate authority in cluster %q", clusterName)
+			}
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("cluster %q not found in kubeconfig %s", clusterName, path)
+	}
+	for _, u := range kc.Users {
+		if u.Name != userName {
+			continue
+		}
+		cfg.token = u.User.Token
+		if u.User.TokenFile != "" {
+			cfg.tokenFile = resolvePath(dir, u.User.TokenFile)
+		}
+		cert, err := readData(dir, u.User.ClientCertificateData, u.User.ClientCertificate)
+		if err != nil {
+			return nil, err
+		}
+		key, err := readData(dir, u.User.ClientKeyData, u.User.ClientKey)
+		if err != nil {
+			return nil, err
+		}
+		if cert != nil && key != nil {
+			pair, err := tls.X509KeyPair(cert, key)
+			if err != nil {
+				return nil, fmt.Errorf("invalid client certificate of user %q: %v", userName, err)
+			}
+			cfg.tls.Certificates = []tls.Certificate{pair}
+		}
+	}
+	return cfg, nil
+}
+
+// readData returns the base64 encoded data if set, or the content of the file otherwise.
+func readData(dir, data, file string) ([]byte, error) {
+	if data != "" {
+		return base64.StdEncoding.DecodeString(data)
+	}
+	if file != "" {
+		return ioutil.ReadFile(resolvePath(dir, file))
+	}
+	return nil, nil
+}
+
+// resolvePath resolves the paths relative to the kubeconfig file.
+func resolvePath(dir, path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(dir, path)
+}
+
+// client is a minimal client of the API server, to list and watch pods.
+type client struct {
+	config *restConfig
+	http   *http.Client
+}
+
+func newClient(config *restConfig) *client {
+	return &client{
+		config: config,
+		http: &http.Client{
+			Transport: &http.Transport{
+				Proxy:                 http.ProxyFromEnvironment,
+				TLSClientConfig:       config.tls,
+				ResponseHeaderTimeout: responseHeaderTimeout,
+			},
+		},
+	}
+}
+
+// podList is a list of pods returned by the API server.
+type podList struct {
+	Metadata struct {
+		ResourceVersion string `json:"resourceVersion"`
+	} `json:"metadata"`
+	Items []pod `json:"items"`
+}
+
+// pod holds the fields of a pod used by the provider.
+type pod struct {
+	Metadata struct {
+		Name            string            `json:"name"`
+		Namespace       string            `json:"namespace"`
+		UID             string            `json:"uid"`
+		ResourceVersion string            `json:"resourceVersion"`
+		Labels          map[string]string `json:"labels"`
+		Annotations     map[string]string `json:"annotations"`
+		OwnerReferences []struct {
+			Kind       string `json:"kind"`
+			Name       string `json:"name"`
+			Controller bool   `json:"controller"`
+		} `json:"ownerReferences"`
+	} `json:"metadata"`
+	Spec struct {
+		NodeName    string `json:"nodeName"`
+		HostNetwork bool   `json:"hostNetwork"`
+	} `json:"spec"`
+	Status struct {
+		Phase string `json:"phase"`
+		PodIP string `json:"podIP"`
+	} `json:"status"`
+}
+
+// watchEvent is an event of a watch. The object is a pod, or a status for errors.
+type watchEvent struct {
+	Type   string          `json:"type"`
+	Object json.RawMessage `json:"object"`
+}
+
+type status struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// listPods lists the pods matching the field selector, if any.
+func (c *client) listPods(fieldSelector string) (*podList, error) {
+	query := url.Values{}
+	if fieldSelector != "" {
+		query.Set("fieldSelector", fieldSelector)
+	}
+	resp, err := c.get("/api/v1/pods", query)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var list podList
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return nil, fmt.Errorf("error decoding pods: %v", err)
+	}
+	return &list, nil
+}
+
+// watchPods calls f for each change to the pods matching the field selector, if any, after the given
+// resource version, until the API server closes the watch or the context is done.
+// It returns the last resource version seen.
+func (c *client) watchPods(ctx context.Context, fieldSelector, resourceVersion string, f func(eventType string, p *pod)) (string, error) {
+	query := url.Values{}
+	query.Set("watch", "true")
+	query.Set("resourceVersion", resourceVersion)
+	query.Set("allowWatchBookmarks", "true")
+	query.Set("timeoutSeconds", fmt.Sprintf("%d", int(watchTimeout/time.Second)))
+	if fieldSelector != "" {
+		query.Set("fieldSelector", fieldSelector)
+	}
+	resp, err := c.get("/api/v1/pods", query)
+	if err != nil {
+		return resourceVersion, err
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-done:
+		}
+		resp.Body.Close() // Unblocks the decoder
+	}()
+
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var event watchEvent
+		if err := decoder.Decode(&event); err != nil {
+			if ctx.Err() != nil {
+				return resourceVersion, ctx.Err()
+			}
+			if err == io.EOF {
+				return resourceVersion, nil
+			}
+			return resourceVersion, fmt.Errorf("error decoding watch event: %v", err)
+		}
+		if event.Type == "ERROR" {
+			var s status
+			if err := json.Unmarshal(event.Object, &s); err == nil && s.Code == http.StatusGone {
+				return resourceVersion, errGone
+			}
+			return resourceVersion, fmt.Errorf("watch error: %s", event.Object)
+		}
+		var p pod
+		if err := json.Unmarshal(event.Object, &p); err != nil {
+			return resourceVersion, fmt.Errorf("error decoding pod: %v", err)
+		}
+		resourceVersion = p.Metadata.ResourceVersion
+		if event.Type != "BOOKMARK" {
+			f(event.Type, &p)
+		}
+	}
+}
+
+func (c *client) get(path string, query url.Values) (*http.Response, error) {
+	req, err := http.NewRequest("GET", c.config.host+path+"?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	token := c.config.token
+	if c.config.tokenFile != "" {
+		data, err := ioutil.ReadFile(c.config.tokenFile)
+		if err != nil {
+			return nil, err
+		}
+		token = strings.TrimSpace(string(data))
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusGone {
+			return nil, errGone
+		}
+		return nil, fmt.Errorf("GET %s: %s: %s", path, resp.Status, body)
+	}
+	return resp, nil
+}
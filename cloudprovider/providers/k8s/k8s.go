@@ -0,0 +1,270 @@
+package k8s
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	cloudTypes "github.com/atlassian/gostatsd/cloudprovider/types"
+	"github.com/atlassian/gostatsd/types"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/cenkalti/backoff"
+	"github.com/spf13/viper"
+	"golang.org/x/net/context"
+)
+
+const (
+	// ProviderName is the name of the Kubernetes cloud provider.
+	ProviderName = "kubernetes"
+	// MaxInstancesBatch is the maximum number of IP addresses looked up by a single call to Instances.
+	// Pods are looked up in memory so it only bounds the time the lock is held.
+	MaxInstancesBatch = 1000
+	// DefaultSyncTimeout is how long lookups wait for the pods to be listed when the provider starts.
+	DefaultSyncTimeout = 10 * time.Second
+)
+
+const sampleConfig = `
+[kubernetes]
+	# path of the kubeconfig file used to connect to the API server
+	kubeconfig = "/home/user/.kube/config" # optional, uses the service account of the pod if empty
+
+	# context of the kubeconfig file
+	context = "production" # optional, default to the current context
+
+	# only watch the pods of this node, e.g. when running as a DaemonSet
+	node_name = "node-1" # optional, default to the pods of all nodes
+
+	# patterns of the labels and annotations of the pods added as tags
+	labels = ["app", "app.kubernetes.io/*"] # optional, default to none
+	annotations = [] # optional, default to none
+`
+
+// Options configures the Kubernetes provider.
+// Label and annotation patterns use the syntax of cloudTypes.MatchPattern.
+type Options struct {
+	NodeName    string   // Only watch the pods of this node if set
+	Labels      []string // Patterns of the labels of pods added as tags
+	Annotations []string // Patterns of the annotations of pods added as tags
+	SyncTimeout time.Duration
+}
+
+// provider maps the IP addresses of pods to their details, kept up to date by watching the API server.
+type provider struct {
+	client  *client
+	options Options
+
+	synced   chan struct{} // Closed once the pods have been listed
+	syncOnce sync.Once
+
+	mu   sync.RWMutex
+	pods map[string]*podEntry // By IP address
+}
+
+type podEntry struct {
+	uid      string
+	instance *cloudTypes.Instance
+}
+
+// ProviderName returns the name of the provider.
+func (p *provider) ProviderName() string {
+	return ProviderName
+}
+
+// SampleConfig returns the sample config for the Kubernetes provider.
+func (p *provider) SampleConfig() string {
+	return sampleConfig
+}
+
+// MaxInstancesBatch returns the maximum number of IP addresses looked up in a single call to Instances.
+func (p *provider) MaxInstancesBatch() int {
+	return MaxInstancesBatch
+}
+
+// Instances returns the details of the pods with the given IP addresses. Pods using the network of their
+// node and pods that are not running anymore are ignored.
+// Lookups wait up to the sync timeout for the pods to be listed when the provider starts.
+func (p *provider) Instances(IPs ...string) (map[string]*cloudTypes.Instance, error) {
+	select {
+	case <-p.synced:
+	case <-time.After(p.options.SyncTimeout):
+		return nil, fmt.Errorf("pods not listed after %v", p.options.SyncTimeout)
+	}
+	result := make(map[string]*cloudTypes.Instance, len(IPs))
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	for _, ip := range IPs {
+		if entry, ok := p.pods[ip]; ok {
+			result[ip] = entry.instance
+		}
+	}
+	return result, nil
+}
+
+// run lists then watches the pods until the context is done, listing them again if the watch fails.
+func (p *provider) run(ctx context.Context) {
+	b := backoff.NewExponentialBackOff()
+	b.MaxElapsedTime = 0 // Retry forever
+	var resourceVersion string
+	for {
+		var err error
+		if resourceVersion == "" {
+			resourceVersion, err = p.list()
+		}
+		if err == nil {
+			resourceVersion, err = p.client.watchPods(ctx, p.fieldSelector(), resourceVersion, p.update)
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		if err == nil {
+			b.Reset()
+			continue
+		}
+		resourceVersion = ""
+		if err != errGone {
+			log.Warnf("[%s] Error watching pods: %v", ProviderName, err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(b.NextBackOff()):
+		}
+	}
+}
+
+func (p *provider) fieldSelector() string {
+	if p.options.NodeName == "" {
+		return ""
+	}
+	return "spec.nodeName=" + p.options.NodeName
+}
+
+// list replaces the pods with the ones listed by the API server and returns the resource version
+// to watch from.
+func (p *provider) list() (string, error) {
+	list, err := p.client.listPods(p.fieldSelector())
+	if err != nil {
+		return "", err
+	}
+	pods := make(map[string]*podEntry, len(list.Items))
+	for i := range list.Items {
+		if ip, entry := p.newEntry(&list.Items[i]); entry != nil {
+			pods[ip] = entry
+		}
+	}
+	p.mu.Lock()
+	p.pods = pods
+	p.mu.Unlock()
+	p.syncOnce.Do(func() { close(p.synced) })
+	log.Debugf("[%s] Listed %d pods", ProviderName, len(pods))
+	return list.Metadata.ResourceVersion, nil
+}
+
+// update applies an event of the watch.
+func (p *provider) update(eventType string, pod *pod) {
+	ip, entry := p.newEntry(pod)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if entry != nil && eventType != "DELETED" {
+		p.pods[ip] = entry
+		return
+	}
+	// The IP address may already belong to a new pod
+	if current, ok := p.pods[pod.Status.PodIP]; ok && current.uid == pod.Metadata.UID {
+		delete(p.pods, pod.Status.PodIP)
+	}
+}
+
+// newEntry returns the IP address and the details of a pod, or a nil entry if the pod is ignored.
+func (p *provider) newEntry(pod *pod) (string, *podEntry) {
+	ip := pod.Status.PodIP
+	if ip == "" || pod.Spec.HostNetwork || pod.Status.Phase == "Succeeded" || pod.Status.Phase == "Failed" {
+		return ip, nil
+	}
+	tags := types.Tags{"namespace:" + types.NormalizeTagElement(pod.Metadata.Namespace)}
+	if pod.Spec.NodeName != "" {
+		tags = append(tags, "node:"+types.NormalizeTagElement(pod.Spec.NodeName))
+	}
+	for _, owner := range pod.Metadata.OwnerReferences {
+		if owner.Controller {
+			tags = append(tags,
+				"owner_kind:"+types.NormalizeTagElement(owner.Kind),
+				"owner:"+types.NormalizeTagElement(owner.Name))
+			break
+		}
+	}
+	tags = appendMatching(tags, p.options.Labels, pod.Metadata.Labels)
+	tags = appendMatching(tags, p.options.Annotations, pod.Metadata.Annotations)
+	return ip, &podEntry{
+		uid:      pod.Metadata.UID,
+		instance: &cloudTypes.Instance{ID: pod.Metadata.Name, Tags: tags},
+	}
+}
+
+// appendMatching appends the values whose key matches one of the patterns as tags.
+func appendMatching(tags types.Tags, patterns []string, values map[string]string) types.Tags {
+	if len(patterns) == 0 {
+		return tags
+	}
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys) // Same tags in the same order for the same pod
+	for _, key := range keys {
+		for _, pattern := range patterns {
+			if ok, _ := cloudTypes.MatchPattern(pattern, key); ok {
+				tags = append(tags, fmt.Sprintf("%s:%s", types.NormalizeTagElement(key), types.NormalizeTagElement(values[key])))
+				break
+			}
+		}
+	}
+	return tags
+}
+
+// newProvider returns a provider watching pods until the context is done.
+func newProvider(ctx context.Context, config *restConfig, options Options) (*provider, error) {
+	for _, pattern := range append(append([]string(nil), options.Labels...), options.Annotations...) {
+		if _, err := cloudTypes.MatchPattern(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %v", pattern, err)
+		}
+	}
+	if options.SyncTimeout <= 0 {
+		options.SyncTimeout = DefaultSyncTimeout
+	}
+	p := &provider{
+		client:  newClient(config),
+		options: options,
+		synced:  make(chan struct{}),
+		pods:    make(map[string]*podEntry),
+	}
+	go p.run(ctx)
+	return p, nil
+}
+
+// NewProvider returns a new Kubernetes provider connecting to the API server with the given kubeconfig
+// file and context, or with the service account of the pod it runs in if kubeconfig is empty.
+func NewProvider(kubeconfig, contextName string, options Options) (cloudTypes.Interface, error) {
+	var config *restConfig
+	var err error
+	if kubeconfig == "" {
+		config, err = inClusterConfig()
+	} else {
+		config, err = kubeconfigConfig(kubeconfig, contextName)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return newProvider(context.Background(), config, options)
+}
+
+// NewProviderFromViper returns a new Kubernetes provider.
+func NewProviderFromViper(v *viper.Viper) (cloudTypes.Interface, error) {
+	return NewProvider(v.GetString("kubernetes.kubeconfig"), v.GetString("kubernetes.context"), Options{
+		NodeName:    v.GetString("kubernetes.node_name"),
+		Labels:      v.GetStringSlice("kubernetes.labels"),
+		Annotations: v.GetStringSlice("kubernetes.annotations"),
+	})
+}
@@ -0,0 +1,295 @@
+package k8s
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	cloudTypes "github.com/atlassian/gostatsd/cloudprovider/types"
+	"github.com/atlassian/gostatsd/types"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+// fakeAPIServer serves lists of pods and streams the watch events sent to it.
+type fakeAPIServer struct {
+	*httptest.Server
+	events chan string // Watch events, an empty string closes the watch
+
+	mu       sync.Mutex
+	pods     []string // JSON of the listed pods
+	lists    int
+	requests []*http.Request
+}
+
+func newFakeAPIServer(pods ...string) *fakeAPIServer {
+	s := &fakeAPIServer{events: make(chan string), pods: pods}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	return s
+}
+
+func (s *fakeAPIServer) serve(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.requests = append(s.requests, r)
+	if r.URL.Query().Get("watch") != "true" {
+		s.lists++
+		fmt.Fprintf(w, `{"metadata":{"resourceVersion":"%d"},"items":[%s]}`, s.lists, join(s.pods))
+		s.mu.Unlock()
+		return
+	}
+	s.mu.Unlock()
+	closed := w.(http.CloseNotifier).CloseNotify()
+	w.WriteHeader(http.StatusOK)
+	w.(http.Flusher).Flush()
+	for {
+		select {
+		case <-closed:
+			return
+		case event := <-s.events:
+			if event == "" {
+				return
+			}
+			fmt.Fprintln(w, event)
+			w.(http.Flusher).Flush()
+		}
+	}
+}
+
+func (s *fakeAPIServer) setPods(pods ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pods = pods
+}
+
+func (s *fakeAPIServer) listCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lists
+}
+
+func join(pods []string) string {
+	var result string
+	for i, p := range pods {
+		if i > 0 {
+			result += ","
+		}
+		result += p
+	}
+	return result
+}
+
+func testPod(name, uid, ip, resourceVersion string) string {
+	return fmt.Sprintf(`{"metadata":{"name":%q,"namespace":"default","uid":%q,"resourceVersion":%q,`+
+		`"labels":{"app":"web","pod-template-hash":"abc"},"annotations":{"team":"Infra"},`+
+		`"ownerReferences":[{"kind":"ReplicaSet","name":"web-abc","controller":true}]},`+
+		`"spec":{"nodeName":"node-1"},"status":{"phase":"Running","podIP":%q}}`, name, uid, resourceVersion, ip)
+}
+
+func watchEventJSON(eventType, object string) string {
+	return fmt.Sprintf(`{"type":%q,"object":%s}`, eventType, object)
+}
+
+func lookup(t *testing.T, p *provider, ip string) *cloudTypes.Instance {
+	instances, err := p.Instances(ip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return instances[ip]
+}
+
+// waitFor waits for the condition to be true, as watch events are applied asynchronously.
+func waitFor(t *testing.T, condition func() bool) {
+	for start := time.Now(); !condition(); time.Sleep(5 * time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("timed out")
+		}
+	}
+}
+
+func TestInstancesFromPods(t *testing.T) {
+	assert := assert.New(t)
+
+	s := newFakeAPIServer(
+		testPod("web-1", "uid-1", "10.1.0.1", "1"),
+		`{"metadata":{"name":"proxy","namespace":"kube-system","uid":"uid-2"},"spec":{"hostNetwork":true},"status":{"phase":"Running","podIP":"10.0.0.1"}}`,
+		`{"metadata":{"name":"job","namespace":"default","uid":"uid-3"},"status":{"phase":"Succeeded","podIP":"10.1.0.3"}}`,
+	)
+	defer s.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	p, err := newProvider(ctx, &restConfig{host: s.URL, token: "secret"}, Options{NodeName: "node-1", Labels: []string{"app"}, Annotations: []string{"t*"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	instances, err := p.Instances("10.1.0.1", "10.0.0.1", "10.1.0.3", "10.1.0.4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(map[string]*cloudTypes.Instance{
+		"10.1.0.1": {
+			ID:   "web-1",
+			Tags: []string{"namespace:default", "node:node-1", "owner_kind:replicaset", "owner:web-abc", "app:web", "team:infra"},
+		},
+	}, instances)
+
+	s.mu.Lock()
+	r := s.requests[0]
+	s.mu.Unlock()
+	assert.Equal("/api/v1/pods", r.URL.Path)
+	assert.Equal("spec.nodeName=node-1", r.URL.Query().Get("fieldSelector"))
+	assert.Equal("Bearer secret", r.Header.Get("Authorization"))
+}
+
+func TestAppendMatching(t *testing.T) {
+	labels := map[string]string{"app": "web", "app.kubernetes.io/name": "web", "app.kubernetes.io/part-of": "shop", "tier": "front"}
+	for _, tc := range []struct {
+		patterns []string
+		expected types.Tags
+	}{
+		{nil, nil},
+		{[]string{"app"}, types.Tags{"app:web"}},
+		{[]string{"app*"}, types.Tags{"app:web", "app_kubernetes_io/name:web", "app_kubernetes_io/part-of:shop"}}, // * matches /
+		{[]string{"*/name", "t?er"}, types.Tags{"app_kubernetes_io/name:web", "tier:front"}},
+	} {
+		assert.Equal(t, tc.expected, appendMatching(nil, tc.patterns, labels), "%q", tc.patterns)
+	}
+}
+
+func TestInstancesWatchesPods(t *testing.T) {
+	assert := assert.New(t)
+
+	s := newFakeAPIServer(testPod("web-1", "uid-1", "10.1.0.1", "1"))
+	defer s.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	p, err := newProvider(ctx, &restConfig{host: s.URL, token: "secret"}, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NotNil(lookup(t, p, "10.1.0.1"))
+
+	s.events <- watchEventJSON("ADDED", testPod("web-2", "uid-2", "10.1.0.2", "2"))
+	waitFor(t, func() bool { return lookup(t, p, "10.1.0.2") != nil })
+	assert.Equal("web-2", lookup(t, p, "10.1.0.2").ID)
+
+	// The IP address of a deleted pod was reused by a new pod before the deletion was seen
+	s.events <- watchEventJSON("ADDED", testPod("web-3", "uid-3", "10.1.0.1", "3"))
+	s.events <- watchEventJSON("DELETED", testPod("web-1", "uid-1", "10.1.0.1", "4"))
+	s.events <- watchEventJSON("DELETED", testPod("web-2", "uid-2", "10.1.0.2", "5"))
+	waitFor(t, func() bool { return lookup(t, p, "10.1.0.2") == nil })
+	assert.Equal("web-3", lookup(t, p, "10.1.0.1").ID)
+
+	// The watch resumes from the last resource version when the API server closes it
+	s.events <- ""
+	s.events <- watchEventJSON("MODIFIED", `{"metadata":{"name":"web-3","uid":"uid-3","resourceVersion":"6"},"status":{"phase":"Failed","podIP":"10.1.0.1"}}`)
+	waitFor(t, func() bool { return lookup(t, p, "10.1.0.1") == nil })
+	assert.Equal(1, s.listCount())
+	s.mu.Lock()
+	assert.Equal("5", s.requests[len(s.requests)-1].URL.Query().Get("resourceVersion"))
+	s.mu.Unlock()
+}
+
+func TestInstancesRelistsWhenResourceVersionIsGone(t *testing.T) {
+	assert := assert.New(t)
+
+	s := newFakeAPIServer(testPod("web-1", "uid-1", "10.1.0.1", "1"))
+	defer s.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	p, err := newProvider(ctx, &restConfig{host: s.URL, token: "secret"}, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NotNil(lookup(t, p, "10.1.0.1"))
+
+	s.setPods(testPod("web-2", "uid-2", "10.1.0.2", "2"))
+	s.events <- watchEventJSON("ERROR", `{"kind":"Status","code":410,"message":"too old resource version"}`)
+	waitFor(t, func() bool { return lookup(t, p, "10.1.0.2") != nil })
+	assert.Nil(lookup(t, p, "10.1.0.1"))
+	assert.Equal(2, s.listCount())
+}
+
+func TestInstancesSyncTimeout(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"message":"forbidden"}`, http.StatusForbidden)
+	}))
+	defer s.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	p, err := newProvider(ctx, &restConfig{host: s.URL}, Options{SyncTimeout: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = p.Instances("10.1.0.1")
+	assert.Error(t, err)
+}
+
+func TestKubeconfigConfig(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "kubeconfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err = ioutil.WriteFile(filepath.Join(dir, "token"), []byte("from-file\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "config")
+	config := `
+current-context: dev
+clusters:
+- name: dev
+  cluster:
+    server: https://dev.example.com/
+- name: prod
+  cluster:
+    server: https://prod.example.com
+    insecure-skip-tls-verify: true
+users:
+- name: dev
+  user:
+    token: dev-token
+- name: prod
+  user:
+    tokenFile: token
+contexts:
+- name: dev
+  context:
+    cluster: dev
+    user: dev
+- name: prod
+  context:
+    cluster: prod
+    user: prod
+`
+	if err = ioutil.WriteFile(path, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := kubeconfigConfig(path, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal("https://dev.example.com", cfg.host)
+	assert.Equal("dev-token", cfg.token)
+
+	cfg, err = kubeconfigConfig(path, "prod")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal("https://prod.example.com", cfg.host)
+	assert.Equal(filepath.Join(dir, "token"), cfg.tokenFile)
+	assert.True(cfg.tls.InsecureSkipVerify)
+
+	_, err = kubeconfigConfig(path, "missing")
+	assert.Error(err)
+}
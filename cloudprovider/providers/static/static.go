@@ -0,0 +1,267 @@
+package static
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	cloudTypes "github.com/atlassian/gostatsd/cloudprovider/types"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/spf13/viper"
+	"golang.org/x/net/context"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	// ProviderName is the name of the static cloud provider.
+	ProviderName = "static"
+	// MaxInstancesBatch is the maximum number of IP addresses looked up in a single call to Instances.
+	MaxInstancesBatch = 1000
+	// DefaultReloadInterval is the default interval between checks of the file for changes.
+	DefaultReloadInterval = 10 * time.Second
+)
+
+const sampleConfig = `
+[static]
+	# YAML or JSON file mapping IP addresses and CIDR ranges to instances, JSON if its extension is .json
+	file = "/etc/gostatsd/hosts.yaml"
+
+	# interval between checks of the file for changes
+	reload_interval = "10s" # optional, default to 10s
+`
+
+// Host maps IP addresses and CIDR ranges to the details of an instance.
+type Host struct {
+	IPs    []string `yaml:"ips" json:"ips"`       // IP addresses or CIDR ranges, e.g. 10.0.0.1 or 10.1.0.0/16
+	ID     string   `yaml:"id" json:"id"`         // ID of the instance, the IP address looked up if empty
+	Region string   `yaml:"region" json:"region"` // Region of the instance, optional
+	Tags   []string `yaml:"tags" json:"tags"`     // Tags of the instance, e.g. role:db
+}
+
+// hostsFile is the content of a hosts file.
+type hostsFile struct {
+	Hosts []Host `yaml:"hosts" json:"hosts"`
+}
+
+// table looks up the hosts of IP addresses. An IP address matches an exact entry first, then the
+// smallest CIDR range it belongs to.
+type table struct {
+	ips    map[string]*cloudTypes.Instance
+	ranges []hostRange // Smallest ranges first
+}
+
+type hostRange struct {
+	network  *net.IPNet
+	instance *cloudTypes.Instance
+}
+
+func newTable(hosts []Host) (*table, error) {
+	t := &table{ips: make(map[string]*cloudTypes.Instance)}
+	for i, host := range hosts {
+		if len(host.IPs) == 0 {
+			return nil, fmt.Errorf("host %d has no IP address", i)
+		}
+		instance := &cloudTypes.Instance{ID: host.ID, Region: host.Region, Tags: host.Tags}
+		for _, s := range host.IPs {
+			if strings.Contains(s, "/") {
+				_, network, err := net.ParseCIDR(s)
+				if err != nil {
+					return nil, fmt.Errorf("host %d: invalid CIDR range %q", i, s)
+				}
+				t.ranges = append(t.ranges, hostRange{network: network, instance: instance})
+				continue
+			}
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("host %d: invalid IP address %q", i, s)
+			}
+			if _, ok := t.ips[ip.String()]; ok {
+				return nil, fmt.Errorf("host %d: duplicate IP address %s", i, ip)
+			}
+			t.ips[ip.String()] = instance
+		}
+	}
+	sort.Stable(bySize(t.ranges))
+	return t, nil
+}
+
+// bySize sorts ranges from the smallest to the largest.
+type bySize []hostRange
+
+func (b bySize) Len() int      { return len(b) }
+func (b bySize) Swap(i, j int) { b[i], b[j] = b[j], b[i] }
+func (b bySize) Less(i, j int) bool {
+	oi, _ := b[i].network.Mask.Size()
+	oj, _ := b[j].network.Mask.Size()
+	return oi > oj
+}
+
+// lookup returns the instance of the IP address, nil if it matches no host.
+func (t *table) lookup(s string) *cloudTypes.Instance {
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil
+	}
+	instance, ok := t.ips[ip.String()]
+	if !ok {
+		for _, r := range t.ranges {
+			if r.network.Contains(ip) {
+				instance = r.instance
+				break
+			}
+		}
+	}
+	if instance == nil || instance.ID != "" {
+		return instance
+	}
+	return &cloudTypes.Instance{ID: s, Region: instance.Region, Tags: instance.Tags}
+}
+
+// provider looks up instances in a table of hosts.
+type provider struct {
+	mu    sync.RWMutex
+	table *table
+}
+
+// ProviderName returns the name of the provider.
+func (p *provider) ProviderName() string {
+	return ProviderName
+}
+
+// SampleConfig returns the sample config for the static provider.
+func (p *provider) SampleConfig() string {
+	return sampleConfig
+}
+
+// MaxInstancesBatch returns the maximum number of IP addresses looked up in a single call to Instances.
+func (p *provider) MaxInstancesBatch() int {
+	return MaxInstancesBatch
+}
+
+// Instances returns the hosts matching the given IP addresses.
+func (p *provider) Instances(IPs ...string) (map[string]*cloudTypes.Instance, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	result := make(map[string]*cloudTypes.Instance, len(IPs))
+	for _, ip := range IPs {
+		if instance := p.table.lookup(ip); instance != nil {
+			result[ip] = instance
+		}
+	}
+	return result, nil
+}
+
+func (p *provider) setTable(t *table) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.table = t
+}
+
+// New returns a static provider looking up the given hosts.
+func New(hosts ...Host) (cloudTypes.Interface, error) {
+	t, err := newTable(hosts)
+	if err != nil {
+		return nil, err
+	}
+	return &provider{table: t}, nil
+}
+
+// ReadHostsFile reads the hosts from a YAML file, or a JSON file if its extension is .json.
+func ReadHostsFile(path string) ([]Host, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var f hostsFile
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		err = json.Unmarshal(data, &f)
+	} else {
+		err = yaml.Unmarshal(data, &f)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid hosts file %s: %v", path, err)
+	}
+	return f.Hosts, nil
+}
+
+// readTableIfModified returns the table of the hosts file if it was modified after modTime
+// and the modification time of the file.
+func readTableIfModified(path string, modTime time.Time) (*table, time.Time, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, modTime, err
+	}
+	if !modTime.IsZero() && info.ModTime().Equal(modTime) {
+		return nil, modTime, nil
+	}
+	hosts, err := ReadHostsFile(path)
+	if err != nil {
+		return nil, modTime, err
+	}
+	t, err := newTable(hosts)
+	if err != nil {
+		return nil, modTime, fmt.Errorf("invalid hosts file %s: %v", path, err)
+	}
+	return t, info.ModTime(), nil
+}
+
+// watch checks the hosts file every interval and reloads it when it is modified, until the context is done.
+// Errors are logged and the previous hosts are kept.
+func (p *provider) watch(ctx context.Context, path string, modTime time.Time, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			t, mt, err := readTableIfModified(path, modTime)
+			if err != nil {
+				log.Warnf("[%s] Error reading hosts file: %v", ProviderName, err)
+				continue
+			}
+			if t != nil {
+				p.setTable(t)
+				log.Infof("[%s] Reloaded hosts file %s", ProviderName, path)
+			}
+			modTime = mt
+		}
+	}
+}
+
+// newProvider returns a provider reading the hosts file, then reloading it every interval if it is
+// modified until the context is done.
+func newProvider(ctx context.Context, path string, interval time.Duration) (*provider, error) {
+	if path == "" {
+		return nil, fmt.Errorf("missing hosts file")
+	}
+	if interval <= 0 {
+		return nil, fmt.Errorf("invalid reload interval %v: must be positive", interval)
+	}
+	t, modTime, err := readTableIfModified(path, time.Time{})
+	if err != nil {
+		return nil, err
+	}
+	p := &provider{table: t}
+	go p.watch(ctx, path, modTime, interval)
+	return p, nil
+}
+
+// NewProvider returns a new static provider reading the hosts file, reloaded when it is modified.
+func NewProvider(path string, reloadInterval time.Duration) (cloudTypes.Interface, error) {
+	return newProvider(context.Background(), path, reloadInterval)
+}
+
+// NewProviderFromViper returns a new static provider.
+func NewProviderFromViper(v *viper.Viper) (cloudTypes.Interface, error) {
+	v.SetDefault("static.reload_interval", DefaultReloadInterval)
+	return NewProvider(v.GetString("static.file"), v.GetDuration("static.reload_interval"))
+}
@@ -0,0 +1,153 @@
+package static
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	cloudTypes "github.com/atlassian/gostatsd/cloudprovider/types"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+func TestInstances(t *testing.T) {
+	assert := assert.New(t)
+
+	p, err := New(
+		Host{IPs: []string{"10.0.0.0/8"}, Region: "dc1", Tags: []string{"network:internal"}},
+		Host{IPs: []string{"10.1.0.0/16", "fd00::/64"}, ID: "rack-1", Region: "dc1", Tags: []string{"rack:1"}},
+		Host{IPs: []string{"10.1.0.1"}, ID: "db-1", Region: "dc1", Tags: []string{"role:db"}},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	instances, err := p.Instances("10.1.0.1", "10.1.0.2", "10.2.0.1", "fd00::1", "192.168.0.1", "invalid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(map[string]*cloudTypes.Instance{
+		"10.1.0.1": {ID: "db-1", Region: "dc1", Tags: []string{"role:db"}},
+		"10.1.0.2": {ID: "rack-1", Region: "dc1", Tags: []string{"rack:1"}},
+		"10.2.0.1": {ID: "10.2.0.1", Region: "dc1", Tags: []string{"network:internal"}},
+		"fd00::1":  {ID: "rack-1", Region: "dc1", Tags: []string{"rack:1"}},
+	}, instances)
+}
+
+func TestInvalidHosts(t *testing.T) {
+	assert := assert.New(t)
+
+	_, err := New(Host{ID: "no-ip"})
+	assert.Error(err)
+	_, err = New(Host{IPs: []string{"10.0.0.256"}})
+	assert.Error(err)
+	_, err = New(Host{IPs: []string{"10.0.0.0/33"}})
+	assert.Error(err)
+	_, err = New(Host{IPs: []string{"10.0.0.1"}}, Host{IPs: []string{"10.0.0.1"}})
+	assert.Error(err)
+}
+
+func TestReadHostsFile(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "hosts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	yamlPath := filepath.Join(dir, "hosts.yaml")
+	yamlHosts := `
+hosts:
+- ips: [10.0.0.1, 10.1.0.0/16]
+  id: db-1
+  region: dc1
+  tags: ["role:db"]
+`
+	if err = ioutil.WriteFile(yamlPath, []byte(yamlHosts), 0644); err != nil {
+		t.Fatal(err)
+	}
+	jsonPath := filepath.Join(dir, "hosts.json")
+	jsonHosts := `{"hosts": [{"ips": ["10.0.0.1", "10.1.0.0/16"], "id": "db-1", "region": "dc1", "tags": ["role:db"]}]}`
+	if err = ioutil.WriteFile(jsonPath, []byte(jsonHosts), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []Host{{IPs: []string{"10.0.0.1", "10.1.0.0/16"}, ID: "db-1", Region: "dc1", Tags: []string{"role:db"}}}
+	hosts, err := ReadHostsFile(yamlPath)
+	assert.NoError(err)
+	assert.Equal(expected, hosts)
+	hosts, err = ReadHostsFile(jsonPath)
+	assert.NoError(err)
+	assert.Equal(expected, hosts)
+
+	if err = ioutil.WriteFile(jsonPath, []byte(yamlHosts), 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, err = ReadHostsFile(jsonPath)
+	assert.Error(err)
+}
+
+func TestProviderReloadsHostsFile(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "hosts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "hosts.yaml")
+	write := func(content string, modTime time.Time) {
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		// Make sure the modification time changes on file systems with a coarse resolution
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var p *provider
+	lookup := func() string {
+		instances, err := p.Instances("10.0.0.1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i := instances["10.0.0.1"]; i != nil {
+			return i.ID
+		}
+		return ""
+	}
+	now := time.Now()
+	write("hosts: [{ips: [10.0.0.1], id: host-1}]", now)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	p, err = newProvider(ctx, path, 10*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal("host-1", lookup())
+
+	waitFor := func(id string) {
+		for start := time.Now(); lookup() != id; time.Sleep(5 * time.Millisecond) {
+			if time.Since(start) > 5*time.Second {
+				t.Fatalf("timed out waiting for %s", id)
+			}
+		}
+	}
+	write("hosts: [{ips: [10.0.0.1], id: host-2}]", now.Add(time.Minute))
+	waitFor("host-2")
+
+	// An invalid file is ignored until it is fixed
+	write("hosts: [{ips: [10.0.0.1/99], id: host-3}]", now.Add(2*time.Minute))
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal("host-2", lookup())
+	write("hosts: [{ips: [10.0.0.1], id: host-4}]", now.Add(3*time.Minute))
+	waitFor("host-4")
+}
+
+func TestNewProviderInvalidFile(t *testing.T) {
+	_, err := NewProvider(filepath.Join(os.TempDir(), "missing-hosts.yaml"), DefaultReloadInterval)
+	assert.Error(t, err)
+}
@@ -0,0 +1,14 @@
+package types
+
+import (
+	"path"
+	"strings"
+)
+
+// MatchPattern reports whether name matches the shell pattern. The syntax is that of path.Match, except that
+// * and ? also match /, which is common in the keys of tags and labels, e.g. app.kubernetes.io/name.
+// The only possible returned error is path.ErrBadPattern, when pattern is malformed.
+func MatchPattern(pattern, name string) (bool, error) {
+	// path.Match treats / as a separator, any other character is matched by * and ?
+	return path.Match(strings.Replace(pattern, "/", "\x00", -1), strings.Replace(name, "/", "\x00", -1))
+}
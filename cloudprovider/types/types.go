@@ -11,9 +11,10 @@ type Factory func(*viper.Viper) (Interface, error)
 
 // Instance represents a cloud instance.
 type Instance struct {
-	ID     string
-	Region string
-	Tags   types.Tags
+	ID       string
+	Region   string
+	Tags     types.Tags
+	Provider string // Names of the providers that resolved the instance when chained, joined with +
 }
 
 // Interface represents a cloud provider.
@@ -22,6 +23,12 @@ type Interface interface {
 	ProviderName() string
 	// SampleConfig returns the sample config for the cloud provider.
 	SampleConfig() string
-	// Instance returns the instance details from the cloud provider.
-	Instance(IP string) (*Instance, error)
+	// MaxInstancesBatch returns the maximum number of IP addresses looked up in a single call to Instances.
+	MaxInstancesBatch() int
+	// Instances returns the details of the instances with the given IP addresses from the cloud provider,
+	// by IP address. The IP addresses that do not belong to an instance are not in the result.
+	// Senders on a unix socket are looked up as pid:<pid> instead of an IP address, providers that do
+	// not know about processes leave them out of the result.
+	// When the lookup of some IP addresses fails, the instances found are returned with the error.
+	Instances(IPs ...string) (map[string]*Instance, error)
 }
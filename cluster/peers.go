@@ -0,0 +1,82 @@
+package cluster
+
+import (
+	"bufio"
+	"os"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"golang.org/x/net/context"
+)
+
+// DefaultPeersFileInterval is the default interval between checks of the peers file for changes.
+const DefaultPeersFileInterval = 10 * time.Second
+
+// ReadPeersFile reads the addresses of the peers from a file, one per line.
+// Blank lines and lines starting with # are ignored.
+func ReadPeersFile(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var peers []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		peers = append(peers, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return peers, nil
+}
+
+// WatchPeersFile reads the peers file and calls f with its content, then checks the file every interval
+// and calls f again each time it is modified, until the context is done.
+// An error is returned if the file cannot be read initially; later errors are logged and the previous
+// peers are kept.
+func WatchPeersFile(ctx context.Context, path string, interval time.Duration, f func([]string)) error {
+	modTime, err := readIfModified(path, time.Time{}, f)
+	if err != nil {
+		return err
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+			t, err := readIfModified(path, modTime, f)
+			if err != nil {
+				log.Warnf("Error reading cluster peers file %s: %v", path, err)
+				continue
+			}
+			modTime = t
+		}
+	}
+}
+
+// readIfModified calls f with the peers of the file if it was modified after modTime
+// and returns the modification time of the file.
+func readIfModified(path string, modTime time.Time, f func([]string)) (time.Time, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return modTime, err
+	}
+	if !modTime.IsZero() && info.ModTime().Equal(modTime) {
+		return modTime, nil
+	}
+	peers, err := ReadPeersFile(path)
+	if err != nil {
+		return modTime, err
+	}
+	f(peers)
+	return info.ModTime(), nil
+}
@@ -0,0 +1,70 @@
+package cluster
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+func TestReadPeersFile(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "peers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "peers")
+	if err = ioutil.WriteFile(path, []byte("# nodes\na:8127\n\n  b:8127  \n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	peers, err := ReadPeersFile(path)
+	assert.NoError(err)
+	assert.Equal([]string{"a:8127", "b:8127"}, peers)
+
+	_, err = ReadPeersFile(filepath.Join(dir, "missing"))
+	assert.Error(err)
+}
+
+func TestWatchPeersFile(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "peers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "peers")
+	if err = ioutil.WriteFile(path, []byte("a:8127\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	updates := make(chan []string, 10)
+	go WatchPeersFile(ctx, path, 10*time.Millisecond, func(peers []string) {
+		updates <- peers
+	})
+	assert.Equal([]string{"a:8127"}, <-updates)
+
+	if err = ioutil.WriteFile(path, []byte("a:8127\nb:8127\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// Make sure the modification time changes on file systems with a coarse resolution
+	future := time.Now().Add(time.Minute)
+	if err = os.Chtimes(path, future, future); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case peers := <-updates:
+		assert.Equal([]string{"a:8127", "b:8127"}, peers)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the peers to be reloaded")
+	}
+}
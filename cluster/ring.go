@@ -0,0 +1,142 @@
+package cluster
+
+import (
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// DefaultReplicas is the default number of points of each node on the ring.
+const DefaultReplicas = 128
+
+// Ring is a consistent hash ring mapping series to the nodes of a cluster.
+// Each node is placed on the ring several times so that series are spread evenly and only
+// the series of the nodes that join or leave move when the membership changes.
+// It is safe for concurrent use.
+type Ring struct {
+	mu       sync.RWMutex
+	replicas int
+	nodes    []string
+	hashes   []uint32 // Sorted points of the ring
+	owners   map[uint32]string
+}
+
+// NewRing creates a new empty Ring with the given number of points per node.
+func NewRing(replicas int) *Ring {
+	if replicas <= 0 {
+		replicas = DefaultReplicas
+	}
+	return &Ring{
+		replicas: replicas,
+		owners:   make(map[uint32]string),
+	}
+}
+
+// SetNodes replaces the nodes of the ring. It returns whether the membership changed.
+func (r *Ring) SetNodes(nodes []string) bool {
+	sorted := make([]string, 0, len(nodes))
+	seen := make(map[string]bool, len(nodes))
+	for _, node := range nodes {
+		if node != "" && !seen[node] {
+			seen[node] = true
+			sorted = append(sorted, node)
+		}
+	}
+	sort.Strings(sorted)
+
+	hashes := make([]uint32, 0, len(sorted)*r.replicas)
+	owners := make(map[uint32]string, len(sorted)*r.replicas)
+	for _, node := range sorted {
+		for i := 0; i < r.replicas; i++ {
+			h := hashString(node + "#" + strconv.Itoa(i))
+			// On collision the smallest node wins, so all the nodes build the same ring
+			if owner, ok := owners[h]; ok && owner < node {
+				continue
+			} else if !ok {
+				hashes = append(hashes, h)
+			}
+			owners[h] = node
+		}
+	}
+	sort.Sort(uint32Slice(hashes))
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if equalStrings(r.nodes, sorted) {
+		return false
+	}
+	r.nodes = sorted
+	r.hashes = hashes
+	r.owners = owners
+	return true
+}
+
+// Nodes returns the sorted nodes of the ring.
+func (r *Ring) Nodes() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.nodes
+}
+
+// Owner returns the node owning the series identified by the metric name and the key of its tags.
+// It returns an empty string if the ring has no nodes.
+func (r *Ring) Owner(name, tagsKey string) string {
+	h := seriesHash(name, tagsKey)
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if len(r.hashes) == 0 {
+		return ""
+	}
+	i := sort.Search(len(r.hashes), func(i int) bool { return r.hashes[i] >= h })
+	if i == len(r.hashes) {
+		i = 0 // Wrap around
+	}
+	return r.owners[r.hashes[i]]
+}
+
+const (
+	fnvOffset32 = 2166136261
+	fnvPrime32  = 16777619
+)
+
+// seriesHash computes FNV-1a over the name and the tags of a series without allocating.
+func seriesHash(name, tagsKey string) uint32 {
+	h := uint32(fnvOffset32)
+	for i := 0; i < len(name); i++ {
+		h ^= uint32(name[i])
+		h *= fnvPrime32
+	}
+	h ^= '|'
+	h *= fnvPrime32
+	for i := 0; i < len(tagsKey); i++ {
+		h ^= uint32(tagsKey[i])
+		h *= fnvPrime32
+	}
+	return h
+}
+
+func hashString(s string) uint32 {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(s))
+	return h.Sum32()
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+type uint32Slice []uint32
+
+func (s uint32Slice) Len() int           { return len(s) }
+func (s uint32Slice) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s uint32Slice) Less(i, j int) bool { return s[i] < s[j] }
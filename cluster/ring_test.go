@@ -0,0 +1,87 @@
+package cluster
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRingEmpty(t *testing.T) {
+	r := NewRing(0)
+	assert.Equal(t, "", r.Owner("foo", ""))
+}
+
+func TestRingIsConsistent(t *testing.T) {
+	assert := assert.New(t)
+
+	r1 := NewRing(DefaultReplicas)
+	r2 := NewRing(DefaultReplicas)
+	assert.True(r1.SetNodes([]string{"a:8127", "b:8127", "c:8127"}))
+	assert.True(r2.SetNodes([]string{"c:8127", "a:8127", "b:8127", "a:8127"}))
+	assert.False(r2.SetNodes([]string{"b:8127", "c:8127", "a:8127"}))
+	assert.Equal([]string{"a:8127", "b:8127", "c:8127"}, r1.Nodes())
+
+	for i := 0; i < 1000; i++ {
+		name := fmt.Sprintf("metric.%d", i)
+		assert.Equal(r1.Owner(name, "env:prod"), r2.Owner(name, "env:prod"))
+	}
+}
+
+func TestRingDistribution(t *testing.T) {
+	r := NewRing(DefaultReplicas)
+	r.SetNodes([]string{"a:8127", "b:8127", "c:8127"})
+
+	counts := make(map[string]int)
+	const n = 30000
+	for i := 0; i < n; i++ {
+		counts[r.Owner(fmt.Sprintf("metric.%d", i), "")]++
+	}
+	for node, count := range counts {
+		if count < n/6 || count > n/2 {
+			t.Errorf("node %s owns %d of %d series", node, count, n)
+		}
+	}
+}
+
+func TestRingRebalance(t *testing.T) {
+	assert := assert.New(t)
+
+	r := NewRing(DefaultReplicas)
+	r.SetNodes([]string{"a:8127", "b:8127", "c:8127"})
+	const n = 10000
+	before := make([]string, n)
+	for i := range before {
+		before[i] = r.Owner(fmt.Sprintf("metric.%d", i), "")
+	}
+
+	// Only the series moving to the new node change owner
+	assert.True(r.SetNodes([]string{"a:8127", "b:8127", "c:8127", "d:8127"}))
+	moved := 0
+	for i := range before {
+		owner := r.Owner(fmt.Sprintf("metric.%d", i), "")
+		if owner != before[i] {
+			assert.Equal("d:8127", owner)
+			moved++
+		}
+	}
+	if moved < n/8 || moved > n/2 {
+		t.Errorf("%d of %d series moved", moved, n)
+	}
+
+	// Removing the node moves its series back
+	assert.True(r.SetNodes([]string{"a:8127", "b:8127", "c:8127"}))
+	for i := range before {
+		assert.Equal(before[i], r.Owner(fmt.Sprintf("metric.%d", i), ""))
+	}
+}
+
+func BenchmarkRingOwner(b *testing.B) {
+	r := NewRing(DefaultReplicas)
+	r.SetNodes([]string{"a:8127", "b:8127", "c:8127"})
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		r.Owner("foo.bar.baz", "env:prod,statsd_source_id:10.0.0.1")
+	}
+}
@@ -12,9 +12,9 @@ echo "mode: count" > coverage.out
 ERROR=""
 
 declare -a packages=('backend' 'backend/types' \
-    'backend/backends/datadog' 'backend/backends/graphite' 'backend/backends/null' \
+    'backend/backends/datadog' 'backend/backends/forwarder' 'backend/backends/graphite' 'backend/backends/null' \
     'backend/backends/statsdaemon' 'backend/backends/stdout' \
-    'cloudprovider' 'cloudprovider/providers/aws' 'cloudprovider/types' \
+    'cloudprovider' 'cloudprovider/providers/aws' 'cloudprovider/types' 'cluster' \
     'statsd' 'types');
 
 # Test each package and append coverage profile info to coverage.out
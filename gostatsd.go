@@ -7,6 +7,7 @@ import (
 	"strings"
 	"syscall"
 
+	"github.com/atlassian/gostatsd/cloudprovider"
 	"github.com/atlassian/gostatsd/statsd"
 
 	log "github.com/Sirupsen/logrus"
@@ -61,21 +62,85 @@ func main() {
 	defer cancelFunc()
 	cancelOnInterrupt(ctx, cancelFunc)
 
+	var percentThresholdOverrides []statsd.PercentThresholdOverride
+	if err := v.UnmarshalKey(statsd.ParamPercentThresholdOverrides, &percentThresholdOverrides); err != nil {
+		augmentErr(&exitErr, fmt.Errorf("Invalid %s: %v", statsd.ParamPercentThresholdOverrides, err))
+		return
+	}
+
+	idlePolicies, err := statsd.ParseIdlePolicies(
+		v.GetString(statsd.ParamIdleCounters),
+		v.GetString(statsd.ParamIdleTimers),
+		v.GetString(statsd.ParamIdleGauges),
+		v.GetString(statsd.ParamIdleSets),
+	)
+	if err != nil {
+		augmentErr(&exitErr, err)
+		return
+	}
+
+	latePolicy, err := statsd.ParseLatePolicy(v.GetString(statsd.ParamLateMetrics))
+	if err != nil {
+		augmentErr(&exitErr, err)
+		return
+	}
+	timestampPolicy := statsd.TimestampPolicy{
+		Late:      latePolicy,
+		Tolerance: v.GetDuration(statsd.ParamTimestampTolerance),
+	}
+
+	unresolvedPolicy, err := statsd.ParseUnresolvedPolicy(v.GetString(statsd.ParamCloudUnresolved))
+	if err != nil {
+		augmentErr(&exitErr, err)
+		return
+	}
+
+	cloudChainPolicy, err := cloudprovider.ParseChainPolicy(v.GetString(statsd.ParamCloudChain))
+	if err != nil {
+		augmentErr(&exitErr, err)
+		return
+	}
+
+	cloudCacheOptions := cloudprovider.CacheOptions{
+		TTL:          v.GetDuration(statsd.ParamCloudCacheTTL),
+		NegativeTTL:  v.GetDuration(statsd.ParamCloudCacheNegativeTTL),
+		RefreshAhead: v.GetDuration(statsd.ParamCloudCacheRefreshAhead),
+		MaxEntries:   v.GetInt(statsd.ParamCloudCacheMaxEntries),
+	}
+
 	log.Info("Starting server")
 	s := statsd.Server{
-		Backends:         toSlice(v.GetString(statsd.ParamBackends)),
-		ConsoleAddr:      v.GetString(statsd.ParamConsoleAddr),
-		CloudProvider:    v.GetString(statsd.ParamCloudProvider),
-		DefaultTags:      toSlice(v.GetString(statsd.ParamDefaultTags)),
-		ExpiryInterval:   v.GetDuration(statsd.ParamExpiryInterval),
-		FlushInterval:    v.GetDuration(statsd.ParamFlushInterval),
-		MaxReaders:       v.GetInt(statsd.ParamMaxReaders),
-		MaxWorkers:       v.GetInt(statsd.ParamMaxWorkers),
-		MetricsAddr:      v.GetString(statsd.ParamMetricsAddr),
-		Namespace:        v.GetString(statsd.ParamNamespace),
-		PercentThreshold: toSlice(v.GetString(statsd.ParamPercentThreshold)),
-		WebConsoleAddr:   v.GetString(statsd.ParamWebAddr),
-		Viper:            v,
+		Backends:                  toSlice(v.GetString(statsd.ParamBackends)),
+		ClusterPeers:              toSlice(v.GetString(statsd.ParamClusterPeers)),
+		ClusterPeersFile:          v.GetString(statsd.ParamClusterPeersFile),
+		ClusterSelf:               v.GetString(statsd.ParamClusterSelf),
+		ConsoleAddr:               v.GetString(statsd.ParamConsoleAddr),
+		CloudProviders:            toSlice(v.GetString(statsd.ParamCloudProvider)),
+		CloudChainPolicy:          cloudChainPolicy,
+		CloudCacheOptions:         cloudCacheOptions,
+		CloudHoldTimeout:          v.GetDuration(statsd.ParamCloudHoldTimeout),
+		CloudLookupWorkers:        v.GetInt(statsd.ParamCloudLookupWorkers),
+		CloudUnresolvedPolicy:     unresolvedPolicy,
+		DefaultTags:               toSlice(v.GetString(statsd.ParamDefaultTags)),
+		ExpiryInterval:            v.GetDuration(statsd.ParamExpiryInterval),
+		FlushAligned:              v.GetBool(statsd.ParamFlushAligned),
+		FlushInterval:             v.GetDuration(statsd.ParamFlushInterval),
+		IdlePolicies:              idlePolicies,
+		IngestAddr:                v.GetString(statsd.ParamIngestAddr),
+		IngestSecret:              v.GetString(statsd.ParamIngestSecret),
+		MaxReaders:                v.GetInt(statsd.ParamMaxReaders),
+		MaxWorkers:                v.GetInt(statsd.ParamMaxWorkers),
+		MetricsAddr:               v.GetString(statsd.ParamMetricsAddr),
+		MetricsSocket:             v.GetString(statsd.ParamMetricsSocket),
+		Namespace:                 v.GetString(statsd.ParamNamespace),
+		PercentThreshold:          toSlice(v.GetString(statsd.ParamPercentThreshold)),
+		PercentThresholdOverrides: percentThresholdOverrides,
+		ShutdownTimeout:           v.GetDuration(statsd.ParamShutdownTimeout),
+		SnapshotFile:              v.GetString(statsd.ParamSnapshotFile),
+		SnapshotInterval:          v.GetDuration(statsd.ParamSnapshotInterval),
+		TimestampPolicy:           timestampPolicy,
+		WebConsoleAddr:            v.GetString(statsd.ParamWebAddr),
+		Viper:                     v,
 	}
 	if err := s.Run(ctx); err != nil && err != context.Canceled {
 		augmentErr(&exitErr, fmt.Errorf("Server error: %v", err))
@@ -20,7 +20,9 @@ type ProcessFunc func(*types.MetricMap)
 // Incoming metrics should be passed via Receive function.
 type Aggregator interface {
 	Receive(*types.Metric, time.Time)
+	ReceiveMap(*types.MetricMap, time.Time)
 	Flush(func() time.Time) *types.MetricMap
+	FlushBuckets(func() time.Time) []*types.MetricMap
 	Process(ProcessFunc)
 	Reset(time.Time)
 }
@@ -28,23 +30,29 @@ type Aggregator interface {
 type aggregator struct {
 	expiryInterval    time.Duration // How often to expire metrics
 	lastFlush         time.Time     // Last time the metrics where aggregated
-	percentThresholds []float64
-	defaultTags       string // Tags to add to system metrics
+	percentThresholds *PercentThresholds
+	idlePolicies      IdlePolicies
+	timestampPolicy   TimestampPolicy
+	buckets           map[int64]*aggregator // Late and early metrics by start of their flush interval, in nsec
+	timestamp         time.Time             // Start of the flush interval of a bucket, zero for the current interval
+	defaultTags       *types.TagSet         // Tags to add to system metrics
 	types.MetricMap
 }
 
 // NewAggregator creates a new Aggregator object.
-func NewAggregator(percentThresholds []float64, flushInterval, expiryInterval time.Duration, defaultTags []string) Aggregator {
+func NewAggregator(percentThresholds *PercentThresholds, idlePolicies IdlePolicies, timestampPolicy TimestampPolicy, flushInterval, expiryInterval time.Duration, defaultTags []string) Aggregator {
 	a := aggregator{}
 	a.FlushInterval = flushInterval
 	a.lastFlush = time.Now()
 	a.expiryInterval = expiryInterval
 	a.percentThresholds = percentThresholds
+	a.idlePolicies = idlePolicies
+	a.timestampPolicy = timestampPolicy
 	a.Counters = types.Counters{}
 	a.Timers = types.Timers{}
 	a.Gauges = types.Gauges{}
 	a.Sets = types.Sets{}
-	a.defaultTags = types.Tags(defaultTags).String()
+	a.defaultTags = types.NewTagSet(defaultTags)
 	return &a
 }
 
@@ -58,17 +66,25 @@ func round(v float64) float64 {
 func (a *aggregator) Flush(now func() time.Time) *types.MetricMap {
 	startTime := now()
 	flushInterval := startTime.Sub(a.lastFlush)
-
-	statName := internalStatName("aggregator_num_stats")
-	a.receiveCounter(statName, a.defaultTags, int64(a.NumStats), startTime)
+	if !a.timestamp.IsZero() {
+		// The metrics of a bucket were sent during its flush interval
+		flushInterval = a.FlushInterval
+	}
+	if a.timestamp.IsZero() {
+		statName := internalStatName("aggregator_num_stats")
+		a.receiveCounter(statName, a.defaultTags, int64(a.NumStats), startTime)
+	}
 
 	a.Counters.Each(func(key, tagsKey string, counter types.Counter) {
 		perSecond := float64(counter.Value) / flushInterval.Seconds()
 		counter.PerSecond = perSecond
+		counter.Idle = a.isIdle(counter.Timestamp)
 		a.Counters[key][tagsKey] = counter
 	})
 
 	a.Timers.Each(func(key, tagsKey string, timer types.Timer) {
+		timer.Idle = a.isIdle(timer.Timestamp)
+		timer.Percentiles = nil // Recomputed, the values of an idle timer may be flushed again
 		if count := len(timer.Values); count > 0 {
 			sort.Float64s(timer.Values)
 			timer.Min = timer.Values[0]
@@ -89,7 +105,7 @@ func (a *aggregator) Flush(now func() time.Time) *types.MetricMap {
 			var sum = timer.Min
 			var thresholdBoundary = timer.Max
 
-			for _, pct := range a.percentThresholds {
+			for _, pct := range a.percentThresholds.For(key) {
 				numInThreshold := timer.Count
 				if timer.Count > 1 {
 					numInThreshold = int(round(math.Abs(pct) / 100 * count))
@@ -102,13 +118,17 @@ func (a *aggregator) Flush(now func() time.Time) *types.MetricMap {
 						sumSquares = cumulSumSquaresValues[numInThreshold-1]
 					} else {
 						thresholdBoundary = timer.Values[timer.Count-numInThreshold]
-						sum = cumulativeValues[timer.Count-1] - cumulativeValues[timer.Count-numInThreshold-1]
-						sumSquares = cumulSumSquaresValues[timer.Count-1] - cumulSumSquaresValues[timer.Count-numInThreshold-1]
+						sum = cumulativeValues[timer.Count-1]
+						sumSquares = cumulSumSquaresValues[timer.Count-1]
+						if numInThreshold < timer.Count { // Otherwise all the values are in the threshold
+							sum -= cumulativeValues[timer.Count-numInThreshold-1]
+							sumSquares -= cumulSumSquaresValues[timer.Count-numInThreshold-1]
+						}
 					}
 					mean = sum / float64(numInThreshold)
 				}
 
-				sPct := fmt.Sprintf("%d", int(pct))
+				sPct := types.PercentThresholdName(pct)
 				timer.Percentiles.Set(fmt.Sprintf("count_%s", sPct), float64(numInThreshold))
 				timer.Percentiles.Set(fmt.Sprintf("mean_%s", sPct), mean)
 				timer.Percentiles.Set(fmt.Sprintf("sum_%s", sPct), sum)
@@ -146,19 +166,33 @@ func (a *aggregator) Flush(now func() time.Time) *types.MetricMap {
 		} else {
 			timer.Count = 0
 			timer.PerSecond = float64(0)
+			a.Timers[key][tagsKey] = timer
 		}
 	})
 
+	a.Gauges.Each(func(key, tagsKey string, gauge types.Gauge) {
+		gauge.Idle = a.isIdle(gauge.Timestamp)
+		a.Gauges[key][tagsKey] = gauge
+	})
+
+	a.Sets.Each(func(key, tagsKey string, set types.Set) {
+		set.Idle = a.isIdle(set.Timestamp)
+		a.Sets[key][tagsKey] = set
+	})
+
 	flushTime := now()
 
 	a.ProcessingTime = flushTime.Sub(startTime)
 
-	statName = internalStatName("processing_time")
-	a.receiveGauge(statName, a.defaultTags, float64(a.ProcessingTime)/float64(time.Millisecond), flushTime)
+	if a.timestamp.IsZero() {
+		statName := internalStatName("processing_time")
+		a.receiveGauge(statName, a.defaultTags, float64(a.ProcessingTime)/float64(time.Millisecond), flushTime)
+	}
 
 	a.lastFlush = flushTime
 
-	return &types.MetricMap{
+	m := &types.MetricMap{
+		Timestamp:      a.timestamp,
 		NumStats:       a.NumStats,
 		ProcessingTime: a.ProcessingTime,
 		FlushInterval:  flushInterval,
@@ -167,16 +201,92 @@ func (a *aggregator) Flush(now func() time.Time) *types.MetricMap {
 		Gauges:         a.Gauges.Clone(),
 		Sets:           a.Sets.Clone(),
 	}
+	a.skipIdle(m)
+	return m
+}
+
+// skipIdle removes the idle series of the types with the IdleSkip policy from the flushed metrics.
+func (a *aggregator) skipIdle(m *types.MetricMap) {
+	if a.idlePolicies.Counters == IdleSkip {
+		m.Counters.Each(func(key, tagsKey string, counter types.Counter) {
+			if counter.Idle {
+				deleteMetric(key, tagsKey, m.Counters)
+			}
+		})
+	}
+	if a.idlePolicies.Timers == IdleSkip {
+		m.Timers.Each(func(key, tagsKey string, timer types.Timer) {
+			if timer.Idle {
+				deleteMetric(key, tagsKey, m.Timers)
+			}
+		})
+	}
+	if a.idlePolicies.Gauges == IdleSkip {
+		m.Gauges.Each(func(key, tagsKey string, gauge types.Gauge) {
+			if gauge.Idle {
+				deleteMetric(key, tagsKey, m.Gauges)
+			}
+		})
+	}
+	if a.idlePolicies.Sets == IdleSkip {
+		m.Sets.Each(func(key, tagsKey string, set types.Set) {
+			if set.Idle {
+				deleteMetric(key, tagsKey, m.Sets)
+			}
+		})
+	}
+}
+
+// FlushBuckets flushes the late and early metrics, one MetricMap per flush interval, and forgets them.
+func (a *aggregator) FlushBuckets(now func() time.Time) []*types.MetricMap {
+	if len(a.buckets) == 0 {
+		return nil
+	}
+	result := make([]*types.MetricMap, 0, len(a.buckets))
+	for _, b := range a.buckets {
+		result = append(result, b.Flush(now))
+	}
+	a.buckets = nil
+	return result
+}
+
+// bucket returns the aggregator of the late or early metrics of the flush interval ts falls in.
+func (a *aggregator) bucket(ts time.Time) *aggregator {
+	start := ts.Truncate(a.FlushInterval)
+	b, ok := a.buckets[start.UnixNano()]
+	if !ok {
+		deleteIdle := IdlePolicies{Counters: IdleDelete, Timers: IdleDelete, Gauges: IdleDelete, Sets: IdleDelete}
+		b = NewAggregator(a.percentThresholds, deleteIdle, TimestampPolicy{}, a.FlushInterval, 0, nil).(*aggregator)
+		b.timestamp = start
+		b.lastFlush = time.Time{} // Metrics of a bucket are never idle
+		if a.buckets == nil {
+			a.buckets = make(map[int64]*aggregator)
+		}
+		a.buckets[start.UnixNano()] = b
+	}
+	return b
 }
 
 func (a *aggregator) Process(f ProcessFunc) {
 	f(&a.MetricMap)
 }
 
+// idleInterval returns the interval of a series kept by Reset, it is idle until it is updated again.
+func idleInterval(i types.Interval) types.Interval {
+	i.Idle = true
+	return i
+}
+
 func (a *aggregator) isExpired(now, ts time.Time) bool {
 	return a.expiryInterval != time.Duration(0) && now.Sub(ts) > a.expiryInterval
 }
 
+// isIdle returns whether a series last updated at ts was not updated since the last flush.
+// The values of such a series, if any, were kept from a previous interval by the IdleLast policy.
+func (a *aggregator) isIdle(ts time.Time) bool {
+	return ts.Before(a.lastFlush)
+}
+
 func deleteMetric(key, tagsKey string, metrics types.AggregatedMetrics) {
 	metrics.DeleteChild(key, tagsKey)
 	if !metrics.HasChildren(key) {
@@ -184,134 +294,249 @@ func deleteMetric(key, tagsKey string, metrics types.AggregatedMetrics) {
 	}
 }
 
-// Reset clears the contents of an Aggregator.
+// Reset clears the contents of an Aggregator according to the idle policies.
+// Series are deleted when they expire, i.e. when they have not been updated for the expiry interval.
+// The series that are kept are marked idle until they are updated again.
 func (a *aggregator) Reset(now time.Time) {
 	a.NumStats = 0
 
 	a.Counters.Each(func(key, tagsKey string, counter types.Counter) {
-		if a.isExpired(now, counter.Timestamp) {
+		switch {
+		case a.isExpired(now, counter.Timestamp), a.idlePolicies.Counters == IdleDelete:
 			deleteMetric(key, tagsKey, a.Counters)
-		} else {
-			interval := counter.Interval
-			a.Counters[key][tagsKey] = types.Counter{Interval: interval}
+		case a.idlePolicies.Counters == IdleLast:
+			// Keep the last value
+			counter.Idle = true
+			a.Counters[key][tagsKey] = counter
+		default:
+			a.Counters[key][tagsKey] = types.Counter{Interval: idleInterval(counter.Interval), TagSet: counter.TagSet}
 		}
 	})
 
 	a.Timers.Each(func(key, tagsKey string, timer types.Timer) {
-		if a.isExpired(now, timer.Timestamp) {
+		switch {
+		case a.isExpired(now, timer.Timestamp), a.idlePolicies.Timers == IdleDelete:
 			deleteMetric(key, tagsKey, a.Timers)
-		} else {
-			interval := timer.Interval
-			a.Timers[key][tagsKey] = types.Timer{Interval: interval}
+		case a.idlePolicies.Timers == IdleLast:
+			// Keep the last values
+			timer.Idle = true
+			a.Timers[key][tagsKey] = timer
+		default:
+			a.Timers[key][tagsKey] = types.Timer{Interval: idleInterval(timer.Interval), TagSet: timer.TagSet}
 		}
 	})
 
 	a.Gauges.Each(func(key, tagsKey string, gauge types.Gauge) {
-		if a.isExpired(now, gauge.Timestamp) {
+		switch {
+		case a.isExpired(now, gauge.Timestamp), a.idlePolicies.Gauges == IdleDelete:
 			deleteMetric(key, tagsKey, a.Gauges)
+		case a.idlePolicies.Gauges == IdleZero:
+			a.Gauges[key][tagsKey] = types.Gauge{Interval: idleInterval(gauge.Interval), TagSet: gauge.TagSet}
+		default:
+			// Keep the last value
+			gauge.Idle = true
+			a.Gauges[key][tagsKey] = gauge
 		}
-		// No reset for gauges, they keep the last value until expiration
 	})
 
 	a.Sets.Each(func(key, tagsKey string, set types.Set) {
-		if a.isExpired(now, set.Timestamp) {
+		switch {
+		case a.isExpired(now, set.Timestamp), a.idlePolicies.Sets == IdleDelete:
 			deleteMetric(key, tagsKey, a.Sets)
-		} else {
-			interval := set.Interval
-			a.Sets[key][tagsKey] = types.Set{Interval: interval, Values: make(map[string]int64)}
+		case a.idlePolicies.Sets == IdleLast:
+			// Keep the last values
+			set.Idle = true
+			a.Sets[key][tagsKey] = set
+		default:
+			a.Sets[key][tagsKey] = types.Set{Interval: idleInterval(set.Interval), TagSet: set.TagSet, Values: make(map[string]int64)}
 		}
 	})
 }
 
-func (a *aggregator) receiveCounter(name, tags string, value int64, now time.Time) {
+func (a *aggregator) receiveCounter(name string, tags *types.TagSet, value int64, now time.Time) {
+	tagsKey := tags.Key()
 	v, ok := a.Counters[name]
 	if ok {
-		c, ok := v[tags]
+		c, ok := v[tagsKey]
 		if ok {
+			if a.isIdle(c.Timestamp) {
+				c.Value = 0
+			}
 			c.Value += value
-			a.Counters[name][tags] = c
+			c.Timestamp = now
+			c.Idle = false
+			a.Counters[name][tagsKey] = c
 		} else {
-			a.Counters[name][tags] = types.NewCounter(now, a.FlushInterval, value)
+			a.Counters[name][tagsKey] = newCounter(now, a.FlushInterval, value, tags)
 		}
 	} else {
 		a.Counters[name] = make(map[string]types.Counter)
-		a.Counters[name][tags] = types.NewCounter(now, a.FlushInterval, value)
+		a.Counters[name][tagsKey] = newCounter(now, a.FlushInterval, value, tags)
 	}
 }
 
-func (a *aggregator) receiveGauge(name, tags string, value float64, now time.Time) {
+func (a *aggregator) receiveGauge(name string, tags *types.TagSet, value float64, now time.Time) {
 	// TODO: handle +/-
+	tagsKey := tags.Key()
 	v, ok := a.Gauges[name]
 	if ok {
-		g, ok := v[tags]
+		g, ok := v[tagsKey]
 		if ok {
 			g.Value = value
-			a.Gauges[name][tags] = g
+			g.Timestamp = now
+			g.Idle = false
+			a.Gauges[name][tagsKey] = g
 		} else {
-			a.Gauges[name][tags] = types.NewGauge(now, a.FlushInterval, value)
+			a.Gauges[name][tagsKey] = newGauge(now, a.FlushInterval, value, tags)
 		}
 	} else {
 		a.Gauges[name] = make(map[string]types.Gauge)
-		a.Gauges[name][tags] = types.NewGauge(now, a.FlushInterval, value)
+		a.Gauges[name][tagsKey] = newGauge(now, a.FlushInterval, value, tags)
 	}
 }
 
-func (a *aggregator) receiveTimer(name, tags string, value float64, now time.Time) {
+func (a *aggregator) receiveTimer(name string, tags *types.TagSet, value float64, now time.Time) {
+	tagsKey := tags.Key()
 	v, ok := a.Timers[name]
 	if ok {
-		t, ok := v[tags]
+		t, ok := v[tagsKey]
 		if ok {
+			if a.isIdle(t.Timestamp) {
+				t.Values = nil
+				t.Percentiles = nil
+			}
 			t.Values = append(t.Values, value)
-			a.Timers[name][tags] = t
+			t.Timestamp = now
+			t.Idle = false
+			a.Timers[name][tagsKey] = t
 		} else {
-			a.Timers[name][tags] = types.NewTimer(now, a.FlushInterval, []float64{value})
+			a.Timers[name][tagsKey] = newTimer(now, a.FlushInterval, []float64{value}, tags)
 		}
 	} else {
 		a.Timers[name] = make(map[string]types.Timer)
-		a.Timers[name][tags] = types.NewTimer(now, a.FlushInterval, []float64{value})
+		a.Timers[name][tagsKey] = newTimer(now, a.FlushInterval, []float64{value}, tags)
 	}
 }
 
-func (a *aggregator) receiveSet(name, tags string, value string, now time.Time) {
+func (a *aggregator) receiveSet(name string, tags *types.TagSet, value string, now time.Time) {
+	tagsKey := tags.Key()
 	v, ok := a.Sets[name]
 	if ok {
-		s, ok := v[tags]
+		s, ok := v[tagsKey]
 		if ok {
+			if a.isIdle(s.Timestamp) {
+				s.Values = make(map[string]int64)
+			}
 			_, ok := s.Values[value]
 			if ok {
 				s.Values[value]++
 			} else {
 				s.Values[value] = 1
 			}
-			a.Sets[name][tags] = s
+			s.Timestamp = now
+			s.Idle = false
+			a.Sets[name][tagsKey] = s
 		} else {
 			unique := make(map[string]int64)
 			unique[value] = 1
-			a.Sets[name][tags] = types.NewSet(now, a.FlushInterval, unique)
+			a.Sets[name][tagsKey] = newSet(now, a.FlushInterval, unique, tags)
 		}
 	} else {
 		a.Sets[name] = make(map[string]types.Set)
 		unique := make(map[string]int64)
 		unique[value] = 1
-		a.Sets[name][tags] = types.NewSet(now, a.FlushInterval, unique)
+		a.Sets[name][tagsKey] = newSet(now, a.FlushInterval, unique, tags)
 	}
 }
 
+func newCounter(now time.Time, flushInterval time.Duration, value int64, tags *types.TagSet) types.Counter {
+	c := types.NewCounter(now, flushInterval, value)
+	c.TagSet = tags
+	return c
+}
+
+func newGauge(now time.Time, flushInterval time.Duration, value float64, tags *types.TagSet) types.Gauge {
+	g := types.NewGauge(now, flushInterval, value)
+	g.TagSet = tags
+	return g
+}
+
+func newTimer(now time.Time, flushInterval time.Duration, values []float64, tags *types.TagSet) types.Timer {
+	t := types.NewTimer(now, flushInterval, values)
+	t.TagSet = tags
+	return t
+}
+
+func newSet(now time.Time, flushInterval time.Duration, values map[string]int64, tags *types.TagSet) types.Set {
+	s := types.NewSet(now, flushInterval, values)
+	s.TagSet = tags
+	return s
+}
+
 // Receive aggregates an incoming metric.
 func (a *aggregator) Receive(m *types.Metric, now time.Time) {
+	if a.timestampPolicy.isLate(m.Timestamp, now) {
+		switch a.timestampPolicy.Late {
+		case LateBucket:
+			a.bucket(m.Timestamp).Receive(m, now)
+			return
+		case LateDrop:
+			log.Debugf("Dropping metric %s with timestamp %v received at %v", m.Name, m.Timestamp, now)
+			return
+		}
+	}
 	a.NumStats++
-	tagsKey := m.Tags.String()
+	tags := m.TagSet
+	if tags == nil {
+		tags = types.NewTagSet(m.Tags)
+	}
 
 	switch m.Type {
 	case types.COUNTER:
-		a.receiveCounter(m.Name, tagsKey, int64(m.Value), now)
+		a.receiveCounter(m.Name, tags, int64(m.Value), now)
 	case types.GAUGE:
-		a.receiveGauge(m.Name, tagsKey, m.Value, now)
+		a.receiveGauge(m.Name, tags, m.Value, now)
 	case types.TIMER:
-		a.receiveTimer(m.Name, tagsKey, m.Value, now)
+		a.receiveTimer(m.Name, tags, m.Value, now)
 	case types.SET:
-		a.receiveSet(m.Name, tagsKey, m.StringValue, now)
+		a.receiveSet(m.Name, tags, m.StringValue, now)
 	default:
 		log.Errorf("Unknow metric type %s for %s", m.Type, m.Name)
 	}
 }
+
+// ReceiveMap merges pre-aggregated metrics, e.g. forwarded by another server,
+// as if each of their values had been received individually.
+// The timestamp policy applies to the whole map.
+func (a *aggregator) ReceiveMap(m *types.MetricMap, now time.Time) {
+	if a.timestampPolicy.isLate(m.Timestamp, now) {
+		switch a.timestampPolicy.Late {
+		case LateBucket:
+			a.bucket(m.Timestamp).ReceiveMap(m, now)
+			return
+		case LateDrop:
+			log.Debugf("Dropping %d metrics with timestamp %v received at %v", m.NumStats, m.Timestamp, now)
+			return
+		}
+	}
+	m.Counters.Each(func(key, tagsKey string, counter types.Counter) {
+		a.NumStats++
+		a.receiveCounter(key, counter.TagSet, counter.Value, now)
+	})
+	m.Timers.Each(func(key, tagsKey string, timer types.Timer) {
+		for _, value := range timer.Values {
+			a.NumStats++
+			a.receiveTimer(key, timer.TagSet, value, now)
+		}
+	})
+	m.Gauges.Each(func(key, tagsKey string, gauge types.Gauge) {
+		a.NumStats++
+		a.receiveGauge(key, gauge.TagSet, gauge.Value, now)
+	})
+	m.Sets.Each(func(key, tagsKey string, set types.Set) {
+		for value := range set.Values {
+			a.NumStats++
+			a.receiveSet(key, set.TagSet, value, now)
+		}
+	})
+}
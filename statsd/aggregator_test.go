@@ -17,7 +17,9 @@ func (fb *FakeBackend) BackendName() string                        { return "fak
 
 func newFakeAggregator() *aggregator {
 	return NewAggregator(
-		[]float64{float64(90)},
+		&PercentThresholds{defaults: []float64{float64(90)}},
+		DefaultIdlePolicies,
+		DefaultTimestampPolicy,
 		time.Duration(10)*time.Second,
 		time.Duration(5)*time.Minute,
 		[]string{},
@@ -55,6 +57,8 @@ func TestFlush(t *testing.T) {
 	expected := newFakeAggregator()
 	ma.lastFlush = now.Add(-10 * time.Second)
 	expected.lastFlush = now.Add(-10 * time.Second)
+	// The series were not updated since the last flush
+	idle := types.Interval{Idle: true}
 
 	ma.Counters["some"] = make(map[string]types.Counter)
 	ma.Counters["some"][""] = types.Counter{Value: 50}
@@ -62,12 +66,12 @@ func TestFlush(t *testing.T) {
 	ma.Counters["some"]["other:thing"] = types.Counter{Value: 150}
 
 	expected.Counters["some"] = make(map[string]types.Counter)
-	expected.Counters["some"][""] = types.Counter{Value: 50, PerSecond: 5}
-	expected.Counters["some"]["thing"] = types.Counter{Value: 100, PerSecond: 10}
-	expected.Counters["some"]["other:thing"] = types.Counter{Value: 150, PerSecond: 15}
+	expected.Counters["some"][""] = types.Counter{Value: 50, PerSecond: 5, Interval: idle}
+	expected.Counters["some"]["thing"] = types.Counter{Value: 100, PerSecond: 10, Interval: idle}
+	expected.Counters["some"]["other:thing"] = types.Counter{Value: 150, PerSecond: 15, Interval: idle}
 	expected.Counters["statsd.aggregator_num_stats"] = make(map[string]types.Counter)
 	expected.Counters["statsd.aggregator_num_stats"][""] = types.Counter{
-		Value: 0, PerSecond: 0,
+		Value: 0, PerSecond: 0, TagSet: types.NewTagSet(nil),
 		Interval: types.Interval{Timestamp: now, Flush: time.Duration(10) * time.Second},
 	} // count happens in Receive
 
@@ -84,9 +88,9 @@ func TestFlush(t *testing.T) {
 	expected.Timers["some"] = make(map[string]types.Timer)
 	expected.Timers["some"]["thing"] = types.Timer{
 		Values: []float64{2, 4, 12}, Count: 3, Min: 2, Max: 12, Mean: 6, Median: 4, Sum: 18,
-		PerSecond: 0.3, SumSquares: 164, StdDev: 4.320493798938574, Percentiles: expPct,
+		PerSecond: 0.3, SumSquares: 164, StdDev: 4.320493798938574, Percentiles: expPct, Interval: idle,
 	}
-	expected.Timers["some"]["empty"] = types.Timer{Values: []float64{}}
+	expected.Timers["some"]["empty"] = types.Timer{Values: []float64{}, Interval: idle}
 
 	ma.Gauges["some"] = make(map[string]types.Gauge)
 	ma.Gauges["some"][""] = types.Gauge{Value: 50}
@@ -94,12 +98,13 @@ func TestFlush(t *testing.T) {
 	ma.Gauges["some"]["other:thing"] = types.Gauge{Value: 150}
 
 	expected.Gauges["some"] = make(map[string]types.Gauge)
-	expected.Gauges["some"][""] = types.Gauge{Value: 50}
-	expected.Gauges["some"]["thing"] = types.Gauge{Value: 100}
-	expected.Gauges["some"]["other:thing"] = types.Gauge{Value: 150}
+	expected.Gauges["some"][""] = types.Gauge{Value: 50, Interval: idle}
+	expected.Gauges["some"]["thing"] = types.Gauge{Value: 100, Interval: idle}
+	expected.Gauges["some"]["other:thing"] = types.Gauge{Value: 150, Interval: idle}
 	expected.Gauges["statsd.processing_time"] = make(map[string]types.Gauge)
 	expected.Gauges["statsd.processing_time"][""] = types.Gauge{
 		Value:    0,
+		TagSet:   types.NewTagSet(nil),
 		Interval: types.Interval{Timestamp: now, Flush: time.Duration(10) * time.Second},
 	} // start and end are the same...
 
@@ -109,7 +114,7 @@ func TestFlush(t *testing.T) {
 	ma.Sets["some"]["thing"] = types.Set{Values: unique}
 
 	expected.Sets["some"] = make(map[string]types.Set)
-	expected.Sets["some"]["thing"] = types.Set{Values: unique}
+	expected.Sets["some"]["thing"] = types.Set{Values: unique, Interval: idle}
 
 	actual := ma.Flush(nowFn)
 	assert.Equal(expected.Counters, actual.Counters)
@@ -118,6 +123,76 @@ func TestFlush(t *testing.T) {
 	assert.Equal(expected.Sets, actual.Sets)
 }
 
+func TestFlushPercentileNames(t *testing.T) {
+	assert := assert.New(t)
+
+	pt, err := NewPercentThresholds([]string{"99", "99.9", "-10"}, []PercentThresholdOverride{
+		{Pattern: "api.*", Thresholds: []string{"50"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ma := NewAggregator(pt, DefaultIdlePolicies, DefaultTimestampPolicy, 10*time.Second, 5*time.Minute, nil).(*aggregator)
+	ma.Timers["some"] = map[string]types.Timer{"": {Values: []float64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}}}
+	ma.Timers["api.latency"] = map[string]types.Timer{"": {Values: []float64{1, 2, 3, 4}}}
+
+	names := func(p types.Percentiles) []string {
+		var result []string
+		for _, pct := range p {
+			result = append(result, pct.String())
+		}
+		return result
+	}
+	actual := ma.Flush(time.Now)
+	assert.Equal([]string{
+		"count_99", "mean_99", "sum_99", "sum_squares_99", "upper_99",
+		"count_99_9", "mean_99_9", "sum_99_9", "sum_squares_99_9", "upper_99_9",
+		"count_top10", "mean_top10", "sum_top10", "sum_squares_top10", "lower_top10",
+	}, names(actual.Timers["some"][""].Percentiles))
+	assert.Equal([]string{
+		"count_50", "mean_50", "sum_50", "sum_squares_50", "upper_50",
+	}, names(actual.Timers["api.latency"][""].Percentiles))
+}
+
+func TestFlushLowerThresholds(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, tc := range []struct {
+		threshold string
+		name      string
+		values    []float64
+		count     float64
+		sum       float64
+		squares   float64
+		lower     float64
+	}{
+		{"-100", "top100", []float64{2, 4}, 2, 6, 20, 2},
+		{"-90", "top90", []float64{2, 4}, 2, 6, 20, 2}, // round(1.8) covers every value
+		{"-50", "top50", []float64{2, 4}, 1, 4, 16, 4},
+		{"-100", "top100", []float64{1, 2, 3}, 3, 6, 14, 1},
+	} {
+		pt, err := NewPercentThresholds([]string{tc.threshold}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ma := NewAggregator(pt, DefaultIdlePolicies, DefaultTimestampPolicy, 10*time.Second, 5*time.Minute, nil).(*aggregator)
+		ma.Timers["some"] = map[string]types.Timer{"": {Values: tc.values}}
+		actual := ma.Flush(time.Now).Timers["some"][""].Percentiles
+
+		values := make(map[string]float64)
+		for _, pct := range actual {
+			values[pct.String()] = pct.Float()
+		}
+		assert.Equal(map[string]float64{
+			"count_" + tc.name:       tc.count,
+			"mean_" + tc.name:        tc.sum / tc.count,
+			"sum_" + tc.name:         tc.sum,
+			"sum_squares_" + tc.name: tc.squares,
+			"lower_" + tc.name:       tc.lower,
+		}, values, tc.threshold)
+	}
+}
+
 func BenchmarkFlush(b *testing.B) {
 	ma := newFakeAggregator()
 	ma.Counters["some"] = make(map[string]types.Counter)
@@ -159,8 +234,8 @@ func TestReset(t *testing.T) {
 
 	expected := newFakeAggregator()
 	expected.Counters["some"] = make(map[string]types.Counter)
-	expected.Counters["some"]["thing"] = types.NewCounter(now, time.Duration(10)*time.Second, int64(0))
-	expected.Counters["some"]["other:thing"] = types.NewCounter(now, time.Duration(10)*time.Second, int64(0))
+	expected.Counters["some"]["thing"] = types.Counter{Interval: types.Interval{Timestamp: now, Flush: time.Duration(10) * time.Second, Idle: true}}
+	expected.Counters["some"]["other:thing"] = types.Counter{Interval: types.Interval{Timestamp: now, Flush: time.Duration(10) * time.Second, Idle: true}}
 
 	assert.Equal(expected.Counters, actual.Counters)
 
@@ -171,7 +246,7 @@ func TestReset(t *testing.T) {
 
 	expected = newFakeAggregator()
 	expected.Timers["some"] = make(map[string]types.Timer)
-	expected.Timers["some"]["thing"] = types.Timer{Interval: types.Interval{Timestamp: now, Flush: time.Duration(10) * time.Second}}
+	expected.Timers["some"]["thing"] = types.Timer{Interval: types.Interval{Timestamp: now, Flush: time.Duration(10) * time.Second, Idle: true}}
 
 	assert.Equal(expected.Timers, actual.Timers)
 
@@ -183,8 +258,8 @@ func TestReset(t *testing.T) {
 
 	expected = newFakeAggregator()
 	expected.Gauges["some"] = make(map[string]types.Gauge)
-	expected.Gauges["some"]["thing"] = types.NewGauge(now, time.Duration(10)*time.Second, float64(50))
-	expected.Gauges["some"]["other:thing"] = types.NewGauge(now, time.Duration(10)*time.Second, float64(90))
+	expected.Gauges["some"]["thing"] = types.Gauge{Value: 50, Interval: types.Interval{Timestamp: now, Flush: time.Duration(10) * time.Second, Idle: true}}
+	expected.Gauges["some"]["other:thing"] = types.Gauge{Value: 90, Interval: types.Interval{Timestamp: now, Flush: time.Duration(10) * time.Second, Idle: true}}
 
 	assert.Equal(expected.Gauges, actual.Gauges)
 
@@ -197,7 +272,7 @@ func TestReset(t *testing.T) {
 
 	expected = newFakeAggregator()
 	expected.Sets["some"] = make(map[string]types.Set)
-	expected.Sets["some"]["thing"] = types.NewSet(now, time.Duration(10)*time.Second, make(map[string]int64))
+	expected.Sets["some"]["thing"] = types.Set{Values: make(map[string]int64), Interval: types.Interval{Timestamp: now, Flush: time.Duration(10) * time.Second, Idle: true}}
 
 	assert.Equal(expected.Sets, actual.Sets)
 
@@ -291,6 +366,8 @@ func TestReceive(t *testing.T) {
 	now := time.Now()
 	d := time.Duration(10) * time.Second
 	interval := types.Interval{Timestamp: now, Flush: d}
+	noTags := types.NewTagSet(nil)
+	fooBarBaz := types.NewTagSet(types.Tags{"foo:bar", "baz"})
 
 	tests := metricsFixtures()
 	for _, metric := range tests {
@@ -299,22 +376,22 @@ func TestReceive(t *testing.T) {
 
 	expectedCounters := types.Counters{}
 	expectedCounters["foo.bar.baz"] = make(map[string]types.Counter)
-	expectedCounters["foo.bar.baz"][""] = types.Counter{Value: 2, Interval: interval}
+	expectedCounters["foo.bar.baz"][""] = types.Counter{TagSet: noTags, Value: 2, Interval: interval}
 	expectedCounters["smp.rte"] = make(map[string]types.Counter)
-	expectedCounters["smp.rte"]["baz,foo:bar"] = types.Counter{Value: 55, Interval: interval}
-	expectedCounters["smp.rte"][""] = types.Counter{Value: 50, Interval: interval}
+	expectedCounters["smp.rte"]["baz,foo:bar"] = types.Counter{TagSet: fooBarBaz, Value: 55, Interval: interval}
+	expectedCounters["smp.rte"][""] = types.Counter{TagSet: noTags, Value: 50, Interval: interval}
 	assert.Equal(expectedCounters, ma.Counters)
 
 	expectedGauges := types.Gauges{}
 	expectedGauges["abc.def.g"] = make(map[string]types.Gauge)
-	expectedGauges["abc.def.g"][""] = types.Gauge{Value: 3, Interval: interval}
-	expectedGauges["abc.def.g"]["baz,foo:bar"] = types.Gauge{Value: 8, Interval: interval}
+	expectedGauges["abc.def.g"][""] = types.Gauge{TagSet: noTags, Value: 3, Interval: interval}
+	expectedGauges["abc.def.g"]["baz,foo:bar"] = types.Gauge{TagSet: fooBarBaz, Value: 8, Interval: interval}
 	assert.Equal(expectedGauges, ma.Gauges)
 
 	expectedTimers := types.Timers{}
 	expectedTimers["def.g"] = make(map[string]types.Timer)
-	expectedTimers["def.g"][""] = types.Timer{Values: []float64{10}, Interval: interval}
-	expectedTimers["def.g"]["baz,foo:bar"] = types.Timer{Values: []float64{1}, Interval: interval}
+	expectedTimers["def.g"][""] = types.Timer{TagSet: noTags, Values: []float64{10}, Interval: interval}
+	expectedTimers["def.g"]["baz,foo:bar"] = types.Timer{TagSet: fooBarBaz, Values: []float64{1}, Interval: interval}
 	assert.Equal(expectedTimers, ma.Timers)
 
 	expectedSets := types.Sets{}
@@ -325,8 +402,8 @@ func TestReceive(t *testing.T) {
 	sets["john"] = 1
 	sets2 := make(map[string]int64)
 	sets2["john"] = 1
-	expectedSets["uniq.usr"][""] = types.Set{Values: sets, Interval: interval}
-	expectedSets["uniq.usr"]["baz,foo:bar"] = types.Set{Values: sets2, Interval: interval}
+	expectedSets["uniq.usr"][""] = types.Set{TagSet: noTags, Values: sets, Interval: interval}
+	expectedSets["uniq.usr"]["baz,foo:bar"] = types.Set{TagSet: fooBarBaz, Values: sets2, Interval: interval}
 	assert.Equal(expectedSets, ma.Sets)
 }
 
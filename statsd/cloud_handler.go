@@ -0,0 +1,449 @@
+package statsd
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/atlassian/gostatsd/cloudprovider"
+	cloudTypes "github.com/atlassian/gostatsd/cloudprovider/types"
+	"github.com/atlassian/gostatsd/types"
+
+	log "github.com/Sirupsen/logrus"
+	"golang.org/x/net/context"
+)
+
+const (
+	// cloudCacheExpiryInterval is how often the expired entries are removed from the cache.
+	cloudCacheExpiryInterval = 1 * time.Minute
+	// cloudLookupQueueSize is the maximum number of IP addresses waiting for a lookup worker.
+	cloudLookupQueueSize = 1000
+	// cloudMaxHeld is the maximum number of metrics and events held at any time. The ones received
+	// beyond that are dispatched without the details of the instance.
+	cloudMaxHeld = 100000
+)
+
+var errLookupQueueFull = errors.New("lookup queue full")
+
+// UnresolvedPolicy is what happens to the metrics and events received from an IP address
+// that has not been looked up yet.
+type UnresolvedPolicy byte
+
+const (
+	// UnresolvedHold holds the metrics and events until the lookup completes or the hold timeout expires,
+	// whichever comes first.
+	UnresolvedHold UnresolvedPolicy = iota
+	// UnresolvedTagLater dispatches the metrics and events immediately, tagged with the IP address only.
+	// The details of the instance are added to the ones received after the lookup completes.
+	UnresolvedTagLater
+)
+
+func (p UnresolvedPolicy) String() string {
+	switch p {
+	case UnresolvedTagLater:
+		return "tag-later"
+	default:
+		return "hold"
+	}
+}
+
+// ParseUnresolvedPolicy parses the name of an UnresolvedPolicy: hold or tag-later.
+func ParseUnresolvedPolicy(s string) (UnresolvedPolicy, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "hold":
+		return UnresolvedHold, nil
+	case "tag-later":
+		return UnresolvedTagLater, nil
+	}
+	return UnresolvedHold, fmt.Errorf("invalid unresolved policy %q: must be one of hold or tag-later", s)
+}
+
+// CloudHandlerStats holds statistics about a CloudHandler.
+type CloudHandlerStats struct {
+	CacheHits      uint64        // Metrics and events tagged from the cache
+	CacheMisses    uint64        // Metrics and events from a source that was not in the cache
+	Refreshes      uint64        // Cached instances in use looked up again before they expire
+	Lookups        uint64        // Completed calls to the cloud provider, each looking up one or more IP addresses
+	LookupErrors   uint64        // Failed calls to the cloud provider
+	LookupsDropped uint64        // Lookups not started because the lookup queue was full
+	LookupTime     time.Duration // Total time spent in lookups
+	Held           uint64        // Metrics and events currently held
+	HeldExpired    uint64        // Metrics and events released without the details of the instance after the hold timeout
+}
+
+// cloudPending holds the metrics and events received from an IP address while it is looked up.
+type cloudPending struct {
+	deadline time.Time // When the held metrics and events are released without the details of the instance
+	expired  bool      // Whether the deadline has passed, metrics and events are not held anymore
+	metrics  []*types.Metric
+	events   []*types.Event
+}
+
+// CloudHandler is a Handler that tags metrics and events with the details of the cloud instance that sent them,
+// before passing them to the next Handler. The instances are looked up asynchronously by a pool of workers,
+// so that a slow cloud provider does not block the receivers, and cached. Each worker looks up all the IP
+// addresses waiting in the lookup queue at once, up to the maximum batch size of the cloud provider.
+// Metrics and events from an IP address that has not been looked up yet are held or tagged later,
+// depending on the UnresolvedPolicy.
+type CloudHandler struct {
+	// Counter fields below must be read/written only using atomic instructions.
+	// 64-bit fields must be the first fields in the struct to guarantee proper memory alignment.
+	// See https://golang.org/pkg/sync/atomic/#pkg-note-BUG
+	cacheHits      uint64
+	cacheMisses    uint64
+	refreshes      uint64
+	lookups        uint64
+	lookupErrors   uint64
+	lookupsDropped uint64
+	lookupTime     int64 // Total time spent in lookups, in nsec.
+	heldExpired    uint64
+
+	cloud       cloudTypes.Interface
+	provider    string // Name of cloud, for the instances that do not record their provider
+	next        Handler
+	workers     int
+	policy      UnresolvedPolicy
+	holdTimeout time.Duration
+	lookupQueue chan string
+	cache       *cloudprovider.Cache
+	interner    *types.TagInterner
+	now         func() time.Time
+
+	mu      sync.Mutex
+	pending map[string]*cloudPending // By IP address, the lookups queued or in progress
+	held    int                      // Number of metrics and events in pending
+	stopped bool                     // Whether Run has returned
+}
+
+// NewCloudHandler creates a CloudHandler that looks up instances with cloud using the given number of workers,
+// caches them in cache and passes the tagged metrics and events to next.
+func NewCloudHandler(cloud cloudTypes.Interface, cache *cloudprovider.Cache, next Handler, workers int, policy UnresolvedPolicy, holdTimeout time.Duration) *CloudHandler {
+	if workers < 1 {
+		workers = 1
+	}
+	return &CloudHandler{
+		cloud:       cloud,
+		provider:    cloud.ProviderName(),
+		next:        next,
+		workers:     workers,
+		policy:      policy,
+		holdTimeout: holdTimeout,
+		lookupQueue: make(chan string, cloudLookupQueueSize),
+		interner:    types.NewTagInterner(types.DefaultTagInternerSize),
+		now:         time.Now,
+		cache:       cache,
+		pending:     make(map[string]*cloudPending),
+	}
+}
+
+// GetStats returns current CloudHandler stats. Safe for concurrent use.
+func (ch *CloudHandler) GetStats() CloudHandlerStats {
+	ch.mu.Lock()
+	held := ch.held
+	ch.mu.Unlock()
+	return CloudHandlerStats{
+		CacheHits:      atomic.LoadUint64(&ch.cacheHits),
+		CacheMisses:    atomic.LoadUint64(&ch.cacheMisses),
+		Refreshes:      atomic.LoadUint64(&ch.refreshes),
+		Lookups:        atomic.LoadUint64(&ch.lookups),
+		LookupErrors:   atomic.LoadUint64(&ch.lookupErrors),
+		LookupsDropped: atomic.LoadUint64(&ch.lookupsDropped),
+		LookupTime:     time.Duration(atomic.LoadInt64(&ch.lookupTime)),
+		Held:           uint64(held),
+		HeldExpired:    atomic.LoadUint64(&ch.heldExpired),
+	}
+}
+
+// Run runs the lookup workers and releases the metrics and events held for longer than the hold timeout,
+// until the context is done. The metrics and events still held when it returns can be dispatched with Release.
+func (ch *CloudHandler) Run(ctx context.Context) error {
+	defer func() {
+		ch.mu.Lock()
+		ch.stopped = true
+		ch.mu.Unlock()
+	}()
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	wg.Add(ch.workers)
+	for i := 0; i < ch.workers; i++ {
+		go func() {
+			defer wg.Done()
+			ch.lookupWorker(ctx)
+		}()
+	}
+
+	interval := ch.holdTimeout / 4
+	if interval < 10*time.Millisecond {
+		interval = 10 * time.Millisecond
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	lastExpiry := ch.now()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+			now := ch.now()
+			if err := ch.releaseExpired(ctx, now); err != nil {
+				return err
+			}
+			if now.Sub(lastExpiry) >= cloudCacheExpiryInterval {
+				ch.cache.Expire(now)
+				if chain, ok := ch.cloud.(*cloudprovider.Chain); ok {
+					chain.Expire(now)
+				}
+				lastExpiry = now
+			}
+		}
+	}
+}
+
+// Release dispatches all the held metrics and events, with the details of their instance if the lookup
+// has completed. It is used on shutdown, after Run has returned and the receivers are stopped.
+func (ch *CloudHandler) Release(ctx context.Context) error {
+	now := ch.now()
+	ch.mu.Lock()
+	pending := ch.pending
+	ch.pending = make(map[string]*cloudPending)
+	ch.held = 0
+	ch.mu.Unlock()
+	for ip, p := range pending {
+		instance, _, _ := ch.cache.Get(ip, now)
+		if err := ch.dispatchPending(ctx, p, instance); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DispatchMetric tags the metric with the details of its instance and passes it to the next Handler,
+// or holds it until its instance is known.
+func (ch *CloudHandler) DispatchMetric(ctx context.Context, m *types.Metric) error {
+	if m.Source == "" {
+		return ch.next.DispatchMetric(ctx, m)
+	}
+	instance, ok := ch.resolve(m.Source, m, nil)
+	if !ok {
+		return nil // Held
+	}
+	ch.updateMetric(m, instance)
+	return ch.next.DispatchMetric(ctx, m)
+}
+
+// DispatchEvent tags the event with the details of its instance and passes it to the next Handler,
+// or holds it until its instance is known.
+func (ch *CloudHandler) DispatchEvent(ctx context.Context, e *types.Event) error {
+	if e.Source == "" {
+		return ch.next.DispatchEvent(ctx, e)
+	}
+	instance, ok := ch.resolve(e.Source, nil, e)
+	if !ok {
+		return nil // Held
+	}
+	e.Tags = updateTags(e.Tags, instance, ch.provider)
+	return ch.next.DispatchEvent(ctx, e)
+}
+
+// resolve returns the cached instance of ip, nil if it is not known. If ip is not in the cache, a lookup
+// is queued and, with the hold policy, the metric or event is held and ok is false. If the cached instance
+// is due for a refresh, a lookup is queued in the background.
+func (ch *CloudHandler) resolve(ip string, m *types.Metric, e *types.Event) (instance *cloudTypes.Instance, ok bool) {
+	now := ch.now()
+	instance, found, refresh := ch.cache.Get(ip, now)
+	if found {
+		atomic.AddUint64(&ch.cacheHits, 1)
+		if refresh {
+			select {
+			case ch.lookupQueue <- ip:
+				atomic.AddUint64(&ch.refreshes, 1)
+			default:
+				atomic.AddUint64(&ch.lookupsDropped, 1)
+				ch.cache.Update(ip, nil, errLookupQueueFull, now) // Try again later
+			}
+		}
+		return instance, true
+	}
+	atomic.AddUint64(&ch.cacheMisses, 1)
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	p, found := ch.pending[ip]
+	if !found {
+		if ch.stopped {
+			return nil, true
+		}
+		select {
+		case ch.lookupQueue <- ip:
+		default:
+			// Try again with the next metric from this IP address
+			atomic.AddUint64(&ch.lookupsDropped, 1)
+			return nil, true
+		}
+		p = &cloudPending{deadline: now.Add(ch.holdTimeout)}
+		ch.pending[ip] = p
+	}
+	if ch.policy != UnresolvedHold || p.expired || ch.held >= cloudMaxHeld {
+		return nil, true
+	}
+	if m != nil {
+		p.metrics = append(p.metrics, m)
+	} else {
+		p.events = append(p.events, e)
+	}
+	ch.held++
+	return nil, false
+}
+
+func (ch *CloudHandler) lookupWorker(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case ip := <-ch.lookupQueue:
+			if err := ch.lookup(ctx, ch.nextBatch(ip)); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// nextBatch returns ip and the other IP addresses waiting in the lookup queue,
+// up to the maximum batch size of the cloud provider.
+func (ch *CloudHandler) nextBatch(ip string) []string {
+	ips := []string{ip}
+	for len(ips) < ch.cloud.MaxInstancesBatch() {
+		select {
+		case ip = <-ch.lookupQueue:
+			ips = append(ips, ip)
+		default:
+			return ips
+		}
+	}
+	return ips
+}
+
+// lookup looks up ips in a single call to the cloud provider, caches the results and dispatches
+// the metrics and events held for them.
+func (ch *CloudHandler) lookup(ctx context.Context, ips []string) error {
+	start := ch.now()
+	instances, err := ch.cloud.Instances(ips...)
+	now := ch.now()
+	if err != nil {
+		log.Debugf("Error retrieving instance details from cloud provider %s: %v", ch.cloud.ProviderName(), err)
+	}
+
+	var resolved []*cloudPending
+	var resolvedInstances []*cloudTypes.Instance
+	ch.mu.Lock()
+	for _, ip := range ips {
+		instance := instances[ip]
+		if instance == nil && err == nil {
+			log.Debugf("No instance with IP address %s from cloud provider %s", ip, ch.cloud.ProviderName())
+		}
+		if instance != nil {
+			ch.cache.Update(ip, instance, nil, now) // Found even if the lookup of other IP addresses failed
+		} else {
+			ch.cache.Update(ip, nil, err, now)
+		}
+		// When shutting down, the held metrics and events are left to Release
+		if p := ch.pending[ip]; p != nil && ctx.Err() == nil {
+			delete(ch.pending, ip)
+			ch.held -= len(p.metrics) + len(p.events)
+			resolved = append(resolved, p)
+			resolvedInstances = append(resolvedInstances, instance)
+		}
+	}
+	ch.mu.Unlock()
+	atomic.AddInt64(&ch.lookupTime, int64(now.Sub(start)))
+	atomic.AddUint64(&ch.lookups, 1)
+	if err != nil {
+		atomic.AddUint64(&ch.lookupErrors, 1)
+	}
+	for i, p := range resolved {
+		if err := ch.dispatchPending(ctx, p, resolvedInstances[i]); err != nil {
+			return err
+		}
+	}
+	return ctx.Err()
+}
+
+// releaseExpired dispatches the metrics and events held for longer than the hold timeout,
+// without the details of their instance. The lookups stay pending but nothing more is held for them.
+func (ch *CloudHandler) releaseExpired(ctx context.Context, now time.Time) error {
+	var expired []*cloudPending
+	ch.mu.Lock()
+	for _, p := range ch.pending {
+		if p.expired || now.Before(p.deadline) {
+			continue
+		}
+		ch.held -= len(p.metrics) + len(p.events)
+		expired = append(expired, &cloudPending{metrics: p.metrics, events: p.events})
+		p.expired = true
+		p.metrics = nil
+		p.events = nil
+	}
+	ch.mu.Unlock()
+	for _, p := range expired {
+		atomic.AddUint64(&ch.heldExpired, uint64(len(p.metrics)+len(p.events)))
+		if err := ch.dispatchPending(ctx, p, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dispatchPending tags the held metrics and events with the details of instance, if not nil,
+// and passes them to the next Handler.
+func (ch *CloudHandler) dispatchPending(ctx context.Context, p *cloudPending, instance *cloudTypes.Instance) error {
+	for _, m := range p.metrics {
+		ch.updateMetric(m, instance)
+		if err := ch.next.DispatchMetric(ctx, m); err != nil {
+			return err
+		}
+	}
+	for _, e := range p.events {
+		e.Tags = updateTags(e.Tags, instance, ch.provider)
+		if err := ch.next.DispatchEvent(ctx, e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ch *CloudHandler) updateMetric(m *types.Metric, instance *cloudTypes.Instance) {
+	if instance == nil {
+		return // Already tagged with the IP address by the receiver
+	}
+	m.Tags = updateTags(m.Tags, instance, ch.provider)
+	m.TagSet = ch.interner.Intern(m.Tags)
+}
+
+// updateTags returns a copy of tags where the IP address added by the receiver is replaced by the ID of
+// instance, with its region if it has one, its tags and the providers that resolved it, provider if the
+// instance does not record them. tags is returned as is if instance is nil.
+func updateTags(tags types.Tags, instance *cloudTypes.Instance, provider string) types.Tags {
+	if instance == nil {
+		return tags
+	}
+	sourcePrefix := types.StatsdSourceID + ":"
+	updated := make(types.Tags, 0, len(tags)+len(instance.Tags)+2)
+	for _, tag := range tags {
+		if !strings.HasPrefix(tag, sourcePrefix) {
+			updated = append(updated, tag)
+		}
+	}
+	if instance.Region != "" {
+		updated = append(updated, fmt.Sprintf("region:%s", instance.Region))
+	}
+	updated = append(updated, instance.Tags...)
+	if instance.Provider != "" {
+		provider = instance.Provider
+	}
+	if provider != "" {
+		updated = append(updated, types.StatsdSourceProvider+":"+provider)
+	}
+	return append(updated, sourcePrefix+instance.ID)
+}
@@ -0,0 +1,420 @@
+package statsd
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/atlassian/gostatsd/cloudprovider"
+	"github.com/atlassian/gostatsd/cloudprovider/providers/static"
+	cloudTypes "github.com/atlassian/gostatsd/cloudprovider/types"
+	"github.com/atlassian/gostatsd/types"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+// fakeCloud looks up instances from a map, waiting for release to be closed if it is not nil.
+// It records the IP addresses of each lookup.
+type fakeCloud struct {
+	instances map[string]*cloudTypes.Instance
+	release   chan struct{}
+
+	mu      sync.Mutex
+	batches [][]string
+}
+
+func (fc *fakeCloud) ProviderName() string {
+	return "fake"
+}
+
+func (fc *fakeCloud) SampleConfig() string {
+	return ""
+}
+
+func (fc *fakeCloud) MaxInstancesBatch() int {
+	return 3
+}
+
+func (fc *fakeCloud) Instances(IPs ...string) (map[string]*cloudTypes.Instance, error) {
+	fc.mu.Lock()
+	fc.batches = append(fc.batches, IPs)
+	fc.mu.Unlock()
+	if fc.release != nil {
+		<-fc.release
+	}
+	if fc.instances == nil {
+		return nil, errors.New("lookup failed")
+	}
+	instances := make(map[string]*cloudTypes.Instance)
+	for _, ip := range IPs {
+		if instance, ok := fc.instances[ip]; ok {
+			instances[ip] = instance
+		}
+	}
+	return instances, nil
+}
+
+// syncHandler records the metrics and events it receives and signals each of them on received.
+type syncHandler struct {
+	mu       sync.Mutex
+	metrics  []*types.Metric
+	events   []*types.Event
+	received chan struct{}
+}
+
+func newSyncHandler() *syncHandler {
+	return &syncHandler{received: make(chan struct{}, 100)}
+}
+
+func (h *syncHandler) DispatchMetric(ctx context.Context, m *types.Metric) error {
+	h.mu.Lock()
+	h.metrics = append(h.metrics, m)
+	h.mu.Unlock()
+	h.received <- struct{}{}
+	return nil
+}
+
+func (h *syncHandler) DispatchEvent(ctx context.Context, e *types.Event) error {
+	h.mu.Lock()
+	h.events = append(h.events, e)
+	h.mu.Unlock()
+	h.received <- struct{}{}
+	return nil
+}
+
+func (h *syncHandler) wait(t *testing.T, n int) {
+	for i := 0; i < n; i++ {
+		select {
+		case <-h.received:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("received %d of %d", i, n)
+		}
+	}
+}
+
+func (h *syncHandler) tags() []types.Tags {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var tags []types.Tags
+	for _, m := range h.metrics {
+		tags = append(tags, m.Tags)
+	}
+	for _, e := range h.events {
+		tags = append(tags, e.Tags)
+	}
+	return tags
+}
+
+func newSourceMetric(ip string) *types.Metric {
+	return &types.Metric{
+		Name:   "m",
+		Value:  1,
+		Type:   types.COUNTER,
+		Tags:   types.Tags{"env:prod", types.StatsdSourceID + ":" + ip},
+		Source: ip,
+	}
+}
+
+var testInstance = &cloudTypes.Instance{ID: "i-1", Region: "us-east-1", Tags: types.Tags{"role:web"}}
+
+func runCloudHandler(ch *CloudHandler) func() {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ch.Run(ctx)
+	}()
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+func TestCloudHandlerHoldsUntilResolved(t *testing.T) {
+	assert := assert.New(t)
+
+	cloud := &fakeCloud{instances: map[string]*cloudTypes.Instance{"10.0.0.1": testInstance}, release: make(chan struct{})}
+	h := newSyncHandler()
+	cache, err := cloudprovider.NewCache(cloudprovider.DefaultCacheOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ch := NewCloudHandler(cloud, cache, h, 2, UnresolvedHold, time.Minute)
+	defer runCloudHandler(ch)()
+
+	ctx := context.Background()
+	assert.NoError(ch.DispatchMetric(ctx, newSourceMetric("10.0.0.1")))
+	assert.NoError(ch.DispatchEvent(ctx, &types.Event{Title: "e", Tags: types.Tags{types.StatsdSourceID + ":10.0.0.1"}, Source: "10.0.0.1"}))
+	assert.NoError(ch.DispatchMetric(ctx, &types.Metric{Name: "local"}))
+	h.wait(t, 1) // Only the metric without a source goes through
+	assert.EqualValues(2, ch.GetStats().Held)
+
+	close(cloud.release)
+	h.wait(t, 2)
+	expected := types.Tags{"env:prod", "region:us-east-1", "role:web", types.StatsdSourceProvider + ":fake", types.StatsdSourceID + ":i-1"}
+	tags := h.tags()
+	assert.Equal(expected, tags[1])
+	assert.Equal(types.Tags{"region:us-east-1", "role:web", types.StatsdSourceProvider + ":fake", types.StatsdSourceID + ":i-1"}, tags[2])
+	h.mu.Lock()
+	assert.Equal(types.NewTagSet(expected).Key(), h.metrics[1].TagSet.Key())
+	h.mu.Unlock()
+
+	assert.NoError(ch.DispatchMetric(ctx, newSourceMetric("10.0.0.1")))
+	h.wait(t, 1)
+	assert.Equal(expected, h.tags()[2])
+
+	stats := ch.GetStats()
+	assert.EqualValues(1, stats.CacheHits)
+	assert.EqualValues(2, stats.CacheMisses)
+	assert.EqualValues(1, stats.Lookups)
+	assert.EqualValues(0, stats.Held)
+}
+
+func TestCloudHandlerStaticProvider(t *testing.T) {
+	assert := assert.New(t)
+
+	cloud, err := static.New(
+		static.Host{IPs: []string{"10.0.0.0/24"}, Tags: types.Tags{"rack:r1"}},
+		static.Host{IPs: []string{"10.0.0.1"}, ID: "db-1", Region: "dc1", Tags: types.Tags{"role:db"}},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := newSyncHandler()
+	cache, err := cloudprovider.NewCache(cloudprovider.DefaultCacheOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ch := NewCloudHandler(cloud, cache, h, 1, UnresolvedHold, time.Minute)
+	defer runCloudHandler(ch)()
+
+	ctx := context.Background()
+	assert.NoError(ch.DispatchMetric(ctx, newSourceMetric("10.0.0.1")))
+	h.wait(t, 1)
+	assert.NoError(ch.DispatchMetric(ctx, newSourceMetric("10.0.0.2")))
+	h.wait(t, 1)
+	assert.NoError(ch.DispatchMetric(ctx, newSourceMetric("10.0.1.1")))
+	h.wait(t, 1)
+	assert.Equal([]types.Tags{
+		{"env:prod", "region:dc1", "role:db", types.StatsdSourceProvider + ":static", types.StatsdSourceID + ":db-1"},
+		{"env:prod", "rack:r1", types.StatsdSourceProvider + ":static", types.StatsdSourceID + ":10.0.0.2"},
+		{"env:prod", types.StatsdSourceID + ":10.0.1.1"}, // Not resolved
+	}, h.tags())
+}
+
+func TestCloudHandlerChainedProviders(t *testing.T) {
+	assert := assert.New(t)
+
+	dc, err := static.New(static.Host{IPs: []string{"10.0.0.0/24"}, Region: "dc1", Tags: types.Tags{"rack:r1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cloud, err := cloudprovider.NewChain(cloudprovider.ChainMerge, cloudprovider.DefaultCacheOptions,
+		&fakeCloud{instances: map[string]*cloudTypes.Instance{"10.0.0.1": testInstance}}, dc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := newSyncHandler()
+	cache, err := cloudprovider.NewCache(cloudprovider.DefaultCacheOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ch := NewCloudHandler(cloud, cache, h, 1, UnresolvedHold, time.Minute)
+	defer runCloudHandler(ch)()
+
+	ctx := context.Background()
+	assert.NoError(ch.DispatchMetric(ctx, newSourceMetric("10.0.0.1")))
+	h.wait(t, 1)
+	assert.NoError(ch.DispatchMetric(ctx, newSourceMetric("10.0.0.2")))
+	h.wait(t, 1)
+	assert.Equal([]types.Tags{
+		{"env:prod", "region:us-east-1", "role:web", "rack:r1", types.StatsdSourceProvider + ":fake+static", types.StatsdSourceID + ":i-1"},
+		{"env:prod", "region:dc1", "rack:r1", types.StatsdSourceProvider + ":static", types.StatsdSourceID + ":10.0.0.2"},
+	}, h.tags())
+}
+
+func TestCloudHandlerHoldTimeout(t *testing.T) {
+	assert := assert.New(t)
+
+	cloud := &fakeCloud{release: make(chan struct{})}
+	h := newSyncHandler()
+	cache, err := cloudprovider.NewCache(cloudprovider.DefaultCacheOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ch := NewCloudHandler(cloud, cache, h, 1, UnresolvedHold, 20*time.Millisecond)
+	defer runCloudHandler(ch)()
+	defer close(cloud.release)
+
+	assert.NoError(ch.DispatchMetric(context.Background(), newSourceMetric("10.0.0.1")))
+	h.wait(t, 1)
+	assert.Equal([]types.Tags{{"env:prod", types.StatsdSourceID + ":10.0.0.1"}}, h.tags())
+	assert.EqualValues(1, ch.GetStats().HeldExpired)
+
+	// The lookup is still in progress but nothing is held anymore
+	assert.NoError(ch.DispatchMetric(context.Background(), newSourceMetric("10.0.0.1")))
+	h.wait(t, 1)
+	assert.EqualValues(0, ch.GetStats().Held)
+}
+
+func TestCloudHandlerTagLater(t *testing.T) {
+	assert := assert.New(t)
+
+	cloud := &fakeCloud{instances: map[string]*cloudTypes.Instance{"10.0.0.1": testInstance}, release: make(chan struct{})}
+	h := newSyncHandler()
+	cache, err := cloudprovider.NewCache(cloudprovider.DefaultCacheOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ch := NewCloudHandler(cloud, cache, h, 1, UnresolvedTagLater, time.Minute)
+	defer runCloudHandler(ch)()
+
+	assert.NoError(ch.DispatchMetric(context.Background(), newSourceMetric("10.0.0.1")))
+	h.wait(t, 1)
+	assert.Equal(types.Tags{"env:prod", types.StatsdSourceID + ":10.0.0.1"}, h.tags()[0])
+
+	close(cloud.release)
+	for ch.GetStats().Lookups == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	assert.NoError(ch.DispatchMetric(context.Background(), newSourceMetric("10.0.0.1")))
+	h.wait(t, 1)
+	assert.Equal(types.Tags{"env:prod", "region:us-east-1", "role:web", types.StatsdSourceProvider + ":fake", types.StatsdSourceID + ":i-1"}, h.tags()[1])
+}
+
+func TestCloudHandlerLookupError(t *testing.T) {
+	assert := assert.New(t)
+
+	h := newSyncHandler()
+	cache, err := cloudprovider.NewCache(cloudprovider.DefaultCacheOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ch := NewCloudHandler(&fakeCloud{}, cache, h, 1, UnresolvedHold, time.Minute)
+	defer runCloudHandler(ch)()
+
+	assert.NoError(ch.DispatchMetric(context.Background(), newSourceMetric("10.0.0.2")))
+	h.wait(t, 1)
+	assert.NoError(ch.DispatchMetric(context.Background(), newSourceMetric("10.0.0.2")))
+	h.wait(t, 1)
+	for _, tags := range h.tags() {
+		assert.Equal(types.Tags{"env:prod", types.StatsdSourceID + ":10.0.0.2"}, tags)
+	}
+	stats := ch.GetStats()
+	assert.EqualValues(1, stats.Lookups)
+	assert.EqualValues(1, stats.LookupErrors)
+	assert.EqualValues(1, stats.CacheHits)
+}
+
+func TestCloudHandlerRelease(t *testing.T) {
+	assert := assert.New(t)
+
+	h := newSyncHandler()
+	cache, err := cloudprovider.NewCache(cloudprovider.DefaultCacheOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ch := NewCloudHandler(&fakeCloud{}, cache, h, 1, UnresolvedHold, time.Minute) // Not running, nothing is looked up
+
+	assert.NoError(ch.DispatchMetric(context.Background(), newSourceMetric("10.0.0.1")))
+	assert.NoError(ch.DispatchMetric(context.Background(), newSourceMetric("10.0.0.3")))
+	assert.EqualValues(2, ch.GetStats().Held)
+	ch.cache.Update("10.0.0.1", testInstance, nil, time.Now())
+
+	assert.NoError(ch.Release(context.Background()))
+	h.wait(t, 2)
+	assert.EqualValues(0, ch.GetStats().Held)
+	tags := h.tags()
+	assert.Contains(tags, types.Tags{"env:prod", "region:us-east-1", "role:web", types.StatsdSourceProvider + ":fake", types.StatsdSourceID + ":i-1"})
+	assert.Contains(tags, types.Tags{"env:prod", types.StatsdSourceID + ":10.0.0.3"})
+}
+
+func TestCloudHandlerBatchesLookups(t *testing.T) {
+	assert := assert.New(t)
+
+	cloud := &fakeCloud{instances: map[string]*cloudTypes.Instance{"10.0.0.2": testInstance}, release: make(chan struct{})}
+	h := newSyncHandler()
+	cache, err := cloudprovider.NewCache(cloudprovider.DefaultCacheOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ch := NewCloudHandler(cloud, cache, h, 1, UnresolvedHold, time.Minute)
+	defer runCloudHandler(ch)()
+
+	// The worker is blocked on the first lookup while the other IP addresses are queued
+	assert.NoError(ch.DispatchMetric(context.Background(), newSourceMetric("10.0.0.1")))
+	for {
+		cloud.mu.Lock()
+		n := len(cloud.batches)
+		cloud.mu.Unlock()
+		if n > 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	for i := 2; i <= 5; i++ {
+		assert.NoError(ch.DispatchMetric(context.Background(), newSourceMetric(fmt.Sprintf("10.0.0.%d", i))))
+	}
+	close(cloud.release)
+	h.wait(t, 5)
+
+	cloud.mu.Lock()
+	assert.Equal([][]string{{"10.0.0.1"}, {"10.0.0.2", "10.0.0.3", "10.0.0.4"}, {"10.0.0.5"}}, cloud.batches)
+	cloud.mu.Unlock()
+	assert.Contains(h.tags(), types.Tags{"env:prod", "region:us-east-1", "role:web", types.StatsdSourceProvider + ":fake", types.StatsdSourceID + ":i-1"})
+	assert.Contains(h.tags(), types.Tags{"env:prod", types.StatsdSourceID + ":10.0.0.3"})
+	assert.EqualValues(3, ch.GetStats().Lookups)
+}
+
+func TestCloudHandlerRefreshesInstances(t *testing.T) {
+	assert := assert.New(t)
+
+	cloud := &fakeCloud{instances: map[string]*cloudTypes.Instance{}}
+	h := newSyncHandler()
+	cache, err := cloudprovider.NewCache(cloudprovider.CacheOptions{TTL: 10 * time.Minute, RefreshAhead: 5 * time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ch := NewCloudHandler(cloud, cache, h, 1, UnresolvedHold, time.Minute)
+	start := time.Now()
+	var elapsed int64
+	ch.now = func() time.Time {
+		return start.Add(time.Duration(atomic.LoadInt64(&elapsed)))
+	}
+	defer runCloudHandler(ch)()
+	waitLookups := func(n uint64) {
+		for ch.GetStats().Lookups < n {
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	cache.Update("10.0.0.1", testInstance, nil, start)
+	cloud.instances["10.0.0.1"] = &cloudTypes.Instance{ID: "i-1", Region: "us-east-1", Tags: types.Tags{"role:api"}}
+	atomic.StoreInt64(&elapsed, int64(6*time.Minute))
+	assert.NoError(ch.DispatchMetric(context.Background(), newSourceMetric("10.0.0.1")))
+	h.wait(t, 1)
+	waitLookups(1)
+	assert.NoError(ch.DispatchMetric(context.Background(), newSourceMetric("10.0.0.1")))
+	h.wait(t, 1)
+
+	// The instance is terminated
+	delete(cloud.instances, "10.0.0.1")
+	atomic.StoreInt64(&elapsed, int64(12*time.Minute))
+	assert.NoError(ch.DispatchMetric(context.Background(), newSourceMetric("10.0.0.1")))
+	h.wait(t, 1)
+	waitLookups(2)
+	assert.NoError(ch.DispatchMetric(context.Background(), newSourceMetric("10.0.0.1")))
+	h.wait(t, 1)
+
+	assert.Equal([]types.Tags{
+		{"env:prod", "region:us-east-1", "role:web", types.StatsdSourceProvider + ":fake", types.StatsdSourceID + ":i-1"},
+		{"env:prod", "region:us-east-1", "role:api", types.StatsdSourceProvider + ":fake", types.StatsdSourceID + ":i-1"},
+		{"env:prod", "region:us-east-1", "role:api", types.StatsdSourceProvider + ":fake", types.StatsdSourceID + ":i-1"},
+		{"env:prod", types.StatsdSourceID + ":10.0.0.1"},
+	}, h.tags())
+	assert.EqualValues(2, ch.GetStats().Refreshes)
+}
@@ -0,0 +1,367 @@
+package statsd
+
+import (
+	"sync"
+	"time"
+
+	"github.com/atlassian/gostatsd/backend/backends/forwarder"
+	backendTypes "github.com/atlassian/gostatsd/backend/types"
+	"github.com/atlassian/gostatsd/cluster"
+	"github.com/atlassian/gostatsd/types"
+
+	log "github.com/Sirupsen/logrus"
+	"golang.org/x/net/context"
+)
+
+// clusterClientTimeout is the timeout of requests forwarding metrics to the other nodes.
+const clusterClientTimeout = 5 * time.Second
+
+// clusterHandler is a Handler that consistently hashes each series to a node of the cluster.
+// Metrics of the series owned by this node are dispatched locally. Metrics of the series owned
+// by other nodes are aggregated per node and forwarded to its ingest endpoint on every flush.
+// Metrics received on the ingest endpoint are always aggregated locally, they are never forwarded again.
+// Late and early metrics are forwarded with their timestamp, the owner applies its timestamp policy to them.
+type clusterHandler struct {
+	self               string
+	secret             string // Shared secret of the ingest endpoints
+	flushInterval      time.Duration
+	timestampTolerance time.Duration
+	ring               *cluster.Ring
+	dispatcher         Dispatcher
+	handler            Handler // Handler for local metrics and events
+
+	mu      sync.RWMutex
+	peers   map[string]*clusterPeer
+	changed chan struct{} // Signals Run to move the series whose owner changed
+}
+
+// clusterPeer holds the metrics pending forwarding to a node.
+type clusterPeer struct {
+	mu      sync.Mutex
+	aggr    Aggregator
+	backend backendTypes.Backend
+}
+
+func newClusterHandler(self, secret string, flushInterval, timestampTolerance time.Duration, dispatcher Dispatcher, handler Handler) *clusterHandler {
+	return &clusterHandler{
+		self:               self,
+		secret:             secret,
+		flushInterval:      flushInterval,
+		timestampTolerance: timestampTolerance,
+		ring:               cluster.NewRing(cluster.DefaultReplicas),
+		dispatcher:         dispatcher,
+		handler:            handler,
+		peers:              make(map[string]*clusterPeer),
+		changed:            make(chan struct{}, 1),
+	}
+}
+
+func (ch *clusterHandler) newAggregator() Aggregator {
+	timestampPolicy := TimestampPolicy{Late: LateBucket, Tolerance: ch.timestampTolerance}
+	return NewAggregator(nil, DefaultIdlePolicies, timestampPolicy, ch.flushInterval, 0, nil)
+}
+
+// SetPeers updates the members of the cluster, including this node. Series are rebalanced
+// among the new members: the metrics pending forwarding to removed nodes are routed again,
+// and Run moves the series of the current interval that are now owned by another node.
+func (ch *clusterHandler) SetPeers(peers []string) {
+	if !ch.ring.SetNodes(peers) {
+		return
+	}
+	nodes := ch.ring.Nodes()
+	log.Infof("Cluster membership changed: %v", nodes)
+
+	ch.mu.Lock()
+	current := make(map[string]bool, len(nodes))
+	found := false
+	for _, node := range nodes {
+		current[node] = true
+		if node == ch.self {
+			found = true
+			continue
+		}
+		if _, ok := ch.peers[node]; ok {
+			continue
+		}
+		b, err := forwarder.NewClient("http://"+node, ch.secret, true, clusterClientTimeout, ch.flushInterval)
+		if err != nil {
+			log.Errorf("Cannot forward metrics to cluster node %s: %v", node, err)
+			continue
+		}
+		ch.peers[node] = &clusterPeer{aggr: ch.newAggregator(), backend: b}
+	}
+	var removed []*clusterPeer
+	for node, p := range ch.peers {
+		if !current[node] {
+			delete(ch.peers, node)
+			removed = append(removed, p)
+		}
+	}
+	ch.mu.Unlock()
+
+	select {
+	case ch.changed <- struct{}{}:
+	default: // A rebalance is already pending
+	}
+	if !found {
+		log.Warnf("This node %s is not a member of the cluster, all metrics will be forwarded", ch.self)
+	}
+	for _, p := range removed {
+		p.mu.Lock()
+		m := p.aggr.Flush(time.Now)
+		buckets := p.aggr.FlushBuckets(time.Now)
+		p.mu.Unlock()
+		for _, m := range append([]*types.MetricMap{m}, buckets...) {
+			ch.route(context.Background(), m)
+		}
+	}
+}
+
+// DispatchMetric dispatches the metric locally or to the node owning the series.
+func (ch *clusterHandler) DispatchMetric(ctx context.Context, m *types.Metric) error {
+	if m.TagSet == nil {
+		m.TagSet = types.NewTagSet(m.Tags)
+	}
+	if p := ch.peer(m.Name, m.TagSet.Key()); p != nil {
+		p.mu.Lock()
+		p.aggr.Receive(m, time.Now())
+		p.mu.Unlock()
+		return nil
+	}
+	return ch.handler.DispatchMetric(ctx, m)
+}
+
+// DispatchEvent dispatches the event locally, events are not aggregated.
+func (ch *clusterHandler) DispatchEvent(ctx context.Context, e *types.Event) error {
+	return ch.handler.DispatchEvent(ctx, e)
+}
+
+// peer returns the peer owning the series, or nil if it is owned by this node.
+func (ch *clusterHandler) peer(name, tagsKey string) *clusterPeer {
+	owner := ch.ring.Owner(name, tagsKey)
+	if owner == "" || owner == ch.self {
+		return nil
+	}
+	ch.mu.RLock()
+	defer ch.mu.RUnlock()
+	return ch.peers[owner]
+}
+
+// route dispatches each series of the map locally or to the node owning it.
+func (ch *clusterHandler) route(ctx context.Context, m *types.MetricMap) {
+	local := &types.MetricMap{
+		Timestamp: m.Timestamp,
+		Counters:  types.Counters{},
+		Timers:    types.Timers{},
+		Gauges:    types.Gauges{},
+		Sets:      types.Sets{},
+	}
+	receive := func(name, tagsKey string, f func(*types.MetricMap)) {
+		if isInternalStat(name) {
+			return // Internal statistics of the pending aggregator
+		}
+		if p := ch.peer(name, tagsKey); p != nil {
+			part := &types.MetricMap{Timestamp: m.Timestamp}
+			f(part)
+			p.mu.Lock()
+			p.aggr.ReceiveMap(part, time.Now())
+			p.mu.Unlock()
+		} else {
+			f(local)
+		}
+	}
+	m.Counters.Each(func(key, tagsKey string, counter types.Counter) {
+		receive(key, tagsKey, func(part *types.MetricMap) {
+			part.Counters = addCounter(part.Counters, key, tagsKey, counter)
+		})
+	})
+	m.Timers.Each(func(key, tagsKey string, timer types.Timer) {
+		receive(key, tagsKey, func(part *types.MetricMap) {
+			part.Timers = addTimer(part.Timers, key, tagsKey, timer)
+		})
+	})
+	m.Gauges.Each(func(key, tagsKey string, gauge types.Gauge) {
+		receive(key, tagsKey, func(part *types.MetricMap) {
+			part.Gauges = addGauge(part.Gauges, key, tagsKey, gauge)
+		})
+	})
+	m.Sets.Each(func(key, tagsKey string, set types.Set) {
+		receive(key, tagsKey, func(part *types.MetricMap) {
+			part.Sets = addSet(part.Sets, key, tagsKey, set)
+		})
+	})
+	if err := ch.dispatcher.DispatchMetricMap(ctx, local); err != nil {
+		log.Warnf("Failed to dispatch rebalanced metrics: %v", err)
+	}
+}
+
+// Run forwards the pending metrics to the other nodes on every flush interval until the context is done.
+// The metrics received since the last interval are forwarded by the final flush on shutdown.
+func (ch *clusterHandler) Run(ctx context.Context) error {
+	ticker := time.NewTicker(ch.flushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+			ch.forward(ctx)
+		case <-ch.changed:
+			ch.rebalance(ctx)
+		}
+	}
+}
+
+// rebalance moves the series aggregated locally or pending forwarding to a node that are now owned
+// by another node, so that the values of the current interval are emitted by their owner only.
+// Idle series are not moved, their values were already emitted by the previous owner.
+func (ch *clusterHandler) rebalance(ctx context.Context) {
+	ch.dispatcher.Drain(ctx).Wait() // Aggregate the metrics queued before the change
+
+	var mu sync.Mutex
+	var moved []*types.MetricMap
+	ch.dispatcher.Process(ctx, func(m *types.MetricMap) {
+		part := ch.takeMoved(ch.self, m)
+		mu.Lock()
+		moved = append(moved, part)
+		mu.Unlock()
+	}).Wait()
+
+	ch.mu.RLock()
+	peers := make(map[string]*clusterPeer, len(ch.peers))
+	for node, p := range ch.peers {
+		peers[node] = p
+	}
+	ch.mu.RUnlock()
+	for node, p := range peers {
+		p.mu.Lock()
+		p.aggr.Process(func(m *types.MetricMap) {
+			moved = append(moved, ch.takeMoved(node, m))
+		})
+		p.mu.Unlock()
+	}
+
+	for _, m := range moved {
+		ch.route(ctx, m)
+	}
+}
+
+// takeMoved deletes the series owned by another node than owner from the map,
+// and returns those that are not idle.
+func (ch *clusterHandler) takeMoved(owner string, m *types.MetricMap) *types.MetricMap {
+	moved := &types.MetricMap{}
+	isMoved := func(name, tagsKey string) bool {
+		if isInternalStat(name) {
+			return false
+		}
+		o := ch.ring.Owner(name, tagsKey)
+		return o != "" && o != owner
+	}
+	m.Counters.Each(func(key, tagsKey string, counter types.Counter) {
+		if isMoved(key, tagsKey) {
+			deleteMetric(key, tagsKey, m.Counters)
+			if !counter.Idle {
+				moved.Counters = addCounter(moved.Counters, key, tagsKey, counter)
+			}
+		}
+	})
+	m.Timers.Each(func(key, tagsKey string, timer types.Timer) {
+		if isMoved(key, tagsKey) {
+			deleteMetric(key, tagsKey, m.Timers)
+			if !timer.Idle {
+				moved.Timers = addTimer(moved.Timers, key, tagsKey, timer)
+			}
+		}
+	})
+	m.Gauges.Each(func(key, tagsKey string, gauge types.Gauge) {
+		if isMoved(key, tagsKey) {
+			deleteMetric(key, tagsKey, m.Gauges)
+			if !gauge.Idle {
+				moved.Gauges = addGauge(moved.Gauges, key, tagsKey, gauge)
+			}
+		}
+	})
+	m.Sets.Each(func(key, tagsKey string, set types.Set) {
+		if isMoved(key, tagsKey) {
+			deleteMetric(key, tagsKey, m.Sets)
+			if !set.Idle {
+				moved.Sets = addSet(moved.Sets, key, tagsKey, set)
+			}
+		}
+	})
+	return moved
+}
+
+// forward sends the pending metrics to the other nodes. The returned WaitGroup is done once they are sent.
+func (ch *clusterHandler) forward(ctx context.Context) *sync.WaitGroup {
+	ch.mu.RLock()
+	peers := make(map[string]*clusterPeer, len(ch.peers))
+	for node, p := range ch.peers {
+		peers[node] = p
+	}
+	ch.mu.RUnlock()
+
+	var wg sync.WaitGroup
+	wg.Add(len(peers))
+	for node, p := range peers {
+		p.mu.Lock()
+		aggr := p.aggr
+		p.aggr = ch.newAggregator()
+		p.mu.Unlock()
+
+		maps := append([]*types.MetricMap{aggr.Flush(time.Now)}, aggr.FlushBuckets(time.Now)...)
+		go func(node string, b backendTypes.Backend, maps []*types.MetricMap) {
+			defer wg.Done()
+			for _, m := range maps {
+				if err := b.SendMetrics(ctx, m); err != nil {
+					log.Errorf("Forwarding metrics to cluster node %s failed: %v", node, err)
+				}
+			}
+		}(node, p.backend, maps)
+	}
+	return &wg
+}
+
+func addCounter(c types.Counters, key, tagsKey string, counter types.Counter) types.Counters {
+	if c == nil {
+		c = types.Counters{}
+	}
+	if c[key] == nil {
+		c[key] = make(map[string]types.Counter)
+	}
+	c[key][tagsKey] = counter
+	return c
+}
+
+func addTimer(t types.Timers, key, tagsKey string, timer types.Timer) types.Timers {
+	if t == nil {
+		t = types.Timers{}
+	}
+	if t[key] == nil {
+		t[key] = make(map[string]types.Timer)
+	}
+	t[key][tagsKey] = timer
+	return t
+}
+
+func addGauge(g types.Gauges, key, tagsKey string, gauge types.Gauge) types.Gauges {
+	if g == nil {
+		g = types.Gauges{}
+	}
+	if g[key] == nil {
+		g[key] = make(map[string]types.Gauge)
+	}
+	g[key][tagsKey] = gauge
+	return g
+}
+
+func addSet(s types.Sets, key, tagsKey string, set types.Set) types.Sets {
+	if s == nil {
+		s = types.Sets{}
+	}
+	if s[key] == nil {
+		s[key] = make(map[string]types.Set)
+	}
+	s[key][tagsKey] = set
+	return s
+}
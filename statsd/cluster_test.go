@@ -0,0 +1,332 @@
+package statsd
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/atlassian/gostatsd/backend"
+	"github.com/atlassian/gostatsd/backend/backends/forwarder"
+	backendTypes "github.com/atlassian/gostatsd/backend/types"
+	"github.com/atlassian/gostatsd/types"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+// captureBackend records the sum of the counters it receives, by node.
+type captureBackend struct {
+	node     int
+	mu       *sync.Mutex
+	counters map[string]map[int]int64
+}
+
+func (b *captureBackend) BackendName() string  { return fmt.Sprintf("capture%d", b.node) }
+func (b *captureBackend) SampleConfig() string { return "" }
+
+func (b *captureBackend) SendMetrics(ctx context.Context, m *types.MetricMap) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	m.Counters.Each(func(key, tagsKey string, counter types.Counter) {
+		if strings.HasPrefix(key, internalStatName("")) || counter.Value == 0 {
+			return
+		}
+		if b.counters[key] == nil {
+			b.counters[key] = make(map[int]int64)
+		}
+		b.counters[key][b.node] += counter.Value
+	})
+	return nil
+}
+
+func (b *captureBackend) SendEvent(ctx context.Context, e *types.Event) error {
+	return nil
+}
+
+func freeAddr(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+// TestClusterAggregatesSeriesOnOwner runs several Servers on loopback and checks that each series
+// is aggregated and sent to the backends by exactly one node.
+func TestClusterAggregatesSeriesOnOwner(t *testing.T) {
+	const numNodes = 3
+	const numSeries = 30
+
+	var mu sync.Mutex
+	counters := make(map[string]map[int]int64)
+	ingestAddrs := make([]string, numNodes)
+	for i := range ingestAddrs {
+		ingestAddrs[i] = freeAddr(t)
+		b := &captureBackend{node: i, mu: &mu, counters: counters}
+		backend.RegisterBackend(b.BackendName(), func(v *viper.Viper) (backendTypes.Backend, error) {
+			return b, nil
+		})
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	defer cancel()
+
+	conns := make([]net.PacketConn, numNodes)
+	for i := range conns {
+		c, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		conns[i] = c
+		s := NewServer()
+		s.Backends = []string{fmt.Sprintf("capture%d", i)}
+		s.ConsoleAddr = ""
+		s.FlushInterval = 50 * time.Millisecond
+		s.MaxReaders = 1
+		s.MaxWorkers = 2
+		s.IngestAddr = ingestAddrs[i]
+		s.ClusterPeers = ingestAddrs
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := s.RunWithCustomSocket(ctx, func() (net.PacketConn, error) { return c, nil }); err != nil && err != context.Canceled {
+				t.Errorf("server failed: %v", err)
+			}
+		}()
+	}
+
+	// Send every series to every node
+	for _, c := range conns {
+		sender, err := net.Dial("udp", c.LocalAddr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < numSeries; i++ {
+			if _, err := fmt.Fprintf(sender, "series.%d:1|c|#env:test", i); err != nil {
+				t.Fatal(err)
+			}
+		}
+		sender.Close()
+	}
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		mu.Lock()
+		complete := len(counters) == numSeries
+		for _, byNode := range counters {
+			var sum int64
+			for _, value := range byNode {
+				sum += value
+			}
+			complete = complete && sum == numNodes
+		}
+		mu.Unlock()
+		if complete || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Len(t, counters, numSeries)
+	owners := make(map[int]bool)
+	for name, byNode := range counters {
+		assert.Len(t, byNode, 1, "series %s was sent by several nodes: %v", name, byNode)
+		for node, value := range byNode {
+			assert.Equal(t, int64(numNodes), value, "series %s", name)
+			owners[node] = true
+		}
+	}
+	assert.Len(t, owners, numNodes, "all the nodes should own some series")
+}
+
+func TestClusterRebalancesPendingMetrics(t *testing.T) {
+	assert := assert.New(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	d := NewDispatcher(1, 10, &agrFactory{flushInterval: time.Second})
+	go d.Run(ctx)
+
+	local := &countingHandler{}
+	ch := newClusterHandler("self:8127", "", time.Minute, DefaultTimestampTolerance, d, local)
+	ch.SetPeers([]string{"self:8127", "other:8127"})
+
+	const numSeries = 100
+	for i := 0; i < numSeries; i++ {
+		assert.NoError(ch.DispatchMetric(ctx, &types.Metric{Name: fmt.Sprintf("series.%d", i), Value: 1, Type: types.COUNTER}))
+	}
+
+	// The other node leaves, its pending metrics are aggregated locally
+	ch.SetPeers([]string{"self:8127"})
+	assert.Empty(ch.peers)
+
+	count := local.count
+	d.Process(ctx, func(m *types.MetricMap) {
+		m.Counters.Each(func(key, tagsKey string, counter types.Counter) {
+			if strings.HasPrefix(key, "series.") {
+				count += int(counter.Value)
+			}
+		})
+	}).Wait()
+	assert.True(local.count > 0)
+	assert.Equal(numSeries, count)
+}
+
+func TestClusterForwardsPendingMetricsOnShutdown(t *testing.T) {
+	assert := assert.New(t)
+
+	var mu sync.Mutex
+	var forwarded int64
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var p forwarder.Payload
+		if err := forwarder.Decode(r.Body, r.Header.Get("Content-Encoding"), &p); err != nil {
+			t.Error(err)
+		}
+		mu.Lock()
+		for _, c := range p.Counters {
+			forwarded += c.Value
+		}
+		mu.Unlock()
+	}))
+	defer ts.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	d := NewDispatcher(1, 10, &agrFactory{flushInterval: time.Second})
+	go d.Run(ctx)
+
+	local := &countingHandler{}
+	ch := newClusterHandler("self:8127", "", time.Minute, DefaultTimestampTolerance, d, local)
+	ch.SetPeers([]string{"self:8127", strings.TrimPrefix(ts.URL, "http://")})
+
+	const numSeries = 100
+	for i := 0; i < numSeries; i++ {
+		assert.NoError(ch.DispatchMetric(ctx, &types.Metric{Name: fmt.Sprintf("series.%d", i), Value: 1, Type: types.COUNTER}))
+	}
+
+	// Shut down before the next forwarding interval
+	s := NewServer()
+	receiver := NewMetricReceiver("", nil, nopHandler{})
+	s.flushRemaining(d, NewFlusher(time.Second, false, d, receiver, nil, nil, nil), nil, ch)
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.True(forwarded > 0)
+	assert.Equal(int64(numSeries), forwarded+int64(local.count))
+}
+
+func TestClusterMovesSeriesWhenANodeJoins(t *testing.T) {
+	assert := assert.New(t)
+
+	var mu sync.Mutex
+	var forwarded int64
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var p forwarder.Payload
+		if err := forwarder.Decode(r.Body, r.Header.Get("Content-Encoding"), &p); err != nil {
+			t.Error(err)
+		}
+		mu.Lock()
+		for _, c := range p.Counters {
+			forwarded += c.Value
+		}
+		mu.Unlock()
+	}))
+	defer ts.Close()
+	other := strings.TrimPrefix(ts.URL, "http://")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	d := NewDispatcher(1, 10, &agrFactory{flushInterval: time.Second})
+	go d.Run(ctx)
+
+	ch := newClusterHandler("self:8127", "", time.Minute, DefaultTimestampTolerance, d, &countingHandler{})
+	ch.SetPeers([]string{"self:8127"})
+	<-ch.changed
+
+	const numSeries = 100
+	for i := 0; i < numSeries; i++ {
+		assert.NoError(d.DispatchMetric(ctx, &types.Metric{Name: fmt.Sprintf("series.%d", i), Value: 1, Type: types.COUNTER}))
+	}
+
+	// The other node joins in the middle of the interval
+	ch.SetPeers([]string{"self:8127", other})
+	select {
+	case <-ch.changed:
+	default:
+		t.Fatal("rebalance not signalled")
+	}
+	ch.rebalance(ctx)
+	ch.forward(ctx).Wait()
+
+	local := 0
+	d.Process(ctx, func(m *types.MetricMap) {
+		m.Counters.Each(func(key, tagsKey string, counter types.Counter) {
+			if strings.HasPrefix(key, "series.") {
+				assert.Equal("self:8127", ch.ring.Owner(key, tagsKey), key)
+				local += int(counter.Value)
+			}
+		})
+	}).Wait()
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.True(local > 0)
+	assert.True(forwarded > 0)
+	assert.Equal(int64(numSeries), forwarded+int64(local))
+}
+
+func TestClusterDoesNotMoveIdleSeries(t *testing.T) {
+	assert := assert.New(t)
+
+	ch := newClusterHandler("self:8127", "", time.Minute, DefaultTimestampTolerance, nil, &countingHandler{})
+	ch.SetPeers([]string{"self:8127", "other:8127"})
+
+	m := &types.MetricMap{Counters: types.Counters{}}
+	for i := 0; i < 100; i++ {
+		name := fmt.Sprintf("series.%d", i)
+		counter := types.Counter{Value: 1}
+		counter.Idle = i%2 == 0
+		m.Counters[name] = map[string]types.Counter{"": counter}
+	}
+	expected := types.Counters{}
+	for i := 1; i < 100; i += 2 {
+		name := fmt.Sprintf("series.%d", i)
+		if ch.ring.Owner(name, "") == "other:8127" {
+			expected = addCounter(expected, name, "", m.Counters[name][""])
+		}
+	}
+	moved := ch.takeMoved("self:8127", m)
+
+	// Idle series owned by the other node are deleted but not moved
+	m.Counters.Each(func(key, tagsKey string, counter types.Counter) {
+		assert.Equal("self:8127", ch.ring.Owner(key, tagsKey), key)
+	})
+	assert.NotEmpty(expected)
+	assert.Equal(expected, moved.Counters)
+}
+
+// countingHandler counts the values of the counters it receives.
+type countingHandler struct {
+	count int
+}
+
+func (h *countingHandler) DispatchMetric(ctx context.Context, m *types.Metric) error {
+	h.count += int(m.Value)
+	return nil
+}
+
+func (h *countingHandler) DispatchEvent(ctx context.Context, e *types.Event) error {
+	return nil
+}
@@ -5,7 +5,9 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"strconv"
 	"sync/atomic"
+	"time"
 
 	"github.com/atlassian/gostatsd/types"
 
@@ -26,6 +28,8 @@ type ConsoleServer struct {
 	Receiver
 	Dispatcher
 	Flusher
+	CloudHandler *CloudHandler // nil if there is no cloud provider
+	Tail         *TailHandler
 }
 
 // ListenAndServe listens on the ConsoleServer's TCP network address and then calls Serve.
@@ -67,24 +71,52 @@ func (c *consoleConn) serve(ctx context.Context) {
 
 	commands := map[string]cmd.CmdFn{
 		"help": func(args []string) (string, error) {
-			return "Commands: stats, counters, timers, gauges, delcounters, deltimers, delgauges, quit\n", nil
+			return "Commands: stats, counters, timers, gauges, delcounters, deltimers, delgauges, tail, quit\n", nil
 		},
 		"stats": func(args []string) (string, error) {
 			receiverStats := c.server.Receiver.GetStats()
 			flusherStats := c.server.Flusher.GetStats()
+			cloudStats := ""
+			if c.server.CloudHandler != nil {
+				stats := c.server.CloudHandler.GetStats()
+				var lookupTime time.Duration
+				if stats.Lookups > 0 {
+					lookupTime = stats.LookupTime / time.Duration(stats.Lookups)
+				}
+				cloudStats = fmt.Sprintf(
+					"Cloud cache hits: %d\n"+
+						"Cloud cache misses: %d\n"+
+						"Cloud cache refreshes: %d\n"+
+						"Cloud lookups: %d\n"+
+						"Cloud lookup errors: %d\n"+
+						"Cloud lookups dropped: %d\n"+
+						"Cloud average lookup time: %s\n"+
+						"Held metrics: %d\n"+
+						"Held metrics released after the hold timeout: %d\n",
+					stats.CacheHits,
+					stats.CacheMisses,
+					stats.Refreshes,
+					stats.Lookups,
+					stats.LookupErrors,
+					stats.LookupsDropped,
+					lookupTime,
+					stats.Held,
+					stats.HeldExpired)
+			}
 			return fmt.Sprintf(
 				"Invalid messages received: %d\n"+
 					"Metrics received: %d\n"+
 					"Packets received: %d\n"+
 					"Last packet received: %s\n"+
 					"Last flush to backends: %s\n"+
-					"Last error from backends: %s\n",
+					"Last error from backends: %s\n%s",
 				receiverStats.BadLines,
 				receiverStats.MetricsReceived,
 				receiverStats.PacketsReceived,
 				receiverStats.LastPacket,
 				flusherStats.LastFlush,
-				flusherStats.LastFlushError), nil
+				flusherStats.LastFlushError,
+				cloudStats), nil
 		},
 		"counters": func(args []string) (string, error) {
 			return c.printMetrics(ctx, getCounters)
@@ -114,6 +146,9 @@ func (c *consoleConn) serve(ctx context.Context) {
 			i := c.delete(ctx, args, getSets)
 			return fmt.Sprintf("deleted %d sets\n", i), nil
 		},
+		"tail": func(args []string) (string, error) {
+			return c.tail(ctx, args)
+		},
 		"quit": func(args []string) (string, error) {
 			return "goodbye\n", errClientQuit
 		},
@@ -142,6 +177,47 @@ func (c *consoleConn) delete(ctx context.Context, keys []string, f mapperFunc) u
 	return counter
 }
 
+// tail writes the metrics and events matching the pattern in args to the connection as they are dispatched,
+// until the number of lines in args is written, if any, or the client sends a line or goes away.
+func (c *consoleConn) tail(ctx context.Context, args []string) (string, error) {
+	const usage = "usage: tail <pattern> [n]\n"
+	if len(args) < 1 || len(args) > 2 {
+		return usage, nil
+	}
+	n := 0
+	if len(args) == 2 {
+		var err error
+		if n, err = strconv.Atoi(args[1]); err != nil || n < 1 {
+			return usage, nil
+		}
+	}
+	sub, err := c.server.Tail.Subscribe(args[0])
+	if err != nil {
+		return err.Error() + "\n", nil
+	}
+	defer c.server.Tail.Unsubscribe(sub)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	readDone := make(chan struct{})
+	go func() {
+		defer close(readDone)
+		defer cancel()
+		buf := make([]byte, 512)
+		_, _ = c.conn.Read(buf) // Any input stops the tail
+	}()
+	fmt.Fprintf(c.conn, "tailing %s, press enter to stop\n", args[0])
+	err = sub.Stream(ctx, c.conn, n, nil)
+	// Stop reading and give the connection back to the console
+	_ = c.conn.SetReadDeadline(time.Now())
+	<-readDone
+	_ = c.conn.SetReadDeadline(time.Time{})
+	if err != nil && err != context.Canceled {
+		return "", err
+	}
+	return "", nil
+}
+
 type mapperFunc func(*types.MetricMap) types.AggregatedMetrics
 
 func (c *consoleConn) printMetrics(ctx context.Context, f mapperFunc) (string, error) {
@@ -15,8 +15,10 @@ import (
 type Dispatcher interface {
 	Run(context.Context) error
 	DispatchMetric(context.Context, *types.Metric) error
+	DispatchMetricMap(context.Context, *types.MetricMap) error
 	Flush(context.Context) <-chan *types.MetricMap
 	Process(context.Context, ProcessFunc) *sync.WaitGroup
+	Drain(context.Context) *sync.WaitGroup
 }
 
 // AggregatorFactory creates Aggregator objects.
@@ -44,11 +46,17 @@ type processCommand struct {
 	wg sync.WaitGroup
 }
 
+type drainCommand struct {
+	wg sync.WaitGroup
+}
+
 type worker struct {
-	aggr         Aggregator
-	flushChan    chan *flushCommand
-	metricsQueue chan *types.Metric
-	processChan  chan *processCommand
+	aggr           Aggregator
+	flushChan      chan *flushCommand
+	metricsQueue   chan *types.Metric
+	metricMapQueue chan *types.MetricMap
+	processChan    chan *processCommand
+	drainChan      chan *drainCommand
 }
 
 type dispatcher struct {
@@ -64,10 +72,12 @@ func NewDispatcher(numWorkers int, perWorkerBufferSize int, af AggregatorFactory
 
 	for i := uint16(0); i < n; i++ {
 		workers[i] = worker{
-			aggr:         af.Create(),
-			flushChan:    make(chan *flushCommand),
-			metricsQueue: make(chan *types.Metric, perWorkerBufferSize),
-			processChan:  make(chan *processCommand),
+			aggr:           af.Create(),
+			flushChan:      make(chan *flushCommand),
+			metricsQueue:   make(chan *types.Metric, perWorkerBufferSize),
+			metricMapQueue: make(chan *types.MetricMap),
+			processChan:    make(chan *processCommand),
+			drainChan:      make(chan *drainCommand),
 		}
 	}
 	return &dispatcher{
@@ -98,8 +108,7 @@ func (d *dispatcher) Run(ctx context.Context) error {
 
 // DispatchMetric dispatches metric to a corresponding Aggregator.
 func (d *dispatcher) DispatchMetric(ctx context.Context, m *types.Metric) error {
-	hash := adler32.Checksum([]byte(m.Name))
-	w := d.workers[uint16(hash%uint32(d.numWorkers))]
+	w := d.workers[d.workerID(m.Name)]
 	select {
 	case <-ctx.Done():
 		return ctx.Err()
@@ -108,6 +117,54 @@ func (d *dispatcher) DispatchMetric(ctx context.Context, m *types.Metric) error
 	}
 }
 
+// DispatchMetricMap splits pre-aggregated metrics by name among Aggregators and dispatches each part to
+// the Aggregator that owns the names, so that they are merged with the metrics received locally.
+func (d *dispatcher) DispatchMetricMap(ctx context.Context, m *types.MetricMap) error {
+	parts := make(map[uint16]*types.MetricMap, d.numWorkers)
+	part := func(name string) *types.MetricMap {
+		id := d.workerID(name)
+		p, ok := parts[id]
+		if !ok {
+			p = &types.MetricMap{
+				Timestamp:     m.Timestamp,
+				FlushInterval: m.FlushInterval,
+				Counters:      types.Counters{},
+				Timers:        types.Timers{},
+				Gauges:        types.Gauges{},
+				Sets:          types.Sets{},
+			}
+			parts[id] = p
+		}
+		return p
+	}
+	for name, value := range m.Counters {
+		part(name).Counters[name] = value
+	}
+	for name, value := range m.Timers {
+		part(name).Timers[name] = value
+	}
+	for name, value := range m.Gauges {
+		part(name).Gauges[name] = value
+	}
+	for name, value := range m.Sets {
+		part(name).Sets[name] = value
+	}
+	for id, p := range parts {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case d.workers[id].metricMapQueue <- p:
+		}
+	}
+	return nil
+}
+
+// workerID returns the id of the worker that owns the metric name.
+func (d *dispatcher) workerID(name string) uint16 {
+	hash := adler32.Checksum([]byte(name))
+	return uint16(hash % uint32(d.numWorkers))
+}
+
 // Flush calls Flush on all managed Aggregators and returns results.
 func (d *dispatcher) Flush(ctx context.Context) <-chan *types.MetricMap {
 	results := make(chan *types.MetricMap, d.numWorkers) // Enough capacity not to block workers
@@ -158,6 +215,26 @@ loop:
 	return &cmd.wg
 }
 
+// Drain makes all Aggregators receive the metrics buffered in their queues. It is used on shutdown,
+// after the metrics stopped being dispatched, so that the final flush includes all the received metrics.
+func (d *dispatcher) Drain(ctx context.Context) *sync.WaitGroup {
+	cmd := &drainCommand{}
+	cmd.wg.Add(len(d.workers))
+	cmdSent := 0
+loop:
+	for _, worker := range d.workers {
+		select {
+		case <-ctx.Done():
+			cmd.wg.Add(cmdSent - len(d.workers)) // Not all commands have been sent, should decrement the WG counter.
+			break loop
+		case worker.drainChan <- cmd:
+			cmdSent++
+		}
+	}
+
+	return &cmd.wg
+}
+
 func (w *worker) work(wg *sync.WaitGroup) {
 	defer wg.Done()
 
@@ -169,10 +246,14 @@ func (w *worker) work(wg *sync.WaitGroup) {
 				return
 			}
 			w.aggr.Receive(metric, time.Now())
+		case m := <-w.metricMapQueue:
+			w.aggr.ReceiveMap(m, time.Now())
 		case cmd := <-w.flushChan:
 			w.executeFlush(cmd)
 		case cmd := <-w.processChan:
 			w.executeProcess(cmd)
+		case cmd := <-w.drainChan:
+			w.executeDrain(cmd)
 		}
 	}
 }
@@ -180,10 +261,14 @@ func (w *worker) work(wg *sync.WaitGroup) {
 func (w *worker) executeFlush(cmd *flushCommand) {
 	defer cmd.wg.Done()              // Done with the flush command
 	result := w.aggr.Flush(time.Now) // pass func for stubbing
+	buckets := w.aggr.FlushBuckets(time.Now)
 	w.aggr.Reset(time.Now())
-	select {
-	case <-cmd.ctx.Done():
-	case cmd.result <- result:
+	for _, m := range append([]*types.MetricMap{result}, buckets...) {
+		select {
+		case <-cmd.ctx.Done():
+			return
+		case cmd.result <- m:
+		}
 	}
 }
 
@@ -191,3 +276,20 @@ func (w *worker) executeProcess(cmd *processCommand) {
 	defer cmd.wg.Done() // Done with the process command
 	w.aggr.Process(cmd.f)
 }
+
+func (w *worker) executeDrain(cmd *drainCommand) {
+	defer cmd.wg.Done() // Done with the drain command
+	for {
+		select {
+		case metric, ok := <-w.metricsQueue:
+			if !ok {
+				return
+			}
+			w.aggr.Receive(metric, time.Now())
+		case m := <-w.metricMapQueue:
+			w.aggr.ReceiveMap(m, time.Now())
+		default:
+			return
+		}
+	}
+}
@@ -25,6 +25,12 @@ func (a *testAggregator) Receive(m *types.Metric, t time.Time) {
 	a.af.Mutex.Unlock()
 }
 
+func (a *testAggregator) ReceiveMap(m *types.MetricMap, t time.Time) {
+	a.af.Mutex.Lock()
+	a.af.receiveInvocations[a.agrNumber]++
+	a.af.Mutex.Unlock()
+}
+
 func (a *testAggregator) Flush(f func() time.Time) *types.MetricMap {
 	a.af.Mutex.Lock()
 	a.af.flushInvocations[a.agrNumber]++
@@ -32,6 +38,10 @@ func (a *testAggregator) Flush(f func() time.Time) *types.MetricMap {
 	return nil
 }
 
+func (a *testAggregator) FlushBuckets(f func() time.Time) []*types.MetricMap {
+	return nil
+}
+
 func (a *testAggregator) Process(f ProcessFunc) {
 	a.af.Mutex.Lock()
 	defer a.af.Mutex.Unlock()
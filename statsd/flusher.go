@@ -1,7 +1,6 @@
 package statsd
 
 import (
-	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -22,6 +21,7 @@ type FlusherStats struct {
 // Flusher periodically flushes metrics from all Aggregators to Senders.
 type Flusher interface {
 	Run(context.Context) error
+	Flush(context.Context)
 	GetStats() FlusherStats
 }
 
@@ -33,42 +33,68 @@ type flusher struct {
 	lastFlushError int64 // Time of the last flush error. Unix timestamp in nsec.
 
 	flushInterval time.Duration // How often to flush metrics to the sender
+	alignFlush    bool          // Whether to flush on multiples of the flush interval
 	dispatcher    Dispatcher
 	receiver      Receiver
-	defaultTags   string
+	cloudHandler  *CloudHandler
+	defaultTags   *types.TagSet
 	backends      []backendTypes.Backend
 
 	// Sent statistics for Receiver. Keep sent values to calculate diff.
 	sentBadLines        uint64
 	sentPacketsReceived uint64
 	sentMetricsReceived uint64
+	// Sent statistics for CloudHandler.
+	sentCloudStats CloudHandlerStats
 }
 
 // NewFlusher creates a new Flusher with provided configuration.
-func NewFlusher(flushInterval time.Duration, dispatcher Dispatcher, receiver Receiver, defaultTags []string, backends []backendTypes.Backend) Flusher {
+// If alignFlush is true, metrics are flushed on multiples of the flush interval of the wall clock,
+// e.g. on :00, :10, :20... with a 10s flush interval.
+// The statistics of cloudHandler are sent with the internal statistics, unless it is nil.
+func NewFlusher(flushInterval time.Duration, alignFlush bool, dispatcher Dispatcher, receiver Receiver, cloudHandler *CloudHandler, defaultTags []string, backends []backendTypes.Backend) Flusher {
 	return &flusher{
 		flushInterval: flushInterval,
+		alignFlush:    alignFlush,
 		dispatcher:    dispatcher,
 		receiver:      receiver,
-		defaultTags:   strings.Join(defaultTags, ","),
+		cloudHandler:  cloudHandler,
+		defaultTags:   types.NewTagSet(defaultTags),
 		backends:      backends,
 	}
 }
 
 // Run runs the Flusher.
 func (f *flusher) Run(ctx context.Context) error {
-	flushTimer := time.NewTimer(f.flushInterval)
 	for {
+		flushTime := f.nextFlush(time.Now())
+		flushTimer := time.NewTimer(flushTime.Sub(time.Now()))
 		select {
 		case <-ctx.Done():
+			flushTimer.Stop()
 			return ctx.Err()
 		case <-flushTimer.C: // Time to flush to the backends
-			f.flushData(ctx)
-			flushTimer = time.NewTimer(f.flushInterval)
+			if !f.alignFlush {
+				flushTime = time.Now()
+			}
+			f.flushData(ctx, flushTime)
 		}
 	}
 }
 
+// nextFlush returns the time of the next flush after now.
+func (f *flusher) nextFlush(now time.Time) time.Time {
+	if f.alignFlush {
+		return now.Truncate(f.flushInterval).Add(f.flushInterval)
+	}
+	return now.Add(f.flushInterval)
+}
+
+// Flush flushes the metrics to the backends immediately. It must not be called while Run is running.
+func (f *flusher) Flush(ctx context.Context) {
+	f.flushData(ctx, time.Now())
+}
+
 // GetStats returns Flusher statistics.
 func (f *flusher) GetStats() FlusherStats {
 	return FlusherStats{
@@ -77,7 +103,9 @@ func (f *flusher) GetStats() FlusherStats {
 	}
 }
 
-func (f *flusher) flushData(ctx context.Context) {
+// flushData flushes the Aggregators and sends the results to the backends.
+// The metrics that do not have a timestamp of their own are sent with flushTime.
+func (f *flusher) flushData(ctx context.Context, flushTime time.Time) {
 	results := f.dispatcher.Flush(ctx)
 	var totalStats uint32
 	for {
@@ -86,9 +114,12 @@ func (f *flusher) flushData(ctx context.Context) {
 			return
 		case result, ok := <-results:
 			if !ok {
-				f.sendFlushedData(ctx, f.internalStats(totalStats))
+				f.sendFlushedData(ctx, f.internalStats(totalStats, flushTime))
 				return
 			}
+			if result.Timestamp.IsZero() {
+				result.Timestamp = flushTime
+			}
 			totalStats += result.NumStats
 			f.sendFlushedData(ctx, result)
 		}
@@ -118,9 +149,8 @@ func (f *flusher) handleSendResult(flushResult error) {
 	}
 }
 
-func (f *flusher) internalStats(totalStats uint32) *types.MetricMap {
+func (f *flusher) internalStats(totalStats uint32, now time.Time) *types.MetricMap {
 	receiverStats := f.receiver.GetStats()
-	now := time.Now()
 	c := make(types.Counters, 4)
 	f.addCounter(c, "bad_lines_seen", now, int64(receiverStats.BadLines-f.sentBadLines))
 	f.addCounter(c, "metrics_received", now, int64(receiverStats.MetricsReceived-f.sentMetricsReceived))
@@ -133,20 +163,56 @@ func (f *flusher) internalStats(totalStats uint32) *types.MetricMap {
 	f.sentMetricsReceived = receiverStats.MetricsReceived
 	f.sentPacketsReceived = receiverStats.PacketsReceived
 
-	return &types.MetricMap{
+	m := &types.MetricMap{
+		Timestamp:      now,
 		NumStats:       4,
 		ProcessingTime: time.Duration(0),
 		FlushInterval:  f.flushInterval,
 		Counters:       c,
 	}
+	if f.cloudHandler != nil {
+		f.addCloudStats(m, now)
+	}
+	return m
+}
+
+// addCloudStats adds the statistics of the CloudHandler since the last flush to m.
+func (f *flusher) addCloudStats(m *types.MetricMap, now time.Time) {
+	stats := f.cloudHandler.GetStats()
+	sent := f.sentCloudStats
+	f.addCounter(m.Counters, "cloud.cache_hits", now, int64(stats.CacheHits-sent.CacheHits))
+	f.addCounter(m.Counters, "cloud.cache_misses", now, int64(stats.CacheMisses-sent.CacheMisses))
+	f.addCounter(m.Counters, "cloud.refreshes", now, int64(stats.Refreshes-sent.Refreshes))
+	f.addCounter(m.Counters, "cloud.lookups", now, int64(stats.Lookups-sent.Lookups))
+	f.addCounter(m.Counters, "cloud.lookup_errors", now, int64(stats.LookupErrors-sent.LookupErrors))
+	f.addCounter(m.Counters, "cloud.lookups_dropped", now, int64(stats.LookupsDropped-sent.LookupsDropped))
+	f.addCounter(m.Counters, "cloud.held_expired", now, int64(stats.HeldExpired-sent.HeldExpired))
+
+	var lookupTime float64 // Average in milliseconds
+	if lookups := stats.Lookups - sent.Lookups; lookups > 0 {
+		lookupTime = float64(stats.LookupTime-sent.LookupTime) / float64(lookups) / float64(time.Millisecond)
+	}
+	m.Gauges = make(types.Gauges, 2)
+	f.addGauge(m.Gauges, "cloud.lookup_time", now, lookupTime)
+	f.addGauge(m.Gauges, "cloud.held", now, float64(stats.Held))
+	m.NumStats += 9
+
+	f.sentCloudStats = stats
 }
 
 func (f *flusher) addCounter(c types.Counters, name string, timestamp time.Time, value int64) {
 	counter := types.NewCounter(timestamp, f.flushInterval, value)
+	counter.TagSet = f.defaultTags
 	counter.PerSecond = float64(counter.Value) / (float64(f.flushInterval) / float64(time.Second))
 
 	elem := make(map[string]types.Counter, 1)
-	elem[f.defaultTags] = counter
+	elem[f.defaultTags.Key()] = counter
 
 	c[internalStatName(name)] = elem
 }
+
+func (f *flusher) addGauge(g types.Gauges, name string, timestamp time.Time, value float64) {
+	gauge := types.NewGauge(timestamp, f.flushInterval, value)
+	gauge.TagSet = f.defaultTags
+	g[internalStatName(name)] = map[string]types.Gauge{f.defaultTags.Key(): gauge}
+}
@@ -0,0 +1,85 @@
+package statsd
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	backendTypes "github.com/atlassian/gostatsd/backend/types"
+	"github.com/atlassian/gostatsd/types"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+// timestampBackend records the timestamps of the metric maps it receives.
+type timestampBackend struct {
+	mu         sync.Mutex
+	timestamps []time.Time
+}
+
+func (b *timestampBackend) BackendName() string  { return "timestamp" }
+func (b *timestampBackend) SampleConfig() string { return "" }
+
+func (b *timestampBackend) SendMetrics(ctx context.Context, m *types.MetricMap) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.timestamps = append(b.timestamps, m.Timestamp)
+	return nil
+}
+
+func (b *timestampBackend) SendEvent(ctx context.Context, e *types.Event) error {
+	return nil
+}
+
+func TestNextFlush(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Unix(1500000003, 500)
+	f := NewFlusher(10*time.Second, false, nil, nil, nil, nil, nil).(*flusher)
+	assert.Equal(now.Add(10*time.Second), f.nextFlush(now))
+
+	f = NewFlusher(10*time.Second, true, nil, nil, nil, nil, nil).(*flusher)
+	assert.Equal(time.Unix(1500000010, 0), f.nextFlush(now))
+	assert.Equal(time.Unix(1500000020, 0), f.nextFlush(time.Unix(1500000010, 0)))
+}
+
+func TestFlushDataUsesSingleTimestamp(t *testing.T) {
+	assert := assert.New(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	d := NewDispatcher(4, 10, &agrFactory{flushInterval: time.Second})
+	go d.Run(ctx)
+
+	b := &timestampBackend{}
+	receiver := NewMetricReceiver("", nil, nopHandler{})
+	f := NewFlusher(time.Second, true, d, receiver, nil, nil, []backendTypes.Backend{b}).(*flusher)
+
+	flushTime := time.Unix(1500000010, 0)
+	f.flushData(ctx, flushTime)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	assert.Len(b.timestamps, 4+1) // One map per worker and the internal stats
+	for _, ts := range b.timestamps {
+		assert.Equal(flushTime, ts)
+	}
+}
+
+func TestInternalStatsNames(t *testing.T) {
+	assert := assert.New(t)
+
+	receiver := NewMetricReceiver("", nil, nopHandler{})
+	f := NewFlusher(time.Second, false, nil, receiver, &CloudHandler{}, nil, nil).(*flusher)
+	for _, m := range []*types.MetricMap{f.internalStats(0, time.Now()), newFakeAggregator().Flush(time.Now)} {
+		m.Counters.Each(func(key, tagsKey string, counter types.Counter) {
+			assert.True(types.IsInternalStat(key), key)
+		})
+		m.Gauges.Each(func(key, tagsKey string, gauge types.Gauge) {
+			assert.True(types.IsInternalStat(key), key)
+		})
+	}
+	assert.False(types.IsInternalStat("statsd.client.requests"))
+}
@@ -0,0 +1,80 @@
+package statsd
+
+import (
+	"fmt"
+	"strings"
+)
+
+// IdlePolicy is what happens to a series that did not receive any value during a flush interval.
+type IdlePolicy byte
+
+const (
+	// IdleZero sends the series with a zero value until it expires.
+	IdleZero IdlePolicy = iota
+	// IdleSkip keeps the series until it expires but does not send it while it is idle.
+	IdleSkip
+	// IdleDelete deletes the series after each flush, so it is never sent while idle.
+	IdleDelete
+	// IdleLast sends the series with the values of the last interval it was updated in, until it expires.
+	IdleLast
+)
+
+func (p IdlePolicy) String() string {
+	switch p {
+	case IdleSkip:
+		return "skip"
+	case IdleDelete:
+		return "delete"
+	case IdleLast:
+		return "last"
+	default:
+		return "zero"
+	}
+}
+
+// ParseIdlePolicy parses the name of an IdlePolicy: zero, skip, delete or last.
+func ParseIdlePolicy(s string) (IdlePolicy, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "zero":
+		return IdleZero, nil
+	case "skip":
+		return IdleSkip, nil
+	case "delete":
+		return IdleDelete, nil
+	case "last":
+		return IdleLast, nil
+	}
+	return IdleZero, fmt.Errorf("invalid idle policy %q: must be one of zero, skip, delete or last", s)
+}
+
+// IdlePolicies holds the IdlePolicy of each type of metric.
+type IdlePolicies struct {
+	Counters IdlePolicy
+	Timers   IdlePolicy
+	Gauges   IdlePolicy
+	Sets     IdlePolicy
+}
+
+// DefaultIdlePolicies are the default idle policies: gauges keep sending their last value,
+// other types send zero.
+var DefaultIdlePolicies = IdlePolicies{
+	Counters: IdleZero,
+	Timers:   IdleZero,
+	Gauges:   IdleLast,
+	Sets:     IdleZero,
+}
+
+// ParseIdlePolicies parses the idle policies of each type of metric.
+func ParseIdlePolicies(counters, timers, gauges, sets string) (IdlePolicies, error) {
+	var p IdlePolicies
+	var err error
+	for _, policy := range []struct {
+		s string
+		p *IdlePolicy
+	}{{counters, &p.Counters}, {timers, &p.Timers}, {gauges, &p.Gauges}, {sets, &p.Sets}} {
+		if *policy.p, err = ParseIdlePolicy(policy.s); err != nil {
+			return p, err
+		}
+	}
+	return p, nil
+}
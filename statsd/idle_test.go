@@ -0,0 +1,167 @@
+package statsd
+
+import (
+	"testing"
+	"time"
+
+	"github.com/atlassian/gostatsd/types"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseIdlePolicies(t *testing.T) {
+	assert := assert.New(t)
+
+	p, err := ParseIdlePolicies("zero", "Skip", "last", " delete ")
+	assert.NoError(err)
+	assert.Equal(IdlePolicies{Counters: IdleZero, Timers: IdleSkip, Gauges: IdleLast, Sets: IdleDelete}, p)
+
+	for _, policy := range []IdlePolicy{IdleZero, IdleSkip, IdleDelete, IdleLast} {
+		parsed, err := ParseIdlePolicy(policy.String())
+		assert.NoError(err)
+		assert.Equal(policy, parsed)
+	}
+
+	_, err = ParseIdlePolicies("zero", "zero", "forever", "zero")
+	assert.Error(err)
+}
+
+// flushIdle receives a counter, gauge, timer and set, then flushes twice without receiving anything
+// else and returns the second flush, where all the series are idle.
+func flushIdle(t *testing.T, policy IdlePolicy) *types.MetricMap {
+	policies := IdlePolicies{Counters: policy, Timers: policy, Gauges: policy, Sets: policy}
+	ma := NewAggregator(nil, policies, DefaultTimestampPolicy, 10*time.Second, 5*time.Minute, nil).(*aggregator)
+	now := time.Now()
+	ma.lastFlush = now.Add(-10 * time.Second)
+	nowFn := func() time.Time { return now }
+
+	ma.Receive(&types.Metric{Name: "c", Value: 5, Type: types.COUNTER}, now.Add(-time.Second))
+	ma.Receive(&types.Metric{Name: "g", Value: 7, Type: types.GAUGE}, now.Add(-time.Second))
+	ma.Receive(&types.Metric{Name: "t", Value: 3, Type: types.TIMER}, now.Add(-time.Second))
+	ma.Receive(&types.Metric{Name: "s", StringValue: "joe", Type: types.SET}, now.Add(-time.Second))
+	first := ma.Flush(nowFn)
+	ma.Reset(now)
+	assert.False(t, first.Counters["c"][""].Idle)
+	assert.False(t, first.Gauges["g"][""].Idle)
+	assert.False(t, first.Timers["t"][""].Idle)
+	assert.False(t, first.Sets["s"][""].Idle)
+
+	now = now.Add(10 * time.Second)
+	m := ma.Flush(nowFn)
+	ma.Reset(now)
+	return m
+}
+
+func TestIdlePolicies(t *testing.T) {
+	assert := assert.New(t)
+
+	m := flushIdle(t, IdleZero)
+	if assert.Contains(m.Counters, "c") {
+		assert.True(m.Counters["c"][""].Idle)
+		assert.Equal(int64(0), m.Counters["c"][""].Value)
+	}
+	if assert.Contains(m.Gauges, "g") {
+		assert.Equal(float64(0), m.Gauges["g"][""].Value)
+	}
+	if assert.Contains(m.Timers, "t") {
+		assert.Equal(0, m.Timers["t"][""].Count)
+	}
+	if assert.Contains(m.Sets, "s") {
+		assert.Empty(m.Sets["s"][""].Values)
+	}
+
+	m = flushIdle(t, IdleLast)
+	if assert.Contains(m.Counters, "c") {
+		assert.True(m.Counters["c"][""].Idle)
+		assert.Equal(int64(5), m.Counters["c"][""].Value)
+	}
+	if assert.Contains(m.Gauges, "g") {
+		assert.Equal(float64(7), m.Gauges["g"][""].Value)
+	}
+	if assert.Contains(m.Timers, "t") {
+		assert.Equal(1, m.Timers["t"][""].Count)
+	}
+	if assert.Contains(m.Sets, "s") {
+		assert.Len(m.Sets["s"][""].Values, 1)
+	}
+	assert.False(m.IsEmpty())
+
+	for _, policy := range []IdlePolicy{IdleSkip, IdleDelete} {
+		m = flushIdle(t, policy)
+		assert.NotContains(m.Counters, "c", policy.String())
+		assert.NotContains(m.Gauges, "g", policy.String())
+		assert.NotContains(m.Timers, "t", policy.String())
+		assert.NotContains(m.Sets, "s", policy.String())
+		assert.True(m.IsEmpty(), policy.String()) // Only internal stats are left
+	}
+}
+
+func TestIdleSkipKeepsSeriesUntilExpiry(t *testing.T) {
+	assert := assert.New(t)
+
+	policies := IdlePolicies{Counters: IdleSkip, Timers: IdleSkip, Gauges: IdleSkip, Sets: IdleSkip}
+	ma := NewAggregator(nil, policies, DefaultTimestampPolicy, 10*time.Second, 30*time.Second, nil).(*aggregator)
+	now := time.Now()
+	ma.Receive(&types.Metric{Name: "g", Value: 7, Type: types.GAUGE}, now)
+
+	ma.Reset(now.Add(10 * time.Second))
+	assert.Equal(float64(7), ma.Gauges["g"][""].Value)
+
+	ma.Reset(now.Add(time.Minute))
+	assert.NotContains(ma.Gauges, "g")
+}
+
+func TestIdleLastRestartsOnUpdate(t *testing.T) {
+	assert := assert.New(t)
+
+	policies := IdlePolicies{Counters: IdleLast, Timers: IdleLast, Gauges: IdleLast, Sets: IdleLast}
+	ma := NewAggregator(nil, policies, DefaultTimestampPolicy, 10*time.Second, 5*time.Minute, nil).(*aggregator)
+	now := time.Now()
+	nowFn := func() time.Time { return now }
+	ma.Receive(&types.Metric{Name: "c", Value: 5, Type: types.COUNTER}, now.Add(-time.Second))
+	ma.Receive(&types.Metric{Name: "t", Value: 3, Type: types.TIMER}, now.Add(-time.Second))
+	ma.Receive(&types.Metric{Name: "s", StringValue: "joe", Type: types.SET}, now.Add(-time.Second))
+	ma.Flush(nowFn)
+	ma.Reset(now)
+	assert.True(ma.Counters["c"][""].Idle)
+	assert.True(ma.Timers["t"][""].Idle)
+	assert.True(ma.Sets["s"][""].Idle)
+
+	now = now.Add(10 * time.Second)
+	ma.Receive(&types.Metric{Name: "c", Value: 2, Type: types.COUNTER}, now)
+	ma.Receive(&types.Metric{Name: "t", Value: 4, Type: types.TIMER}, now)
+	ma.Receive(&types.Metric{Name: "s", StringValue: "bob", Type: types.SET}, now)
+	assert.False(ma.Counters["c"][""].Idle)
+	assert.False(ma.Timers["t"][""].Idle)
+	assert.False(ma.Sets["s"][""].Idle)
+	m := ma.Flush(nowFn)
+
+	assert.Equal(int64(2), m.Counters["c"][""].Value)
+	assert.Equal([]float64{4}, m.Timers["t"][""].Values)
+	assert.Equal(map[string]int64{"bob": 1}, m.Sets["s"][""].Values)
+}
+
+func TestIdleLastRecomputesPercentiles(t *testing.T) {
+	assert := assert.New(t)
+
+	policies := IdlePolicies{Counters: IdleLast, Timers: IdleLast, Gauges: IdleLast, Sets: IdleLast}
+	pt := &PercentThresholds{defaults: []float64{90}}
+	ma := NewAggregator(pt, policies, DefaultTimestampPolicy, 10*time.Second, 5*time.Minute, nil).(*aggregator)
+	now := time.Now()
+	nowFn := func() time.Time { return now }
+	ma.Receive(&types.Metric{Name: "t", Value: 3, Type: types.TIMER}, now.Add(-time.Second))
+
+	var counts []int
+	for i := 0; i < 3; i++ {
+		m := ma.Flush(nowFn)
+		ma.Reset(now)
+		counts = append(counts, len(m.Timers["t"][""].Percentiles))
+		now = now.Add(10 * time.Second)
+	}
+	assert.Equal([]int{5, 5, 5}, counts)
+
+	ma.Receive(&types.Metric{Name: "t", Value: 4, Type: types.TIMER}, now)
+	m := ma.Flush(nowFn)
+	assert.Len(m.Timers["t"][""].Percentiles, 5)
+	assert.Equal([]float64{4}, m.Timers["t"][""].Values)
+}
@@ -0,0 +1,142 @@
+package statsd
+
+import (
+	"crypto/subtle"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/atlassian/gostatsd/backend/backends/forwarder"
+	"github.com/atlassian/gostatsd/types"
+
+	log "github.com/Sirupsen/logrus"
+	"golang.org/x/net/context"
+)
+
+// maxIngestBodySize is the maximum size of the body of a request to the ingest endpoint.
+const maxIngestBodySize = 64 << 20
+
+// IngestStats holds statistics about an IngestServer.
+type IngestStats struct {
+	RequestsReceived uint64
+	BadRequests      uint64
+	SeriesReceived   uint64
+}
+
+// IngestServer is an object that listens for HTTP requests on a TCP address Addr and merges
+// metrics forwarded by other gostatsd servers into its Dispatcher's aggregators.
+// Forwarded events are passed to the Handler. If Secret is set, requests must carry it in the
+// forwarder.SecretHeader header. Set members are merged by union, their counts are not forwarded.
+type IngestServer struct {
+	// Counter fields below must be read/written only using atomic instructions.
+	requestsReceived uint64
+	badRequests      uint64
+	seriesReceived   uint64
+
+	Addr          string
+	Secret        string // Shared secret required from the senders, optional
+	FlushInterval time.Duration
+	Dispatcher    Dispatcher
+	Handler       Handler
+
+	interner *types.TagInterner
+}
+
+// NewIngestServer creates a new IngestServer.
+func NewIngestServer(addr, secret string, flushInterval time.Duration, dispatcher Dispatcher, handler Handler) *IngestServer {
+	return &IngestServer{
+		Addr:          addr,
+		Secret:        secret,
+		FlushInterval: flushInterval,
+		Dispatcher:    dispatcher,
+		Handler:       handler,
+		interner:      types.NewTagInterner(types.DefaultTagInternerSize),
+	}
+}
+
+// ListenAndServe listens on the IngestServer's TCP network address and then calls Serve.
+func (s *IngestServer) ListenAndServe(ctx context.Context) error {
+	l, err := net.Listen("tcp", s.Addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(ctx, l)
+}
+
+// Serve accepts incoming HTTP requests on the listener until the context is done.
+func (s *IngestServer) Serve(ctx context.Context, l net.Listener) error {
+	go func() {
+		<-ctx.Done()
+		l.Close() // Makes Serve return
+	}()
+	err := http.Serve(l, s.handler(ctx))
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	default:
+		return err
+	}
+}
+
+// GetStats returns IngestServer statistics.
+func (s *IngestServer) GetStats() IngestStats {
+	return IngestStats{
+		RequestsReceived: atomic.LoadUint64(&s.requestsReceived),
+		BadRequests:      atomic.LoadUint64(&s.badRequests),
+		SeriesReceived:   atomic.LoadUint64(&s.seriesReceived),
+	}
+}
+
+func (s *IngestServer) handler(ctx context.Context) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(forwarder.MetricsPath, func(w http.ResponseWriter, r *http.Request) {
+		var payload forwarder.Payload
+		if !s.decode(w, r, &payload) {
+			return
+		}
+		atomic.AddUint64(&s.seriesReceived, uint64(payload.Len()))
+		m := payload.MetricMap(s.interner, time.Now(), s.FlushInterval)
+		if err := s.Dispatcher.DispatchMetricMap(ctx, m); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	})
+	mux.HandleFunc(forwarder.EventsPath, func(w http.ResponseWriter, r *http.Request) {
+		var event forwarder.Event
+		if !s.decode(w, r, &event) {
+			return
+		}
+		if err := s.Handler.DispatchEvent(ctx, event.Event()); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	})
+	return mux
+}
+
+// decode decodes the body of the request into v and writes an error response if it fails.
+func (s *IngestServer) decode(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	atomic.AddUint64(&s.requestsReceived, 1)
+	if r.Method != "POST" {
+		atomic.AddUint64(&s.badRequests, 1)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return false
+	}
+	if s.Secret != "" && subtle.ConstantTimeCompare([]byte(r.Header.Get(forwarder.SecretHeader)), []byte(s.Secret)) != 1 {
+		atomic.AddUint64(&s.badRequests, 1)
+		log.Debugf("Rejecting request to %s from %s without the ingest secret", r.URL.Path, r.RemoteAddr)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	err := forwarder.Decode(http.MaxBytesReader(w, r.Body, maxIngestBodySize), r.Header.Get("Content-Encoding"), v)
+	if err != nil {
+		atomic.AddUint64(&s.badRequests, 1)
+		log.Debugf("Error decoding request to %s from %s: %v", r.URL.Path, r.RemoteAddr, err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,137 @@
+package statsd
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/atlassian/gostatsd/backend/backends/forwarder"
+	"github.com/atlassian/gostatsd/types"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+func TestIngestMergesForwardedMetrics(t *testing.T) {
+	assert := assert.New(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	factory := &agrFactory{flushInterval: time.Second}
+	d := NewDispatcher(2, 10, factory)
+	go d.Run(ctx)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewIngestServer(l.Addr().String(), "", time.Second, d, nopHandler{})
+	go s.Serve(ctx, l)
+
+	// A metric received locally
+	assert.NoError(d.DispatchMetric(ctx, &types.Metric{Name: "c", Value: 1, Type: types.COUNTER, Tags: types.Tags{"env:prod"}}))
+
+	// The same series forwarded by another server
+	now := time.Now()
+	tags := types.NewTagSet(types.Tags{"env:prod"})
+	counter := types.NewCounter(now, time.Second, 5)
+	counter.TagSet = tags
+	timer := types.NewTimer(now, time.Second, []float64{1, 2})
+	timer.TagSet = tags
+	b, err := forwarder.NewClient("http://"+l.Addr().String(), "", true, time.Second, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(b.SendMetrics(ctx, &types.MetricMap{
+		Counters: types.Counters{"c": {tags.Key(): counter}},
+		Timers:   types.Timers{"t": {tags.Key(): timer}},
+	}))
+
+	merged := make(chan types.MetricMap, 2)
+	d.Process(ctx, func(m *types.MetricMap) {
+		merged <- types.MetricMap{Counters: m.Counters.Clone(), Timers: m.Timers.Clone()}
+	}).Wait()
+	close(merged)
+
+	var value int64
+	var values []float64
+	for m := range merged {
+		value += m.Counters["c"]["env:prod"].Value
+		values = append(values, m.Timers["t"]["env:prod"].Values...)
+	}
+	assert.Equal(int64(6), value)
+	assert.Equal([]float64{1, 2}, values)
+
+	stats := s.GetStats()
+	assert.Equal(uint64(1), stats.RequestsReceived)
+	assert.Equal(uint64(2), stats.SeriesReceived)
+}
+
+func TestIngestRejectsBadRequests(t *testing.T) {
+	assert := assert.New(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewIngestServer(l.Addr().String(), "", time.Second, nil, nopHandler{})
+	go s.Serve(ctx, l)
+
+	url := "http://" + l.Addr().String() + forwarder.MetricsPath
+	resp, err := http.Post(url, "application/json", strings.NewReader("{"))
+	if assert.NoError(err) {
+		resp.Body.Close()
+		assert.Equal(http.StatusBadRequest, resp.StatusCode)
+	}
+	resp, err = http.Get(url)
+	if assert.NoError(err) {
+		resp.Body.Close()
+		assert.Equal(http.StatusMethodNotAllowed, resp.StatusCode)
+	}
+	assert.Equal(uint64(2), s.GetStats().BadRequests)
+}
+
+func TestIngestRequiresSecret(t *testing.T) {
+	assert := assert.New(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	d := NewDispatcher(1, 10, &agrFactory{flushInterval: time.Second})
+	go d.Run(ctx)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewIngestServer(l.Addr().String(), "s3cret", time.Second, d, nopHandler{})
+	go s.Serve(ctx, l)
+
+	m := &types.MetricMap{Counters: types.Counters{"c": {"": types.NewCounter(time.Now(), time.Second, 5)}}}
+	for _, tc := range []struct {
+		secret   string
+		accepted bool
+	}{
+		{"", false},
+		{"wrong", false},
+		{"s3cret", true},
+	} {
+		b, err := forwarder.NewClient("http://"+l.Addr().String(), tc.secret, true, time.Second, time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = b.SendMetrics(ctx, m)
+		assert.Equal(tc.accepted, err == nil, "secret %q: %v", tc.secret, err)
+	}
+
+	stats := s.GetStats()
+	assert.Equal(uint64(3), stats.RequestsReceived)
+	assert.Equal(uint64(2), stats.BadRequests)
+	assert.Equal(uint64(1), stats.SeriesReceived)
+}
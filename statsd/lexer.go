@@ -5,6 +5,8 @@ import (
 	"errors"
 	"math"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/atlassian/gostatsd/types"
 )
@@ -22,6 +24,7 @@ type lexer struct {
 	namespace     string
 	err           error
 	sampling      float64
+	packed        []float64 // Values after the first one of a line with several values
 }
 
 // assumes we don't have \x00 bytes in input.
@@ -74,18 +77,26 @@ func (l *lexer) run(input []byte, namespace string) (*types.Metric, *types.Event
 	}
 	if l.m != nil {
 		if l.m.Type != types.SET {
-			v, err := strconv.ParseFloat(l.m.StringValue, 64)
+			// Numeric values can be packed in a single line, e.g. "a:1:2:3|ms"
+			values := strings.Split(l.m.StringValue, ":")
+			v, err := parseValue(values[0])
 			if err != nil {
 				return nil, nil, err
 			}
-			if math.IsNaN(v) {
-				return nil, nil, errNaN
-			}
 			l.m.Value = v
 			l.m.StringValue = ""
+			for _, value := range values[1:] {
+				if v, err = parseValue(value); err != nil {
+					return nil, nil, err
+				}
+				l.packed = append(l.packed, v)
+			}
 		}
 		if l.m.Type == types.COUNTER {
 			l.m.Value = l.m.Value / l.sampling
+			for i := range l.packed {
+				l.packed[i] /= l.sampling
+			}
 		}
 		l.m.Tags = l.tags
 	} else {
@@ -94,6 +105,17 @@ func (l *lexer) run(input []byte, namespace string) (*types.Metric, *types.Event
 	return l.m, l.e, nil
 }
 
+func parseValue(s string) (float64, error) {
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, err
+	}
+	if math.IsNaN(v) {
+		return 0, errNaN
+	}
+	return v, nil
+}
+
 type stateFn func(*lexer) stateFn
 
 // check the first byte for special Datadog type.
@@ -379,37 +401,48 @@ func lexType(l *lexer) stateFn {
 	}
 }
 
-// lex the possible separator between type and sampling rate.
+// lex the possible separator between type and the optional fields.
 func lexTypeSep(l *lexer) stateFn {
 	b := l.next()
 	switch b {
 	case eof:
 		return nil
 	case '|':
-		l.start = l.pos
-		return lexSampleRateOrTags
+		return lexMetricField
 	}
 	l.err = errInvalidType
 	return nil
 }
 
-// lex the sample rate or the tags.
-func lexSampleRateOrTags(l *lexer) stateFn {
-	b := l.next()
-	switch b {
+// lex an optional field: the sample rate, the tags or the timestamp.
+func lexMetricField(l *lexer) stateFn {
+	switch b := l.next(); b {
 	case '@':
-		l.start = l.pos
-		for {
-			switch b := l.next(); b {
-			case '|':
-				return lexSampleRate
-			case eof:
-				l.pos++
-				return lexSampleRate
-			}
-		}
+		return lexUntil('|', lexSampleRate)
 	case '#':
 		return lexTags
+	case 'T':
+		return lexUint(func(l *lexer, value uint64) stateFn {
+			if value > math.MaxInt64 {
+				l.err = errOverflow
+				return nil
+			}
+			l.m.Timestamp = time.Unix(int64(value), 0)
+			return lexMetricFieldSep
+		})
+	default:
+		l.err = errInvalidSamplingOrTags
+		return nil
+	}
+}
+
+// lex the separator between optional fields.
+func lexMetricFieldSep(l *lexer) stateFn {
+	switch b := l.next(); b {
+	case eof:
+		return nil
+	case '|':
+		return lexMetricField
 	default:
 		l.err = errInvalidSamplingOrTags
 		return nil
@@ -417,17 +450,14 @@ func lexSampleRateOrTags(l *lexer) stateFn {
 }
 
 // lex the sample rate.
-func lexSampleRate(l *lexer) stateFn {
-	v, err := strconv.ParseFloat(string(l.input[l.start:l.pos-1]), 64)
+func lexSampleRate(l *lexer, data []byte) stateFn {
+	v, err := strconv.ParseFloat(string(data), 64)
 	if err != nil {
 		l.err = err
 		return nil
 	}
 	l.sampling = v
-	if l.pos >= l.len {
-		return nil
-	}
-	return lexAssert('#', lexTags)
+	return lexMetricFieldSep
 }
 
 // lex the tags.
@@ -438,6 +468,16 @@ func lexTags(l *lexer) stateFn {
 		case ',':
 			l.tags = append(l.tags, string(l.input[l.start:l.pos-1]))
 			l.start = l.pos
+		case '|':
+			if l.m == nil {
+				// Tags are the last attribute of events
+				l.input = append(l.input[0:l.pos-1], l.input[l.pos:]...)
+				l.len--
+				l.pos--
+				continue
+			}
+			l.tags = append(l.tags, string(l.input[l.start:l.pos-1]))
+			return lexMetricField
 		case eof:
 			l.pos++
 			l.tags = append(l.tags, string(l.input[l.start:l.pos-1]))
@@ -3,6 +3,7 @@ package statsd
 import (
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/atlassian/gostatsd/types"
 )
@@ -27,6 +28,8 @@ func TestMetricsLexer(t *testing.T) {
 		"un1qu3:john|s|#some:42":        {Name: "un1qu3", StringValue: "john", Type: types.SET, Tags: types.Tags{"some:42"}},
 		"da-sh:1|s":                     {Name: "da-sh", StringValue: "1", Type: types.SET},
 		"under_score:1|s":               {Name: "under_score", StringValue: "1", Type: types.SET},
+		"uniq:fe80::1|s":                {Name: "uniq", StringValue: "fe80::1", Type: types.SET},
+		"uniq:10.0.0.1:8080|s":          {Name: "uniq", StringValue: "10.0.0.1:8080", Type: types.SET},
 	}
 
 	compareMetric(tests, "", t)
@@ -51,6 +54,56 @@ func TestInvalidMetricsLexer(t *testing.T) {
 	compareMetric(tests, "stats", t)
 }
 
+func TestTimestampedMetricsLexer(t *testing.T) {
+	ts := time.Unix(1500000000, 0)
+	tests := map[string]types.Metric{
+		"foo.bar.baz:2|c|T1500000000":               {Name: "foo.bar.baz", Value: 2, Type: types.COUNTER, Timestamp: ts},
+		"smp.rte:5|c|@0.1|T1500000000":              {Name: "smp.rte", Value: 50, Type: types.COUNTER, Timestamp: ts},
+		"smp.rte:5|c|#foo:bar,baz|T1500000000":      {Name: "smp.rte", Value: 5, Type: types.COUNTER, Tags: types.Tags{"foo:bar", "baz"}, Timestamp: ts},
+		"smp.rte:5|c|T1500000000|@0.1|#foo:bar,baz": {Name: "smp.rte", Value: 50, Type: types.COUNTER, Tags: types.Tags{"foo:bar", "baz"}, Timestamp: ts},
+		"smp.rte:5|c|#foo:bar,baz|@0.1|T1500000000": {Name: "smp.rte", Value: 50, Type: types.COUNTER, Tags: types.Tags{"foo:bar", "baz"}, Timestamp: ts},
+		"uniq.usr:joe|s|T1500000000|#some:42":       {Name: "uniq.usr", StringValue: "joe", Type: types.SET, Tags: types.Tags{"some:42"}, Timestamp: ts},
+	}
+
+	compareMetric(tests, "", t)
+
+	failing := []string{"foo:2|c|T", "foo:2|c|Tabc", "foo:2|c|T12x", "foo:2|c|T1500000000|", "foo:2|c|T99999999999999999999999"}
+	for _, tc := range failing {
+		result, _, err := parseLine([]byte(tc), "")
+		if err == nil {
+			t.Errorf("test %s: expected error but got %s", tc, result)
+		}
+	}
+}
+
+func TestPackedMetricsLexer(t *testing.T) {
+	tests := map[string][]float64{
+		"def.g:10|ms":          nil,
+		"def.g:10:20:30.5|ms":  {20, 30.5},
+		"smp.rte:5:1|c|@0.1":   {10},
+		"abc.def.g:3:4|g|#a:b": {4},
+		"uniq.usr:a:b:c|s":     nil,
+	}
+	for input, expected := range tests {
+		l := lexer{}
+		if _, _, err := l.run([]byte(input), ""); err != nil {
+			t.Errorf("test %s error: %v", input, err)
+			continue
+		}
+		if !reflect.DeepEqual(l.packed, expected) {
+			t.Errorf("test %s: expected %v, got %v", input, expected, l.packed)
+		}
+	}
+
+	failing := []string{"def.g:10:|ms", "def.g:10:abc|ms", "def.g:10:NaN|ms"}
+	for _, tc := range failing {
+		result, _, err := parseLine([]byte(tc), "")
+		if err == nil {
+			t.Errorf("test %s: expected error but got %s", tc, result)
+		}
+	}
+}
+
 func TestEventsLexer(t *testing.T) {
 	//_e{title.length,text.length}:title|text|d:date_happened|h:hostname|p:priority|t:alert_type|#tag1,tag2
 	tests := map[string]types.Event{
@@ -0,0 +1,76 @@
+package statsd
+
+import (
+	"fmt"
+
+	"github.com/atlassian/gostatsd/types"
+)
+
+// PercentThresholdOverride sets the percentile thresholds applied to the timers whose name matches Pattern.
+// Pattern uses the syntax of types.NamePatterns, e.g. "api.*.latency".
+type PercentThresholdOverride struct {
+	Pattern    string   `mapstructure:"pattern"`
+	Thresholds []string `mapstructure:"thresholds"`
+}
+
+// PercentThresholds holds the validated percentile thresholds applied to timers.
+// A nil *PercentThresholds applies no thresholds.
+type PercentThresholds struct {
+	defaults  []float64
+	patterns  types.NamePatterns
+	overrides map[string][]float64 // By pattern
+}
+
+// NewPercentThresholds parses and validates the default percentile thresholds and the overrides.
+// When several patterns match a timer, the longest one applies.
+func NewPercentThresholds(defaults []string, overrides []PercentThresholdOverride) (*PercentThresholds, error) {
+	pt := &PercentThresholds{overrides: make(map[string][]float64, len(overrides))}
+	var err error
+	if pt.defaults, err = parsePercentThresholds(defaults); err != nil {
+		return nil, err
+	}
+	patterns := make([]string, 0, len(overrides))
+	for _, o := range overrides {
+		thresholds, err := parsePercentThresholds(o.Thresholds)
+		if err != nil {
+			return nil, fmt.Errorf("pattern %q: %v", o.Pattern, err)
+		}
+		patterns = append(patterns, o.Pattern)
+		pt.overrides[o.Pattern] = thresholds
+	}
+	if pt.patterns, err = types.NewNamePatterns(patterns...); err != nil {
+		return nil, fmt.Errorf("percentile thresholds: %v", err)
+	}
+	return pt, nil
+}
+
+// For returns the percentile thresholds to apply to the timer with the given name.
+func (pt *PercentThresholds) For(name string) []float64 {
+	if pt == nil {
+		return nil
+	}
+	if pattern, ok := pt.patterns.Match(name); ok {
+		return pt.overrides[pattern]
+	}
+	return pt.defaults
+}
+
+// parsePercentThresholds parses the thresholds, ignoring empty values and duplicates.
+func parsePercentThresholds(values []string) ([]float64, error) {
+	var thresholds []float64
+	seen := make(map[float64]bool, len(values))
+	for _, value := range values {
+		if value == "" {
+			continue
+		}
+		pct, err := types.ParsePercentThreshold(value)
+		if err != nil {
+			return nil, err
+		}
+		if !seen[pct] {
+			seen[pct] = true
+			thresholds = append(thresholds, pct)
+		}
+	}
+	return thresholds, nil
+}
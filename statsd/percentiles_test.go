@@ -0,0 +1,36 @@
+package statsd
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewPercentThresholds(t *testing.T) {
+	assert := assert.New(t)
+
+	pt, err := NewPercentThresholds([]string{"90", "", "90", "-10"}, []PercentThresholdOverride{
+		{Pattern: "api.*", Thresholds: []string{"50"}},
+		{Pattern: "api.*.latency", Thresholds: []string{"99", "99.9"}},
+	})
+	assert.NoError(err)
+	assert.Equal([]float64{90, -10}, pt.For("foo"))
+	assert.Equal([]float64{50}, pt.For("api.requests"))
+	assert.Equal([]float64{99, 99.9}, pt.For("api.users.latency"))
+
+	var nilThresholds *PercentThresholds
+	assert.Nil(nilThresholds.For("foo"))
+}
+
+func TestNewPercentThresholdsInvalid(t *testing.T) {
+	assert := assert.New(t)
+
+	_, err := NewPercentThresholds([]string{"0"}, nil)
+	assert.Error(err)
+	_, err = NewPercentThresholds([]string{"101"}, nil)
+	assert.Error(err)
+	_, err = NewPercentThresholds(nil, []PercentThresholdOverride{{Pattern: "api.*", Thresholds: []string{"-100.5"}}})
+	assert.Error(err)
+	_, err = NewPercentThresholds(nil, []PercentThresholdOverride{{Pattern: "api.[", Thresholds: []string{"90"}}})
+	assert.Error(err)
+}
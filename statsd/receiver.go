@@ -5,12 +5,9 @@ import (
 	"fmt"
 	"io"
 	"net"
-	"strings"
 	"sync/atomic"
 	"time"
 
-	"github.com/atlassian/gostatsd/cloudprovider"
-	cloudTypes "github.com/atlassian/gostatsd/cloudprovider/types"
 	"github.com/atlassian/gostatsd/types"
 
 	log "github.com/Sirupsen/logrus"
@@ -51,19 +48,21 @@ type metricReceiver struct {
 	metricsReceived uint64
 	eventsReceived  uint64
 
-	cloud     cloudTypes.Interface // Cloud provider interface
-	handler   Handler              // handler to invoke
-	namespace string               // Namespace to prefix all metrics
-	tags      types.Tags           // Tags to add to all metrics
+	handler   Handler            // handler to invoke
+	namespace string             // Namespace to prefix all metrics
+	tags      types.Tags         // Tags to add to all metrics
+	interner  *types.TagInterner // Canonical tag sets of the received series
 }
 
 // NewMetricReceiver initialises a new Receiver.
-func NewMetricReceiver(ns string, tags []string, cloud cloudTypes.Interface, handler Handler) Receiver {
+// Metrics and events sent from an IP address are tagged with it, see types.StatsdSourceID.
+// Use a CloudHandler as the handler to tag them with the details of the cloud instance instead.
+func NewMetricReceiver(ns string, tags []string, handler Handler) Receiver {
 	return &metricReceiver{
-		cloud:     cloud,
 		handler:   handler,
 		namespace: ns,
 		tags:      tags,
+		interner:  types.NewTagInterner(types.DefaultTagInternerSize),
 	}
 }
 
@@ -79,11 +78,19 @@ func (mr *metricReceiver) GetStats() ReceiverStats {
 }
 
 // Receive accepts incoming datagrams on c, parses them and calls Handler.HandleMetric() for each metric.
+// On Linux, senders on a unix socket that receives credentials are identified by their process ID,
+// see Server.MetricsSocket.
 func (mr *metricReceiver) Receive(ctx context.Context, c net.PacketConn) error {
 	buf := make([]byte, packetSizeUDP)
+	oob := make([]byte, oobSize)
 	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
 		// This will error out when the socket is closed.
-		nbytes, addr, err := c.ReadFrom(buf)
+		nbytes, addr, err := readFrom(c, buf, oob)
 		if err != nil {
 			if netErr, ok := err.(net.Error); ok && !netErr.Temporary() {
 				select {
@@ -112,8 +119,11 @@ func (mr *metricReceiver) Receive(ctx context.Context, c net.PacketConn) error {
 // for each line that successfully parses into a types.Metric.
 func (mr *metricReceiver) handleMessage(ctx context.Context, addr net.Addr, msg []byte) error {
 	var numMetrics, numEvents uint16
-	var triedToGetTags bool
-	var additionalTags types.Tags
+	source := getSource(addr)
+	var sourceTags types.Tags
+	if source != "" {
+		sourceTags = types.Tags{fmt.Sprintf("%s:%s", types.StatsdSourceID, source)}
+	}
 	var exitError error
 	buf := bytes.NewBuffer(msg)
 	for {
@@ -131,7 +141,7 @@ func (mr *metricReceiver) handleMessage(ctx context.Context, addr net.Addr, msg
 		}
 
 		if len(line) > 1 {
-			metric, event, err := mr.parseLine(line)
+			metric, packed, event, err := mr.parsePackedLine(line)
 			if err != nil {
 				// logging as debug to avoid spamming logs when a bad actor sends
 				// badly formatted messages
@@ -139,19 +149,31 @@ func (mr *metricReceiver) handleMessage(ctx context.Context, addr net.Addr, msg
 				atomic.AddUint64(&mr.badLines, 1)
 				continue
 			}
-			if !triedToGetTags {
-				triedToGetTags = true
-				additionalTags = mr.getAdditionalTags(addr.String())
-			}
 			if metric != nil {
 				numMetrics++
-				metric.Tags = append(metric.Tags, mr.tags...)
-				metric.Tags = append(metric.Tags, additionalTags...)
+				metric.Tags = append(metric.Tags.StripReserved(), mr.tags...)
+				metric.Tags = append(metric.Tags, sourceTags...)
+				metric.Source = source
+				metric.TagSet = mr.interner.Intern(metric.Tags)
+				// Copy the metric for the other values before dispatching it, handlers may change it concurrently
+				metrics := make([]types.Metric, len(packed))
+				for i, value := range packed {
+					metrics[i] = *metric
+					metrics[i].Value = value
+				}
 				err = mr.handler.DispatchMetric(ctx, metric)
+				for i := range metrics {
+					if err != nil {
+						break
+					}
+					numMetrics++
+					err = mr.handler.DispatchMetric(ctx, &metrics[i])
+				}
 			} else if event != nil {
 				numEvents++
-				event.Tags = append(event.Tags, mr.tags...)
-				event.Tags = append(event.Tags, additionalTags...)
+				event.Tags = append(event.Tags.StripReserved(), mr.tags...)
+				event.Tags = append(event.Tags, sourceTags...)
+				event.Source = source
 				if event.DateHappened == 0 {
 					event.DateHappened = time.Now().Unix()
 				}
@@ -176,28 +198,33 @@ func (mr *metricReceiver) handleMessage(ctx context.Context, addr net.Addr, msg
 	return exitError
 }
 
-func (mr *metricReceiver) getAdditionalTags(addr string) types.Tags {
-	n := strings.IndexByte(addr, ':')
-	if n <= 1 {
-		return nil
+// peerAddr is the address of a sender on a unix socket, identified by its process ID.
+type peerAddr struct {
+	pid int32
+}
+
+func (a peerAddr) Network() string {
+	return "unixgram"
+}
+
+func (a peerAddr) String() string {
+	return fmt.Sprintf("pid:%d", a.pid)
+}
+
+// getSource returns the IP address of addr, pid:<pid> if addr is the process of a sender on a unix socket,
+// or an empty string otherwise.
+func getSource(addr net.Addr) string {
+	if addr == nil {
+		return ""
 	}
-	hostname := addr[0:n]
-	if net.ParseIP(hostname) != nil {
-		tags := make(types.Tags, 0, 16)
-		if mr.cloud != nil {
-			instance, err := cloudprovider.GetInstance(mr.cloud, hostname)
-			if err != nil {
-				log.Debugf("Error retrieving instance details from cloud provider %s: %v", mr.cloud.ProviderName(), err)
-			} else {
-				hostname = instance.ID
-				tags = append(tags, fmt.Sprintf("region:%s", instance.Region))
-				tags = append(tags, instance.Tags...)
-			}
-		}
-		tags = append(tags, fmt.Sprintf("%s:%s", types.StatsdSourceID, hostname))
-		return tags
+	if peer, ok := addr.(peerAddr); ok {
+		return peer.String()
 	}
-	return nil
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil || net.ParseIP(host) == nil {
+		return ""
+	}
+	return host
 }
 
 // parseLine with lexer impl.
@@ -205,3 +232,11 @@ func (mr *metricReceiver) parseLine(line []byte) (*types.Metric, *types.Event, e
 	l := lexer{}
 	return l.run(line, mr.namespace)
 }
+
+// parsePackedLine parses a line like parseLine and also returns the values after the first one
+// of a line with several values, e.g. "a:1:2:3|ms".
+func (mr *metricReceiver) parsePackedLine(line []byte) (*types.Metric, []float64, *types.Event, error) {
+	l := lexer{}
+	m, e, err := l.run(line, mr.namespace)
+	return m, l.packed, e, err
+}
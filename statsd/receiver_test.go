@@ -1,11 +1,14 @@
 package statsd
 
 import (
+	"net"
+	"sync"
 	"testing"
 
 	"github.com/atlassian/gostatsd/tester/fakesocket"
 	"github.com/atlassian/gostatsd/types"
 
+	"github.com/stretchr/testify/assert"
 	"golang.org/x/net/context"
 )
 
@@ -32,3 +35,67 @@ func (h nopHandler) DispatchMetric(ctx context.Context, m *types.Metric) error {
 func (h nopHandler) DispatchEvent(ctx context.Context, e *types.Event) error {
 	return context.Canceled // Stops receiver after first read is done
 }
+
+// capturingHandler records the metrics it receives.
+type capturingHandler struct {
+	metrics []*types.Metric
+}
+
+func (h *capturingHandler) DispatchMetric(ctx context.Context, m *types.Metric) error {
+	h.metrics = append(h.metrics, m)
+	return nil
+}
+
+func (h *capturingHandler) DispatchEvent(ctx context.Context, e *types.Event) error {
+	return nil
+}
+
+func TestHandlePackedMessage(t *testing.T) {
+	assert := assert.New(t)
+
+	h := &capturingHandler{}
+	mr := NewMetricReceiver("", nil, h).(*metricReceiver)
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 8125}
+	assert.NoError(mr.handleMessage(context.Background(), addr, []byte("t:1:2:3|ms|#a:b\nc:1|c")))
+
+	var values []float64
+	for _, m := range h.metrics {
+		if m.Name == "t" {
+			values = append(values, m.Value)
+			assert.Equal(types.TIMER, m.Type)
+			assert.Contains(m.Tags, "a:b")
+			assert.Contains(m.Tags, "statsd_source_id:127.0.0.1")
+			assert.Equal("127.0.0.1", m.Source)
+		}
+	}
+	assert.Equal([]float64{1, 2, 3}, values)
+	assert.Len(h.metrics, 4)
+}
+
+// retaggingHandler changes the tags of the metrics it receives in the background, like a CloudHandler holding them.
+type retaggingHandler struct {
+	capturingHandler
+	wg sync.WaitGroup
+}
+
+func (h *retaggingHandler) DispatchMetric(ctx context.Context, m *types.Metric) error {
+	h.wg.Add(1)
+	go func() {
+		defer h.wg.Done()
+		m.Tags = types.Tags{"retagged"}
+	}()
+	return h.capturingHandler.DispatchMetric(ctx, m)
+}
+
+func TestHandlePackedMessageCopiesBeforeDispatch(t *testing.T) {
+	h := &retaggingHandler{}
+	mr := NewMetricReceiver("", nil, h).(*metricReceiver)
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 8125}
+	assert.NoError(t, mr.handleMessage(context.Background(), addr, []byte("t:1:2:3|ms|#a:b")))
+	h.wg.Wait()
+
+	for _, m := range h.metrics {
+		assert.Equal(t, types.Tags{"retagged"}, m.Tags) // Each value was retagged on its own
+	}
+	assert.Len(t, h.metrics, 3)
+}
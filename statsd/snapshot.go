@@ -0,0 +1,180 @@
+package statsd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/atlassian/gostatsd/backend/backends/forwarder"
+	"github.com/atlassian/gostatsd/types"
+
+	log "github.com/Sirupsen/logrus"
+	"golang.org/x/net/context"
+)
+
+// snapshotVersion is the version of the format of snapshot files.
+// It must be incremented when the format changes in a way older versions cannot read.
+const snapshotVersion = 1
+
+// snapshot is the on-disk representation of the state of the aggregators: the gauges and the
+// counters, timers and sets of the current flush interval.
+type snapshot struct {
+	Version     int                  `json:"version"`
+	Time        int64                `json:"time"` // Unix time the snapshot was taken at
+	Aggregators []*forwarder.Payload `json:"aggregators"`
+}
+
+// newSnapshotPayload copies the state of an aggregator. Internal statistics, counters without a value
+// and timers and sets without values are skipped.
+func newSnapshotPayload(m *types.MetricMap) *forwarder.Payload {
+	p := &forwarder.Payload{}
+	m.Counters.Each(func(key, tagsKey string, counter types.Counter) {
+		if !isInternalStat(key) && counter.Value != 0 {
+			p.Counters = append(p.Counters, forwarder.Counter{Name: key, Tags: counter.TagSet.Strings(), Value: counter.Value})
+		}
+	})
+	m.Timers.Each(func(key, tagsKey string, timer types.Timer) {
+		if !isInternalStat(key) && len(timer.Values) > 0 {
+			values := append([]float64(nil), timer.Values...)
+			p.Timers = append(p.Timers, forwarder.Timer{Name: key, Tags: timer.TagSet.Strings(), Values: values})
+		}
+	})
+	m.Gauges.Each(func(key, tagsKey string, gauge types.Gauge) {
+		if !isInternalStat(key) {
+			p.Gauges = append(p.Gauges, forwarder.Gauge{Name: key, Tags: gauge.TagSet.Strings(), Value: gauge.Value})
+		}
+	})
+	m.Sets.Each(func(key, tagsKey string, set types.Set) {
+		if !isInternalStat(key) && len(set.Values) > 0 {
+			values := make([]string, 0, len(set.Values))
+			for value := range set.Values {
+				values = append(values, value)
+			}
+			p.Sets = append(p.Sets, forwarder.Set{Name: key, Tags: set.TagSet.Strings(), Values: values})
+		}
+	})
+	return p
+}
+
+// takeSnapshot copies the state of all the aggregators of the dispatcher.
+func takeSnapshot(ctx context.Context, dispatcher Dispatcher) (*snapshot, error) {
+	s := &snapshot{
+		Version: snapshotVersion,
+		Time:    time.Now().Unix(),
+	}
+	var mu sync.Mutex
+	dispatcher.Process(ctx, func(m *types.MetricMap) {
+		p := newSnapshotPayload(m)
+		mu.Lock()
+		s.Aggregators = append(s.Aggregators, p)
+		mu.Unlock()
+	}).Wait()
+	if err := ctx.Err(); err != nil {
+		return nil, err // Not all the aggregators were copied
+	}
+	return s, nil
+}
+
+// writeSnapshot writes a snapshot of the aggregators of the dispatcher to path.
+// The file is replaced atomically, a crash while writing leaves the previous snapshot in place.
+func writeSnapshot(ctx context.Context, dispatcher Dispatcher, path string) error {
+	s, err := takeSnapshot(ctx, dispatcher)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(s)
+	if err != nil {
+		return fmt.Errorf("unable to marshal snapshot: %v", err)
+	}
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return fmt.Errorf("unable to create snapshot: %v", err)
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return fmt.Errorf("unable to write snapshot: %v", err)
+	}
+	return nil
+}
+
+// readSnapshot reads the snapshot at path.
+func readSnapshot(path string) (*snapshot, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var s snapshot
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, fmt.Errorf("corrupt snapshot: %v", err)
+	}
+	if s.Version != snapshotVersion {
+		return nil, fmt.Errorf("unsupported snapshot version %d", s.Version)
+	}
+	return &s, nil
+}
+
+// restoreSnapshot dispatches the metrics of the snapshot at path to the aggregators of the dispatcher.
+// Nothing is restored if there is no snapshot or if it is older than maxAge, when maxAge is not 0.
+// A snapshot that cannot be read is renamed with a ".corrupt" suffix so that it is not read again.
+// Restored metrics are aggregated in the current flush interval.
+func restoreSnapshot(ctx context.Context, dispatcher Dispatcher, path string, flushInterval, maxAge time.Duration) error {
+	s, err := readSnapshot(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if renameErr := os.Rename(path, path+".corrupt"); renameErr != nil {
+			log.Warnf("Unable to rename unreadable snapshot %s: %v", path, renameErr)
+		}
+		return fmt.Errorf("unable to read snapshot %s: %v", path, err)
+	}
+	taken := time.Unix(s.Time, 0)
+	if maxAge != 0 && time.Since(taken) > maxAge {
+		log.Infof("Ignoring snapshot %s taken at %v, metrics have expired", path, taken)
+		return nil
+	}
+	now := time.Now()
+	var series int
+	for _, p := range s.Aggregators {
+		series += p.Len()
+		if err := dispatcher.DispatchMetricMap(ctx, p.MetricMap(nil, now, flushInterval)); err != nil {
+			return err
+		}
+	}
+	log.Infof("Restored %d series from snapshot %s taken at %v", series, path, taken)
+	return nil
+}
+
+// runSnapshots writes a snapshot of the aggregators of the dispatcher to path on every interval until the context is done.
+func runSnapshots(ctx context.Context, dispatcher Dispatcher, path string, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+			if err := writeSnapshot(ctx, dispatcher, path); err != nil {
+				log.Warnf("Snapshot failed: %v", err)
+			}
+		}
+	}
+}
+
+func isInternalStat(name string) bool {
+	return types.IsInternalStat(name)
+}
@@ -0,0 +1,159 @@
+package statsd
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/atlassian/gostatsd/types"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+// newSnapshotDispatcher starts a dispatcher with aggregators that do not expire metrics.
+func newSnapshotDispatcher(ctx context.Context) Dispatcher {
+	d := NewDispatcher(2, 10, &agrFactory{
+		idlePolicies:    DefaultIdlePolicies,
+		timestampPolicy: DefaultTimestampPolicy,
+		flushInterval:   10 * time.Second,
+	})
+	go d.Run(ctx)
+	return d
+}
+
+// snapshotDir creates a temporary directory for snapshot files.
+func snapshotDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+// dispatcherState returns the counters, gauges and number of timer values and set values of the dispatcher.
+func dispatcherState(ctx context.Context, d Dispatcher) (map[string]int64, map[string]float64, int, int) {
+	var mu sync.Mutex
+	counters := make(map[string]int64)
+	gauges := make(map[string]float64)
+	var timers, sets int
+	d.Drain(ctx).Wait()
+	d.Process(ctx, func(m *types.MetricMap) {
+		mu.Lock()
+		defer mu.Unlock()
+		m.Counters.Each(func(key, tagsKey string, c types.Counter) {
+			if !isInternalStat(key) {
+				counters[key] += c.Value
+			}
+		})
+		m.Gauges.Each(func(key, tagsKey string, g types.Gauge) {
+			gauges[key] = g.Value
+		})
+		m.Timers.Each(func(key, tagsKey string, t types.Timer) {
+			timers += len(t.Values)
+		})
+		m.Sets.Each(func(key, tagsKey string, s types.Set) {
+			sets += len(s.Values)
+		})
+	}).Wait()
+	return counters, gauges, timers, sets
+}
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	assert := assert.New(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dir := snapshotDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "state.json")
+
+	d := newSnapshotDispatcher(ctx)
+	for _, m := range []*types.Metric{
+		{Name: "c1", Value: 3, Type: types.COUNTER},
+		{Name: "c2", Value: 4, Type: types.COUNTER, Tags: types.Tags{"env:prod"}},
+		{Name: "g", Value: 7, Type: types.GAUGE},
+		{Name: "t", Value: 1, Type: types.TIMER},
+		{Name: "t", Value: 2, Type: types.TIMER},
+		{Name: "s", StringValue: "joe", Type: types.SET},
+	} {
+		if err := d.DispatchMetric(ctx, m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	d.Drain(ctx).Wait()
+	if err := writeSnapshot(ctx, d, path); err != nil {
+		t.Fatal(err)
+	}
+
+	restored := newSnapshotDispatcher(ctx)
+	if err := restoreSnapshot(ctx, restored, path, 10*time.Second, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	counters, gauges, timers, sets := dispatcherState(ctx, restored)
+	assert.Equal(map[string]int64{"c1": 3, "c2": 4}, counters)
+	assert.Equal(map[string]float64{"g": 7}, gauges)
+	assert.Equal(2, timers)
+	assert.Equal(1, sets)
+}
+
+func TestRestoreMissingSnapshot(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	assert.NoError(t, restoreSnapshot(ctx, newSnapshotDispatcher(ctx), "/nonexistent/state.json", 10*time.Second, 0))
+}
+
+func TestRestoreCorruptSnapshot(t *testing.T) {
+	assert := assert.New(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dir := snapshotDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "state.json")
+
+	for _, data := range []string{`{"version": 1, "aggr`, `{"version": 99, "aggregators": []}`} {
+		if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		assert.Error(restoreSnapshot(ctx, newSnapshotDispatcher(ctx), path, 10*time.Second, 0), data)
+		_, err := os.Stat(path)
+		assert.True(os.IsNotExist(err), data)
+		_, err = os.Stat(path + ".corrupt")
+		assert.NoError(err, data)
+	}
+}
+
+func TestRestoreStaleSnapshot(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dir := snapshotDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "state.json")
+
+	data, err := json.Marshal(map[string]interface{}{
+		"version": snapshotVersion,
+		"time":    time.Now().Add(-time.Hour).Unix(),
+		"aggregators": []interface{}{
+			map[string]interface{}{"gauges": []interface{}{map[string]interface{}{"name": "g", "value": 7}}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	d := newSnapshotDispatcher(ctx)
+	assert.NoError(t, restoreSnapshot(ctx, d, path, 10*time.Second, time.Minute))
+	_, gauges, _, _ := dispatcherState(ctx, d)
+	assert.Empty(t, gauges)
+}
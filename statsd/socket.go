@@ -0,0 +1,21 @@
+package statsd
+
+import (
+	"fmt"
+	"os"
+)
+
+// removeSocket removes the unix socket at path, if any. Other files are left untouched.
+func removeSocket(path string) error {
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+	return os.Remove(path)
+}
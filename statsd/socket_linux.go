@@ -0,0 +1,55 @@
+package statsd
+
+import (
+	"net"
+	"os"
+	"syscall"
+)
+
+// oobSize is the size of the buffer for the credentials of the senders on a unix socket.
+var oobSize = syscall.CmsgSpace(syscall.SizeofUcred)
+
+// listenUnixgram listens on a unix datagram socket at path. The socket receives the credentials of the
+// senders, so that they are identified by their process ID.
+// A socket left at path by a previous run is removed.
+func listenUnixgram(path string) (net.PacketConn, error) {
+	if err := removeSocket(path); err != nil {
+		return nil, err
+	}
+	fd, err := syscall.Socket(syscall.AF_UNIX, syscall.SOCK_DGRAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+	f := os.NewFile(uintptr(fd), path)
+	defer f.Close()
+	if err = syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_PASSCRED, 1); err != nil {
+		return nil, os.NewSyscallError("setsockopt", err)
+	}
+	if err = syscall.Bind(fd, &syscall.SockaddrUnix{Name: path}); err != nil {
+		return nil, &net.OpError{Op: "listen", Net: "unixgram", Addr: &net.UnixAddr{Name: path, Net: "unixgram"}, Err: err}
+	}
+	return net.FilePacketConn(f)
+}
+
+// readFrom reads a datagram from c. The address of a sender on a unix socket that receives credentials is
+// its process ID, see peerAddr.
+func readFrom(c net.PacketConn, buf, oob []byte) (int, net.Addr, error) {
+	uc, ok := c.(*net.UnixConn)
+	if !ok {
+		return c.ReadFrom(buf)
+	}
+	n, oobn, _, addr, err := uc.ReadMsgUnix(buf, oob)
+	if err != nil || oobn == 0 {
+		return n, addr, err
+	}
+	msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return n, addr, nil
+	}
+	for i := range msgs {
+		if cred, err := syscall.ParseUnixCredentials(&msgs[i]); err == nil {
+			return n, peerAddr{pid: cred.Pid}, nil
+		}
+	}
+	return n, addr, nil
+}
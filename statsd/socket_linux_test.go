@@ -0,0 +1,66 @@
+package statsd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/atlassian/gostatsd/types"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+// stoppingHandler records the first metric it receives and stops the receiver.
+type stoppingHandler struct {
+	metric *types.Metric
+}
+
+func (h *stoppingHandler) DispatchMetric(ctx context.Context, m *types.Metric) error {
+	h.metric = m
+	return context.Canceled
+}
+
+func (h *stoppingHandler) DispatchEvent(ctx context.Context, e *types.Event) error {
+	return context.Canceled
+}
+
+func TestReceiveUnixgramCredentials(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "socket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "statsd.sock")
+	c, err := listenUnixgram(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	sender, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sender.Close()
+	if _, err = sender.Write([]byte("m:1|c")); err != nil {
+		t.Fatal(err)
+	}
+
+	h := &stoppingHandler{}
+	assert.Equal(context.Canceled, NewMetricReceiver("", nil, h).Receive(context.Background(), c))
+	source := fmt.Sprintf("pid:%d", os.Getpid())
+	assert.Equal(source, h.metric.Source)
+	assert.Equal(types.Tags{types.StatsdSourceID + ":" + source}, h.metric.Tags)
+
+	// A socket left by a previous run is replaced
+	c2, err := listenUnixgram(path)
+	if assert.NoError(err) {
+		c2.Close()
+	}
+}
@@ -0,0 +1,24 @@
+// +build !linux
+
+package statsd
+
+import (
+	"net"
+)
+
+// oobSize is 0 as the credentials of the senders on a unix socket are only received on Linux.
+const oobSize = 0
+
+// listenUnixgram listens on a unix datagram socket at path. The senders are not identified.
+// A socket left at path by a previous run is removed.
+func listenUnixgram(path string) (net.PacketConn, error) {
+	if err := removeSocket(path); err != nil {
+		return nil, err
+	}
+	return net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+}
+
+// readFrom reads a datagram from c.
+func readFrom(c net.PacketConn, buf, oob []byte) (int, net.Addr, error) {
+	return c.ReadFrom(buf)
+}
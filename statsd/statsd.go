@@ -4,7 +4,6 @@ import (
 	"fmt"
 	"net"
 	"runtime"
-	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -12,6 +11,7 @@ import (
 	"github.com/atlassian/gostatsd/backend"
 	backendTypes "github.com/atlassian/gostatsd/backend/types"
 	"github.com/atlassian/gostatsd/cloudprovider"
+	"github.com/atlassian/gostatsd/cluster"
 	"github.com/atlassian/gostatsd/types"
 
 	log "github.com/Sirupsen/logrus"
@@ -36,6 +36,10 @@ var DefaultPercentThreshold = []string{"90"}
 var DefaultTags = []string{""}
 
 const (
+	// DefaultCloudHoldTimeout is the default maximum time metrics from an unresolved source are held.
+	DefaultCloudHoldTimeout = 1 * time.Second
+	// DefaultCloudLookupWorkers is the default number of concurrent lookups to the cloud provider.
+	DefaultCloudLookupWorkers = 10
 	// DefaultExpiryInterval is the default expiry interval for metrics.
 	DefaultExpiryInterval = 5 * time.Minute
 	// DefaultFlushInterval is the default metrics flush interval.
@@ -44,21 +48,65 @@ const (
 	DefaultMetricsAddr = ":8125"
 	// DefaultMaxQueueSize is the default maximum number of buffered metrics per worker.
 	DefaultMaxQueueSize = 10000 // arbitrary
+	// DefaultShutdownTimeout is the default maximum time to deliver the final flush on shutdown.
+	DefaultShutdownTimeout = 10 * time.Second
+	// DefaultSnapshotInterval is the default interval between snapshots of the aggregators.
+	DefaultSnapshotInterval = 1 * time.Minute
+	// DefaultTimestampTolerance is the default tolerance for the timestamps supplied by clients.
+	DefaultTimestampTolerance = 10 * time.Second
 )
 
 const (
 	// ParamBackends is the name of parameter with backends.
 	ParamBackends = "backends"
+	// ParamClusterPeers is the name of parameter with the list of nodes of the cluster.
+	ParamClusterPeers = "cluster-peers"
+	// ParamClusterPeersFile is the name of parameter with the file listing the nodes of the cluster.
+	ParamClusterPeersFile = "cluster-peers-file"
+	// ParamClusterSelf is the name of parameter with the address identifying this node in the cluster.
+	ParamClusterSelf = "cluster-self"
 	// ParamConsoleAddr is the name of parameter with console address.
 	ParamConsoleAddr = "console-addr"
-	// ParamCloudProvider is the name of parameter with the name of cloud provider.
+	// ParamCloudProvider is the name of parameter with the names of cloud providers.
 	ParamCloudProvider = "cloud-provider"
+	// ParamCloudChain is the name of parameter with the policy combining several cloud providers.
+	ParamCloudChain = "cloud-chain"
+	// ParamCloudCacheMaxEntries is the name of parameter with the maximum number of cached cloud instances.
+	ParamCloudCacheMaxEntries = "cloud-cache-max-entries"
+	// ParamCloudCacheNegativeTTL is the name of parameter with how long failed cloud provider lookups are cached.
+	ParamCloudCacheNegativeTTL = "cloud-cache-negative-ttl"
+	// ParamCloudCacheRefreshAhead is the name of parameter with how long before they expire cloud instances in use are refreshed.
+	ParamCloudCacheRefreshAhead = "cloud-cache-refresh-ahead"
+	// ParamCloudCacheTTL is the name of parameter with how long cloud instances are cached.
+	ParamCloudCacheTTL = "cloud-cache-ttl"
+	// ParamCloudHoldTimeout is the name of parameter with the maximum time metrics from an unresolved source are held.
+	ParamCloudHoldTimeout = "cloud-hold-timeout"
+	// ParamCloudLookupWorkers is the name of parameter with the number of concurrent lookups to the cloud provider.
+	ParamCloudLookupWorkers = "cloud-lookup-workers"
+	// ParamCloudUnresolved is the name of parameter with the policy applied to metrics from an unresolved source.
+	ParamCloudUnresolved = "cloud-unresolved"
 	// ParamDefaultTags is the name of parameter with the list of additional tags.
 	ParamDefaultTags = "default-tags"
 	// ParamExpiryInterval is the name of parameter with expiry interval for metrics.
 	ParamExpiryInterval = "expiry-interval"
+	// ParamIdleCounters is the name of parameter with the idle policy of counters.
+	ParamIdleCounters = "idle-counters"
+	// ParamIdleGauges is the name of parameter with the idle policy of gauges.
+	ParamIdleGauges = "idle-gauges"
+	// ParamIdleSets is the name of parameter with the idle policy of sets.
+	ParamIdleSets = "idle-sets"
+	// ParamIdleTimers is the name of parameter with the idle policy of timers.
+	ParamIdleTimers = "idle-timers"
+	// ParamIngestAddr is the name of parameter with the address of the ingest endpoint for forwarded metrics.
+	ParamIngestAddr = "ingest-addr"
+	// ParamIngestSecret is the name of parameter with the shared secret required by the ingest endpoint.
+	ParamIngestSecret = "ingest-secret"
+	// ParamLateMetrics is the name of parameter with the policy applied to metrics with a late or early timestamp.
+	ParamLateMetrics = "late-metrics"
 	// ParamFlushInterval is the name of parameter with metrics flush interval.
 	ParamFlushInterval = "flush-interval"
+	// ParamFlushAligned is the name of parameter to flush metrics on multiples of the flush interval.
+	ParamFlushAligned = "flush-aligned"
 	// ParamMaxReaders is the name of parameter with number of socket readers.
 	ParamMaxReaders = "max-readers"
 	// ParamMaxWorkers is the name of parameter with number of goroutines that aggregate metrics.
@@ -67,10 +115,23 @@ const (
 	ParamMaxQueueSize = "max-queue-size"
 	// ParamMetricsAddr is the name of parameter with address on which to listen for metrics.
 	ParamMetricsAddr = "metrics-addr"
+	// ParamMetricsSocket is the name of parameter with the path of the unix datagram socket on which to listen for metrics.
+	ParamMetricsSocket = "metrics-socket"
 	// ParamNamespace is the name of parameter with namespace for all metrics.
 	ParamNamespace = "namespace"
 	// ParamPercentThreshold is the name of parameter with list of applied percentiles.
 	ParamPercentThreshold = "percent-threshold"
+	// ParamPercentThresholdOverrides is the name of parameter with the percentiles applied to timers by name pattern.
+	// It can only be set in the configuration file.
+	ParamPercentThresholdOverrides = "percent-threshold-overrides"
+	// ParamShutdownTimeout is the name of parameter with the maximum time to deliver the final flush on shutdown.
+	ParamShutdownTimeout = "shutdown-timeout"
+	// ParamSnapshotFile is the name of parameter with the file the state of the aggregators is saved to.
+	ParamSnapshotFile = "snapshot-file"
+	// ParamSnapshotInterval is the name of parameter with the interval between snapshots of the aggregators.
+	ParamSnapshotInterval = "snapshot-interval"
+	// ParamTimestampTolerance is the name of parameter with the tolerance for the timestamps supplied by clients.
+	ParamTimestampTolerance = "timestamp-tolerance"
 	// ParamWebAddr is the name of parameter with the address of the web-based console.
 	ParamWebAddr = "web-addr"
 )
@@ -78,55 +139,104 @@ const (
 // Server encapsulates all of the parameters necessary for starting up
 // the statsd server. These can either be set via command line or directly.
 type Server struct {
-	Backends         []string
-	ConsoleAddr      string
-	CloudProvider    string
-	DefaultTags      []string
-	ExpiryInterval   time.Duration
-	FlushInterval    time.Duration
-	MaxReaders       int
-	MaxWorkers       int
-	MaxQueueSize     int
-	MaxMessengers    int
-	MetricsAddr      string
-	Namespace        string
-	PercentThreshold []string
-	WebConsoleAddr   string
-	Viper            *viper.Viper
+	Backends                  []string
+	ClusterPeers              []string
+	ClusterPeersFile          string
+	ClusterSelf               string
+	ConsoleAddr               string
+	CloudProviders            []string // Looked up in order of precedence when there are several
+	CloudChainPolicy          cloudprovider.ChainPolicy
+	CloudCacheOptions         cloudprovider.CacheOptions
+	CloudHoldTimeout          time.Duration
+	CloudLookupWorkers        int
+	CloudUnresolvedPolicy     UnresolvedPolicy
+	DefaultTags               []string
+	ExpiryInterval            time.Duration
+	FlushAligned              bool
+	FlushInterval             time.Duration
+	IdlePolicies              IdlePolicies
+	IngestAddr                string
+	IngestSecret              string
+	MaxReaders                int
+	MaxWorkers                int
+	MaxQueueSize              int
+	MaxMessengers             int
+	MetricsAddr               string
+	MetricsSocket             string // Path of a unix datagram socket to also receive metrics on, optional
+	Namespace                 string
+	PercentThreshold          []string
+	PercentThresholdOverrides []PercentThresholdOverride
+	ShutdownTimeout           time.Duration
+	SnapshotFile              string
+	SnapshotInterval          time.Duration
+	TimestampPolicy           TimestampPolicy
+	WebConsoleAddr            string
+	Viper                     *viper.Viper
 }
 
 // NewServer will create a new Server with the default configuration.
 func NewServer() *Server {
 	return &Server{
-		Backends:         DefaultBackends,
-		ConsoleAddr:      DefaultConsoleAddr,
-		DefaultTags:      DefaultTags,
-		ExpiryInterval:   DefaultExpiryInterval,
-		FlushInterval:    DefaultFlushInterval,
-		MaxReaders:       DefaultMaxReaders,
-		MaxWorkers:       DefaultMaxWorkers,
-		MaxQueueSize:     DefaultMaxQueueSize,
-		MetricsAddr:      DefaultMetricsAddr,
-		PercentThreshold: DefaultPercentThreshold,
-		WebConsoleAddr:   DefaultWebConsoleAddr,
-		Viper:            viper.New(),
+		Backends:           DefaultBackends,
+		CloudCacheOptions:  cloudprovider.DefaultCacheOptions,
+		CloudHoldTimeout:   DefaultCloudHoldTimeout,
+		CloudLookupWorkers: DefaultCloudLookupWorkers,
+		ConsoleAddr:        DefaultConsoleAddr,
+		DefaultTags:        DefaultTags,
+		ExpiryInterval:     DefaultExpiryInterval,
+		FlushInterval:      DefaultFlushInterval,
+		IdlePolicies:       DefaultIdlePolicies,
+		MaxReaders:         DefaultMaxReaders,
+		MaxWorkers:         DefaultMaxWorkers,
+		MaxQueueSize:       DefaultMaxQueueSize,
+		MetricsAddr:        DefaultMetricsAddr,
+		PercentThreshold:   DefaultPercentThreshold,
+		ShutdownTimeout:    DefaultShutdownTimeout,
+		SnapshotInterval:   DefaultSnapshotInterval,
+		TimestampPolicy:    DefaultTimestampPolicy,
+		WebConsoleAddr:     DefaultWebConsoleAddr,
+		Viper:              viper.New(),
 	}
 }
 
 // AddFlags adds flags to the specified FlagSet.
 func AddFlags(fs *pflag.FlagSet) {
+	fs.String(ParamClusterPeersFile, "", "If set, read the nodes of the cluster from the file, one per line, and watch it for changes")
+	fs.String(ParamClusterSelf, "", "Address of the ingest endpoint identifying this node in the cluster, defaults to the ingest address")
 	fs.String(ParamConsoleAddr, DefaultConsoleAddr, "If set, use as the address of the telnet-based console")
-	fs.String(ParamCloudProvider, "", "If set, use the cloud provider to retrieve metadata about the sender")
+	fs.String(ParamCloudProvider, "", "If set, use the cloud provider to retrieve metadata about the sender. Comma-separated list of providers looked up in order of precedence")
+	fs.String(ParamCloudChain, cloudprovider.ChainFirst.String(), "How several cloud providers are combined: first to use the first provider that knows the sender, merge to merge the metadata of all of them")
+	fs.Int(ParamCloudCacheMaxEntries, cloudprovider.DefaultCacheOptions.MaxEntries, "Maximum number of cached cloud instances (0 for no limit)")
+	fs.Duration(ParamCloudCacheNegativeTTL, cloudprovider.DefaultCacheOptions.NegativeTTL, "How long failed cloud provider lookups are cached")
+	fs.Duration(ParamCloudCacheRefreshAhead, cloudprovider.DefaultCacheOptions.RefreshAhead, "How long before they expire cached cloud instances in use are looked up again (0 to disable)")
+	fs.Duration(ParamCloudCacheTTL, cloudprovider.DefaultCacheOptions.TTL, "How long cloud instances are cached")
+	fs.Duration(ParamCloudHoldTimeout, DefaultCloudHoldTimeout, "Maximum time to hold metrics from a sender that has not been looked up yet")
+	fs.Int(ParamCloudLookupWorkers, DefaultCloudLookupWorkers, "Maximum number of concurrent lookups to the cloud provider")
+	fs.String(ParamCloudUnresolved, UnresolvedHold.String(), "What to do with metrics from a sender that has not been looked up yet: hold or tag-later")
 	fs.Duration(ParamExpiryInterval, DefaultExpiryInterval, "After how long do we expire metrics (0 to disable)")
+	fs.Bool(ParamFlushAligned, false, "Flush metrics on multiples of the flush interval of the wall clock, e.g. on :00 boundaries")
 	fs.Duration(ParamFlushInterval, DefaultFlushInterval, "How often to flush metrics to the backends")
+	fs.String(ParamIdleCounters, DefaultIdlePolicies.Counters.String(), "What to do with idle counters: zero, skip, delete or last")
+	fs.String(ParamIdleGauges, DefaultIdlePolicies.Gauges.String(), "What to do with idle gauges: zero, skip, delete or last")
+	fs.String(ParamIdleSets, DefaultIdlePolicies.Sets.String(), "What to do with idle sets: zero, skip, delete or last")
+	fs.String(ParamIdleTimers, DefaultIdlePolicies.Timers.String(), "What to do with idle timers: zero, skip, delete or last")
+	fs.String(ParamIngestAddr, "", "If set, use as the address of the HTTP endpoint receiving metrics from forwarder backends")
+	fs.String(ParamIngestSecret, "", "If set, the ingest endpoint only accepts requests carrying this shared secret, cluster nodes send it to each other")
+	fs.String(ParamLateMetrics, DefaultTimestampPolicy.Late.String(), "What to do with metrics whose timestamp is outside of the tolerance: current, bucket or drop")
 	fs.Int(ParamMaxReaders, DefaultMaxReaders, "Maximum number of socket readers")
 	fs.Int(ParamMaxWorkers, DefaultMaxWorkers, "Maximum number of workers to process metrics")
 	fs.Int(ParamMaxQueueSize, DefaultMaxQueueSize, "Maximum number of buffered metrics per worker")
 	fs.String(ParamMetricsAddr, DefaultMetricsAddr, "Address on which to listen for metrics")
+	fs.String(ParamMetricsSocket, "", "If set, also listen for metrics on a unix datagram socket at this path, senders are identified by their process ID on Linux")
 	fs.String(ParamNamespace, "", "Namespace all metrics")
+	fs.Duration(ParamShutdownTimeout, DefaultShutdownTimeout, "Maximum time to deliver the metrics aggregated since the last flush on shutdown (0 to disable)")
+	fs.String(ParamSnapshotFile, "", "If set, save the state of the aggregators to the file periodically and on shutdown, and restore it on startup")
+	fs.Duration(ParamSnapshotInterval, DefaultSnapshotInterval, "How often to save the state of the aggregators to the snapshot file")
+	fs.Duration(ParamTimestampTolerance, DefaultTimestampTolerance, "How far the timestamp of a metric can be from the time it is received")
 	fs.String(ParamWebAddr, DefaultWebConsoleAddr, "If set, use as the address of the web-based console")
 	//TODO Remove workaround when https://github.com/spf13/viper/issues/112 is fixed
 	fs.String(ParamBackends, strings.Join(DefaultBackends, ","), "Comma-separated list of backends")
+	fs.String(ParamClusterPeers, "", "Comma-separated list of the ingest addresses of the nodes of the cluster, including this node")
 	fs.String(ParamDefaultTags, strings.Join(DefaultTags, ","), "Comma-separated list of tags to add to all metrics")
 	fs.String(ParamPercentThreshold, strings.Join(DefaultPercentThreshold, ","), "Comma-separated list of percentiles")
 }
@@ -143,6 +253,10 @@ type SocketFactory func() (net.PacketConn, error)
 
 // RunWithCustomSocket runs the server until context signals done.
 // Listening socket is created using sf.
+//
+// On shutdown the readers are stopped first, then the metrics held by the cloud handler and the ones buffered
+// in the queues of the workers are aggregated and flushed to the backends one last time, within the shutdown
+// timeout. Finally the state of the aggregators is saved to the snapshot file, if any.
 func (s *Server) RunWithCustomSocket(ctx context.Context, sf SocketFactory) error {
 	backends := make([]backendTypes.Backend, 0, len(s.Backends))
 	for _, backendName := range s.Backends {
@@ -153,16 +267,12 @@ func (s *Server) RunWithCustomSocket(ctx context.Context, sf SocketFactory) erro
 		backends = append(backends, b)
 	}
 
-	var percentThresholds []float64
-	for _, sPercentThreshold := range s.PercentThreshold {
-		pt, err := strconv.ParseFloat(sPercentThreshold, 64)
-		if err != nil {
-			return err
-		}
-		percentThresholds = append(percentThresholds, pt)
+	percentThresholds, err := NewPercentThresholds(s.PercentThreshold, s.PercentThresholdOverrides)
+	if err != nil {
+		return err
 	}
 
-	cloud, err := cloudprovider.InitCloudProvider(s.CloudProvider, s.Viper)
+	cloud, err := cloudprovider.InitCloudProviders(s.CloudProviders, s.CloudChainPolicy, s.CloudCacheOptions, s.Viper)
 	if err != nil {
 		return err
 	}
@@ -170,6 +280,8 @@ func (s *Server) RunWithCustomSocket(ctx context.Context, sf SocketFactory) erro
 	// 1. Start the Dispatcher
 	factory := agrFactory{
 		percentThresholds: percentThresholds,
+		idlePolicies:      s.IdlePolicies,
+		timestampPolicy:   s.TimestampPolicy,
 		flushInterval:     s.FlushInterval,
 		expiryInterval:    s.ExpiryInterval,
 		defaultTags:       s.DefaultTags,
@@ -188,6 +300,24 @@ func (s *Server) RunWithCustomSocket(ctx context.Context, sf SocketFactory) erro
 		}
 	}()
 
+	// Restore the state saved by the previous run
+	var wgSnapshots sync.WaitGroup
+	defer wgSnapshots.Wait()
+	if s.SnapshotFile != "" {
+		if err := restoreSnapshot(ctx, dispatcher, s.SnapshotFile, s.FlushInterval, s.ExpiryInterval); err != nil {
+			log.Errorf("Starting without the saved state: %v", err)
+		}
+		if s.SnapshotInterval > 0 {
+			wgSnapshots.Add(1)
+			go func() {
+				defer wgSnapshots.Done()
+				if err := runSnapshots(ctx, dispatcher, s.SnapshotFile, s.SnapshotInterval); err != nil && err != context.Canceled && err != context.DeadlineExceeded {
+					log.Errorf("Snapshots quit unexpectedly: %v", err)
+				}
+			}()
+		}
+	}
+
 	// 2. Start the Receiver
 	var wgReceiver sync.WaitGroup
 	defer wgReceiver.Wait() // Wait for all receivers to finish
@@ -197,29 +327,87 @@ func (s *Server) RunWithCustomSocket(ctx context.Context, sf SocketFactory) erro
 	if err != nil {
 		return err
 	}
-	defer func() {
-		// This makes receivers error out and stop
-		if err := c.Close(); err != nil {
-			log.Warnf("Error closing socket: %v", err)
+	sockets := []net.PacketConn{c}
+	var closeOnce sync.Once
+	closeSocket := func() {
+		closeOnce.Do(func() {
+			// This makes receivers error out and stop
+			for _, c := range sockets {
+				if err := c.Close(); err != nil {
+					log.Warnf("Error closing socket: %v", err)
+				}
+			}
+			if s.MetricsSocket != "" {
+				if err := removeSocket(s.MetricsSocket); err != nil {
+					log.Warnf("Error removing socket: %v", err)
+				}
+			}
+		})
+	}
+	defer closeSocket()
+	if s.MetricsSocket != "" {
+		uc, err := listenUnixgram(s.MetricsSocket)
+		if err != nil {
+			return err
 		}
-	}()
+		sockets = append(sockets, uc)
+	}
 
-	receiver := NewMetricReceiver(s.Namespace, s.DefaultTags, cloud, &handler{
+	h := &handler{
 		dispatcher: dispatcher,
 		backends:   backends,
-	})
-	wgReceiver.Add(s.MaxReaders)
-	for r := 0; r < s.MaxReaders; r++ {
+	}
+	var receiverHandler Handler = h
+	var ch *clusterHandler
+	if len(s.ClusterPeers) > 0 || s.ClusterPeersFile != "" {
+		ch, err = s.startCluster(ctx, dispatcher, h)
+		if err != nil {
+			return err
+		}
+		receiverHandler = ch
+	}
+
+	// Copy the metrics and events to the tail clients of the consoles, with the details of their instance
+	tail := NewTailHandler(receiverHandler)
+	receiverHandler = tail
+
+	// Look up the instances of the senders off the receive path
+	var cloudHandler *CloudHandler
+	var wgCloud sync.WaitGroup
+	defer wgCloud.Wait()
+	ctxCloud, cancelCloud := context.WithCancel(context.Background()) // Separate context, stopped after the receivers
+	defer cancelCloud()
+	if cloud != nil {
+		cache, err := cloudprovider.NewCache(s.CloudCacheOptions)
+		if err != nil {
+			return err
+		}
+		cloudHandler = NewCloudHandler(cloud, cache, receiverHandler, s.CloudLookupWorkers, s.CloudUnresolvedPolicy, s.CloudHoldTimeout)
+		receiverHandler = cloudHandler
+		wgCloud.Add(1)
 		go func() {
-			defer wgReceiver.Done()
-			if err := receiver.Receive(ctx, c); err != nil && err != context.Canceled && err != context.DeadlineExceeded {
-				log.Panicf("Receiver quit unexpectedly: %v", err)
+			defer wgCloud.Done()
+			if err := cloudHandler.Run(ctxCloud); err != nil && err != context.Canceled {
+				log.Panicf("Cloud provider lookups quit unexpectedly: %v", err)
 			}
 		}()
 	}
 
+	receiver := NewMetricReceiver(s.Namespace, s.DefaultTags, receiverHandler)
+	for _, c := range sockets {
+		wgReceiver.Add(s.MaxReaders)
+		for r := 0; r < s.MaxReaders; r++ {
+			go func(c net.PacketConn) {
+				defer wgReceiver.Done()
+				if err := receiver.Receive(ctx, c); err != nil && err != context.Canceled && err != context.DeadlineExceeded {
+					log.Panicf("Receiver quit unexpectedly: %v", err)
+				}
+			}(c)
+		}
+	}
+
 	// 3. Start the Flusher
-	flusher := NewFlusher(s.FlushInterval, dispatcher, receiver, s.DefaultTags, backends)
+	flusher := NewFlusher(s.FlushInterval, s.FlushAligned, dispatcher, receiver, cloudHandler, s.DefaultTags, backends)
 	var wgFlusher sync.WaitGroup
 	defer wgFlusher.Wait() // Wait for the Flusher to finish
 	wgFlusher.Add(1)
@@ -230,21 +418,116 @@ func (s *Server) RunWithCustomSocket(ctx context.Context, sf SocketFactory) erro
 		}
 	}()
 
+	// Start the ingest endpoint
+	if s.IngestAddr != "" {
+		ingest := NewIngestServer(s.IngestAddr, s.IngestSecret, s.FlushInterval, dispatcher, h)
+		go func() {
+			if err := ingest.ListenAndServe(ctx); err != nil && err != context.Canceled {
+				log.Errorf("Ingest endpoint quit unexpectedly: %v", err)
+			}
+		}()
+	}
+
 	// Start the console(s)
 	if s.ConsoleAddr != "" {
-		console := ConsoleServer{s.ConsoleAddr, receiver, dispatcher, flusher}
+		console := ConsoleServer{s.ConsoleAddr, receiver, dispatcher, flusher, cloudHandler, tail}
 		go console.ListenAndServe(ctx)
 	}
-	//if s.WebConsoleAddr != "" {
-	//	console := WebConsoleServer{s.WebConsoleAddr, aggregator}
-	//	go console.ListenAndServe()
-	//}
+	if s.WebConsoleAddr != "" {
+		console := WebConsoleServer{s.WebConsoleAddr, tail}
+		go func() {
+			if err := console.ListenAndServe(ctx); err != nil && err != context.Canceled {
+				log.Errorf("Web console quit unexpectedly: %v", err)
+			}
+		}()
+	}
 
 	// Listen until done
 	<-ctx.Done()
+
+	// Shut down: stop reading metrics and wait for the last regular flush to finish, then flush the rest
+	closeSocket()
+	wgReceiver.Wait()
+	cancelCloud()
+	wgCloud.Wait()
+	wgFlusher.Wait()
+	s.flushRemaining(dispatcher, flusher, cloudHandler, ch)
+	if s.SnapshotFile != "" {
+		wgSnapshots.Wait() // Make sure a periodic snapshot does not replace the final one
+		if err := writeSnapshot(context.Background(), dispatcher, s.SnapshotFile); err != nil {
+			log.Errorf("Saving the state of the aggregators failed: %v", err)
+		}
+	}
 	return ctx.Err()
 }
 
+// flushRemaining dispatches the metrics held by the cloud handler, if any, forwards the metrics pending for the
+// other nodes of the cluster, if any, aggregates the metrics buffered in the queues of the workers and flushes
+// the aggregators to the backends, giving up after the shutdown timeout.
+func (s *Server) flushRemaining(dispatcher Dispatcher, flusher Flusher, cloudHandler *CloudHandler, ch *clusterHandler) {
+	if s.ShutdownTimeout <= 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), s.ShutdownTimeout)
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if cloudHandler != nil {
+			if err := cloudHandler.Release(ctx); err != nil {
+				log.Warnf("Dispatching held metrics failed: %v", err)
+			}
+		}
+		var forwarded *sync.WaitGroup
+		if ch != nil {
+			forwarded = ch.forward(ctx)
+		}
+		dispatcher.Drain(ctx).Wait()
+		flusher.Flush(ctx)
+		if forwarded != nil {
+			forwarded.Wait()
+		}
+	}()
+	select {
+	case <-done:
+		log.Info("Flushed remaining metrics")
+	case <-ctx.Done():
+		log.Warnf("Flushing remaining metrics did not complete within %v", s.ShutdownTimeout)
+	}
+}
+
+// startCluster starts the cluster mode, where each series is aggregated by the node owning it.
+func (s *Server) startCluster(ctx context.Context, dispatcher Dispatcher, h Handler) (*clusterHandler, error) {
+	if s.IngestAddr == "" {
+		return nil, fmt.Errorf("%s is required in cluster mode", ParamIngestAddr)
+	}
+	self := s.ClusterSelf
+	if self == "" {
+		self = s.IngestAddr
+	}
+	ch := newClusterHandler(self, s.IngestSecret, s.FlushInterval, s.TimestampPolicy.Tolerance, dispatcher, h)
+	if s.ClusterPeersFile != "" {
+		peers, err := cluster.ReadPeersFile(s.ClusterPeersFile)
+		if err != nil {
+			return nil, err
+		}
+		ch.SetPeers(peers)
+		go func() {
+			if err := cluster.WatchPeersFile(ctx, s.ClusterPeersFile, cluster.DefaultPeersFileInterval, ch.SetPeers); err != nil && err != context.Canceled {
+				log.Errorf("Watching cluster peers file failed: %v", err)
+			}
+		}()
+	} else {
+		ch.SetPeers(s.ClusterPeers)
+	}
+	go func() {
+		if err := ch.Run(ctx); err != nil && err != context.Canceled && err != context.DeadlineExceeded {
+			log.Errorf("Cluster forwarding quit unexpectedly: %v", err)
+		}
+	}()
+	return ch, nil
+}
+
 type handler struct {
 	dispatcher Dispatcher
 	backends   []backendTypes.Backend
@@ -266,7 +549,9 @@ func (h *handler) DispatchEvent(ctx context.Context, e *types.Event) error {
 }
 
 type agrFactory struct {
-	percentThresholds []float64
+	percentThresholds *PercentThresholds
+	idlePolicies      IdlePolicies
+	timestampPolicy   TimestampPolicy
 	flushInterval     time.Duration
 	expiryInterval    time.Duration
 	defaultTags       []string
@@ -278,7 +563,7 @@ func (af *agrFactory) Create() Aggregator {
 	tags = append(tags, af.defaultTags...)
 	tags = append(tags, fmt.Sprintf("aggregator_%d", af.workerNumber))
 	af.workerNumber++
-	return NewAggregator(af.percentThresholds, af.flushInterval, af.expiryInterval, tags)
+	return NewAggregator(af.percentThresholds, af.idlePolicies, af.timestampPolicy, af.flushInterval, af.expiryInterval, tags)
 }
 
 func internalStatName(name string) string {
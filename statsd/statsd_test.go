@@ -2,12 +2,18 @@ package statsd
 
 import (
 	"math/rand"
+	"net"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/atlassian/gostatsd/backend"
+	backendTypes "github.com/atlassian/gostatsd/backend/types"
 	"github.com/atlassian/gostatsd/tester/fakesocket"
+	"github.com/atlassian/gostatsd/types"
 
 	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
 	"golang.org/x/net/context"
 )
 
@@ -33,3 +39,76 @@ func TestStatsdThroughput(t *testing.T) {
 		t.Errorf("statsd run failed: %v", err)
 	}
 }
+
+// shutdownBackend records the value of the fake counter and can block to simulate a slow backend.
+type shutdownBackend struct {
+	mu    sync.Mutex
+	value int64
+	block chan struct{}
+}
+
+func (b *shutdownBackend) BackendName() string  { return "shutdown" }
+func (b *shutdownBackend) SampleConfig() string { return "" }
+
+func (b *shutdownBackend) SendMetrics(ctx context.Context, m *types.MetricMap) error {
+	if b.block != nil {
+		<-b.block
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	m.Counters.Each(func(key, tagsKey string, counter types.Counter) {
+		if key == "foo.bar.baz" {
+			b.value += counter.Value
+		}
+	})
+	return nil
+}
+
+func (b *shutdownBackend) SendEvent(ctx context.Context, e *types.Event) error {
+	return nil
+}
+
+func runShutdownServer(t *testing.T, b *shutdownBackend, shutdownTimeout time.Duration) time.Duration {
+	backend.RegisterBackend(b.BackendName(), func(v *viper.Viper) (backendTypes.Backend, error) {
+		return b, nil
+	})
+	s := NewServer()
+	s.Backends = []string{b.BackendName()}
+	s.ConsoleAddr = ""
+	s.WebConsoleAddr = ""
+	s.FlushInterval = time.Hour // Only the final flush happens
+	s.MaxReaders = 2
+	s.MaxWorkers = 2
+	s.ShutdownTimeout = shutdownTimeout
+
+	ctx, cancelFunc := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancelFunc()
+	err := s.RunWithCustomSocket(ctx, func() (net.PacketConn, error) {
+		return fakesocket.FakePacketConn{}, nil
+	})
+	if err != nil && err != context.Canceled && err != context.DeadlineExceeded {
+		t.Errorf("statsd run failed: %v", err)
+	}
+	deadline, _ := ctx.Deadline()
+	return time.Since(deadline)
+}
+
+func TestShutdownFlushesRemainingMetrics(t *testing.T) {
+	b := &shutdownBackend{}
+	runShutdownServer(t, b, 5*time.Second)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	assert.True(t, b.value > 0, "the metrics received before shutdown should be flushed")
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	b := &shutdownBackend{block: make(chan struct{})}
+	defer close(b.block)
+	elapsed := runShutdownServer(t, b, 100*time.Millisecond)
+
+	assert.True(t, elapsed < 2*time.Second, "shutdown took %v", elapsed)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	assert.Zero(t, b.value)
+}
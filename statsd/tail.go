@@ -0,0 +1,180 @@
+package statsd
+
+import (
+	"fmt"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/atlassian/gostatsd/backend/backends/statsdaemon"
+	"github.com/atlassian/gostatsd/types"
+
+	"golang.org/x/net/context"
+)
+
+// tailBufferSize is the maximum number of lines waiting to be written to a tail client.
+// The lines matched beyond that are dropped, so that a slow client does not slow down the receivers.
+const tailBufferSize = 1000
+
+// TailHandler is a Handler that passes metrics and events to the next Handler, and copies the ones matching
+// the pattern of a TailSubscription to it as statsd lines. It does nothing more than the next Handler when
+// there are no subscriptions.
+type TailHandler struct {
+	next Handler
+
+	mu            sync.Mutex   // Serialises changes to subscriptions
+	subscriptions atomic.Value // []*TailSubscription, replaced on every change so that dispatching does not lock
+}
+
+// TailSubscription receives the lines of the metrics and events matching its pattern.
+type TailSubscription struct {
+	// Counter fields below must be read/written only using atomic instructions.
+	dropped uint64
+
+	pattern string
+	lines   chan string
+}
+
+// NewTailHandler creates a TailHandler passing metrics and events to next.
+func NewTailHandler(next Handler) *TailHandler {
+	th := &TailHandler{next: next}
+	th.subscriptions.Store([]*TailSubscription(nil))
+	return th
+}
+
+// Subscribe returns a subscription to the metrics named and the events titled after the pattern,
+// with the syntax of path.Match. It must be passed to Unsubscribe when done.
+func (th *TailHandler) Subscribe(pattern string) (*TailSubscription, error) {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, fmt.Errorf("invalid pattern %q: %v", pattern, err)
+	}
+	s := &TailSubscription{pattern: pattern, lines: make(chan string, tailBufferSize)}
+	th.mu.Lock()
+	defer th.mu.Unlock()
+	current := th.subscriptions.Load().([]*TailSubscription)
+	subscriptions := make([]*TailSubscription, 0, len(current)+1)
+	subscriptions = append(subscriptions, current...)
+	th.subscriptions.Store(append(subscriptions, s))
+	return s, nil
+}
+
+// Unsubscribe stops copying metrics and events to the subscription.
+func (th *TailHandler) Unsubscribe(s *TailSubscription) {
+	th.mu.Lock()
+	defer th.mu.Unlock()
+	current := th.subscriptions.Load().([]*TailSubscription)
+	subscriptions := make([]*TailSubscription, 0, len(current))
+	for _, sub := range current {
+		if sub != s {
+			subscriptions = append(subscriptions, sub)
+		}
+	}
+	th.subscriptions.Store(subscriptions)
+}
+
+// DispatchMetric copies the metric to the matching subscriptions and passes it to the next Handler.
+func (th *TailHandler) DispatchMetric(ctx context.Context, m *types.Metric) error {
+	if subscriptions := th.subscriptions.Load().([]*TailSubscription); len(subscriptions) > 0 {
+		// The metric is formatted now, it may be changed once passed to the next Handler
+		var line string
+		for _, s := range subscriptions {
+			if s.matches(m.Name) {
+				if line == "" {
+					line = formatTailMetric(m)
+				}
+				s.send(line)
+			}
+		}
+	}
+	return th.next.DispatchMetric(ctx, m)
+}
+
+// DispatchEvent copies the event to the matching subscriptions and passes it to the next Handler.
+func (th *TailHandler) DispatchEvent(ctx context.Context, e *types.Event) error {
+	if subscriptions := th.subscriptions.Load().([]*TailSubscription); len(subscriptions) > 0 {
+		var line string
+		for _, s := range subscriptions {
+			if s.matches(e.Title) {
+				if line == "" {
+					line = string(statsdaemon.EncodeEvent(e))
+				}
+				s.send(line)
+			}
+		}
+	}
+	return th.next.DispatchEvent(ctx, e)
+}
+
+// Dropped returns the number of lines dropped because the client did not keep up.
+func (s *TailSubscription) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+func (s *TailSubscription) matches(name string) bool {
+	ok, _ := path.Match(s.pattern, name)
+	return ok
+}
+
+// send queues the line without blocking, or drops it if the buffer is full.
+func (s *TailSubscription) send(line string) {
+	select {
+	case s.lines <- line:
+	default:
+		atomic.AddUint64(&s.dropped, 1)
+	}
+}
+
+// Stream writes the lines of the subscription to w, calling flush after each of them if it is not nil,
+// until n lines are written if n is positive, the context is done or writing fails. The number of lines
+// dropped since the previous line is written before it.
+func (s *TailSubscription) Stream(ctx context.Context, w io.Writer, n int, flush func()) error {
+	var reported uint64
+	for written := 0; n <= 0 || written < n; written++ {
+		var line string
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case line = <-s.lines:
+		}
+		if dropped := s.Dropped(); dropped > reported {
+			if _, err := fmt.Fprintf(w, "(%d lines dropped)\n", dropped-reported); err != nil {
+				return err
+			}
+			reported = dropped
+		}
+		if _, err := io.WriteString(w, line+"\n"); err != nil {
+			return err
+		}
+		if flush != nil {
+			flush()
+		}
+	}
+	return nil
+}
+
+// formatTailMetric returns the metric as a statsd line, without a trailing newline.
+func formatTailMetric(m *types.Metric) string {
+	var value, metricType string
+	switch m.Type {
+	case types.COUNTER:
+		metricType = "c"
+	case types.TIMER:
+		metricType = "ms"
+	case types.GAUGE:
+		metricType = "g"
+	case types.SET:
+		metricType = "s"
+		value = m.StringValue
+	}
+	if m.Type != types.SET {
+		value = strconv.FormatFloat(m.Value, 'f', -1, 64)
+	}
+	line := m.Name + ":" + value + "|" + metricType
+	if len(m.Tags) > 0 {
+		line += "|#" + strings.Join(m.Tags, ",")
+	}
+	return line
+}
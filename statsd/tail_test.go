@@ -0,0 +1,193 @@
+package statsd
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/atlassian/gostatsd/types"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+func TestTailHandlerCopiesMatchingMetricsAndEvents(t *testing.T) {
+	assert := assert.New(t)
+
+	next := newSyncHandler()
+	th := NewTailHandler(next)
+	sub, err := th.Subscribe("web.*")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	assert.NoError(th.DispatchMetric(ctx, &types.Metric{Name: "web.requests", Value: 1.5, Type: types.COUNTER, Tags: types.Tags{"env:prod", "bare"}}))
+	assert.NoError(th.DispatchMetric(ctx, &types.Metric{Name: "db.queries", Value: 1, Type: types.COUNTER}))
+	assert.NoError(th.DispatchMetric(ctx, &types.Metric{Name: "web.users", StringValue: "joe", Type: types.SET}))
+	assert.NoError(th.DispatchMetric(ctx, &types.Metric{Name: "web.latency", Value: 20, Type: types.TIMER}))
+	assert.NoError(th.DispatchEvent(ctx, &types.Event{Title: "web.deploy", Text: "v2"}))
+	next.wait(t, 5) // Everything is passed to the next Handler
+
+	var buf bytes.Buffer
+	assert.NoError(sub.Stream(ctx, &buf, 4, nil))
+	assert.Equal("web.requests:1.5|c|#env:prod,bare\nweb.users:joe|s\nweb.latency:20|ms\n_e{10,2}:web.deploy|v2\n", buf.String())
+
+	th.Unsubscribe(sub)
+	assert.NoError(th.DispatchMetric(ctx, &types.Metric{Name: "web.requests", Value: 1, Type: types.COUNTER}))
+	next.wait(t, 1)
+	assert.Len(sub.lines, 0)
+}
+
+func TestTailHandlerDropsWhenClientIsSlow(t *testing.T) {
+	assert := assert.New(t)
+
+	th := NewTailHandler(&countingHandler{})
+	sub, err := th.Subscribe("*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer th.Unsubscribe(sub)
+
+	ctx := context.Background()
+	for i := 0; i < tailBufferSize+10; i++ {
+		assert.NoError(th.DispatchMetric(ctx, &types.Metric{Name: fmt.Sprintf("m%d", i), Value: 1, Type: types.GAUGE}))
+	}
+	assert.EqualValues(10, sub.Dropped())
+
+	var buf bytes.Buffer
+	assert.NoError(sub.Stream(ctx, &buf, 1, nil))
+	assert.Equal("(10 lines dropped)\nm0:1|g\n", buf.String())
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	assert.Equal(context.DeadlineExceeded, sub.Stream(ctx, &buf, 0, nil))
+}
+
+func TestTailHandlerInvalidPattern(t *testing.T) {
+	_, err := NewTailHandler(&countingHandler{}).Subscribe("[")
+	assert.Error(t, err)
+}
+
+// consolePair returns both ends of a TCP connection to a console serving th.
+func consolePair(t *testing.T, th *TailHandler) (*consoleConn, net.Conn) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	client, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &consoleConn{conn: conn, server: &ConsoleServer{Tail: th}}, client
+}
+
+func TestConsoleTail(t *testing.T) {
+	assert := assert.New(t)
+
+	th := NewTailHandler(&countingHandler{})
+	console, client := consolePair(t, th)
+	defer console.conn.Close()
+	defer client.Close()
+	r := bufio.NewReader(client)
+
+	ctx := context.Background()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, err := console.tail(ctx, []string{"web.*", "2"})
+		assert.NoError(err)
+	}()
+	banner, err := r.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal("tailing web.*, press enter to stop\n", banner)
+	for _, name := range []string{"web.a", "db.b", "web.c", "web.d"} {
+		assert.NoError(th.DispatchMetric(ctx, &types.Metric{Name: name, Value: 1, Type: types.COUNTER}))
+	}
+	<-done // After 2 lines
+	for _, expected := range []string{"web.a:1|c\n", "web.c:1|c\n"} {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(expected, line)
+	}
+
+	// Until the client sends a line, then the connection is usable again
+	done = make(chan struct{})
+	go func() {
+		defer close(done)
+		_, err := console.tail(ctx, []string{"*"})
+		assert.NoError(err)
+	}()
+	if _, err := r.ReadString('\n'); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Write([]byte("\n")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("tail did not stop")
+	}
+	if _, err := client.Write([]byte("stats\n")); err != nil {
+		t.Fatal(err)
+	}
+	line, err := bufio.NewReader(console.conn).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal("stats\n", line)
+
+	usage, err := console.tail(ctx, []string{"*", "many"})
+	assert.NoError(err)
+	assert.True(strings.HasPrefix(usage, "usage:"))
+}
+
+func TestWebConsoleTail(t *testing.T) {
+	assert := assert.New(t)
+
+	th := NewTailHandler(&countingHandler{})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s := httptest.NewServer((&WebConsoleServer{Tail: th}).handler(ctx))
+	defer s.Close()
+
+	resp, err := http.Get(s.URL + "/tail?pattern=web.*&n=2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	assert.Equal(http.StatusOK, resp.StatusCode)
+	for _, name := range []string{"web.a", "db.b", "web.c", "web.d"} {
+		assert.NoError(th.DispatchMetric(ctx, &types.Metric{Name: name, Value: 2, Type: types.GAUGE}))
+	}
+	var body bytes.Buffer
+	if _, err := body.ReadFrom(resp.Body); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal("web.a:2|g\nweb.c:2|g\n", body.String())
+
+	for _, query := range []string{"pattern=[", "n=0"} {
+		resp, err := http.Get(s.URL + "/tail?" + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		assert.Equal(http.StatusBadRequest, resp.StatusCode, query)
+	}
+}
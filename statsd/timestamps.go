@@ -0,0 +1,67 @@
+package statsd
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// LatePolicy is what happens to the metrics whose client supplied timestamp is too far from the time they are received.
+type LatePolicy byte
+
+const (
+	// LateCurrent aggregates late and early metrics in the current flush interval, ignoring their timestamp.
+	LateCurrent LatePolicy = iota
+	// LateBucket aggregates late and early metrics with the other metrics of the flush interval their timestamp
+	// falls in. They are sent to the backends with the time of that interval.
+	LateBucket
+	// LateDrop drops late and early metrics.
+	LateDrop
+)
+
+func (p LatePolicy) String() string {
+	switch p {
+	case LateBucket:
+		return "bucket"
+	case LateDrop:
+		return "drop"
+	default:
+		return "current"
+	}
+}
+
+// ParseLatePolicy parses the name of a LatePolicy: current, bucket or drop.
+func ParseLatePolicy(s string) (LatePolicy, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "current":
+		return LateCurrent, nil
+	case "bucket":
+		return LateBucket, nil
+	case "drop":
+		return LateDrop, nil
+	}
+	return LateCurrent, fmt.Errorf("invalid late metrics policy %q: must be one of current, bucket or drop", s)
+}
+
+// TimestampPolicy is how metrics with a client supplied timestamp are aggregated.
+// Metrics whose timestamp is within Tolerance of the time they are received are aggregated
+// in the current flush interval, Late applies to the other ones.
+type TimestampPolicy struct {
+	Late      LatePolicy
+	Tolerance time.Duration
+}
+
+// DefaultTimestampPolicy is the default timestamp policy: all metrics are aggregated in the current flush interval.
+var DefaultTimestampPolicy = TimestampPolicy{
+	Late:      LateCurrent,
+	Tolerance: DefaultTimestampTolerance,
+}
+
+// isLate returns whether a metric with timestamp ts received at now is late or early.
+func (p TimestampPolicy) isLate(ts, now time.Time) bool {
+	if ts.IsZero() {
+		return false
+	}
+	d := now.Sub(ts)
+	return d > p.Tolerance || d < -p.Tolerance
+}
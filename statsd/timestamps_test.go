@@ -0,0 +1,77 @@
+package statsd
+
+import (
+	"testing"
+	"time"
+
+	"github.com/atlassian/gostatsd/types"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseLatePolicy(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, policy := range []LatePolicy{LateCurrent, LateBucket, LateDrop} {
+		parsed, err := ParseLatePolicy(policy.String())
+		assert.NoError(err)
+		assert.Equal(policy, parsed)
+	}
+	_, err := ParseLatePolicy("later")
+	assert.Error(err)
+}
+
+// receiveLate receives a counter on time, a late one and an early one and flushes the aggregator.
+func receiveLate(policy LatePolicy, now time.Time) (*types.MetricMap, []*types.MetricMap) {
+	ma := NewAggregator(nil, DefaultIdlePolicies, TimestampPolicy{Late: policy, Tolerance: 10 * time.Second}, 10*time.Second, 5*time.Minute, nil).(*aggregator)
+	ma.lastFlush = now.Add(-10 * time.Second)
+	ma.Receive(&types.Metric{Name: "c", Value: 1, Type: types.COUNTER}, now)
+	ma.Receive(&types.Metric{Name: "c", Value: 2, Type: types.COUNTER, Timestamp: now.Add(-5 * time.Second)}, now)
+	ma.Receive(&types.Metric{Name: "c", Value: 4, Type: types.COUNTER, Timestamp: now.Add(-time.Minute)}, now)
+	ma.Receive(&types.Metric{Name: "c", Value: 8, Type: types.COUNTER, Timestamp: now.Add(time.Minute)}, now)
+	nowFn := func() time.Time { return now }
+	return ma.Flush(nowFn), ma.FlushBuckets(nowFn)
+}
+
+func TestLatePolicies(t *testing.T) {
+	assert := assert.New(t)
+	now := time.Unix(1500000005, 0)
+
+	m, buckets := receiveLate(LateCurrent, now)
+	assert.Equal(int64(15), m.Counters["c"][""].Value)
+	assert.Empty(buckets)
+
+	m, buckets = receiveLate(LateDrop, now)
+	assert.Equal(int64(3), m.Counters["c"][""].Value)
+	assert.Empty(buckets)
+
+	m, buckets = receiveLate(LateBucket, now)
+	assert.Equal(int64(3), m.Counters["c"][""].Value)
+	assert.Zero(m.Timestamp)
+	values := make(map[int64]int64)
+	for _, b := range buckets {
+		assert.NotContains(b.Counters, internalStatName("aggregator_num_stats"))
+		assert.Equal(uint32(1), b.NumStats)
+		values[b.Timestamp.Unix()] = b.Counters["c"][""].Value
+	}
+	assert.Equal(map[int64]int64{1499999940: 4, 1500000060: 8}, values)
+}
+
+func TestLateBucketReceiveMap(t *testing.T) {
+	assert := assert.New(t)
+	now := time.Unix(1500000005, 0)
+
+	ma := NewAggregator(nil, DefaultIdlePolicies, TimestampPolicy{Late: LateBucket, Tolerance: 10 * time.Second}, 10*time.Second, 5*time.Minute, nil).(*aggregator)
+	ma.ReceiveMap(&types.MetricMap{
+		Timestamp: now.Add(-time.Minute),
+		Counters:  types.Counters{"c": {"": types.Counter{Value: 3}}},
+	}, now)
+	assert.Empty(ma.Counters)
+
+	buckets := ma.FlushBuckets(time.Now)
+	if assert.Len(buckets, 1) {
+		assert.Equal(int64(3), buckets[0].Counters["c"][""].Value)
+		assert.Equal(now.Add(-time.Minute).Truncate(10*time.Second), buckets[0].Timestamp)
+	}
+	assert.Empty(ma.FlushBuckets(time.Now))
+}
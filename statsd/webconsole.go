@@ -1,116 +1,101 @@
 package statsd
 
-// DefaultWebConsoleAddr is the default address on which a WebConsoleServer will listen.
-const DefaultWebConsoleAddr = ":8181"
-
-/*
 import (
-	"fmt"
-	"html/template"
+	"net"
 	"net/http"
-)
+	"strconv"
 
-// WebConsoleServer is an object that listens for HTTP connection on a TCP address Addr
-// and provides a web interface for its MetricAggregator.
-type WebConsoleServer struct {
-	Addr       string
-	Aggregator *MetricAggregator
-}
-
-const tempText = `
-<html>
-<head>
-<title>gostatsd</title>
-<link rel="stylesheet" href="https://maxcdn.bootstrapcdn.com/bootstrap/3.3.6/css/bootstrap.min.css" integrity="sha384-1q8mTJOASx8j1Au+a5WDVnPi2lkFfwwEAa8hDDdjZlpLegxhjVME1fgjWPGmkzs7" crossorigin="anonymous">
-<style>
-.table {
-	font-size: 14px;
-}
-</style>
-</head>
-<body>
-<div class="container">
-<div class="row">
-<div class="col-md9">
-  	<h1 class="page-header">gostatsd</h1>
-	<p>Bad lines received: {{.Stats.BadLines}}</p>
-	<p>Last messsage received: {{.Stats.LastMessage}}</p>
-	<p>Last flush to backends: {{.Stats.LastFlush}}</p>
-	<p>Last error flushing to backends: {{.Stats.LastFlushError}}</p>
-	<h2>Counters</h2>
-	<table class="table">
-	<thead>
-	<tr><th>Name</th><th>Rate</th><th>Tags</th></tr>
-	</thead>
-	{{range $metric, $value := .Counters}}
-	{{range $tags, $counter := $value}}
-	<tr><td>{{$metric}}</td><td>{{$counter.PerSecond}}</td><td>{{$tags}}</td></tr>
-	{{end}}
-	{{end}}
-	</table>
-	<h2>Gauges</h2>
-	<table class="table">
-	<thead>
-	<tr><th>Name</th><th>Value</th><th>Tags</th></tr>
-	</thead>
-	{{range $metric, $value := .Gauges}}
-	{{range $tags, $gauge := $value}}
-	<tr><td>{{$metric}}</td><td>{{$gauge.Value}}</td><td>{{$tags}}</td></tr>
-	{{end}}
-	{{end}}
-	</table>
-	<h2>Timers</h2>
-	<table class="table">
-	<thead>
-	<tr><th>Name</th><th>Value</th><th>Tags</th></tr>
-	</thead>
-	{{range $metric, $value := .Timers}}
-	{{range $tags, $timer := $value}}
-	{{range $idx, $time := $timer.Values}}
-	<tr><td>{{$metric}}.{{$idx}}</td><td>{{$time}}</td><td>{{$tags}}</td></tr>
-	{{end}}
-	{{end}}
-	{{end}}
-	</table>
-	<h2>Sets</h2>
-	<table class="table">
-	<thead>
-	<tr><th>Name</th><th>Count</th><th>Tags</th></tr>
-	</thead>
-	{{range $metric, $value := .Sets}}
-	{{range $tags, $set := $value}}
-	<tr><td>{{$metric}}</td><td>{{size $set.Values}}</td><td>{{$tags}}</td></tr>
-	{{end}}
-	{{end}}
-	</table>
-</div>
-</div>
-</div>
-</body>
-</html>
-`
+	"golang.org/x/net/context"
+)
 
-var funcMap = template.FuncMap{"size": size}
-var temp = template.Must(template.New("temp").Funcs(funcMap).Parse(tempText))
+// DefaultWebConsoleAddr is the default address on which a WebConsoleServer will listen.
+const DefaultWebConsoleAddr = ":8181"
 
-func size(arr map[string]int64) string {
-	return fmt.Sprintf("%d", len(arr))
+// WebConsoleServer is an object that listens for HTTP connections on a TCP address Addr
+// and streams the metrics and events passing through its TailHandler.
+type WebConsoleServer struct {
+	Addr string
+	Tail *TailHandler
 }
 
-func (s *WebConsoleServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-	s.Aggregator.Lock()
-	defer s.Aggregator.Unlock()
-	err := temp.Execute(w, s.Aggregator)
+// ListenAndServe listens on the WebConsoleServer's TCP network address and then calls Serve.
+func (s *WebConsoleServer) ListenAndServe(ctx context.Context) error {
+	addr := s.Addr
+	if addr == "" {
+		addr = DefaultWebConsoleAddr
+	}
+	l, err := net.Listen("tcp", addr)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return err
 	}
+	return s.Serve(ctx, l)
 }
 
-// ListenAndServe listens on the ConsoleServer's TCP network address and then calls Serve.
-func (s *WebConsoleServer) ListenAndServe() error {
-	if s.Addr == "" {
-		s.Addr = DefaultWebConsoleAddr
+// Serve accepts incoming HTTP requests on the listener until the context is done.
+func (s *WebConsoleServer) Serve(ctx context.Context, l net.Listener) error {
+	go func() {
+		<-ctx.Done()
+		l.Close() // Makes Serve return
+	}()
+	err := http.Serve(l, s.handler(ctx))
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	default:
+		return err
 	}
-	return http.ListenAndServe(s.Addr, s)
 }
-*/
+
+func (s *WebConsoleServer) handler(ctx context.Context) http.Handler {
+	mux := http.NewServeMux()
+	// GET /tail?pattern=<pattern>&n=<n> streams the metrics and events matching the pattern, all of them by default,
+	// until n lines are sent, if n is set, or the client goes away.
+	mux.HandleFunc("/tail", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		pattern := r.FormValue("pattern")
+		if pattern == "" {
+			pattern = "*"
+		}
+		n := 0
+		if v := r.FormValue("n"); v != "" {
+			var err error
+			if n, err = strconv.Atoi(v); err != nil || n < 1 {
+				http.Error(w, "invalid n: must be a positive integer", http.StatusBadRequest)
+				return
+			}
+		}
+		sub, err := s.Tail.Subscribe(pattern)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		defer s.Tail.Unsubscribe(sub)
+
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		if cn, ok := w.(http.CloseNotifier); ok {
+			closed := cn.CloseNotify()
+			go func() {
+				select {
+				case <-closed:
+					cancel()
+				case <-ctx.Done():
+				}
+			}()
+		}
+		var flush func()
+		if f, ok := w.(http.Flusher); ok {
+			flush = f.Flush
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		if flush != nil {
+			flush() // Send the headers before the first line
+		}
+		_ = sub.Stream(ctx, w, n, flush)
+	})
+	return mux
+}
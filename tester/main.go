@@ -7,6 +7,7 @@ import (
 	"runtime/pprof"
 	"time"
 
+	"github.com/atlassian/gostatsd/cloudprovider"
 	"github.com/atlassian/gostatsd/statsd"
 	"github.com/atlassian/gostatsd/tester/fakesocket"
 
@@ -39,16 +40,23 @@ func main() {
 	if s.Benchmark != 0 {
 		rand.Seed(time.Now().Unix())
 		server := statsd.Server{
-			Backends:         []string{"null"},
-			ConsoleAddr:      "",
-			DefaultTags:      statsd.DefaultTags,
-			ExpiryInterval:   statsd.DefaultExpiryInterval,
-			FlushInterval:    statsd.DefaultFlushInterval,
-			MaxReaders:       statsd.DefaultMaxReaders,
-			MaxWorkers:       statsd.DefaultMaxWorkers,
-			MaxQueueSize:     statsd.DefaultMaxQueueSize,
-			PercentThreshold: statsd.DefaultPercentThreshold,
-			Viper:            viper.New(),
+			Backends:           []string{"null"},
+			CloudCacheOptions:  cloudprovider.DefaultCacheOptions,
+			CloudHoldTimeout:   statsd.DefaultCloudHoldTimeout,
+			CloudLookupWorkers: statsd.DefaultCloudLookupWorkers,
+			ConsoleAddr:        "",
+			DefaultTags:        statsd.DefaultTags,
+			ExpiryInterval:     statsd.DefaultExpiryInterval,
+			FlushInterval:      statsd.DefaultFlushInterval,
+			IdlePolicies:       statsd.DefaultIdlePolicies,
+			MaxReaders:         statsd.DefaultMaxReaders,
+			MaxWorkers:         statsd.DefaultMaxWorkers,
+			MaxQueueSize:       statsd.DefaultMaxQueueSize,
+			PercentThreshold:   statsd.DefaultPercentThreshold,
+			ShutdownTimeout:    statsd.DefaultShutdownTimeout,
+			SnapshotInterval:   statsd.DefaultSnapshotInterval,
+			TimestampPolicy:    statsd.DefaultTimestampPolicy,
+			Viper:              viper.New(),
 		}
 		ctx, cancelFunc := context.WithTimeout(context.Background(), time.Duration(s.Benchmark)*time.Second)
 		defer cancelFunc()
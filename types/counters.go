@@ -6,6 +6,7 @@ import "time"
 type Counter struct {
 	PerSecond float64 // The calculated per second rate
 	Value     int64   // The numeric value of the metric
+	TagSet    *TagSet // The canonical tags of the series
 	Interval          // The flush and expiration interval information
 }
 
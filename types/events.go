@@ -90,6 +90,8 @@ type Event struct {
 	Priority Priority
 	// AlertType of the event.
 	AlertType AlertType
+	// Source is the IP address of the sender, or pid:<pid> on a unix socket, empty if unknown.
+	Source string
 }
 
 // Events represents a list of events.
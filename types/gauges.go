@@ -5,6 +5,7 @@ import "time"
 // Gauge is used for storing aggregated values for gauges.
 type Gauge struct {
 	Value    float64 // The numeric value of the metric
+	TagSet   *TagSet // The canonical tags of the series
 	Interval         // The flush and expiration interval information
 }
 
@@ -13,6 +13,34 @@ type MetricType byte
 // StatsdSourceID stores the key used to tag metrics with the origin IP address.
 const StatsdSourceID = "statsd_source_id"
 
+// StatsdSourceProvider stores the key used to tag metrics with the cloud providers that resolved the origin.
+const StatsdSourceProvider = "statsd_source_provider"
+
+// internalStats are the names of the statistics a server reports about itself.
+var internalStats = map[string]bool{
+	"statsd.aggregator_num_stats":  true,
+	"statsd.processing_time":       true,
+	"statsd.bad_lines_seen":        true,
+	"statsd.metrics_received":      true,
+	"statsd.packets_received":      true,
+	"statsd.numStats":              true,
+	"statsd.cloud.cache_hits":      true,
+	"statsd.cloud.cache_misses":    true,
+	"statsd.cloud.refreshes":       true,
+	"statsd.cloud.lookups":         true,
+	"statsd.cloud.lookup_errors":   true,
+	"statsd.cloud.lookups_dropped": true,
+	"statsd.cloud.held_expired":    true,
+	"statsd.cloud.lookup_time":     true,
+	"statsd.cloud.held":            true,
+}
+
+// IsInternalStat returns whether the metric is one of the statistics a server reports about itself.
+// Metrics sent by clients are never internal statistics, even when their names start with statsd.
+func IsInternalStat(name string) bool {
+	return internalStats[name]
+}
+
 const (
 	_ = iota
 	// COUNTER is statsd counter type
@@ -50,8 +78,11 @@ type Metric struct {
 	Name        string     // The name of the metric
 	Value       float64    // The numeric value of the metric
 	Tags        Tags       // The tags for the metric
+	TagSet      *TagSet    // The canonical tags for the metric, computed from Tags when nil
 	StringValue string     // The string value for some metrics e.g. Set
 	Type        MetricType // The type of metric
+	Timestamp   time.Time  // The time supplied by the client, zero if the metric has none
+	Source      string     // The IP address of the sender, or pid:<pid> on a unix socket, empty if unknown
 }
 
 // NewMetric creates a metric with tags.
@@ -79,6 +110,7 @@ type AggregatedMetrics interface {
 // MetricMap is used for storing aggregated Metric values.
 // The keys of each map are metric names.
 type MetricMap struct {
+	Timestamp      time.Time // The time of the metrics, zero if they should be sent at the current time
 	NumStats       uint32
 	ProcessingTime time.Duration
 	FlushInterval  time.Duration
@@ -88,6 +120,22 @@ type MetricMap struct {
 	Sets           Sets
 }
 
+// IsEmpty returns whether the MetricMap holds no series other than internal statistics, which are
+// reported on every flush. Backends have nothing to send when all the series of clients were skipped.
+func (m *MetricMap) IsEmpty() bool {
+	for name := range m.Counters {
+		if !IsInternalStat(name) {
+			return false
+		}
+	}
+	for name := range m.Gauges {
+		if !IsInternalStat(name) {
+			return false
+		}
+	}
+	return len(m.Timers) == 0 && len(m.Sets) == 0
+}
+
 func (m *MetricMap) String() string {
 	buf := new(bytes.Buffer)
 	m.Counters.Each(func(k, tags string, counter Counter) {
@@ -109,6 +157,7 @@ func (m *MetricMap) String() string {
 
 // Interval stores the flush interval and timestamp for expiration interval.
 type Interval struct {
-	Timestamp time.Time
-	Flush     time.Duration
+	Timestamp time.Time     // When the series was last updated
+	Flush     time.Duration // The flush interval
+	Idle      bool          // Whether the series was not updated during the flush interval
 }
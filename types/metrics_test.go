@@ -0,0 +1,26 @@
+package types
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetricMapIsEmpty(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Now()
+	m := &MetricMap{
+		Counters: Counters{"statsd.numStats": {"": NewCounter(now, time.Second, 1)}},
+		Gauges:   Gauges{"statsd.processing_time": {"": NewGauge(now, time.Second, 1)}},
+	}
+	assert.True(m.IsEmpty()) // Internal stats only
+
+	m.Counters["statsd.client.requests"] = map[string]Counter{"": NewCounter(now, time.Second, 1)}
+	assert.False(m.IsEmpty())
+
+	m = &MetricMap{Sets: Sets{"s": {"": NewSet(now, time.Second, map[string]int64{"joe": 1})}}}
+	assert.False(m.IsEmpty())
+	assert.True((&MetricMap{}).IsEmpty())
+}
@@ -0,0 +1,51 @@
+package types
+
+import (
+	"fmt"
+	"path"
+	"sort"
+)
+
+// NamePatterns holds patterns of metric names used to configure some metrics differently from the others.
+// Patterns use the syntax of path.Match, e.g. "api.*.latency". When several patterns match a name, the
+// longest one applies. A nil NamePatterns matches no name.
+type NamePatterns []string
+
+// NewNamePatterns validates the patterns. Duplicates are ignored.
+func NewNamePatterns(patterns ...string) (NamePatterns, error) {
+	np := make(NamePatterns, 0, len(patterns))
+	seen := make(map[string]bool, len(patterns))
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %v", pattern, err)
+		}
+		if !seen[pattern] {
+			seen[pattern] = true
+			np = append(np, pattern)
+		}
+	}
+	sort.Sort(bySpecificity(np))
+	return np, nil
+}
+
+// Match returns the pattern that applies to the name, and false if none matches it.
+func (np NamePatterns) Match(name string) (string, bool) {
+	for _, pattern := range np { // Most specific first
+		if ok, _ := path.Match(pattern, name); ok {
+			return pattern, true
+		}
+	}
+	return "", false
+}
+
+// bySpecificity orders patterns from the longest to the shortest, then alphabetically.
+type bySpecificity []string
+
+func (p bySpecificity) Len() int      { return len(p) }
+func (p bySpecificity) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
+func (p bySpecificity) Less(i, j int) bool {
+	if len(p[i]) != len(p[j]) {
+		return len(p[i]) > len(p[j])
+	}
+	return p[i] < p[j]
+}
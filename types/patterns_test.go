@@ -0,0 +1,35 @@
+package types
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNamePatterns(t *testing.T) {
+	assert := assert.New(t)
+
+	np, err := NewNamePatterns("api.*", "api.*.latency", "*.latency", "api.*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(NamePatterns{"api.*.latency", "*.latency", "api.*"}, np)
+
+	for name, expected := range map[string]string{
+		"api.users.latency": "api.*.latency",
+		"db.latency":        "*.latency",
+		"api.requests":      "api.*",
+		"db.queries":        "",
+	} {
+		pattern, ok := np.Match(name)
+		assert.Equal(expected, pattern, name)
+		assert.Equal(expected != "", ok, name)
+	}
+
+	var none NamePatterns
+	_, ok := none.Match("api.requests")
+	assert.False(ok)
+
+	_, err = NewNamePatterns("api.[")
+	assert.Error(err)
+}
@@ -3,9 +3,34 @@ package types
 import (
 	"bytes"
 	"fmt"
+	"math"
+	"strconv"
 	"strings"
 )
 
+// ParsePercentThreshold parses a percentile threshold. It must be a number such that 0 < |pct| <= 100.
+// Positive thresholds aggregate the lowest values of timers, negative thresholds the highest ones.
+func ParsePercentThreshold(s string) (float64, error) {
+	pct, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid percentile threshold %q: %v", s, err)
+	}
+	if pct == 0 || math.Abs(pct) > 100 || math.IsNaN(pct) {
+		return 0, fmt.Errorf("invalid percentile threshold %q: must be between -100 and 100, excluding 0", s)
+	}
+	return pct, nil
+}
+
+// PercentThresholdName returns the suffix naming the aggregations of a percentile threshold.
+// It follows the conventions of etsy's statsd: the decimal point is replaced with an underscore and
+// negative thresholds are prefixed with "top" instead of the minus sign, e.g. 99.9 is named "99_9"
+// and -10 is named "top10".
+func PercentThresholdName(pct float64) string {
+	name := strconv.FormatFloat(pct, 'f', -1, 64)
+	name = strings.Replace(name, ".", "_", -1)
+	return strings.Replace(name, "-", "top", 1)
+}
+
 // Percentile is used to store the aggregation for a percentile.
 type Percentile struct {
 	float float64
@@ -0,0 +1,32 @@
+package types
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParsePercentThreshold(t *testing.T) {
+	assert := assert.New(t)
+
+	for input, expected := range map[string]float64{"90": 90, "99.9": 99.9, " 100": 100, "-10": -10, "0.1": 0.1} {
+		pct, err := ParsePercentThreshold(input)
+		assert.NoError(err, input)
+		assert.Equal(expected, pct, input)
+	}
+	for _, input := range []string{"", "0", "-0", "100.1", "-101", "abc", "NaN"} {
+		_, err := ParsePercentThreshold(input)
+		assert.Error(err, input)
+	}
+}
+
+func TestPercentThresholdName(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal("90", PercentThresholdName(90))
+	assert.Equal("99_9", PercentThresholdName(99.9))
+	assert.Equal("99_99", PercentThresholdName(99.99))
+	assert.Equal("top10", PercentThresholdName(-10))
+	assert.Equal("top99_5", PercentThresholdName(-99.5))
+	assert.NotEqual(PercentThresholdName(99), PercentThresholdName(99.9))
+}
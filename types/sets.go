@@ -5,6 +5,7 @@ import "time"
 // Set is used for storing aggregated values for sets.
 type Set struct {
 	Values   map[string]int64 // The number of occurrences for a specific value
+	TagSet   *TagSet          // The canonical tags of the series
 	Interval                  // The flush and expiration interval information
 }
 
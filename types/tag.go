@@ -0,0 +1,160 @@
+package types
+
+import (
+	"errors"
+	"strings"
+)
+
+// MaxTagLength is the maximum length of a tag, including the key, the separator and the value.
+// It matches the limit enforced by Datadog.
+const MaxTagLength = 200
+
+// ReservedTagKeys holds the keys of tags that are set by the server.
+// Tags with these keys that are sent by clients are discarded, including when the client is a relay such as
+// another server with the statsdaemon backend: its metrics are tagged with the source of the relay.
+var ReservedTagKeys = map[string]bool{
+	StatsdSourceID:       true,
+	StatsdSourceProvider: true,
+}
+
+var (
+	errTagEmpty        = errors.New("tag is empty")
+	errTagTooLong      = errors.New("tag is too long")
+	errTagInvalidStart = errors.New("tag must start with a letter")
+	errTagInvalidChar  = errors.New("tag contains an invalid character")
+)
+
+// Tag is a single tag made of a key and an optional value.
+//
+// A tag without a value is called a bare tag, e.g. "production". Its Value is empty and
+// its string representation is just the key. A tag is parsed by splitting on the first colon,
+// so the value may contain colons, e.g. "url:http://example.com" has key "url" and value
+// "http://example.com". A tag with a colon but nothing after it, e.g. "env:", is not bare: it
+// has an empty value, recorded by EmptyValue.
+type Tag struct {
+	Key        string
+	Value      string
+	EmptyValue bool // Whether Value is empty but present, i.e. the tag is "key:"
+}
+
+// ParseTag parses a tag in the form "key:value" or "key".
+func ParseTag(s string) Tag {
+	if n := strings.IndexByte(s, ':'); n != -1 {
+		return Tag{Key: s[:n], Value: s[n+1:], EmptyValue: n == len(s)-1}
+	}
+	return Tag{Key: s}
+}
+
+// String returns the tag as "key:value", or "key" for a bare tag.
+func (t Tag) String() string {
+	if t.IsBare() {
+		return t.Key
+	}
+	return t.Key + ":" + t.Value
+}
+
+// IsBare returns whether the tag has no value.
+func (t Tag) IsBare() bool {
+	return t.Value == "" && !t.EmptyValue
+}
+
+// IsReserved returns whether the key of the tag is reserved for the server.
+func (t Tag) IsReserved() bool {
+	return ReservedTagKeys[t.Key]
+}
+
+// Normalise returns the tag as key:value, a bare tag becomes "tag:<key>".
+func (t Tag) Normalise() Tag {
+	if t.IsBare() {
+		return Tag{Key: "tag", Value: t.Key}
+	}
+	return t
+}
+
+// MetricName returns the tag as a component of a hierarchical metric name, as used by Graphite: the tag is
+// sanitized like SanitizeTag, and its key and value are separated by dots, as are the parts of a value with colons.
+// An error is returned if the tag cannot be sanitized.
+func (t Tag) MetricName() (string, error) {
+	s, err := SanitizeTag(t.String())
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(TagToMetricName(s), "."), nil // An empty value is not a component of its own
+}
+
+// less orders tags by key, then by value. A bare tag comes before the same key with an empty value.
+func (t Tag) less(o Tag) bool {
+	if t.Key != o.Key {
+		return t.Key < o.Key
+	}
+	if t.Value != o.Value {
+		return t.Value < o.Value
+	}
+	return t.IsBare() && !o.IsBare()
+}
+
+// ValidateTag checks that a tag follows Datadog's rules: it must start with a letter,
+// contain only lowercase alphanumerics, underscores, minuses, colons, periods and slashes
+// and be at most MaxTagLength characters long.
+func ValidateTag(s string) error {
+	if s == "" {
+		return errTagEmpty
+	}
+	if len(s) > MaxTagLength {
+		return errTagTooLong
+	}
+	if !isLetter(s[0]) {
+		return errTagInvalidStart
+	}
+	for i := 1; i < len(s); i++ {
+		if !isValidTagChar(s[i]) {
+			return errTagInvalidChar
+		}
+	}
+	return nil
+}
+
+// SanitizeTag converts a tag to follow Datadog's rules: it is lowercased, invalid characters are
+// replaced with underscores and it is truncated to MaxTagLength. An error is returned if the tag
+// cannot be fixed, i.e. if it does not start with a letter.
+func SanitizeTag(s string) (string, error) {
+	if len(s) > MaxTagLength {
+		s = s[:MaxTagLength]
+	}
+	s = strings.ToLower(s)
+	if s == "" {
+		return "", errTagEmpty
+	}
+	if !isLetter(s[0]) {
+		return "", errTagInvalidStart
+	}
+	var b []byte
+	for i := 1; i < len(s); i++ {
+		if !isValidTagChar(s[i]) {
+			if b == nil {
+				b = []byte(s)
+			}
+			b[i] = '_'
+		}
+	}
+	if b != nil {
+		s = string(b)
+	}
+	return s, nil
+}
+
+func isLetter(c byte) bool {
+	return 'a' <= c && c <= 'z'
+}
+
+func isValidTagChar(c byte) bool {
+	switch {
+	case isLetter(c), '0' <= c && c <= '9':
+		return true
+	}
+	switch c {
+	case '_', '-', ':', '.', '/':
+		return true
+	}
+	return false
+}
@@ -0,0 +1,142 @@
+package types
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseTag(t *testing.T) {
+	assert := assert.New(t)
+
+	tests := []struct {
+		input    string
+		expected Tag
+	}{
+		{"foo", Tag{Key: "foo"}},
+		{"foo:bar", Tag{Key: "foo", Value: "bar"}},
+		{"url:http://example.com:80", Tag{Key: "url", Value: "http://example.com:80"}},
+		{"foo:", Tag{Key: "foo", EmptyValue: true}},
+	}
+	for _, test := range tests {
+		tag := ParseTag(test.input)
+		assert.Equal(test.expected, tag, test.input)
+	}
+}
+
+func TestTagRoundTrip(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, input := range []string{"foo", "foo:", "foo:bar", "url:http://example.com:80", "a:b:c", "a::"} {
+		assert.Equal(input, ParseTag(input).String())
+	}
+}
+
+func TestTagNormalise(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal(Tag{Key: "tag", Value: "foo"}, Tag{Key: "foo"}.Normalise())
+	assert.Equal(Tag{Key: "foo", Value: "bar"}, Tag{Key: "foo", Value: "bar"}.Normalise())
+	assert.Equal(Tag{Key: "foo", EmptyValue: true}, ParseTag("foo:").Normalise()) // Not bare
+	assert.Equal(Tags{"tag:foo", "env:"}, Tags{"foo", "env:"}.Normalise())
+}
+
+func TestTagIsReserved(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.True(ParseTag("statsd_source_id:1.2.3.4").IsReserved())
+	assert.True(ParseTag("statsd_source_provider:aws").IsReserved())
+	assert.False(ParseTag("foo:bar").IsReserved())
+	assert.Equal(Tags{"foo", "bar:baz"}, Tags{"statsd_source_id:1.2.3.4", "foo", "bar:baz"}.StripReserved())
+}
+
+func TestValidateTag(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.NoError(ValidateTag("env:prod"))
+	assert.NoError(ValidateTag("url:example.com/path-1_2"))
+	assert.Equal(errTagEmpty, ValidateTag(""))
+	assert.Equal(errTagInvalidStart, ValidateTag("1foo"))
+	assert.Equal(errTagInvalidChar, ValidateTag("env:Prod"))
+	assert.Equal(errTagInvalidChar, ValidateTag("foo bar"))
+	assert.Equal(errTagTooLong, ValidateTag("a"+strings.Repeat("b", MaxTagLength)))
+}
+
+func TestSanitizeTag(t *testing.T) {
+	assert := assert.New(t)
+
+	tests := []struct {
+		input    string
+		expected string
+		err      error
+	}{
+		{"env:prod", "env:prod", nil},
+		{"Env:Prod", "env:prod", nil},
+		{"foo bar!", "foo_bar_", nil},
+		{"1foo", "", errTagInvalidStart},
+		{"", "", errTagEmpty},
+	}
+	for _, test := range tests {
+		actual, err := SanitizeTag(test.input)
+		assert.Equal(test.err, err, test.input)
+		assert.Equal(test.expected, actual, test.input)
+		if err == nil {
+			assert.NoError(ValidateTag(actual))
+		}
+	}
+
+	actual, err := SanitizeTag("a" + strings.Repeat("b", MaxTagLength))
+	assert.NoError(err)
+	assert.Len(actual, MaxTagLength)
+}
+
+func TestTagMetricName(t *testing.T) {
+	assert := assert.New(t)
+
+	tests := map[string]string{
+		"canary":                    "canary",
+		"env:prod":                  "env.prod",
+		"Env:Prod":                  "env.prod",
+		"env:":                      "env",
+		"url:http://example.com:80": "url.http.//example.com.80",
+		"team:Site Reliability":     "team.site_reliability",
+	}
+	for input, expected := range tests {
+		actual, err := ParseTag(input).MetricName()
+		assert.NoError(err, input)
+		assert.Equal(expected, actual, input)
+	}
+	_, err := ParseTag("1foo:bar").MetricName()
+	assert.Error(err)
+}
+
+func TestTagsMap(t *testing.T) {
+	assert := assert.New(t)
+
+	tags := Tags{"foo", "bar:baz", "url:http://example.com", "bar:qux"}
+	expected := map[string]string{
+		"foo": "",
+		"bar": "baz",
+		"url": "http://example.com",
+	}
+
+	assert.Equal(expected, tags.Map())
+}
+
+func TestTagSetValues(t *testing.T) {
+	assert := assert.New(t)
+
+	ts := NewTagSet(Tags{"role:web", "env:prod", "role:api", "canary"})
+
+	value, ok := ts.Value("env")
+	assert.True(ok)
+	assert.Equal("prod", value)
+	_, ok = ts.Value("missing")
+	assert.False(ok)
+	assert.Equal([]string{"api", "web"}, ts.Values("role"))
+	assert.Equal("canary,env:prod,role:api,role:web", ts.Key())
+
+	// The canonical strings parse back to the same set.
+	assert.Equal(ts, NewTagSet(ts.Strings()))
+}
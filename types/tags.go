@@ -8,26 +8,39 @@ import (
 // Tags represents a list of tags.
 type Tags []string
 
-// String sorts the tags alphabetically and returns
-// a comma-separated string representation of the tags.
+// String returns a comma-separated string representation of the tags sorted alphabetically.
+// The receiver is not modified.
 func (tags Tags) String() string {
-	sort.Strings(tags)
-	return strings.Join(tags, ",")
+	sorted := make(Tags, len(tags))
+	copy(sorted, tags)
+	sort.Strings(sorted)
+	return strings.Join(sorted, ",")
 }
 
-// Map returns a map of the tags.
+// Map returns a map of the tags. Values may contain colons, bare tags map to an empty value.
+// For duplicate keys the first value is kept.
 func (tags Tags) Map() map[string]string {
 	tagMap := make(map[string]string, len(tags))
-	for _, tag := range tags {
-		s := strings.Split(tag, ":")
-		tagMap[s[0]] = ""
-		if len(s) > 1 {
-			tagMap[s[0]] = s[1]
+	for _, s := range tags {
+		tag := ParseTag(s)
+		if _, ok := tagMap[tag.Key]; !ok {
+			tagMap[tag.Key] = tag.Value
 		}
 	}
 	return tagMap
 }
 
+// StripReserved removes the tags with a reserved key. It reuses the underlying array of the receiver.
+func (tags Tags) StripReserved() Tags {
+	result := tags[:0]
+	for _, tag := range tags {
+		if !ParseTag(tag).IsReserved() {
+			result = append(result, tag)
+		}
+	}
+	return result
+}
+
 // IndexOfKey returns the index and the element starting with the string key.
 func (tags Tags) IndexOfKey(key string) (int, string) {
 	for i, v := range tags {
@@ -38,15 +51,12 @@ func (tags Tags) IndexOfKey(key string) (int, string) {
 	return -1, ""
 }
 
-// Normalise normalises tags as key:value.
+// Normalise normalises tags as key:value, bare tags are prefixed with "tag:".
 func (tags Tags) Normalise() Tags {
 	nTags := Tags{}
 	for _, tag := range tags {
 		if tag != "" {
-			if !strings.Contains(tag, ":") {
-				tag = "tag:" + tag
-			}
-			nTags = append(nTags, tag)
+			nTags = append(nTags, ParseTag(tag).Normalise().String())
 		}
 	}
 	return nTags
@@ -64,16 +74,21 @@ func NormalizeTagElement(name string) string {
 	return strings.ToLower(element)
 }
 
-// ExtractSourceFromTags returns the source from the tags
-// and the updated tags.
-func ExtractSourceFromTags(s string) (string, Tags) {
-	tags := Tags(strings.Split(s, ","))
+// ExtractSource returns the source from the tags and a copy of the tags without it.
+// The receiver is not modified.
+func (tags Tags) ExtractSource() (string, Tags) {
 	idx, element := tags.IndexOfKey(StatsdSourceID)
 	if idx != -1 {
-		bits := strings.Split(element, ":")
-		if len(bits) > 1 {
-			return bits[1], append(tags[:idx], tags[idx+1:]...)
-		}
+		rest := make(Tags, 0, len(tags)-1)
+		rest = append(rest, tags[:idx]...)
+		rest = append(rest, tags[idx+1:]...)
+		return element[len(StatsdSourceID)+1:], rest
 	}
 	return "", tags
 }
+
+// ExtractSourceFromTags returns the source from the tags
+// and the updated tags.
+func ExtractSourceFromTags(s string) (string, Tags) {
+	return Tags(strings.Split(s, ",")).ExtractSource()
+}
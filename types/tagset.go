@@ -0,0 +1,235 @@
+package types
+
+import (
+	"hash/fnv"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// DefaultTagInternerSize is the default maximum number of distinct tag sets kept by a TagInterner.
+const DefaultTagInternerSize = 100000
+
+// TagSet is an immutable, canonical set of tags. The tags are parsed, sorted and de-duplicated once,
+// when the set is created, and the series key and hash are precomputed.
+// Tags are ordered by key, then by value. Exact duplicates are removed but several tags
+// may share a key with different values, as allowed by DogStatsD.
+// A nil *TagSet is valid and represents an empty set of tags.
+type TagSet struct {
+	tags    []Tag
+	strings Tags
+	key     string
+	hash    uint32
+}
+
+// NewTagSet creates a canonical TagSet from a list of tags. The provided slice is not modified.
+func NewTagSet(tags Tags) *TagSet {
+	parsed := make([]Tag, 0, len(tags))
+	for _, tag := range tags {
+		if tag != "" {
+			parsed = append(parsed, ParseTag(tag))
+		}
+	}
+	sort.Sort(tagsByKeyValue(parsed))
+	// Remove duplicates, the slice is sorted so they are adjacent.
+	unique := parsed[:0]
+	for i, tag := range parsed {
+		if i == 0 || tag != parsed[i-1] {
+			unique = append(unique, tag)
+		}
+	}
+	strs := make(Tags, len(unique))
+	for i, tag := range unique {
+		strs[i] = tag.String()
+	}
+	key := strings.Join(strs, ",")
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key))
+	return &TagSet{
+		tags:    unique,
+		strings: strs,
+		key:     key,
+		hash:    h.Sum32(),
+	}
+}
+
+// Tags returns the sorted tags of the set. The returned slice is shared and must not be modified.
+func (ts *TagSet) Tags() []Tag {
+	if ts == nil {
+		return nil
+	}
+	return ts.tags
+}
+
+// Strings returns the string representation of each tag of the set, in the same order as Tags.
+// The returned slice is shared and must not be modified.
+func (ts *TagSet) Strings() Tags {
+	if ts == nil {
+		return nil
+	}
+	return ts.strings
+}
+
+// Value returns the value of the first tag with the given key and whether such a tag exists.
+func (ts *TagSet) Value(key string) (string, bool) {
+	for _, tag := range ts.Tags() {
+		if tag.Key == key {
+			return tag.Value, true
+		}
+	}
+	return "", false
+}
+
+// Values returns the values of all the tags with the given key.
+func (ts *TagSet) Values(key string) []string {
+	var values []string
+	for _, tag := range ts.Tags() {
+		if tag.Key == key {
+			values = append(values, tag.Value)
+		}
+	}
+	return values
+}
+
+// Key returns the comma-separated string representation of the tags, suitable as a series key.
+func (ts *TagSet) Key() string {
+	if ts == nil {
+		return ""
+	}
+	return ts.key
+}
+
+// Hash returns the precomputed hash of the key.
+func (ts *TagSet) Hash() uint32 {
+	if ts == nil {
+		return emptyTagSetHash
+	}
+	return ts.hash
+}
+
+// Len returns the number of tags in the set.
+func (ts *TagSet) Len() int {
+	if ts == nil {
+		return 0
+	}
+	return len(ts.tags)
+}
+
+func (ts *TagSet) String() string {
+	return ts.Key()
+}
+
+type tagsByKeyValue []Tag
+
+func (t tagsByKeyValue) Len() int           { return len(t) }
+func (t tagsByKeyValue) Swap(i, j int)      { t[i], t[j] = t[j], t[i] }
+func (t tagsByKeyValue) Less(i, j int) bool { return t[i].less(t[j]) }
+
+// TagInterner returns shared TagSet instances for identical lists of tags,
+// so that sorting and joining happen once per unique series instead of once per metric.
+// It is safe for concurrent use.
+type TagInterner struct {
+	mu      sync.RWMutex
+	maxSize int
+	size    int
+	sets    map[uint64][]internedTags
+}
+
+type internedTags struct {
+	raw Tags
+	set *TagSet
+}
+
+// NewTagInterner creates a TagInterner that keeps at most maxSize tag sets.
+// When the limit is reached the interner is emptied. Zero means no limit.
+func NewTagInterner(maxSize int) *TagInterner {
+	return &TagInterner{
+		maxSize: maxSize,
+		sets:    make(map[uint64][]internedTags),
+	}
+}
+
+// Intern returns the canonical TagSet for the tags. Lists of tags that only differ by order
+// or duplicates map to equal TagSets, identical lists map to the same instance.
+// A nil *TagInterner creates a new TagSet on every call.
+func (ti *TagInterner) Intern(tags Tags) *TagSet {
+	if ti == nil {
+		return NewTagSet(tags)
+	}
+	h := hashRawTags(tags)
+
+	ti.mu.RLock()
+	set := ti.lookup(h, tags)
+	ti.mu.RUnlock()
+	if set != nil {
+		return set
+	}
+
+	set = NewTagSet(tags)
+	raw := make(Tags, len(tags))
+	copy(raw, tags)
+
+	ti.mu.Lock()
+	defer ti.mu.Unlock()
+	if existing := ti.lookup(h, tags); existing != nil {
+		return existing
+	}
+	if ti.maxSize > 0 && ti.size >= ti.maxSize {
+		ti.sets = make(map[uint64][]internedTags)
+		ti.size = 0
+	}
+	ti.sets[h] = append(ti.sets[h], internedTags{raw: raw, set: set})
+	ti.size++
+	return set
+}
+
+// Len returns the number of interned tag sets.
+func (ti *TagInterner) Len() int {
+	ti.mu.RLock()
+	defer ti.mu.RUnlock()
+	return ti.size
+}
+
+// lookup must be called with the mutex held.
+func (ti *TagInterner) lookup(h uint64, tags Tags) *TagSet {
+	for _, it := range ti.sets[h] {
+		if equalTags(it.raw, tags) {
+			return it.set
+		}
+	}
+	return nil
+}
+
+// emptyTagSetHash is the FNV-1a hash of an empty key, i.e. the 32-bit offset basis.
+const emptyTagSetHash = 2166136261
+
+const (
+	fnvOffset64 = 14695981039346656037
+	fnvPrime64  = 1099511628211
+)
+
+// hashRawTags computes FNV-1a over the tags in their original order without allocating.
+func hashRawTags(tags Tags) uint64 {
+	h := uint64(fnvOffset64)
+	for _, tag := range tags {
+		for i := 0; i < len(tag); i++ {
+			h ^= uint64(tag[i])
+			h *= fnvPrime64
+		}
+		h ^= ','
+		h *= fnvPrime64
+	}
+	return h
+}
+
+func equalTags(a, b Tags) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
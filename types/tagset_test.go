@@ -0,0 +1,103 @@
+package types
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewTagSet(t *testing.T) {
+	assert := assert.New(t)
+
+	tags := Tags{"foo:bar", "baz", "", "baz"}
+	ts := NewTagSet(tags)
+
+	assert.Equal([]Tag{{Key: "baz"}, {Key: "foo", Value: "bar"}}, ts.Tags())
+	assert.Equal(Tags{"baz", "foo:bar"}, ts.Strings())
+	assert.Equal("baz,foo:bar", ts.Key())
+	assert.Equal(2, ts.Len())
+	assert.Equal(Tags{"foo:bar", "baz", "", "baz"}, tags) // Caller's slice is not modified
+
+	assert.Equal(ts.Hash(), NewTagSet(Tags{"baz", "foo:bar"}).Hash())
+	assert.NotEqual(ts.Hash(), NewTagSet(Tags{"baz"}).Hash())
+
+	// A tag with an empty value is not the bare tag with the same key
+	assert.Equal("env,env:,env:prod", NewTagSet(Tags{"env:prod", "env:", "env", "env:"}).Key())
+}
+
+func TestNilTagSet(t *testing.T) {
+	assert := assert.New(t)
+
+	var ts *TagSet
+	assert.Nil(ts.Tags())
+	assert.Nil(ts.Strings())
+	assert.Equal("", ts.Key())
+	assert.Equal(0, ts.Len())
+	assert.Equal(NewTagSet(nil).Hash(), ts.Hash())
+}
+
+func TestTagInterner(t *testing.T) {
+	assert := assert.New(t)
+
+	ti := NewTagInterner(0)
+	a := ti.Intern(Tags{"foo:bar", "baz"})
+	b := ti.Intern(Tags{"foo:bar", "baz"})
+	c := ti.Intern(Tags{"baz", "foo:bar"})
+
+	assert.True(a == b) // Same instance for identical lists
+	assert.Equal(a, c)  // Equal set for lists that only differ by order
+	assert.Equal(2, ti.Len())
+
+	var nilInterner *TagInterner
+	assert.Equal(a, nilInterner.Intern(Tags{"foo:bar", "baz"}))
+}
+
+func TestTagInternerMaxSize(t *testing.T) {
+	assert := assert.New(t)
+
+	ti := NewTagInterner(2)
+	ti.Intern(Tags{"a"})
+	ti.Intern(Tags{"b"})
+	assert.Equal(2, ti.Len())
+	ti.Intern(Tags{"c"})
+	assert.Equal(1, ti.Len())
+}
+
+func TestTagsStringDoesNotSortInPlace(t *testing.T) {
+	assert := assert.New(t)
+
+	tags := Tags{"foo", "bar"}
+	assert.Equal("bar,foo", tags.String())
+	assert.Equal(Tags{"foo", "bar"}, tags)
+}
+
+func TestExtractSource(t *testing.T) {
+	assert := assert.New(t)
+
+	tags := Tags{"foo", "statsd_source_id:1.2.3.4", "baz"}
+	source, rest := tags.ExtractSource()
+
+	assert.Equal("1.2.3.4", source)
+	assert.Equal(Tags{"foo", "baz"}, rest)
+	assert.Equal(Tags{"foo", "statsd_source_id:1.2.3.4", "baz"}, tags)
+}
+
+func BenchmarkTagInternerHit(b *testing.B) {
+	ti := NewTagInterner(0)
+	tags := Tags{"env:prod", "service:api", "statsd_source_id:10.0.0.1"}
+	ti.Intern(tags)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		ti.Intern(tags)
+	}
+}
+
+func BenchmarkNewTagSet(b *testing.B) {
+	tags := Tags{"env:prod", "service:api", "statsd_source_id:10.0.0.1"}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		NewTagSet(tags)
+	}
+}
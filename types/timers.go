@@ -15,6 +15,7 @@ type Timer struct {
 	SumSquares  float64     // The sum squares for the series
 	Values      []float64   // The numeric value of the metric
 	Percentiles Percentiles // The percentile aggregations of the metric
+	TagSet      *TagSet     // The canonical tags of the series
 	Interval                // The flush and expiration interval information
 }
 